@@ -43,9 +43,25 @@ type BuildType struct {
 	OperatingSystem string            `yaml:"operatingsystem,omitempty"`
 	Finish          string            `yaml:"finish,omitempty"`
 	Preseed         string            `yaml:"preseed,omitempty"`
+	UserData        string            `yaml:"user_data,omitempty"`
+	VendorData      string            `yaml:"vendor_data,omitempty"`
+	Butane          string            `yaml:"butane,omitempty"`
 	Params          map[string]string `yaml:"params,omitempty"`
 
-	StaleBuildThresholdSeconds int `yaml:"stale_build_threshold_secs,omitempty"`
+	Templates map[string]StageTemplate `yaml:"templates,omitempty"`
+
+	Profile string  `yaml:"profile,omitempty"` // The installer being driven: preseed (the default), kickstart, autoinstall, or ignition.
+	Storage Storage `yaml:"storage,omitempty"`
+
+	Images []ImageArtifact `yaml:"images,omitempty"` // Kernel and initrd files listed here are served from verified local copies instead of image_url.
+
+	StaleBuildThresholdSeconds      int  `yaml:"stale_build_threshold_secs,omitempty"`
+	StaleBuildFailThresholdSeconds  int  `yaml:"stale_build_fail_threshold_secs,omitempty"`
+	StaleBuildCommandsRepeatSeconds int  `yaml:"stalebuild_commands_repeat_secs,omitempty"`
+	ProgressResetsStaleTimer        bool `yaml:"progress_resets_stale_timer,omitempty"`
+
+	PxeServeLimit         int `yaml:"pxe_serve_limit,omitempty"`       // How many times a job serves its installer before MACs are told to boot locally.  0 is no limit.
+	LocalBootGraceSeconds int `yaml:"local_boot_grace_secs,omitempty"` // How long MACs of a completed job are told to boot locally.
 
 	StaleBuildCommands   []BuildCommand `yaml:"stalebuild_commands,omitempty"`
 	PreBuildCommands     []BuildCommand `yaml:"prebuild_commands,omitempty"`
@@ -54,8 +70,30 @@ type BuildType struct {
 	UnknownBuildCommands []BuildCommand `yaml:"unknownbuild_commands,omitempty"`
 	PxeEventCommands     []BuildCommand `yaml:"pxeevent_commands,omitempty"`
 
-	Tags        []string `yaml:"tags`
-	Description string   `yaml:"description`
+	Tags        []string `yaml:"tags"`
+	Description string   `yaml:"description"`
+}
+
+/*
+	A named template that can be rendered through /template/{name}/{hostname}/{token}.
+	Status is the job status to move to when it's rendered.  If it's empty, rendering it doesn't change the status at all.
+*/
+type StageTemplate struct {
+	File   string `yaml:"file"`
+	Status string `yaml:"status,omitempty"`
+}
+
+/*
+	Templates can be given as just a file name, or as a map when a status is needed.
+*/
+func (t *StageTemplate) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&t.File); err == nil {
+		t.Status = ""
+		return nil
+	}
+
+	type plain StageTemplate
+	return unmarshal((*plain)(t))
 }
 
 /*
@@ -83,6 +121,36 @@ type MachineInventoryPluginSettings struct {
 	SupplementalOnly  bool                   `yaml:"supplemental_only"`
 }
 
+/*
+	Secrets providers are asked for secrets, in order, until one of them has it.
+*/
+type SecretsProviderSettings struct {
+	Name              string                 `yaml:"name"`
+	Type              string                 `yaml:"type"`
+	Source            string                 `yaml:"source"`
+	AuthToken         Password               `yaml:"auth_token"`
+	AdditionalOptions map[string]interface{} `yaml:"additional_options"`
+	Disabled          bool                   `yaml:"disabled"`
+}
+
+/*
+	Limits on how many builds can be active at once.  Builds over any limit are queued until a slot opens up.
+	A limit of 0 means no limit.
+*/
+type BuildConcurrency struct {
+	Global       int                     `yaml:"global,omitempty"`
+	PerBuildType map[string]int          `yaml:"per_build_type,omitempty"`
+	PerGroup     []GroupConcurrencyLimit `yaml:"per_group,omitempty"`
+}
+
+/*
+	Key can be "domain" or "params.<name>" to group machines by their domain or one of their params, such as "params.rack".
+*/
+type GroupConcurrencyLimit struct {
+	Key   string `yaml:"key"`
+	Limit int    `yaml:"limit"`
+}
+
 // Config is our global configuration file
 /*
 	The omitempty's need to be cleaned up.  They're mostly there to let someone see the state of things when they requested a build.
@@ -94,11 +162,19 @@ type Config struct {
 	TemplatePath    string `yaml:"templatepath,omitempty"`
 	StaticFilesPath string `yaml:"staticspath,omitempty"`
 	BaseURL         string `yaml:"baseurl,omitempty"`
+	HardwarePath    string `yaml:"hardware_path,omitempty"` // Where registered hardware reports are kept.  Without it, they only live in memory.
+
+	DiscoveredLimit         int `yaml:"discovered_limit,omitempty"`        // How many unknown MACs are kept waiting to be adopted.  Defaults to 1000.
+	DiscoveredMaxAgeSeconds int `yaml:"discovered_max_age_secs,omitempty"` // How long an unknown MAC is kept after it was last seen.  Defaults to a day.
 
 	MachineInventoryPlugins  []MachineInventoryPluginSettings `yaml:"inventory_plugins,omitempty"`
+	SecretsProviders         []SecretsProviderSettings        `yaml:"secrets_providers,omitempty"`
 	BuildTypes               map[string]BuildType             `yaml:"build_types,omitempty"`
 	StaleBuildCheckFrequency int                              `yaml:"stale_build_check_frequency_secs,omitempty"`
 	HistoryCacheSeconds      int                              `yaml:"history_cache_seconds,omitempty"`
+	JobLogLines              int                              `yaml:"job_log_lines,omitempty"`
+	BuildConcurrency         BuildConcurrency                 `yaml:"build_concurrency,omitempty"`
+	StrictTemplates          bool                             `yaml:"strict_templates,omitempty"` // Fail renders that reference anything undefined instead of rendering it as empty.
 	LogLevelName             string                           `yaml:"log_level,omitempty"`
 	LogLevel                 LogLevel                         `yaml:"-,omitempty"`
 
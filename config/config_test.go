@@ -2,6 +2,8 @@ package config
 
 import (
 	"testing"
+
+	"gopkg.in/yaml.v2"
 )
 
 func TestLoadConfig(t *testing.T) {
@@ -24,3 +26,109 @@ func TestInvalidYAMLConfig(t *testing.T) {
 		t.Errorf("No error presented when invalid configuration is loaded")
 	}
 }
+
+func TestStageTemplates(t *testing.T) {
+	bt := BuildType{}
+
+	err := yaml.Unmarshal([]byte("templates:\n  motd: motd.j2\n  partitioning: {file: partitioning.j2, status: preseed}\n"), &bt)
+	if err != nil {
+		t.Errorf("Failed to load stage templates: %v", err)
+		return
+	}
+
+	if bt.Templates["motd"] != (StageTemplate{File: "motd.j2"}) {
+		t.Errorf("Unexpected template from a plain file name: %+v", bt.Templates["motd"])
+	}
+
+	if bt.Templates["partitioning"] != (StageTemplate{File: "partitioning.j2", Status: "preseed"}) {
+		t.Errorf("Unexpected template from a map: %+v", bt.Templates["partitioning"])
+	}
+}
+
+func TestStorage(t *testing.T) {
+	sizes := []struct {
+		size     string
+		expected int64
+		rest     bool
+		valid    bool
+	}{
+		{"512M", 512 * 1024 * 1024, false, true},
+		{"512MiB", 512 * 1024 * 1024, false, true},
+		{"20g", 20 * 1024 * 1024 * 1024, false, true},
+		{"1T", 1024 * 1024 * 1024 * 1024, false, true},
+		{"", 0, true, true},
+		{"rest", 0, true, true},
+		{"512", 0, false, false},
+		{"-1G", 0, false, false},
+		{"lots", 0, false, false},
+	}
+
+	for _, test := range sizes {
+		size, rest, err := StoragePartition{Size: test.size}.Bytes()
+		if (err == nil) != test.valid || size != test.expected || rest != test.rest {
+			t.Errorf("Unexpected size for '%s': %d rest(%v) err(%v)", test.size, size, rest, err)
+		}
+	}
+
+	layouts := []struct {
+		yaml  string
+		valid bool
+	}{
+		{"disks: [{device: sda, partitions: [{size: 1M, filesystem: biosboot}, {size: 8G, filesystem: swap}, {filesystem: ext4, mount: /}]}]", true},
+		{"disks: [{device: sda, table: msdos, partitions: [{filesystem: ext4, mount: /}]}]", true},
+		{"disks: [{device: sda, table: aix}]", false},
+		{"disks: [{partitions: [{filesystem: ext4, mount: /}]}]", false},
+		{"disks: [{device: sda}, {device: sda}]", false},
+		{"disks: [{device: sda, partitions: [{filesystem: ext4, mount: /}, {size: 1G, filesystem: ext4, mount: /boot}]}]", false},
+		{"disks: [{device: sda, partitions: [{size: 1G, mount: /boot}]}]", false},
+		{"disks: [{device: sda, partitions: [{size: 1G, filesystem: ext4, mount: /}]}, {device: sdb, partitions: [{filesystem: xfs, mount: /}]}]", false},
+		{"disks: [{serial: S3Z9NB0K123456, partitions: [{filesystem: ext4, mount: /}]}, {size: largest}]", true},
+		{"disks: [{size: 480G}]", false},
+		{"disks: [{device: sda, partitions: [{size: 1G, raid: md0}]}, {device: sdb, partitions: [{size: 1G, raid: md0}]}]\nraids: [{name: md0, level: 1, filesystem: ext4, mount: /}]", true},
+		{"disks: [{device: sda, partitions: [{size: 1G, raid: md0}]}, {device: sdb, partitions: [{size: 1G, raid: md0}]}]\nraids: [{name: md0, level: 5, filesystem: ext4, mount: /}]", false},
+		{"disks: [{device: sda, partitions: [{size: 1G, raid: md0}]}, {device: sdb, partitions: [{size: 1G, raid: md0}]}]\nraids: [{name: md0, level: 3, filesystem: ext4, mount: /}]", false},
+		{"disks: [{device: sda, partitions: [{size: 1G, raid: md1}]}]\nraids: [{name: md0, level: 1, filesystem: ext4, mount: /}]", false},
+		{"disks: [{device: sda, partitions: [{size: 1G, raid: md0, filesystem: ext4, mount: /}]}]\nraids: [{name: md0, level: 1}]", false},
+		{"disks: [{device: sda, partitions: [{volume_group: vg0}]}]\nvolume_groups: [{name: vg0, logical_volumes: [{name: root, size: 10G, filesystem: xfs, mount: /}, {name: swap, size: 2G, filesystem: swap}]}]", true},
+		{"disks: [{device: sda, partitions: [{filesystem: xfs, mount: /}]}]\nvolume_groups: [{name: vg0}]", false},
+		{"disks: [{device: sda, partitions: [{volume_group: vg0}]}]\nvolume_groups: [{name: vg0, logical_volumes: [{name: root, filesystem: xfs, mount: /}, {name: srv, size: 2G, filesystem: xfs, mount: /srv}]}]", false},
+		{"disks: [{device: sda, partitions: [{size: 1G, filesystem: xfs, mount: /}, {volume_group: vg0}]}]\nvolume_groups: [{name: vg0, logical_volumes: [{name: root, filesystem: xfs, mount: /}]}]", false},
+	}
+
+	for _, test := range layouts {
+		s := Storage{}
+		if err := yaml.Unmarshal([]byte(test.yaml), &s); err != nil {
+			t.Errorf("Failed to load storage layout %s: %v", test.yaml, err)
+			continue
+		}
+
+		if err := s.Validate(); (err == nil) != test.valid {
+			t.Errorf("Unexpected validation of %s: %v", test.yaml, err)
+		}
+	}
+}
+
+func TestImageArtifacts(t *testing.T) {
+	sha := "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	tests := []struct {
+		image ImageArtifact
+		valid bool
+	}{
+		{ImageArtifact{Name: "vmlinuz", URL: "https://mirror.example.com/vmlinuz", SHA256: sha}, true},
+		{ImageArtifact{Name: "initrd.gz", URL: "http://mirror.example.com/initrd.gz", SHA256: "9F86D081884C7D659A2FEAA0C55AD015A3BF4F1B2B0B822CD15D6C15B0F00A08"}, true},
+		{ImageArtifact{Name: "", URL: "https://mirror.example.com/vmlinuz", SHA256: sha}, false},
+		{ImageArtifact{Name: "..", URL: "https://mirror.example.com/vmlinuz", SHA256: sha}, false},
+		{ImageArtifact{Name: "boot/vmlinuz", URL: "https://mirror.example.com/vmlinuz", SHA256: sha}, false},
+		{ImageArtifact{Name: "vmlinuz", URL: "ftp://mirror.example.com/vmlinuz", SHA256: sha}, false},
+		{ImageArtifact{Name: "vmlinuz", URL: "/vmlinuz", SHA256: sha}, false},
+		{ImageArtifact{Name: "vmlinuz", URL: "https://mirror.example.com/vmlinuz", SHA256: sha[1:]}, false},
+		{ImageArtifact{Name: "vmlinuz", URL: "https://mirror.example.com/vmlinuz", SHA256: "z" + sha[1:]}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.image.Validate(); (err == nil) != test.valid {
+			t.Errorf("Unexpected validation of %+v: %v", test.image, err)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+/*
+	A kernel, initrd, or anything else a build type boots, mirrored from URL into staticspath and checked against SHA256.
+	Name is what kernel and initrd refer to it as.
+*/
+type ImageArtifact struct {
+	Name   string `yaml:"name"`
+	URL    string `yaml:"url"`
+	SHA256 string `yaml:"sha256"`
+}
+
+/*
+	Checks that the artifact can be mirrored and stored safely.
+*/
+func (i ImageArtifact) Validate() error {
+	if i.Name == "" || i.Name == "." || i.Name == ".." || strings.ContainsAny(i.Name, "/\\") {
+		return fmt.Errorf("image '%s' needs a plain file name", i.Name)
+	}
+
+	u, err := url.Parse(i.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("image '%s' has invalid url '%s'", i.Name, i.URL)
+	}
+
+	if len(i.SHA256) != 64 || strings.Trim(strings.ToLower(i.SHA256), "0123456789abcdef") != "" {
+		return fmt.Errorf("image '%s' has invalid sha256 '%s'", i.Name, i.SHA256)
+	}
+
+	return nil
+}
@@ -0,0 +1,373 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/*
+	A declarative disk layout.  Installer profiles turn this into partman, kickstart, or autoinstall storage config,
+	so the same layout can be used no matter what is doing the installing.
+	An empty layout leaves it up to the installer.
+
+	Partitions, raids, and logical volumes each end up as exactly one of: a filesystem with a mount point, swap,
+	a member of a raid, or a physical volume of a volume group.  Partitions can also be biosboot.
+*/
+type Storage struct {
+	Disks        []StorageDisk        `yaml:"disks,omitempty"`
+	Raids        []StorageRaid        `yaml:"raids,omitempty"`
+	VolumeGroups []StorageVolumeGroup `yaml:"volume_groups,omitempty"`
+}
+
+/*
+	A disk is found by its device, its serial, or its size, which is either largest or smallest.
+	Device can be a name, like sda, or a path, like /dev/disk/by-path/pci-0000:00:17.0-ata-1.
+	Only autoinstall can find a disk by serial or size by itself, so partman and kickstart need a device.
+	Table is gpt unless it's set to msdos.
+*/
+type StorageDisk struct {
+	Device     string             `yaml:"device,omitempty"`
+	Serial     string             `yaml:"serial,omitempty"`
+	Size       string             `yaml:"size,omitempty"`
+	Table      string             `yaml:"table,omitempty"`
+	Partitions []StoragePartition `yaml:"partitions,omitempty"`
+}
+
+/*
+	Size is in K, M, G, or T, all powers of 1024, and a size of "rest", or no size at all, uses whatever is left of the disk.
+	Filesystem can be any filesystem the installer knows, or swap, or biosboot for the little partition grub wants on BIOS machines with gpt.
+	A vfat partition mounted at /boot/efi is treated as the EFI system partition.
+	Raid and VolumeGroup make the partition a member of the named raid or volume group instead.
+*/
+type StoragePartition struct {
+	Size        string `yaml:"size,omitempty"`
+	Filesystem  string `yaml:"filesystem,omitempty"`
+	Mount       string `yaml:"mount,omitempty"`
+	Raid        string `yaml:"raid,omitempty"`
+	VolumeGroup string `yaml:"volume_group,omitempty"`
+}
+
+/*
+	A software raid built from every partition that names it.  Level is one of 0, 1, 5, 6, or 10.
+*/
+type StorageRaid struct {
+	Name        string `yaml:"name"`
+	Level       string `yaml:"level"`
+	Filesystem  string `yaml:"filesystem,omitempty"`
+	Mount       string `yaml:"mount,omitempty"`
+	VolumeGroup string `yaml:"volume_group,omitempty"`
+}
+
+/*
+	An LVM volume group made of every partition and raid that names it.
+*/
+type StorageVolumeGroup struct {
+	Name           string                 `yaml:"name"`
+	LogicalVolumes []StorageLogicalVolume `yaml:"logical_volumes,omitempty"`
+}
+
+/*
+	Size works just like the size of a partition, with "rest" taking whatever is left of the volume group.
+*/
+type StorageLogicalVolume struct {
+	Name       string `yaml:"name"`
+	Size       string `yaml:"size,omitempty"`
+	Filesystem string `yaml:"filesystem,omitempty"`
+	Mount      string `yaml:"mount,omitempty"`
+}
+
+var storageSizeUnits = map[string]int64{
+	"K": 1024,
+	"M": 1024 * 1024,
+	"G": 1024 * 1024 * 1024,
+	"T": 1024 * 1024 * 1024 * 1024,
+}
+
+/*
+	Returns a size in bytes, or rest=true if it takes whatever is left.
+*/
+func storageBytes(size string) (int64, bool, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+
+	if s == "" || s == "REST" {
+		return 0, true, nil
+	}
+
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	if len(s) < 2 {
+		return 0, false, fmt.Errorf("invalid size '%s'", size)
+	}
+
+	unit, found := storageSizeUnits[s[len(s)-1:]]
+	if !found {
+		return 0, false, fmt.Errorf("invalid size '%s', expected a size like 512M or 20G", size)
+	}
+
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false, fmt.Errorf("invalid size '%s'", size)
+	}
+
+	return n * unit, false, nil
+}
+
+/*
+	Returns the size of the partition in bytes, or rest=true if it takes whatever is left.
+*/
+func (p StoragePartition) Bytes() (size int64, rest bool, err error) {
+	return storageBytes(p.Size)
+}
+
+func (p StoragePartition) IsSwap() bool {
+	return p.Filesystem == "swap"
+}
+
+func (p StoragePartition) IsBIOSBoot() bool {
+	return p.Filesystem == "biosboot"
+}
+
+func (p StoragePartition) IsESP() bool {
+	return p.Mount == "/boot/efi" && (p.Filesystem == "vfat" || p.Filesystem == "efi")
+}
+
+/*
+	Whether the partition is only there to be part of a raid or volume group.
+*/
+func (p StoragePartition) IsMember() bool {
+	return p.Raid != "" || p.VolumeGroup != ""
+}
+
+/*
+	The table of the disk, defaulting to gpt.
+*/
+func (d StorageDisk) PartitionTable() string {
+	if d.Table == "" {
+		return "gpt"
+	}
+	return d.Table
+}
+
+/*
+	Something to call the disk in errors.
+*/
+func (d StorageDisk) String() string {
+	switch {
+	case d.Device != "":
+		return d.Device
+	case d.Serial != "":
+		return "serial " + d.Serial
+	}
+	return d.Size + " disk"
+}
+
+/*
+	The level of the raid as a number, with any "raid" in front of it dropped.
+*/
+func (r StorageRaid) RaidLevel() (int, error) {
+	l, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(r.Level), "raid"))
+	if err != nil || storageRaidMinMembers[l] == 0 {
+		return 0, fmt.Errorf("raid '%s' has unknown level '%s'", r.Name, r.Level)
+	}
+	return l, nil
+}
+
+func (r StorageRaid) IsSwap() bool {
+	return r.Filesystem == "swap"
+}
+
+func (lv StorageLogicalVolume) Bytes() (size int64, rest bool, err error) {
+	return storageBytes(lv.Size)
+}
+
+func (lv StorageLogicalVolume) IsSwap() bool {
+	return lv.Filesystem == "swap"
+}
+
+var storageRaidMinMembers = map[int]int{
+	0:  2,
+	1:  2,
+	5:  3,
+	6:  4,
+	10: 4,
+}
+
+/*
+	The partitions that make up a raid, as disk and partition indexes.
+*/
+func (s Storage) RaidMembers(name string) [][2]int {
+	members := make([][2]int, 0)
+
+	for didx, d := range s.Disks {
+		for pidx, p := range d.Partitions {
+			if p.Raid == name {
+				members = append(members, [2]int{didx, pidx})
+			}
+		}
+	}
+
+	return members
+}
+
+/*
+	Checks what something that gets formatted is formatted with, and that nothing else is mounted in the same place.
+*/
+func checkStorageFormat(what string, filesystem string, mount string, mounts map[string]string) error {
+	if filesystem == "swap" {
+		return nil
+	}
+
+	if filesystem == "" || !strings.HasPrefix(mount, "/") {
+		return fmt.Errorf("%s needs a filesystem and an absolute mount point", what)
+	}
+
+	if other, found := mounts[mount]; found {
+		return fmt.Errorf("%s: %s is already mounted from %s", what, mount, other)
+	}
+	mounts[mount] = what
+
+	return nil
+}
+
+/*
+	Checks that the layout is something every installer profile can actually build.
+*/
+func (s Storage) Validate() error {
+	mounts := make(map[string]string)
+	devices := make(map[string]bool)
+	raids := make(map[string]bool)
+	vgs := make(map[string]bool)
+	pvs := make(map[string]bool)
+
+	for _, r := range s.Raids {
+		if r.Name == "" || raids[r.Name] {
+			return fmt.Errorf("storage raid '%s' needs a name of its own", r.Name)
+		}
+		raids[r.Name] = true
+	}
+
+	for _, vg := range s.VolumeGroups {
+		if vg.Name == "" || vgs[vg.Name] {
+			return fmt.Errorf("storage volume group '%s' needs a name of its own", vg.Name)
+		}
+		vgs[vg.Name] = true
+	}
+
+	for _, d := range s.Disks {
+		if d.Device == "" && d.Serial == "" && d.Size == "" {
+			return fmt.Errorf("storage disk without a device, serial, or size")
+		}
+
+		if d.Size != "" && d.Size != "largest" && d.Size != "smallest" {
+			return fmt.Errorf("storage disk has unknown size '%s', expected largest or smallest", d.Size)
+		}
+
+		if devices[d.String()] {
+			return fmt.Errorf("storage disk '%s' is listed more than once", d)
+		}
+		devices[d.String()] = true
+
+		if t := d.PartitionTable(); t != "gpt" && t != "msdos" {
+			return fmt.Errorf("storage disk '%s' has unknown partition table '%s'", d, t)
+		}
+
+		for idx, p := range d.Partitions {
+			_, rest, err := p.Bytes()
+			if err != nil {
+				return fmt.Errorf("storage disk '%s' partition %d: %v", d, idx+1, err)
+			}
+
+			if rest && idx != len(d.Partitions)-1 {
+				return fmt.Errorf("storage disk '%s' partition %d: only the last partition can use the rest of the disk", d, idx+1)
+			}
+
+			what := fmt.Sprintf("storage disk '%s' partition %d", d, idx+1)
+
+			switch {
+			case p.Raid != "" || p.VolumeGroup != "":
+				if p.Raid != "" && p.VolumeGroup != "" || p.Filesystem != "" || p.Mount != "" {
+					return fmt.Errorf("%s can only be one of a raid member, a physical volume, or a filesystem", what)
+				}
+
+				if p.Raid != "" && !raids[p.Raid] {
+					return fmt.Errorf("%s is a member of unknown raid '%s'", what, p.Raid)
+				}
+
+				if p.VolumeGroup != "" {
+					if !vgs[p.VolumeGroup] {
+						return fmt.Errorf("%s is a member of unknown volume group '%s'", what, p.VolumeGroup)
+					}
+					pvs[p.VolumeGroup] = true
+				}
+			case p.IsBIOSBoot():
+			default:
+				if err := checkStorageFormat(what, p.Filesystem, p.Mount, mounts); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, r := range s.Raids {
+		l, err := r.RaidLevel()
+		if err != nil {
+			return err
+		}
+
+		if n := len(s.RaidMembers(r.Name)); n < storageRaidMinMembers[l] {
+			return fmt.Errorf("storage raid '%s' has %d members, raid%d needs at least %d", r.Name, n, l, storageRaidMinMembers[l])
+		}
+
+		what := fmt.Sprintf("storage raid '%s'", r.Name)
+
+		if r.VolumeGroup != "" {
+			if r.Filesystem != "" || r.Mount != "" {
+				return fmt.Errorf("%s can only be one of a physical volume or a filesystem", what)
+			}
+
+			if !vgs[r.VolumeGroup] {
+				return fmt.Errorf("%s is a member of unknown volume group '%s'", what, r.VolumeGroup)
+			}
+			pvs[r.VolumeGroup] = true
+
+			continue
+		}
+
+		if err := checkStorageFormat(what, r.Filesystem, r.Mount, mounts); err != nil {
+			return err
+		}
+	}
+
+	for _, vg := range s.VolumeGroups {
+		if !pvs[vg.Name] {
+			return fmt.Errorf("storage volume group '%s' has no physical volumes", vg.Name)
+		}
+
+		lvs := make(map[string]bool)
+
+		for idx, lv := range vg.LogicalVolumes {
+			what := fmt.Sprintf("storage logical volume '%s/%s'", vg.Name, lv.Name)
+
+			if lv.Name == "" || lvs[lv.Name] {
+				return fmt.Errorf("%s needs a name of its own", what)
+			}
+			lvs[lv.Name] = true
+
+			_, rest, err := lv.Bytes()
+			if err != nil {
+				return fmt.Errorf("%s: %v", what, err)
+			}
+
+			if rest && idx != len(vg.LogicalVolumes)-1 {
+				return fmt.Errorf("%s: only the last logical volume can use the rest of the volume group", what)
+			}
+
+			if err := checkStorageFormat(what, lv.Filesystem, lv.Mount, mounts); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
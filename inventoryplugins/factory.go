@@ -9,6 +9,9 @@ import (
 
 var machineInventoryPlugins map[string]func(*config.MachineInventoryPluginSettings, *config.Config, func(string, config.LogLevel) bool) MachineInventoryPlugin = make(map[string]func(*config.MachineInventoryPluginSettings, *config.Config, func(string, config.LogLevel) bool) MachineInventoryPlugin)
 
+// Returned by PutMachine when the plugin already has a definition for the machine and left it alone.
+var ErrMachineExists = errors.New("machine already exists")
+
 type MachineInventoryPlugin interface {
 	Init() error
 	GetMachine(string, string) (*machine.Machine, error)
@@ -16,6 +19,14 @@ type MachineInventoryPlugin interface {
 	Deinit() error
 }
 
+/*
+	Plugins that can also list the hostnames of the machines they know about, so machines can be selected for building in bulk.
+	What the query means is up to the plugin.  An empty query lists everything.
+*/
+type MachineLister interface {
+	ListMachines(string) ([]string, error)
+}
+
 func AddMachineInventoryPlugin(t string, f func(*config.MachineInventoryPluginSettings, *config.Config, func(string, config.LogLevel) bool) MachineInventoryPlugin) error {
 	if _, found := machineInventoryPlugins[t]; found {
 		return errors.New("plugin type already exists: " + t)
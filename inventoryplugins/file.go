@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"sort"
 	"strings"
 
 	"waitron/config"
@@ -53,10 +54,106 @@ func (p *FileInventoryPlugin) Deinit() error {
 	return nil
 }
 
+/*
+	Only what can't be worked out from the config and build type ends up in a definition written by PutMachine.
+*/
+type fileMachineDefinition struct {
+	BuildTypeName string              `yaml:"build_type,omitempty"`
+	Params        map[string]string   `yaml:"params,omitempty"`
+	Network       []machine.Interface `yaml:"network,omitempty"`
+}
+
+/*
+	Writes a definition for a machine that doesn't have one yet.
+	Definitions that already exist are left alone, since they're usually hand-written and know more than whatever is being put,
+	and ErrMachineExists is returned so the caller knows nothing was written.
+*/
 func (p *FileInventoryPlugin) PutMachine(m *machine.Machine) error {
+	hostname := strings.ToLower(m.Hostname)
+
+	if hostname == "" || strings.ContainsAny(hostname, "/\\") || strings.HasPrefix(hostname, ".") {
+		return fmt.Errorf("invalid hostname '%s'", m.Hostname)
+	}
+
+	for _, ext := range []string{".yaml", ".yml"} {
+		if _, err := os.Stat(path.Join(p.machinePath, hostname+ext)); err == nil {
+			p.Log(fmt.Sprintf("%s%s already exists in %s, leaving it alone", hostname, ext, p.machinePath), config.LogLevelInfo)
+			return fmt.Errorf("%w: %s%s in %s", ErrMachineExists, hostname, ext, p.machinePath)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	data, err := yaml.Marshal(&fileMachineDefinition{BuildTypeName: m.BuildTypeName, Params: m.Params, Network: m.Network})
+	if err != nil {
+		return err
+	}
+
+	// O_EXCL, so that two machines being put at once can't clobber each other.
+	f, err := os.OpenFile(path.Join(p.machinePath, hostname+".yml"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%w: %s.yml in %s", ErrMachineExists, hostname, p.machinePath)
+		}
+		return err
+	}
+
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	p.Log(fmt.Sprintf("wrote %s.yml to %s", hostname, p.machinePath), config.LogLevelInfo)
+
 	return nil
 }
 
+/*
+	Lists the hostname of every definition in machinepath.  The query is a shell pattern, like "*.rack12.example.com", matched against the hostnames.
+*/
+func (p *FileInventoryPlugin) ListMachines(query string) ([]string, error) {
+	if query == "" {
+		query = "*"
+	}
+
+	// Checked up front so a bad pattern is an error, and not just nothing matching.
+	if _, err := path.Match(strings.ToLower(query), ""); err != nil {
+		return nil, fmt.Errorf("invalid query '%s': %v", query, err)
+	}
+
+	files, err := ioutil.ReadDir(p.machinePath)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	hostnames := make([]string, 0, len(files))
+
+	for _, f := range files {
+		ext := path.Ext(f.Name())
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || (ext != ".yml" && ext != ".yaml") {
+			continue
+		}
+
+		hostname := strings.ToLower(strings.TrimSuffix(f.Name(), ext))
+
+		if matched, _ := path.Match(strings.ToLower(query), hostname); matched && !seen[hostname] {
+			seen[hostname] = true
+			hostnames = append(hostnames, hostname)
+		}
+	}
+
+	sort.Strings(hostnames)
+
+	p.Log(fmt.Sprintf("%d machines in %s match '%s'", len(hostnames), p.machinePath, query), config.LogLevelDebug)
+
+	return hostnames, nil
+}
+
 func (p *FileInventoryPlugin) GetMachine(hostname string, macaddress string) (*machine.Machine, error) {
 	hostname = strings.ToLower(hostname)
 
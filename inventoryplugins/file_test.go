@@ -0,0 +1,107 @@
+package inventoryplugins_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"waitron/config"
+	"waitron/inventoryplugins"
+	"waitron/machine"
+)
+
+func TestFilePutMachine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-machines")
+	if err != nil {
+		t.Errorf("Failed to create machine dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	p := inventoryplugins.NewFileInventoryPlugin(&config.MachineInventoryPluginSettings{AdditionalOptions: map[string]interface{}{"machinepath": dir}}, &config.Config{}, func(s string, l config.LogLevel) bool { return true })
+
+	if err := p.Init(); err != nil {
+		t.Errorf("Failed to init file plugin: %v", err)
+		return
+	}
+
+	m, _ := machine.New("new01.example.com")
+	m.Params = map[string]string{"hw_serial": "ABC1234"}
+	m.Network = []machine.Interface{machine.Interface{Name: "eno1", MacAddress: "de:ad:be:ef:00:01"}}
+
+	if err := p.PutMachine(m); err != nil {
+		t.Errorf("Failed to put machine: %v", err)
+		return
+	}
+
+	got, err := p.GetMachine("new01.example.com", "")
+	if err != nil || got == nil || got.Params["hw_serial"] != "ABC1234" || len(got.Network) != 1 || got.Network[0].MacAddress != "de:ad:be:ef:00:01" {
+		t.Errorf("Unexpected machine after put: err(%v) %+v", err, got)
+	}
+
+	// Existing definitions are left alone.
+	if err := ioutil.WriteFile(path.Join(dir, "old01.example.com.yaml"), []byte("params: {hand: written}\n"), 0644); err != nil {
+		t.Errorf("Failed to write machine: %v", err)
+		return
+	}
+
+	m.Hostname = "old01.example.com"
+
+	if err := p.PutMachine(m); !errors.Is(err, inventoryplugins.ErrMachineExists) {
+		t.Errorf("Expected an existing machine, got %v", err)
+	}
+
+	if got, err := p.GetMachine("old01.example.com", ""); err != nil || got.Params["hand"] != "written" || len(got.Network) != 0 {
+		t.Errorf("Existing definition was changed: err(%v) %+v", err, got)
+	}
+
+	m.Hostname = "../escape"
+
+	if err := p.PutMachine(m); err == nil {
+		t.Errorf("Put a machine with a path for a hostname")
+	}
+}
+
+func TestFileListMachines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-machines")
+	if err != nil {
+		t.Errorf("Failed to create machine dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"a01.rack1.example.com.yml", "a02.rack1.example.com.yaml", "A02.rack1.example.com.yml", "b01.rack2.example.com.yml", ".hidden.yml", "notes.txt"} {
+		if err := ioutil.WriteFile(path.Join(dir, f), []byte("{}\n"), 0644); err != nil {
+			t.Errorf("Failed to write machine: %v", err)
+			return
+		}
+	}
+
+	p := inventoryplugins.NewFileInventoryPlugin(&config.MachineInventoryPluginSettings{AdditionalOptions: map[string]interface{}{"machinepath": dir}}, &config.Config{}, func(s string, l config.LogLevel) bool { return true })
+
+	if err := p.Init(); err != nil {
+		t.Errorf("Failed to init file plugin: %v", err)
+		return
+	}
+
+	lister := p.(inventoryplugins.MachineLister)
+
+	for query, expected := range map[string]string{
+		"":                    "a01.rack1.example.com,a02.rack1.example.com,b01.rack2.example.com",
+		"*.RACK1.example.com": "a01.rack1.example.com,a02.rack1.example.com",
+		"b*":                  "b01.rack2.example.com",
+		"c*":                  "",
+	} {
+		hostnames, err := lister.ListMachines(query)
+		if err != nil || strings.Join(hostnames, ",") != expected {
+			t.Errorf("Unexpected machines for '%s': err(%v) %v", query, err, hostnames)
+		}
+	}
+
+	if _, err := lister.ListMachines("[a"); err == nil {
+		t.Errorf("Listed machines with a bad pattern")
+	}
+}
@@ -62,6 +62,13 @@ type netboxDeviceResults struct {
 	} `yaml:"results"`
 }
 
+type netboxDeviceNameResults struct {
+	Next    string `yaml:"next"`
+	Results []struct {
+		Name string `yaml:"name"`
+	} `yaml:"results"`
+}
+
 type annotatedIface struct {
 	iface  *machine.Interface
 	isIpmi bool
@@ -340,6 +347,45 @@ func (p *NetboxInventoryPlugin) GetMachine(hostname string, macaddress string) (
 
 }
 
+/*
+	Lists the names of the devices matched by the query, which is passed straight through as filters to /dcim/devices/,
+	like "site=ams1&rack_id=12" or "tag=hypervisor".
+*/
+func (p *NetboxInventoryPlugin) ListMachines(query string) ([]string, error) {
+	hostnames := make([]string, 0)
+
+	next := p.settings.Source + "/dcim/devices/?limit=1000"
+	if query != "" {
+		next += "&" + strings.TrimPrefix(query, "?")
+	}
+
+	// Results are paged, and each page says where the next one is.
+	for next != "" {
+		response, err := p.queryNetbox(next)
+		if err != nil {
+			return nil, err
+		}
+
+		results := &netboxDeviceNameResults{}
+
+		if err = yaml.Unmarshal(response, results); err != nil {
+			return nil, err
+		}
+
+		for _, d := range results.Results {
+			if d.Name != "" {
+				hostnames = append(hostnames, strings.ToLower(d.Name))
+			}
+		}
+
+		next = results.Next
+	}
+
+	p.Log(fmt.Sprintf("%d devices in netbox match '%s'", len(hostnames), query), config.LogLevelDebug)
+
+	return hostnames, nil
+}
+
 func (p *NetboxInventoryPlugin) getGateway(iface *machine.Interface, addr string) (string, error) {
 
 	gwResponse, err := p.queryNetbox(p.settings.Source + "/ipam/ip-addresses/?tag=waitron_gateway&parent=" + addr)
@@ -397,10 +443,12 @@ func (p *NetboxInventoryPlugin) queryNetbox(q string) ([]byte, error) {
 		p.Log(fmt.Sprintf("error while querying %s: %v", q, err), config.LogLevelDebug)
 		return nil, err
 	}
+	defer resp.Body.Close()
 
+	// A bad token or filter is an error, not an empty result.
 	if resp.StatusCode >= 400 {
-		p.Log(fmt.Sprintf("error while querying %s: %v", q, err), config.LogLevelDebug)
-		return nil, err
+		p.Log(fmt.Sprintf("error while querying %s: %s", q, resp.Status), config.LogLevelDebug)
+		return nil, fmt.Errorf("netbox query %s failed: %s", q, resp.Status)
 	}
 
 	response, err := ioutil.ReadAll(resp.Body)
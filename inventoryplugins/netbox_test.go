@@ -0,0 +1,56 @@
+package inventoryplugins_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"waitron/config"
+	"waitron/inventoryplugins"
+)
+
+func TestNetboxListMachines(t *testing.T) {
+	var server *httptest.Server
+
+	server = httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "Token good" {
+			http.Error(response, `{"detail": "Invalid token"}`, 403)
+			return
+		}
+
+		if request.URL.Query().Get("offset") == "" {
+			fmt.Fprintf(response, `{"next": "%s/dcim/devices/?limit=1000&tag=hv&offset=1000", "results": [{"name": "HV01.example.com"}]}`, server.URL)
+			return
+		}
+
+		response.Write([]byte(`{"next": null, "results": [{"name": "hv02.example.com"}]}`))
+	}))
+	defer server.Close()
+
+	for _, test := range []struct {
+		token    string
+		expected string
+		fails    bool
+	}{
+		{token: "good", expected: "hv01.example.com hv02.example.com"},
+		// A query netbox refuses isn't the same as one that matches nothing.
+		{token: "bad", fails: true},
+	} {
+		p := inventoryplugins.NewNetboxInventoryPlugin(&config.MachineInventoryPluginSettings{Source: server.URL, AuthToken: config.Password(test.token)}, &config.Config{}, func(s string, l config.LogLevel) bool { return true })
+
+		hostnames, err := p.(inventoryplugins.MachineLister).ListMachines("tag=hv")
+
+		if test.fails {
+			if err == nil {
+				t.Errorf("Expected an error with token '%s', got %v", test.token, hostnames)
+			}
+			continue
+		}
+
+		if err != nil || strings.Join(hostnames, " ") != test.expected {
+			t.Errorf("Unexpected machines with token '%s': err(%v) %v", test.token, err, hostnames)
+		}
+	}
+}
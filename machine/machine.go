@@ -25,7 +25,7 @@ type IPConfig struct {
 	IPAddress   string   `yaml:"ipaddress"`
 	Netmask     string   `yaml:"netmask"`
 	Cidr        string   `yaml:"cidr"`
-	Tags        []string `yaml:"tags`
+	Tags        []string `yaml:"tags"`
 	Description string   `yaml:"description"`
 }
 
@@ -41,7 +41,7 @@ type Interface struct {
 	Gateway6             string     `yaml:"gateway6"`
 	ZSideDevice          string     `yaml:"zside_device"`
 	ZSideDeviceInterface string     `yaml:"zside_device_port"`
-	Tags                 []string   `yaml:"tags`
+	Tags                 []string   `yaml:"tags"`
 	Description          string     `yaml:"description"`
 }
 
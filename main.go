@@ -6,15 +6,24 @@ package main
 // @License BSD
 // @LicenseUrl http://opensource.org/licenses/BSD-2-Clause
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
 	"waitron/config"
+	"waitron/secrets"
 	"waitron/waitron"
 
 	"github.com/gorilla/handlers"
@@ -77,14 +86,68 @@ func jobDefinitionHandler(response http.ResponseWriter, request *http.Request, p
 	response.Write(jb)
 }
 
+// @Title jobLogHandler
+// @Description Return the log lines recorded for the specified job token
+// @Summary Return the log lines recorded for the specified job token.  With follow=true, the response is streamed until the job is no longer active.
+// @Param token    path    string    true    "Token"
+// @Param follow   query   bool      false   "Keep streaming new log lines until the job completes"
+// @Success 200    {object} string "Job log lines as plain text."
+// @Failure 404    {object} string "Job not found"
+// @Router /job/{token}/log [GET]
+func jobLogHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	token := ps.ByName("token")
+
+	if request.URL.Query().Get("follow") != "true" {
+		entries, err := w.GetJobLog(token)
+		if err != nil {
+			http.Error(response, fmt.Sprintf("Unable to find valid job for %s. %s", token, err.Error()), 404)
+			return
+		}
+
+		response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, e := range entries {
+			fmt.Fprintln(response, e.String())
+		}
+		return
+	}
+
+	flusher, _ := response.(http.Flusher)
+	wroteHeader := false
+
+	err := w.FollowJobLog(request.Context(), token, func(e waitron.JobLogEntry) error {
+		if !wroteHeader {
+			response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			wroteHeader = true
+		}
+
+		if _, err := fmt.Fprintln(response, e.String()); err != nil {
+			return err
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		return nil
+	})
+
+	if err != nil && !wroteHeader {
+		http.Error(response, fmt.Sprintf("Unable to find valid job for %s. %s", token, err.Error()), 404)
+	}
+}
+
 // @Title templateHandler
-// @Description Render either the finish or the preseed template
-// @Summary Render either the finish or the preseed template
+// @Description Render a template declared for the build.  preseed and finish are always available if set, and anything else must be declared in "templates".
+// @Summary Render a named template declared for the build
 // @Param hostname    path    string    true    "Hostname"
 // @Param template    path    string    true    "The template to be rendered"
 // @Param token        path    string    true    "Token"
 // @Success 200    {object} string "Rendered template"
 // @Failure 400    {object} string "Unable to render template"
+// @Failure 404    {object} string "Template not declared for the build"
+// @Failure 409    {object} string "Job cannot move to the status of the template stage"
+// @Failure 500    {object} string "Template could not be parsed"
 // @Router /template/{template}/{hostname}/{token} [GET]
 func templateHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
 
@@ -92,13 +155,188 @@ func templateHandler(response http.ResponseWriter, request *http.Request, ps htt
 
 	renderedTemplate, err := w.RenderStageTemplate(ps.ByName("token"), ps.ByName("template"))
 	if err != nil {
-		http.Error(response, "Unable to render template", 400)
+		var te *waitron.JobTransitionError
+		if errors.As(err, &te) {
+			http.Error(response, "Unable to render template: "+te.Error(), 409)
+			return
+		}
+
+		if errors.Is(err, waitron.ErrTemplateNotFound) {
+			http.Error(response, "Unable to render template: "+err.Error(), 404)
+			return
+		}
+
+		var pe *waitron.TemplateParseError
+		if errors.As(err, &pe) {
+			http.Error(response, "Unable to render template: "+pe.Error(), 500)
+			return
+		}
+
+		http.Error(response, "Unable to render template: "+err.Error(), 400)
 		return
 	}
 
 	fmt.Fprintf(response, renderedTemplate)
 }
 
+// @Title renderHandler
+// @Description Render the cmdline, build commands and a template for a machine without creating a job, running commands or changing anything.  Use "cmdline" as the template to only render the cmdline and commands.
+// @Summary Preview everything a build would render
+// @Accept json
+// @Produce json
+// @Param template    path    string    true    "The template to be rendered"
+// @Param hostname    path    string    true    "Hostname"
+// @Param type        path    string    true    "Build Type"
+// @Param {object}     body    string    false    "Machine definition if desired, just like for /build"
+// @Success 200    {object} string "Rendered preview in JSON format"
+// @Failure 400    {object} string "Rendered preview in JSON format, with the errors, and line numbers where possible, in Errors"
+// @Failure 404    {object} string "Template not declared for the build"
+// @Failure 500    {object} string "Unable to render preview"
+// @Router /render/{template}/{hostname}/{type} [POST]
+func renderHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	body := http.MaxBytesReader(response, request.Body, 1024*1024)
+	machineDefinition, err := ioutil.ReadAll(body)
+
+	if err != nil {
+		http.Error(response, "Unable to render preview while reading request body: "+err.Error(), 500)
+		return
+	}
+
+	preview, err := w.RenderPreview(ps.ByName("template"), ps.ByName("hostname"), ps.ByName("type"), machineDefinition)
+	if err != nil {
+		if errors.Is(err, waitron.ErrTemplateNotFound) {
+			http.Error(response, "Unable to render preview: "+err.Error(), 404)
+			return
+		}
+
+		http.Error(response, "Unable to render preview: "+err.Error(), 500)
+		return
+	}
+
+	result, err := json.Marshal(preview)
+	if err != nil {
+		http.Error(response, "Unable to render preview: "+err.Error(), 500)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+
+	if len(preview.Errors) > 0 {
+		response.WriteHeader(400)
+	}
+
+	response.Write(result)
+}
+
+// @Title cloudInitHandler
+// @Description Serve a file of a cloud-init NoCloud datasource for an active build
+// @Summary Serve a file of a cloud-init NoCloud datasource for an active build
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Param item        path    string    true    "One of meta-data, user-data, vendor-data or network-config"
+// @Success 200    {object} string "Rendered file"
+// @Failure 400    {object} string "Unable to render cloud-init item"
+// @Failure 404    {object} string "Unknown cloud-init item"
+// @Failure 500    {object} string "Template could not be parsed"
+// @Router /cloud-init/{hostname}/{token}/{item} [GET]
+func cloudInitHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	rendered, err := w.RenderCloudInit(ps.ByName("hostname"), ps.ByName("token"), ps.ByName("item"))
+	if err != nil {
+		if errors.Is(err, waitron.ErrTemplateNotFound) {
+			http.Error(response, err.Error(), 404)
+			return
+		}
+
+		var pe *waitron.TemplateParseError
+		if errors.As(err, &pe) {
+			http.Error(response, "Unable to render cloud-init item: "+pe.Error(), 500)
+			return
+		}
+
+		http.Error(response, "Unable to render cloud-init item: "+err.Error(), 400)
+		return
+	}
+
+	response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(response, rendered)
+}
+
+// @Title ignitionHandler
+// @Description Serve the Ignition config for an active build, converted from its butane template
+// @Summary Serve the Ignition config for an active build, converted from its butane template
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Success 200    {object} string "Ignition config"
+// @Failure 400    {object} string "Unable to render ignition config"
+// @Failure 404    {object} string "No butane template for the build"
+// @Failure 409    {object} string "Job cannot move to preseed"
+// @Failure 500    {object} string "Template could not be parsed"
+// @Router /ignition/{hostname}/{token} [GET]
+func ignitionHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	rendered, err := w.RenderIgnition(ps.ByName("hostname"), ps.ByName("token"))
+	if err != nil {
+		if errors.Is(err, waitron.ErrTemplateNotFound) {
+			http.Error(response, err.Error(), 404)
+			return
+		}
+
+		var te *waitron.JobTransitionError
+		if errors.As(err, &te) {
+			http.Error(response, "Unable to render ignition config: "+te.Error(), 409)
+			return
+		}
+
+		var pe *waitron.TemplateParseError
+		if errors.As(err, &pe) {
+			http.Error(response, "Unable to render ignition config: "+pe.Error(), 500)
+			return
+		}
+
+		http.Error(response, "Unable to render ignition config: "+err.Error(), 400)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/vnd.coreos.ignition+json")
+	fmt.Fprint(response, rendered)
+}
+
+// @Title networkConfigHandler
+// @Description Generate network configuration for an active build from the interfaces of the machine
+// @Summary Generate network configuration for an active build
+// @Param format    path    string    true    "One of netplan, interfaces, or networkmanager"
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Success 200    {object} string "Generated config, or a JSON list of keyfiles for networkmanager"
+// @Failure 400    {object} string "Unable to generate network config"
+// @Failure 404    {object} string "Unknown format"
+// @Router /network/{format}/{hostname}/{token} [GET]
+func networkConfigHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	format := ps.ByName("format")
+
+	rendered, err := w.RenderNetworkConfig(ps.ByName("hostname"), ps.ByName("token"), format)
+	if err != nil {
+		if errors.Is(err, waitron.ErrTemplateNotFound) {
+			http.Error(response, err.Error(), 404)
+			return
+		}
+
+		http.Error(response, "Unable to generate network config: "+err.Error(), 400)
+		return
+	}
+
+	if format == "networkmanager" {
+		response.Header().Set("Content-Type", "application/json")
+	} else {
+		response.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	fmt.Fprint(response, rendered)
+}
+
 // @Title buildHandler
 // @Description Put the server in build mode
 // @Summary Put the server in build mode
@@ -107,7 +345,9 @@ func templateHandler(response http.ResponseWriter, request *http.Request, ps htt
 // @Param hostname    path    string    true    "Hostname"
 // @Param type        path    string    true    "Build Type"
 // @Param {object}     body    string    true    "Machine definition if desired.  Can be used to override nearly all properties of a compiled machine.  See examples directory for machine definition."
+// @Param force    query    bool    false    "Take over MACs that other active jobs are using"
 // @Success 200    {object} string "{"State": "OK", "Token": <UUID of the build>}"
+// @Failure 409    {object} string "The hostname, or without force, any of the MACs, belong to an active job"
 // @Failure 500    {object} string "Failed to set build mode on hostname"
 // @Router /build/{hostname}/{type} [PUT]
 func buildHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
@@ -123,8 +363,14 @@ func buildHandler(response http.ResponseWriter, request *http.Request, ps httpro
 		return
 	}
 
-	token, err := w.Build(hostname, btype, machineDefinition)
+	token, err := w.BuildWithOptions(hostname, btype, machineDefinition, waitron.BuildOptions{Force: request.URL.Query().Get("force") == "true"})
 	if err != nil {
+		var ce *waitron.JobCollisionError
+		if errors.As(err, &ce) {
+			http.Error(response, fmt.Sprintf("Failed to set build mode for %s - %s: %s", hostname, btype, ce.Error()), 409)
+			return
+		}
+
 		http.Error(response, fmt.Sprintf("Failed to set build mode for %s - %s: %s", hostname, btype, err.Error()), 500)
 		return
 	}
@@ -140,6 +386,7 @@ func buildHandler(response http.ResponseWriter, request *http.Request, ps httpro
 // @Param hostname    path    string    true    "Hostname"
 // @Param token        path    string    true    "Token"
 // @Success 200    {object} string "{"State": "OK"}"
+// @Failure 409    {object} string "Job cannot be completed from its current status"
 // @Failure 500    {object} string "Failed to finish build mode"
 // @Router /done/{hostname}/{token} [GET]
 func doneHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
@@ -149,6 +396,12 @@ func doneHandler(response http.ResponseWriter, request *http.Request, ps httprou
 	err := w.FinishBuild(ps.ByName("hostname"), ps.ByName("token"))
 
 	if err != nil {
+		var te *waitron.JobTransitionError
+		if errors.As(err, &te) {
+			http.Error(response, "Failed to finish build: "+te.Error(), 409)
+			return
+		}
+
 		http.Error(response, "Failed to finish build.", 500)
 		return
 	}
@@ -158,6 +411,65 @@ func doneHandler(response http.ResponseWriter, request *http.Request, ps httprou
 	fmt.Fprintf(response, string(result))
 }
 
+// @Title progressHandler
+// @Description Record installer progress for an active build
+// @Summary Record installer progress for an active build.  The body can be JSON or form-encoded, so that simple installer hooks like wget --post-data can use it.
+// @Accept json
+// @Produce json
+// @Param hostname    path    string    true    "Hostname"
+// @Param token       path    string    true    "Token"
+// @Param {object}    body    string    true    "{"phase": <name of the install phase>, "percent": <0-100>, "message": <free text>}"
+// @Success 200    {object} string "{"State": "OK"}"
+// @Failure 400    {object} string "Failed to parse progress report"
+// @Failure 500    {object} string "Failed to record progress"
+// @Router /progress/{hostname}/{token} [POST]
+func progressHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	hostname := ps.ByName("hostname")
+
+	body := http.MaxBytesReader(response, request.Body, 64*1024)
+	report, err := ioutil.ReadAll(body)
+
+	if err != nil {
+		http.Error(response, fmt.Sprintf("Failed to parse progress report for %s: %s", hostname, err.Error()), 400)
+		return
+	}
+
+	p := waitron.ProgressEvent{}
+
+	if strings.Contains(request.Header.Get("Content-Type"), "json") || bytes.HasPrefix(bytes.TrimSpace(report), []byte("{")) {
+		if err = json.Unmarshal(report, &p); err != nil {
+			http.Error(response, fmt.Sprintf("Failed to parse progress report for %s: %s", hostname, err.Error()), 400)
+			return
+		}
+	} else {
+		values, err := url.ParseQuery(string(report))
+		if err != nil {
+			http.Error(response, fmt.Sprintf("Failed to parse progress report for %s: %s", hostname, err.Error()), 400)
+			return
+		}
+
+		p.Phase = values.Get("phase")
+		p.Message = values.Get("message")
+
+		if pct := values.Get("percent"); pct != "" {
+			if p.Percent, err = strconv.Atoi(pct); err != nil {
+				http.Error(response, fmt.Sprintf("Failed to parse progress report for %s: %s", hostname, err.Error()), 400)
+				return
+			}
+		}
+	}
+
+	if err := w.ReportProgress(hostname, ps.ByName("token"), p); err != nil {
+		http.Error(response, fmt.Sprintf("Failed to record progress for %s: %s", hostname, err.Error()), 500)
+		return
+	}
+
+	result, _ := json.Marshal(&result{State: "OK"})
+
+	fmt.Fprintf(response, string(result))
+}
+
 // @Title cancelHandler
 // @Description Remove the server from build mode
 // @Summary Remove the server from build mode
@@ -167,6 +479,7 @@ func doneHandler(response http.ResponseWriter, request *http.Request, ps httprou
 // @Param token       path    string    true    "Token"
 // @Param {object}    body    string    true    "Machine definition if desired.  Can be used to override nearly all properties of a compiled machine.  See examples directory for machine definition."
 // @Success 200    {object} string "{"State": "OK"}"
+// @Failure 409    {object} string "Job cannot be terminated from its current status"
 // @Failure 500    {object} string "Failed to cancel build mode"
 // @Router /cancel/{hostname}/{token} [PUT]
 func cancelHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
@@ -176,6 +489,12 @@ func cancelHandler(response http.ResponseWriter, request *http.Request, ps httpr
 	err := w.CancelBuild(ps.ByName("hostname"), ps.ByName("token"))
 
 	if err != nil {
+		var te *waitron.JobTransitionError
+		if errors.As(err, &te) {
+			http.Error(response, "Failed to cancel build mode: "+te.Error(), 409)
+			return
+		}
+
 		http.Error(response, "Failed to cancel build mode", 500)
 		return
 	}
@@ -241,13 +560,24 @@ func cleanHistory(response http.ResponseWriter, request *http.Request, ps httpro
 // @Summary Dictionary with kernel, intrd(s) and commandline for pixiecore
 // @Param macaddr    path    string    true    "MacAddress"
 // @Success 200    {object} string "Dictionary with kernel, intrd(s) and commandline for pixiecore"
+// @Failure 404    {object} string "The machine should boot from its local disk.  pixiecore ignores machines it gets a 404 for, so they move on to the next boot device."
 // @Failure 500    {object} string "failed to get pxe config: <error>"
 // @Router /v1/boot/{macaddr} [GET]
 func pixieHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
 
-	pxeconfig, err := w.GetPxeConfig(ps.ByName("macaddr"))
+	source, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		source = request.RemoteAddr
+	}
+
+	pxeconfig, err := w.GetPxeConfig(ps.ByName("macaddr"), source)
 
 	if err != nil {
+		if errors.Is(err, waitron.ErrLocalBoot) {
+			http.Error(response, err.Error(), 404)
+			return
+		}
+
 		http.Error(response, "failed to get pxe config: "+err.Error(), 500)
 		return
 	}
@@ -256,6 +586,360 @@ func pixieHandler(response http.ResponseWriter, request *http.Request, ps httpro
 	response.Write(result)
 }
 
+// @Title registerHandler
+// @Description Register the hardware report of a machine, usually sent by a registration image booted through the _unknown_ build type
+// @Summary Register the hardware report of a machine.  If the report has a hostname, a machine made from it is also given to every writable inventory plugin.
+// @Accept json
+// @Produce json
+// @Param macaddr    path    string    true    "MacAddress"
+// @Param {object}    body    string    true    "{"hostname": <optional>, "dmi": {...}, "cpus": [...], "memory": {...}, "disks": [...], "nics": [{"name": ..., "mac": ..., "lldp": {...}}]}"
+// @Success 200    {object} string "{"State": "OK"}"
+// @Failure 400    {object} string "Failed to parse hardware report"
+// @Failure 500    {object} string "Failed to register hardware"
+// @Router /register/{macaddr} [POST]
+func registerHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	mac := ps.ByName("macaddr")
+
+	body := http.MaxBytesReader(response, request.Body, 1024*1024)
+	report, err := ioutil.ReadAll(body)
+
+	if err != nil {
+		http.Error(response, fmt.Sprintf("Failed to parse hardware report for %s: %s", mac, err.Error()), 400)
+		return
+	}
+
+	hr := waitron.HardwareReport{}
+
+	if err = json.Unmarshal(report, &hr); err != nil {
+		http.Error(response, fmt.Sprintf("Failed to parse hardware report for %s: %s", mac, err.Error()), 400)
+		return
+	}
+
+	if err = w.RegisterHardware(mac, hr); err != nil {
+		if errors.Is(err, waitron.ErrBadHardwareReport) {
+			http.Error(response, fmt.Sprintf("Failed to parse hardware report for %s: %s", mac, err.Error()), 400)
+			return
+		}
+
+		http.Error(response, fmt.Sprintf("Failed to register hardware for %s: %s", mac, err.Error()), 500)
+		return
+	}
+
+	result, _ := json.Marshal(&result{State: "OK"})
+
+	fmt.Fprintf(response, string(result))
+}
+
+// @Title hardwareHandler
+// @Description Return the last hardware report registered for a MAC
+// @Summary Return the last hardware report registered for a MAC
+// @Param macaddr    path    string    true    "MacAddress"
+// @Success 200    {object} string "Hardware report in JSON format."
+// @Failure 404    {object} string "No hardware report for the MAC"
+// @Failure 500    {object} string "Failed to get hardware report"
+// @Router /hardware/{macaddr} [GET]
+func hardwareHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	hr, err := w.GetHardware(ps.ByName("macaddr"))
+	if err != nil {
+		if errors.Is(err, waitron.ErrHardwareNotFound) {
+			http.Error(response, err.Error(), 404)
+			return
+		}
+
+		http.Error(response, "Failed to get hardware report: "+err.Error(), 500)
+		return
+	}
+
+	result, err := json.Marshal(hr)
+	if err != nil {
+		http.Error(response, "Failed to get hardware report: "+err.Error(), 500)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(result)
+}
+
+// @Title discoveredHandler
+// @Description Return the unknown MACs that have asked for a PXE config and are waiting to be adopted
+// @Summary Return the unknown MACs that have asked for a PXE config, oldest first, with when and how often they were seen, and any hardware they registered
+// @Success 200    {object} string "Discovered machines in JSON format."
+// @Router /discovered [GET]
+func discoveredHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	result, err := json.Marshal(w.GetDiscovered())
+	if err != nil {
+		http.Error(response, "Failed to get discovered machines: "+err.Error(), 500)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(result)
+}
+
+// @Title adoptHandler
+// @Description Give a discovered machine a hostname and build type, store it in every writable inventory plugin, and optionally start a build
+// @Summary Give a discovered machine a hostname and build type, store it in every writable inventory plugin, and optionally start a build
+// @Accept json
+// @Produce json
+// @Param macaddr    path    string    true    "MacAddress"
+// @Param {object}    body    string    true    "{"hostname": <hostname>, "build_type": <build type>, "build": <true to start a build>}"
+// @Success 200    {object} string "{"State": "OK", "Token": <job token, if a build was started>}"
+// @Failure 400    {object} string "Failed to adopt"
+// @Failure 404    {object} string "No discovered machine for the MAC"
+// @Failure 409    {object} string "The hostname is already defined in an inventory plugin"
+// @Failure 500    {object} string "Failed to adopt"
+// @Router /discovered/{macaddr}/adopt [POST]
+func adoptHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	mac := ps.ByName("macaddr")
+
+	body, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		http.Error(response, fmt.Sprintf("Failed to adopt %s: %s", mac, err.Error()), 400)
+		return
+	}
+
+	o := waitron.AdoptOptions{}
+
+	if err = json.Unmarshal(body, &o); err != nil {
+		http.Error(response, fmt.Sprintf("Failed to adopt %s: %s", mac, err.Error()), 400)
+		return
+	}
+
+	token, err := w.AdoptDiscovered(mac, o)
+	if err != nil {
+		if errors.Is(err, waitron.ErrDiscoveredNotFound) {
+			http.Error(response, err.Error(), 404)
+			return
+		}
+
+		if errors.Is(err, waitron.ErrBadAdoption) {
+			http.Error(response, fmt.Sprintf("Failed to adopt %s: %s", mac, err.Error()), 400)
+			return
+		}
+
+		if errors.Is(err, waitron.ErrAdoptionConflict) {
+			http.Error(response, fmt.Sprintf("Failed to adopt %s: %s", mac, err.Error()), 409)
+			return
+		}
+
+		http.Error(response, fmt.Sprintf("Failed to adopt %s: %s", mac, err.Error()), 500)
+		return
+	}
+
+	result, _ := json.Marshal(&result{State: "OK", Token: token})
+
+	fmt.Fprintf(response, string(result))
+}
+
+// @Title batchBuildHandler
+// @Description Start builds for a set of machines, listed by hostname, picked with a selector, or both, and keep them together as a batch
+// @Summary Start builds for a set of machines as a batch.  Builds that can't be started are reported with their errors, and don't stop the rest.
+// @Accept json
+// @Produce json
+// @Param {object}    body    string    true    "{"name": <name>, "hostnames": [<hostname>], "selector": {"domain": <domain>, "tag": <tag>, "plugin": <plugin name>, "query": <plugin query>}, "build_type": <build type>, "override": <machine definition>, "force": <take over MACs>}"
+// @Success 200    {object} string "The batch, with a token or an error for each machine, in JSON format."
+// @Failure 400    {object} string "Bad request, or nothing was selected"
+// @Failure 500    {object} string "Failed to select machines"
+// @Router /builds [POST]
+func batchBuildHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(response, request.Body, 1024*1024))
+	if err != nil {
+		http.Error(response, "Failed to start batch: "+err.Error(), 400)
+		return
+	}
+
+	r := waitron.BatchRequest{}
+
+	if err = json.Unmarshal(body, &r); err != nil {
+		http.Error(response, "Failed to start batch: "+err.Error(), 400)
+		return
+	}
+
+	b, err := w.BuildBatch(r)
+	if err != nil {
+		if errors.Is(err, waitron.ErrBadBatch) {
+			http.Error(response, "Failed to start batch: "+err.Error(), 400)
+			return
+		}
+
+		http.Error(response, "Failed to start batch: "+err.Error(), 500)
+		return
+	}
+
+	result, err := json.Marshal(b)
+	if err != nil {
+		http.Error(response, "Failed to get batch: "+err.Error(), 500)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(result)
+}
+
+// @Title batchHandler
+// @Description Return a batch, with the current status of each of its builds
+// @Summary Return a batch, with the current status of each of its builds and how many builds are in each status
+// @Param id    path    string    true    "Batch ID"
+// @Success 200    {object} string "The batch in JSON format."
+// @Failure 404    {object} string "No such batch"
+// @Router /batches/{id} [GET]
+func batchHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	b, err := w.GetBatch(ps.ByName("id"))
+	if err != nil {
+		if errors.Is(err, waitron.ErrBatchNotFound) {
+			http.Error(response, err.Error(), 404)
+			return
+		}
+
+		http.Error(response, "Failed to get batch: "+err.Error(), 500)
+		return
+	}
+
+	result, err := json.Marshal(b)
+	if err != nil {
+		http.Error(response, "Failed to get batch: "+err.Error(), 500)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(result)
+}
+
+// @Title cancelBatchHandler
+// @Description Cancel every build of a batch that hasn't finished yet
+// @Summary Cancel every build of a batch that hasn't finished yet.  Builds that couldn't be cancelled have a cancel_error.
+// @Param id    path    string    true    "Batch ID"
+// @Success 200    {object} string "The batch in JSON format."
+// @Failure 404    {object} string "No such batch"
+// @Router /batches/{id}/cancel [PUT]
+func cancelBatchHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	b, err := w.CancelBatch(ps.ByName("id"))
+	if err != nil {
+		if errors.Is(err, waitron.ErrBatchNotFound) {
+			http.Error(response, err.Error(), 404)
+			return
+		}
+
+		http.Error(response, "Failed to cancel batch: "+err.Error(), 500)
+		return
+	}
+
+	result, err := json.Marshal(b)
+	if err != nil {
+		http.Error(response, "Failed to get batch: "+err.Error(), 500)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(result)
+}
+
+// @Title imagesHandler
+// @Description Return the state of every image waitron mirrors from the image manifests of the config and build types
+// @Summary Return the state of every mirrored image: pending, fetching, verified, or failed, and why
+// @Success 200    {object} string "Images in JSON format."
+// @Router /images [GET]
+func imagesHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	result, err := json.Marshal(w.GetImages())
+	if err != nil {
+		http.Error(response, "Failed to get images: "+err.Error(), 500)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	response.Write(result)
+}
+
+// @Title imageFileHandler
+// @Description Serve the verified local copy of a mirrored image
+// @Summary Serve the verified local copy of a mirrored image
+// @Param sha256    path    string    true    "sha256 of the image"
+// @Param name    path    string    true    "Name of the image"
+// @Success 200    {object} string "The image"
+// @Failure 404    {object} string "No verified image with that sha256 and name"
+// @Router /images/{sha256}/{name} [GET]
+func imageFileHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	file, err := w.ImageFile(ps.ByName("sha256"), ps.ByName("name"))
+	if err != nil {
+		http.Error(response, err.Error(), 404)
+		return
+	}
+
+	http.ServeFile(response, request, file)
+}
+
+/*
+	Counts what actually gets written, so a download can be accounted for even if it's cut short.
+*/
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (cw *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(b)
+	cw.written += int64(n)
+	return n, err
+}
+
+// @Title filesHandler
+// @Description Serve a file from staticspath, with a strong ETag, Range support, and its sha256 in a Digest header
+// @Summary Serve a file from staticspath.  Files ending in .j2 are rendered for the job with the token.  What's sent is counted against the job with the token, or, without one, the job with an interface that has the address of the requester.
+// @Param filepath    path    string    true    "Path of the file under staticspath"
+// @Param token    query    string    false    "Token of the job fetching the file"
+// @Success 200    {object} string "The file"
+// @Success 206    {object} string "The requested range of the file"
+// @Failure 400    {object} string "Templated file without the token of an active job"
+// @Failure 404    {object} string "No such file"
+// @Failure 500    {object} string "Failed to serve file"
+// @Router /files/{filepath} [GET]
+func filesHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, w *waitron.Waitron) {
+
+	address, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		address = request.RemoteAddr
+	}
+
+	f, err := w.OpenStaticFile(ps.ByName("filepath"), request.URL.Query().Get("token"), address)
+	if err != nil {
+		if errors.Is(err, waitron.ErrStaticFileNotFound) {
+			http.Error(response, err.Error(), 404)
+			return
+		}
+
+		if errors.Is(err, waitron.ErrStaticFileNeedsToken) {
+			http.Error(response, err.Error(), 400)
+			return
+		}
+
+		http.Error(response, "Failed to serve file: "+err.Error(), 500)
+		return
+	}
+	defer f.Close()
+
+	sum, _ := hex.DecodeString(f.SHA256)
+
+	response.Header().Set("ETag", `"`+f.SHA256+`"`)
+	response.Header().Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(sum))
+
+	// ServeContent takes care of ranges and conditional requests.
+	cw := &countingResponseWriter{ResponseWriter: response}
+	http.ServeContent(cw, request, f.Name, f.ModTime, f.Content)
+
+	if request.Method != "HEAD" {
+		w.RecordDownload(f, cw.written)
+	}
+}
+
 // @Title healthHandler
 // @Description Check that Waitron is running
 // @Summary Check that Waitron is running
@@ -268,13 +952,149 @@ func healthHandler(response http.ResponseWriter, request *http.Request, ps httpr
 	fmt.Fprintf(response, string(result))
 }
 
+/*
+	Helpers for managing the encrypted file used by the "file" secrets provider.  Plaintext comes in on stdin and the result goes to stdout.
+*/
+func secretsTool(generateKey bool, sealKeyFile string, openKeyFile string) error {
+	if generateKey {
+		k, err := secrets.GenerateKey()
+		if err != nil {
+			return err
+		}
+
+		_, err = os.Stdout.Write(k)
+		return err
+	}
+
+	keyFile, f := sealKeyFile, secrets.Seal
+	if openKeyFile != "" {
+		keyFile, f = openKeyFile, secrets.Open
+	}
+
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	key, err := secrets.ParseKey(b)
+	if err != nil {
+		return err
+	}
+
+	in, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	out, err := f(key, in)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+/*
+	waitron -config config.yml render <template> <hostname> [type] [machine definition file]
+
+	Prints what a build would render without starting Waitron, and exits non-zero if anything failed to render.
+*/
+func renderCommand(w *waitron.Waitron, args []string) error {
+	if len(args) < 2 || len(args) > 4 {
+		return errors.New("usage: waitron render <template> <hostname> [type] [machine definition file]")
+	}
+
+	btype := ""
+	if len(args) > 2 {
+		btype = args[2]
+	}
+
+	var machineDefinition []byte
+	if len(args) > 3 {
+		b, err := ioutil.ReadFile(args[3])
+		if err != nil {
+			return err
+		}
+		machineDefinition = b
+	}
+
+	preview, err := w.RenderPreview(args[0], args[1], btype, machineDefinition)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("# cmdline\n%s\n", preview.Cmdline)
+
+	for _, name := range []string{"prebuild_commands", "pxeevent_commands", "postbuild_commands", "cancelbuild_commands", "stalebuild_commands"} {
+		for _, c := range preview.Commands[name] {
+			fmt.Printf("\n# %s\n%s\n", name, c)
+		}
+	}
+
+	if preview.Template != "" {
+		fmt.Printf("\n# %s (%s)\n%s\n", args[0], preview.Template, preview.Result)
+	}
+
+	for _, e := range preview.Errors {
+		fmt.Fprintln(os.Stderr, e.String())
+	}
+
+	if len(preview.Errors) > 0 {
+		return fmt.Errorf("%d errors while rendering", len(preview.Errors))
+	}
+
+	return nil
+}
+
+/*
+	waitron -config config.yml lint [hostname]
+
+	Checks every template, cmdline, and build command against every build type, using a sample machine unless a real one is named.
+*/
+func lintCommand(w *waitron.Waitron, args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: waitron lint [hostname]")
+	}
+
+	hostname := ""
+	if len(args) > 0 {
+		hostname = args[0]
+	}
+
+	issues, err := w.LintTemplates(hostname)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range issues {
+		fmt.Println(i.String())
+	}
+
+	if len(issues) > 0 {
+		return fmt.Errorf("%d problems found", len(issues))
+	}
+
+	return nil
+}
+
 func main() {
 
 	configPath := flag.String("config", "", "Path to config file.")
 	address := flag.String("address", "", "Address to listen for requests.")
 	port := flag.String("port", "9090", "Port to listen for requests.")
+	secretsGenerateKey := flag.Bool("secrets-generate-key", false, "Print a new key for the file secrets provider and exit.")
+	secretsSeal := flag.String("secrets-seal", "", "Encrypt stdin to stdout with the specified key file and exit.")
+	secretsOpen := flag.String("secrets-open", "", "Decrypt stdin to stdout with the specified key file and exit.")
 	flag.Parse()
 
+	if *secretsGenerateKey || *secretsSeal != "" || *secretsOpen != "" {
+		if err := secretsTool(*secretsGenerateKey, *secretsSeal, *secretsOpen); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	configFile := *configPath
 
 	if configFile == "" {
@@ -293,6 +1113,20 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if flag.Arg(0) == "render" {
+		if err := renderCommand(w, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.Arg(0) == "lint" {
+		if err := lintCommand(w, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	r := httprouter.New()
 	r.PUT("/build/:hostname",
 		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
@@ -326,11 +1160,19 @@ func main() {
 		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
 			jobDefinitionHandler(response, request, ps, w)
 		})
+	r.GET("/job/:token/log",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			jobLogHandler(response, request, ps, w)
+		})
 
 	r.GET("/done/:hostname/:token",
 		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
 			doneHandler(response, request, ps, w)
 		})
+	r.POST("/progress/:hostname/:token",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			progressHandler(response, request, ps, w)
+		})
 	r.PUT("/cancel/:hostname/:token",
 		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
 			cancelHandler(response, request, ps, w)
@@ -339,18 +1181,80 @@ func main() {
 		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
 			templateHandler(response, request, ps, w)
 		})
+	r.POST("/render/:template/:hostname",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			renderHandler(response, request, ps, w)
+		})
+	r.POST("/render/:template/:hostname/:type",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			renderHandler(response, request, ps, w)
+		})
+	r.GET("/cloud-init/:hostname/:token/:item",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			cloudInitHandler(response, request, ps, w)
+		})
+	r.GET("/ignition/:hostname/:token",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			ignitionHandler(response, request, ps, w)
+		})
+	r.GET("/network/:format/:hostname/:token",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			networkConfigHandler(response, request, ps, w)
+		})
 	r.GET("/v1/boot/:macaddr",
 		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
 			pixieHandler(response, request, ps, w)
 		})
+	r.POST("/register/:macaddr",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			registerHandler(response, request, ps, w)
+		})
+	r.GET("/hardware/:macaddr",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			hardwareHandler(response, request, ps, w)
+		})
+	r.GET("/discovered",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			discoveredHandler(response, request, ps, w)
+		})
+	r.POST("/discovered/:macaddr/adopt",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			adoptHandler(response, request, ps, w)
+		})
+	r.GET("/images",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			imagesHandler(response, request, ps, w)
+		})
+	r.GET("/images/:sha256/:name",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			imageFileHandler(response, request, ps, w)
+		})
+	r.POST("/builds",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			batchBuildHandler(response, request, ps, w)
+		})
+	r.GET("/batches/:id",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			batchHandler(response, request, ps, w)
+		})
+	r.PUT("/batches/:id/cancel",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			cancelBatchHandler(response, request, ps, w)
+		})
 	r.GET("/health",
 		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
 			healthHandler(response, request, ps, w)
 		})
 
 	if configuration.StaticFilesPath != "" {
-		fs := http.FileServer(http.Dir(configuration.StaticFilesPath))
-		r.Handler("GET", "/files/:filename", http.StripPrefix("/files/", fs))
+		r.GET("/files/*filepath",
+			func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+				filesHandler(response, request, ps, w)
+			})
+		r.HEAD("/files/*filepath",
+			func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+				filesHandler(response, request, ps, w)
+			})
 		log.Println("Serving static files from " + configuration.StaticFilesPath)
 	}
 
@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path"
 	"strings"
 	"testing"
 
@@ -160,3 +162,54 @@ func TestPixieHandlerNotInBuildMode(t *testing.T) {
 	}
 
 }
+
+func TestFilesHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-files")
+	if err != nil {
+		t.Errorf("Failed to create staticspath: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(path.Join(dir, "ubuntu/focal"), 0755)
+	ioutil.WriteFile(path.Join(dir, "ubuntu/focal/linux"), []byte("0123456789"), 0644)
+	ioutil.WriteFile(path.Join(dir, "preseed.cfg.j2"), []byte("{{ machine.Hostname }}"), 0644)
+
+	w := waitron.New(&config.Config{StaticFilesPath: dir})
+
+	serve := func(method string, file string, headers map[string]string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, "/files/"+file, nil)
+		for k, v := range headers {
+			request.Header.Set(k, v)
+		}
+		response := httptest.NewRecorder()
+		filesHandler(response, request, httprouter.Params{httprouter.Param{Key: "filepath", Value: "/" + file}}, w)
+		return response
+	}
+
+	response := serve("GET", "ubuntu/focal/linux", nil)
+	etag := `"84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"`
+
+	if response.Code != 200 || response.Body.String() != "0123456789" || response.Header().Get("ETag") != etag ||
+		response.Header().Get("Digest") != "sha-256=hNiYd/DUBB77a/kaFvAkjy/Vc+avBcGflr7bn4gveII=" {
+		t.Errorf("Unexpected response for a nested file: %d %v %s", response.Code, response.Header(), response.Body)
+	}
+
+	if response = serve("GET", "ubuntu/focal/linux", map[string]string{"Range": "bytes=4-"}); response.Code != 206 || response.Body.String() != "456789" {
+		t.Errorf("Unexpected response for a range: %d %s", response.Code, response.Body)
+	}
+
+	if response = serve("GET", "ubuntu/focal/linux", map[string]string{"If-None-Match": etag}); response.Code != 304 {
+		t.Errorf("Unexpected response for a matching ETag: %d", response.Code)
+	}
+
+	for _, file := range []string{"ubuntu/focal/missing", "ubuntu", "../../etc/passwd", ""} {
+		if response = serve("GET", file, nil); response.Code != 404 {
+			t.Errorf("Unexpected response for %s: %d %s", file, response.Code, response.Body)
+		}
+	}
+
+	if response = serve("GET", "preseed.cfg.j2", nil); response.Code != 400 {
+		t.Errorf("Templated file was served without a token: %d %s", response.Code, response.Body)
+	}
+}
@@ -0,0 +1,64 @@
+package secrets
+
+import (
+	"os"
+	"strings"
+	"unicode"
+
+	"waitron/config"
+)
+
+func init() {
+	if err := AddSecretsProvider("env", NewEnvSecretsProvider); err != nil {
+		panic(err)
+	}
+}
+
+/*
+	Looks secrets up in the environment.  "hosts/db01/root_password" is WAITRON_SECRET_HOSTS_DB01_ROOT_PASSWORD,
+	with the prefix changeable through the "prefix" option.
+*/
+type EnvSecretsProvider struct {
+	settings      *config.SecretsProviderSettings
+	waitronConfig *config.Config
+	Log           func(string, config.LogLevel) bool
+
+	prefix string
+}
+
+func NewEnvSecretsProvider(s *config.SecretsProviderSettings, c *config.Config, lf func(string, config.LogLevel) bool) SecretsProvider {
+
+	p := &EnvSecretsProvider{
+		settings:      s,
+		waitronConfig: c,
+		Log:           lf,
+	}
+
+	return p
+}
+
+func (p *EnvSecretsProvider) Init() error {
+	var found bool
+	if p.prefix, found = p.settings.AdditionalOptions["prefix"].(string); !found {
+		p.prefix = "WAITRON_SECRET_"
+	}
+
+	return nil
+}
+
+func (p *EnvSecretsProvider) Deinit() error {
+	return nil
+}
+
+func (p *EnvSecretsProvider) GetSecret(path string, key string) (string, bool, error) {
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToUpper(r)
+		}
+		return '_'
+	}, path+"/"+key)
+
+	v, found := os.LookupEnv(p.prefix + name)
+
+	return v, found, nil
+}
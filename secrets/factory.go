@@ -0,0 +1,59 @@
+package secrets
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"waitron/config"
+)
+
+var secretsProviders map[string]func(*config.SecretsProviderSettings, *config.Config, func(string, config.LogLevel) bool) SecretsProvider = make(map[string]func(*config.SecretsProviderSettings, *config.Config, func(string, config.LogLevel) bool) SecretsProvider)
+
+/*
+	GetSecret returns the value, and whether it was found at all.  Not finding a secret isn't an error,
+	so that the next provider can be asked for it.
+*/
+type SecretsProvider interface {
+	Init() error
+	GetSecret(string, string) (string, bool, error)
+	Deinit() error
+}
+
+func AddSecretsProvider(t string, f func(*config.SecretsProviderSettings, *config.Config, func(string, config.LogLevel) bool) SecretsProvider) error {
+	if _, found := secretsProviders[t]; found {
+		return errors.New("secrets provider type already exists: " + t)
+	}
+
+	secretsProviders[t] = f
+
+	return nil
+}
+
+func GetProvider(t string, s *config.SecretsProviderSettings, c *config.Config, lf func(string, config.LogLevel) bool) (SecretsProvider, error) {
+	pNew, found := secretsProviders[t]
+
+	if !found {
+		return nil, errors.New("secrets provider type not found: " + t)
+	}
+
+	plf := func(ls string, ll config.LogLevel) bool {
+		return lf("[secrets:"+t+"] "+ls, ll)
+	}
+
+	return pNew(s, c, plf), nil
+}
+
+/*
+	Secrets are referred to as "path/key", e.g., "hosts/db01/root_password", where everything up to the last slash is the path.
+*/
+func SplitPath(p string) (string, string, error) {
+	p = strings.Trim(p, "/")
+
+	idx := strings.LastIndex(p, "/")
+	if idx <= 0 || idx == len(p)-1 {
+		return "", "", fmt.Errorf("secret '%s' should look like 'path/key'", p)
+	}
+
+	return p[:idx], p[idx+1:], nil
+}
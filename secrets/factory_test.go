@@ -0,0 +1,59 @@
+package secrets_test
+
+import (
+	"testing"
+
+	"waitron/config"
+	"waitron/secrets"
+)
+
+type TestProvider struct {
+}
+
+func (t *TestProvider) Init() error {
+	return nil
+}
+
+func (t *TestProvider) GetSecret(p string, k string) (string, bool, error) {
+	return "", false, nil
+}
+
+func (t *TestProvider) Deinit() error {
+	return nil
+}
+
+func TestNew(t *testing.T) {
+
+	if _, err := secrets.GetProvider("test", &config.SecretsProviderSettings{}, &config.Config{}, func(s string, i config.LogLevel) bool { return true }); err == nil {
+		t.Errorf("Secrets provider factory did not return error for unknown type.")
+	}
+
+	if err := secrets.AddSecretsProvider("test", func(s *config.SecretsProviderSettings, c *config.Config, lf func(string, config.LogLevel) bool) secrets.SecretsProvider {
+		return &TestProvider{}
+	}); err != nil {
+		t.Errorf("Secrets provider factory failed to add new type.")
+	}
+
+	if err := secrets.AddSecretsProvider("test", func(s *config.SecretsProviderSettings, c *config.Config, lf func(string, config.LogLevel) bool) secrets.SecretsProvider {
+		return &TestProvider{}
+	}); err == nil {
+		t.Errorf("Secrets provider factory allowed duplicate type.")
+	}
+
+	if _, err := secrets.GetProvider("test", &config.SecretsProviderSettings{}, &config.Config{}, func(s string, i config.LogLevel) bool { return true }); err != nil {
+		t.Errorf("Secrets provider factory failed to return known type.")
+	}
+
+}
+
+func TestSplitPath(t *testing.T) {
+	if p, k, err := secrets.SplitPath("/hosts/db01/root_password"); err != nil || p != "hosts/db01" || k != "root_password" {
+		t.Errorf("Unexpected split: path(%s) key(%s) err(%v)", p, k, err)
+	}
+
+	for _, bad := range []string{"", "password", "hosts/", "/password"} {
+		if _, _, err := secrets.SplitPath(bad); err == nil {
+			t.Errorf("Split of '%s' did not fail", bad)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"waitron/config"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"gopkg.in/yaml.v2"
+)
+
+func init() {
+	if err := AddSecretsProvider("file", NewFileSecretsProvider); err != nil {
+		panic(err)
+	}
+}
+
+const nonceSize = 24
+
+/*
+	Reads secrets from a local file encrypted with NaCl secretbox.
+	Once decrypted, the file is YAML with paths at the top level and keys below them:
+
+		hosts/db01:
+		  root_password: hunter2
+		ipmi:
+		  password: hunter3
+
+	The file is re-read whenever it changes, so secrets can be rotated without a restart.
+*/
+type FileSecretsProvider struct {
+	settings      *config.SecretsProviderSettings
+	waitronConfig *config.Config
+	Log           func(string, config.LogLevel) bool
+
+	sync.Mutex
+
+	key     *[32]byte
+	modTime time.Time
+	secrets map[string]map[string]string
+}
+
+func NewFileSecretsProvider(s *config.SecretsProviderSettings, c *config.Config, lf func(string, config.LogLevel) bool) SecretsProvider {
+
+	p := &FileSecretsProvider{
+		settings:      s,
+		waitronConfig: c,
+		Log:           lf,
+	}
+
+	return p
+}
+
+func (p *FileSecretsProvider) Init() error {
+	if p.settings.Source == "" {
+		return fmt.Errorf("source not found in config of file secrets provider")
+	}
+
+	keyFile, _ := p.settings.AdditionalOptions["key_file"].(string)
+	if keyFile == "" {
+		return fmt.Errorf("key_file not found in config of file secrets provider")
+	}
+
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+
+	if p.key, err = ParseKey(b); err != nil {
+		return err
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	return p.load()
+}
+
+func (p *FileSecretsProvider) Deinit() error {
+	return nil
+}
+
+/*
+	The lock must be held by the caller.
+*/
+func (p *FileSecretsProvider) load() error {
+	fi, err := os.Stat(p.settings.Source)
+	if err != nil {
+		return err
+	}
+
+	if fi.ModTime().Equal(p.modTime) && p.secrets != nil {
+		return nil
+	}
+
+	sealed, err := ioutil.ReadFile(p.settings.Source)
+	if err != nil {
+		return err
+	}
+
+	plain, err := Open(p.key, sealed)
+	if err != nil {
+		return fmt.Errorf("unable to decrypt %s: %v", p.settings.Source, err)
+	}
+
+	secrets := make(map[string]map[string]string)
+	if err = yaml.Unmarshal(plain, &secrets); err != nil {
+		return fmt.Errorf("unable to parse %s: %v", p.settings.Source, err)
+	}
+
+	p.secrets = secrets
+	p.modTime = fi.ModTime()
+
+	p.Log(fmt.Sprintf("loaded %d secret paths from %s", len(secrets), p.settings.Source), config.LogLevelInfo)
+
+	return nil
+}
+
+func (p *FileSecretsProvider) GetSecret(path string, key string) (string, bool, error) {
+	p.Lock()
+	defer p.Unlock()
+
+	// Keep using what we had if the file went bad, but say so.
+	if err := p.load(); err != nil {
+		p.Log(fmt.Sprintf("failed to reload secrets: %v", err), config.LogLevelError)
+	}
+
+	v, found := p.secrets[path][key]
+
+	return v, found, nil
+}
+
+/*
+	Returns a new random key, base64 encoded, as it should be written to a key file.
+*/
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return []byte(base64.StdEncoding.EncodeToString(key) + "\n"), nil
+}
+
+func ParseKey(b []byte) (*[32]byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil {
+		return nil, fmt.Errorf("secrets key is not valid base64: %v", err)
+	}
+
+	if len(raw) != 32 {
+		return nil, fmt.Errorf("secrets key must be 32 bytes, got %d", len(raw))
+	}
+
+	key := new([32]byte)
+	copy(key[:], raw)
+
+	return key, nil
+}
+
+/*
+	Encrypts plaintext with the key.  The result is base64 encoded, with the nonce up front.
+*/
+func Seal(key *[32]byte, plain []byte) ([]byte, error) {
+	var nonce [nonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nil, err
+	}
+
+	box := secretbox.Seal(nonce[:], plain, &nonce, key)
+
+	return []byte(base64.StdEncoding.EncodeToString(box) + "\n"), nil
+}
+
+func Open(key *[32]byte, sealed []byte) ([]byte, error) {
+	box, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sealed)))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(box) < nonceSize+secretbox.Overhead {
+		return nil, errors.New("sealed secrets are too short")
+	}
+
+	var nonce [nonceSize]byte
+	copy(nonce[:], box[:nonceSize])
+
+	plain, ok := secretbox.Open(nil, box[nonceSize:], &nonce, key)
+	if !ok {
+		return nil, errors.New("wrong key or corrupted secrets")
+	}
+
+	return plain, nil
+}
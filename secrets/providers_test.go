@@ -0,0 +1,159 @@
+package secrets_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"waitron/config"
+	"waitron/secrets"
+)
+
+func nopLog(s string, l config.LogLevel) bool { return true }
+
+func initProvider(t *testing.T, s *config.SecretsProviderSettings) secrets.SecretsProvider {
+	p, err := secrets.GetProvider(s.Type, s, &config.Config{}, nopLog)
+	if err != nil {
+		t.Fatalf("Failed to get %s provider: %v", s.Type, err)
+	}
+
+	if err = p.Init(); err != nil {
+		t.Fatalf("Failed to init %s provider: %v", s.Type, err)
+	}
+
+	return p
+}
+
+func TestEnvSecretsProvider(t *testing.T) {
+	os.Setenv("WAITRON_SECRET_HOSTS_DB01_ROOT_PASSWORD", "hunter2")
+	defer os.Unsetenv("WAITRON_SECRET_HOSTS_DB01_ROOT_PASSWORD")
+
+	p := initProvider(t, &config.SecretsProviderSettings{Type: "env"})
+
+	if v, found, err := p.GetSecret("hosts/db01", "root_password"); err != nil || !found || v != "hunter2" {
+		t.Errorf("Unexpected env secret: value(%s) found(%v) err(%v)", v, found, err)
+	}
+
+	if _, found, err := p.GetSecret("hosts/db02", "root_password"); err != nil || found {
+		t.Errorf("Found env secret that doesn't exist: err(%v)", err)
+	}
+}
+
+func TestFileSecretsProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-secrets")
+	if err != nil {
+		t.Fatalf("Failed to create secrets dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := path.Join(dir, "secrets.key")
+	secretsFile := path.Join(dir, "secrets.enc")
+
+	k, err := secrets.GenerateKey()
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	if err = ioutil.WriteFile(keyFile, k, 0600); err != nil {
+		t.Fatalf("Failed to write key: %v", err)
+	}
+
+	key, err := secrets.ParseKey(k)
+	if err != nil {
+		t.Fatalf("Failed to parse generated key: %v", err)
+	}
+
+	seal := func(plain string, mt time.Time) {
+		b, err := secrets.Seal(key, []byte(plain))
+		if err != nil {
+			t.Fatalf("Failed to seal secrets: %v", err)
+		}
+
+		if err = ioutil.WriteFile(secretsFile, b, 0600); err != nil {
+			t.Fatalf("Failed to write secrets: %v", err)
+		}
+
+		os.Chtimes(secretsFile, mt, mt)
+	}
+
+	seal("hosts/db01:\n  root_password: hunter2\n", time.Now().Add(-time.Hour))
+
+	p := initProvider(t, &config.SecretsProviderSettings{Type: "file", Source: secretsFile, AdditionalOptions: map[string]interface{}{"key_file": keyFile}})
+
+	if v, found, err := p.GetSecret("hosts/db01", "root_password"); err != nil || !found || v != "hunter2" {
+		t.Errorf("Unexpected file secret: value(%s) found(%v) err(%v)", v, found, err)
+	}
+
+	// Rotated secrets should be picked up without a restart.
+	seal("hosts/db01:\n  root_password: hunter3\n", time.Now())
+
+	if v, found, err := p.GetSecret("hosts/db01", "root_password"); err != nil || !found || v != "hunter3" {
+		t.Errorf("Unexpected file secret after rotation: value(%s) found(%v) err(%v)", v, found, err)
+	}
+
+	other, _ := secrets.GenerateKey()
+	otherKey, _ := secrets.ParseKey(other)
+	sealed, _ := ioutil.ReadFile(secretsFile)
+
+	if _, err := secrets.Open(otherKey, sealed); err == nil {
+		t.Errorf("Secrets opened with the wrong key")
+	}
+}
+
+func TestVaultSecretsProvider(t *testing.T) {
+	requests := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v1/kv/data/hosts/db01":
+			fmt.Fprint(w, `{"data":{"data":{"root_password":"hunter2","pin":1234},"metadata":{"version":3}}}`)
+		case "/v1/kv/data/hosts/we?ird#100%":
+			fmt.Fprint(w, `{"data":{"data":{"root_password":"escaped"}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[]}`)
+		}
+	}))
+	defer ts.Close()
+
+	p := initProvider(t, &config.SecretsProviderSettings{Type: "vault", Source: ts.URL, AuthToken: "s.token", AdditionalOptions: map[string]interface{}{"mount": "kv"}})
+
+	if v, found, err := p.GetSecret("hosts/db01", "root_password"); err != nil || !found || v != "hunter2" {
+		t.Errorf("Unexpected vault secret: value(%s) found(%v) err(%v)", v, found, err)
+	}
+
+	if v, found, err := p.GetSecret("hosts/db01", "pin"); err != nil || !found || v != "1234" {
+		t.Errorf("Unexpected non-string vault secret: value(%s) found(%v) err(%v)", v, found, err)
+	}
+
+	if requests != 1 {
+		t.Errorf("Vault path was not cached: %d requests", requests)
+	}
+
+	if _, found, err := p.GetSecret("hosts/db02", "root_password"); err != nil || found {
+		t.Errorf("Found vault secret that doesn't exist: err(%v)", err)
+	}
+
+	// Anything that means something in a URL stays part of the path.
+	if v, found, err := p.GetSecret("/hosts/we?ird#100%", "root_password"); err != nil || !found || v != "escaped" {
+		t.Errorf("Unexpected vault secret with an odd path: value(%s) found(%v) err(%v)", v, found, err)
+	}
+
+	bad := initProvider(t, &config.SecretsProviderSettings{Type: "vault", Source: ts.URL, AuthToken: "wrong"})
+
+	if _, _, err := bad.GetSecret("hosts/db01", "root_password"); err == nil {
+		t.Errorf("Vault provider did not fail with a bad token")
+	}
+}
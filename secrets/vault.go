@@ -0,0 +1,219 @@
+package secrets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"waitron/config"
+)
+
+func init() {
+	if err := AddSecretsProvider("vault", NewVaultSecretsProvider); err != nil {
+		panic(err)
+	}
+}
+
+type vaultCachedPath struct {
+	fetched time.Time
+	values  map[string]string
+}
+
+/*
+	Reads secrets from a Vault-compatible KV secrets engine over HTTP.
+	The path of the secret is the path within the mount, and the key is the key within that secret.
+
+	Options:
+		mount:          Where the KV engine is mounted.  Defaults to "secret".
+		kv_version:     1 or 2.  Defaults to 2.
+		namespace:      Sent as X-Vault-Namespace if set.
+		cache_seconds:  How long to hold on to a fetched path.  Defaults to 60.  0 disables caching.
+		timeout_seconds: Defaults to 10.
+*/
+type VaultSecretsProvider struct {
+	settings      *config.SecretsProviderSettings
+	waitronConfig *config.Config
+	Log           func(string, config.LogLevel) bool
+
+	client    *http.Client
+	mount     string
+	kvVersion int
+	namespace string
+	cacheTTL  time.Duration
+
+	cacheLock sync.Mutex
+	cache     map[string]vaultCachedPath
+}
+
+func NewVaultSecretsProvider(s *config.SecretsProviderSettings, c *config.Config, lf func(string, config.LogLevel) bool) SecretsProvider {
+
+	p := &VaultSecretsProvider{
+		settings:      s,
+		waitronConfig: c,
+		Log:           lf,
+		cache:         make(map[string]vaultCachedPath),
+	}
+
+	return p
+}
+
+/*
+	YAML will hand us ints for numbers, but be forgiving about it.
+*/
+func intOption(options map[string]interface{}, name string, def int) int {
+	switch v := options[name].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+	return def
+}
+
+func (p *VaultSecretsProvider) Init() error {
+	if p.settings.Source == "" {
+		return fmt.Errorf("source for vault secrets provider must not be empty")
+	}
+
+	if p.settings.AuthToken == "" {
+		return fmt.Errorf("auth token for vault secrets provider must not be empty")
+	}
+
+	if p.mount, _ = p.settings.AdditionalOptions["mount"].(string); p.mount == "" {
+		p.mount = "secret"
+	}
+	p.mount = strings.Trim(p.mount, "/")
+
+	p.namespace, _ = p.settings.AdditionalOptions["namespace"].(string)
+
+	p.kvVersion = intOption(p.settings.AdditionalOptions, "kv_version", 2)
+	if p.kvVersion != 1 && p.kvVersion != 2 {
+		return fmt.Errorf("kv_version for vault secrets provider must be 1 or 2, got %d", p.kvVersion)
+	}
+
+	p.cacheTTL = time.Duration(intOption(p.settings.AdditionalOptions, "cache_seconds", 60)) * time.Second
+	p.client = &http.Client{Timeout: time.Duration(intOption(p.settings.AdditionalOptions, "timeout_seconds", 10)) * time.Second}
+
+	return nil
+}
+
+func (p *VaultSecretsProvider) Deinit() error {
+	return nil
+}
+
+func (p *VaultSecretsProvider) GetSecret(path string, key string) (string, bool, error) {
+	values, err := p.getPath(path)
+	if err != nil {
+		return "", false, err
+	}
+
+	v, found := values[key]
+
+	return v, found, nil
+}
+
+func (p *VaultSecretsProvider) getPath(path string) (map[string]string, error) {
+	p.cacheLock.Lock()
+	cached, found := p.cache[path]
+	p.cacheLock.Unlock()
+
+	if found && time.Since(cached.fetched) < p.cacheTTL {
+		return cached.values, nil
+	}
+
+	u := strings.TrimRight(p.settings.Source, "/") + "/v1/" + escapePath(p.mount) + "/"
+	if p.kvVersion == 2 {
+		u += "data/"
+	}
+	u += escapePath(path)
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("X-Vault-Token", string(p.settings.AuthToken))
+	if p.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.namespace)
+	}
+
+	p.Log(fmt.Sprintf("fetching secret path %s", path), config.LogLevelDebug)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// A missing path is just a secret this provider doesn't have.
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault returned %d for secret path %s", resp.StatusCode, path)
+	}
+
+	// KV v2 wraps the secret in another "data" along with its metadata.
+	var raw map[string]interface{}
+	if p.kvVersion == 2 {
+		var r struct {
+			Data struct {
+				Data map[string]interface{} `json:"data"`
+			} `json:"data"`
+		}
+		err = json.Unmarshal(body, &r)
+		raw = r.Data.Data
+	} else {
+		var r struct {
+			Data map[string]interface{} `json:"data"`
+		}
+		err = json.Unmarshal(body, &r)
+		raw = r.Data
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse vault response for secret path %s: %v", path, err)
+	}
+
+	values := make(map[string]string, len(raw))
+	for k, v := range raw {
+		if s, ok := v.(string); ok {
+			values[k] = s
+		} else {
+			values[k] = fmt.Sprint(v)
+		}
+	}
+
+	if p.cacheTTL > 0 {
+		p.cacheLock.Lock()
+		p.cache[path] = vaultCachedPath{fetched: time.Now(), values: values}
+		p.cacheLock.Unlock()
+	}
+
+	return values, nil
+}
+
+/*
+	Escapes every segment of a path on its own, so hostnames and keys with things like ? or % in them can't change the request.
+*/
+func escapePath(path string) string {
+	segments := make([]string, 0)
+	for _, s := range strings.Split(path, "/") {
+		if s != "" {
+			segments = append(segments, url.PathEscape(s))
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,397 @@
+package waitron
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"waitron/config"
+	"waitron/inventoryplugins"
+	"waitron/machine"
+
+	"github.com/google/uuid"
+)
+
+// How many builds of a batch are started, or cancelled, at once.  Pre-build and cancel commands are usually IPMI calls, which can be slow.
+const batchWorkers = 8
+
+var (
+	ErrBatchNotFound = errors.New("batch not found")
+	ErrBadBatch      = errors.New("bad batch")
+)
+
+/*
+	Picks machines out of the inventory.  Machines are listed by the plugin named, or by every plugin that can list machines,
+	and are then narrowed down to those in the domain, and with the tag, if either of them is given.
+	Query only means something to the plugin named.  See ListMachines of each plugin for what it can be.
+*/
+type BatchSelector struct {
+	Domain string `json:"domain,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+	Plugin string `json:"plugin,omitempty"`
+	Query  string `json:"query,omitempty"`
+}
+
+/*
+	A request to build a set of machines.  Machines can be listed by hostname, picked with a selector, or both.
+	Override is a machine definition shared by every build, just like the body of /build/{hostname}/{type}.
+*/
+type BatchRequest struct {
+	Name          string          `json:"name,omitempty"`
+	Hostnames     []string        `json:"hostnames,omitempty"`
+	Selector      *BatchSelector  `json:"selector,omitempty"`
+	BuildTypeName string          `json:"build_type,omitempty"`
+	Override      json.RawMessage `json:"override,omitempty"`
+	Force         bool            `json:"force,omitempty"` // Take over MACs that other active jobs are using.
+}
+
+/*
+	A build of a batch.  Token is empty, and Error says why, if the build couldn't be started.
+*/
+type BatchBuild struct {
+	Hostname    string    `json:"hostname"`
+	Token       string    `json:"token,omitempty"`
+	Status      JobStatus `json:"status,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	CancelError string    `json:"cancel_error,omitempty"` // Why the build couldn't be cancelled with the rest of the batch.
+
+	job *Job
+}
+
+/*
+	A named set of builds that were started together.  Counts has how many builds are in each status,
+	and how many couldn't be started, as "not_started".
+*/
+type Batch struct {
+	ID            string         `json:"id"`
+	Name          string         `json:"name,omitempty"`
+	Created       time.Time      `json:"created"`
+	CancelledAt   time.Time      `json:"cancelled_at,omitempty"`
+	BuildTypeName string         `json:"build_type,omitempty"`
+	Selector      *BatchSelector `json:"selector,omitempty"`
+	Builds        []BatchBuild   `json:"builds"`
+	Counts        map[string]int `json:"counts"`
+}
+
+/*
+	Every batch, by ID.  Batches go away with CleanHistory once none of their jobs are left in the history.
+*/
+type batches struct {
+	sync.RWMutex
+	byID map[string]*Batch
+}
+
+/*
+	Calls f for 0 through n-1, batchWorkers at a time, and waits for all of them.
+*/
+func runBatchWorkers(n int, f func(i int)) {
+	sem := make(chan struct{}, batchWorkers)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
+
+/*
+	Works out the hostnames a batch request is for, sorted and without duplicates.
+*/
+func (w *Waitron) selectBatchHostnames(r BatchRequest) ([]string, error) {
+	seen := make(map[string]bool)
+	hostnames := make([]string, 0, len(r.Hostnames))
+
+	add := func(hostname string) {
+		hostname = strings.ToLower(strings.TrimSpace(hostname))
+		if hostname != "" && !seen[hostname] {
+			seen[hostname] = true
+			hostnames = append(hostnames, hostname)
+		}
+	}
+
+	for _, hostname := range r.Hostnames {
+		add(hostname)
+	}
+
+	if r.Selector != nil {
+		selected, err := w.selectMachines(*r.Selector, r.BuildTypeName, r.Override)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, hostname := range selected {
+			add(hostname)
+		}
+	}
+
+	sort.Strings(hostnames)
+
+	return hostnames, nil
+}
+
+func (w *Waitron) selectMachines(s BatchSelector, buildTypeName string, override []byte) ([]string, error) {
+	// An empty selector would build everything in the inventory, which is never what anyone wants.
+	if s.Domain == "" && s.Tag == "" && s.Plugin == "" {
+		return nil, fmt.Errorf("%w: a selector needs a domain, tag, or plugin", ErrBadBatch)
+	}
+
+	if s.Query != "" && s.Plugin == "" {
+		return nil, fmt.Errorf("%w: a query needs the plugin it's for", ErrBadBatch)
+	}
+
+	listed := false
+	candidates := make([]string, 0)
+
+	for _, ap := range w.activePlugins {
+		if s.Plugin != "" && ap.settings.Name != s.Plugin {
+			continue
+		}
+
+		lister, ok := ap.plugin.(inventoryplugins.MachineLister)
+		if !ok {
+			if s.Plugin != "" {
+				return nil, fmt.Errorf("%w: plugin '%s' can't list machines", ErrBadBatch, s.Plugin)
+			}
+			continue
+		}
+
+		hostnames, err := lister.ListMachines(s.Query)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list machines with plugin '%s': %v", ap.settings.Name, err)
+		}
+
+		listed = true
+		candidates = append(candidates, hostnames...)
+	}
+
+	if !listed {
+		if s.Plugin != "" {
+			return nil, fmt.Errorf("%w: plugin '%s' isn't active", ErrBadBatch, s.Plugin)
+		}
+		return nil, fmt.Errorf("%w: no active plugin can list machines", ErrBadBatch)
+	}
+
+	selected := make([]string, 0, len(candidates))
+
+	for _, hostname := range candidates {
+		m, _ := machine.New(hostname)
+
+		if s.Domain != "" && m.Domain != strings.ToLower(s.Domain) {
+			continue
+		}
+
+		if s.Tag != "" {
+			// Tags can come from anywhere a machine is merged from, so only the merged machine knows them all.
+			merged, err := w.GetMergedMachine(hostname, "", buildTypeName, override)
+			if err != nil {
+				w.addLog(fmt.Sprintf("leaving %s out of batch selection: %v", hostname, err), config.LogLevelWarning)
+				continue
+			}
+
+			tagged := false
+			for _, tag := range merged.Tags {
+				if tag == s.Tag {
+					tagged = true
+				}
+			}
+
+			if !tagged {
+				continue
+			}
+		}
+
+		selected = append(selected, hostname)
+	}
+
+	return selected, nil
+}
+
+/*
+	Starts a build for every machine in the request, and keeps them together as a batch.
+	A build that can't be started doesn't stop the others, it's just reported with its error in the batch that's returned.
+*/
+func (w *Waitron) BuildBatch(r BatchRequest) (Batch, error) {
+	if r.BuildTypeName != "" {
+		if _, found := w.config.BuildTypes[r.BuildTypeName]; !found {
+			return Batch{}, fmt.Errorf("%w: unknown build type '%s'", ErrBadBatch, r.BuildTypeName)
+		}
+	}
+
+	hostnames, err := w.selectBatchHostnames(r)
+	if err != nil {
+		return Batch{}, err
+	}
+
+	if len(hostnames) == 0 {
+		return Batch{}, fmt.Errorf("%w: no machines were selected", ErrBadBatch)
+	}
+
+	b := &Batch{
+		ID:            uuid.New().String(),
+		Name:          r.Name,
+		Created:       time.Now(),
+		BuildTypeName: r.BuildTypeName,
+		Selector:      r.Selector,
+		Builds:        make([]BatchBuild, len(hostnames)),
+	}
+
+	w.addLog(fmt.Sprintf("starting batch %s '%s' of %d builds", b.ID, b.Name, len(hostnames)), config.LogLevelInfo)
+
+	// Every worker only touches its own build, so nothing needs locking until the batch is added.
+	runBatchWorkers(len(hostnames), func(i int) {
+		bb := &b.Builds[i]
+		bb.Hostname = hostnames[i]
+
+		token, err := w.BuildWithOptions(bb.Hostname, r.BuildTypeName, r.Override, BuildOptions{Force: r.Force, Batch: b.ID})
+		if err != nil {
+			w.addLog(fmt.Sprintf("batch %s failed to start a build for %s: %v", b.ID, bb.Hostname, err), config.LogLevelWarning)
+			bb.Error = err.Error()
+			return
+		}
+
+		bb.Token = token
+
+		w.history.RLock()
+		bb.job = w.history.jobByToken[token]
+		w.history.RUnlock()
+	})
+
+	w.batches.Lock()
+	w.batches.byID[b.ID] = b
+	s := w.batchSnapshot(b)
+	w.batches.Unlock()
+
+	w.addLog(fmt.Sprintf("batch %s started %d of %d builds", b.ID, len(hostnames)-s.Counts["not_started"], len(hostnames)), config.LogLevelInfo)
+
+	return s, nil
+}
+
+/*
+	Copies a batch, along with the current status of each of its jobs.  The caller must hold the batches lock.
+*/
+func (w *Waitron) batchSnapshot(b *Batch) Batch {
+	s := *b
+	s.Builds = make([]BatchBuild, len(b.Builds))
+	s.Counts = make(map[string]int)
+
+	for i, bb := range b.Builds {
+		if bb.job != nil {
+			bb.job.RLock()
+			bb.Status = bb.job.Status
+			bb.job.RUnlock()
+
+			s.Counts[string(bb.Status)]++
+		} else {
+			s.Counts["not_started"]++
+		}
+
+		bb.job = nil
+		s.Builds[i] = bb
+	}
+
+	return s
+}
+
+/*
+	Returns a batch with the current status of all of its builds.
+*/
+func (w *Waitron) GetBatch(id string) (Batch, error) {
+	w.batches.RLock()
+	defer w.batches.RUnlock()
+
+	b, found := w.batches.byID[id]
+	if !found {
+		return Batch{}, fmt.Errorf("%w: %s", ErrBatchNotFound, id)
+	}
+
+	return w.batchSnapshot(b), nil
+}
+
+/*
+	Cancels every build of a batch that hasn't finished yet.  Builds that can't be cancelled have their error
+	in CancelError, and don't stop the rest from being cancelled.
+*/
+func (w *Waitron) CancelBatch(id string) (Batch, error) {
+	w.batches.Lock()
+
+	b, found := w.batches.byID[id]
+	if !found {
+		w.batches.Unlock()
+		return Batch{}, fmt.Errorf("%w: %s", ErrBatchNotFound, id)
+	}
+
+	b.CancelledAt = time.Now()
+	builds := append([]BatchBuild{}, b.Builds...)
+
+	w.batches.Unlock()
+
+	w.addLog(fmt.Sprintf("cancelling batch %s '%s'", b.ID, b.Name), config.LogLevelInfo)
+
+	cancelErrors := make([]string, len(builds))
+
+	// Cancel commands can be slow, so they're run without holding the batches lock.
+	runBatchWorkers(len(builds), func(i int) {
+		bb := builds[i]
+		if bb.job == nil {
+			return
+		}
+
+		bb.job.RLock()
+		status := bb.job.Status
+		bb.job.RUnlock()
+
+		// Failed jobs have already been cleaned up, just like finished ones.
+		if status == JobStatusCompleted || status == JobStatusTerminated || status == JobStatusFailed {
+			return
+		}
+
+		if err := w.CancelBuild(bb.Hostname, bb.Token); err != nil {
+			w.addLog(fmt.Sprintf("batch %s failed to cancel job %s for %s: %v", b.ID, bb.Token, bb.Hostname, err), config.LogLevelWarning)
+			cancelErrors[i] = err.Error()
+		}
+	})
+
+	w.batches.Lock()
+	defer w.batches.Unlock()
+
+	for i := range b.Builds {
+		b.Builds[i].CancelError = cancelErrors[i]
+	}
+
+	return w.batchSnapshot(b), nil
+}
+
+/*
+	Drops every batch that has none of its jobs left in the history.  The caller must hold the history lock.
+*/
+func (w *Waitron) cleanBatches() {
+	w.batches.Lock()
+	defer w.batches.Unlock()
+
+	for id, b := range w.batches.byID {
+		keep := false
+		for _, bb := range b.Builds {
+			if _, found := w.history.jobByToken[bb.Token]; found && bb.Token != "" {
+				keep = true
+			}
+		}
+
+		if !keep {
+			delete(w.batches.byID, id)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package waitron
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+// An inventory that can list its machines.  The query is a suffix the hostnames must have.
+type rackPlugin struct {
+	machines map[string][]string // Tags by hostname.
+}
+
+func (p *rackPlugin) Init() error   { return nil }
+func (p *rackPlugin) Deinit() error { return nil }
+
+func (p *rackPlugin) PutMachine(m *machine.Machine) error { return nil }
+
+func (p *rackPlugin) GetMachine(hostname string, mac string) (*machine.Machine, error) {
+	tags, found := p.machines[hostname]
+	if !found {
+		return nil, nil
+	}
+
+	m, _ := machine.New(hostname)
+	m.Tags = tags
+	m.Network = []machine.Interface{machine.Interface{MacAddress: fmt.Sprintf("de:ad:%x", []byte(hostname[:3]))}}
+
+	return m, nil
+}
+
+func (p *rackPlugin) ListMachines(query string) ([]string, error) {
+	hostnames := make([]string, 0)
+	for hostname := range p.machines {
+		if strings.HasSuffix(hostname, query) {
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	return hostnames, nil
+}
+
+func TestBuildBatch(t *testing.T) {
+	w := New(&config.Config{
+		BuildTypes: map[string]config.BuildType{
+			"rescue": config.BuildType{ImageURL: "http://images.example.com", Kernel: "rescue"},
+		},
+	})
+
+	w.activePlugins = append(w.activePlugins,
+		activePlugin{plugin: &hardwarePlugin{}, settings: &config.MachineInventoryPluginSettings{Name: "unlisted"}},
+		activePlugin{plugin: &rackPlugin{machines: map[string][]string{
+			"a01.rack1.example.com": []string{"hypervisor"},
+			"a02.rack1.example.com": []string{"storage"},
+			"b01.rack2.example.com": []string{"hypervisor"},
+		}}, settings: &config.MachineInventoryPluginSettings{Name: "racks"}},
+	)
+
+	for _, r := range []BatchRequest{
+		BatchRequest{Selector: &BatchSelector{}},
+		BatchRequest{Selector: &BatchSelector{Query: "rack1.example.com"}},
+		BatchRequest{Selector: &BatchSelector{Plugin: "unlisted"}},
+		BatchRequest{Selector: &BatchSelector{Plugin: "missing"}},
+		BatchRequest{Selector: &BatchSelector{Domain: "rack3.example.com"}},
+		BatchRequest{Hostnames: []string{"a01.rack1.example.com"}, BuildTypeName: "missing"},
+		BatchRequest{},
+	} {
+		if _, err := w.BuildBatch(r); !errors.Is(err, ErrBadBatch) {
+			t.Errorf("Expected a bad batch for %+v, got %v", r, err)
+		}
+	}
+
+	b, err := w.BuildBatch(BatchRequest{Name: "rack1", Selector: &BatchSelector{Domain: "RACK1.example.com"}, BuildTypeName: "rescue"})
+	if err != nil {
+		t.Errorf("Failed to build batch: %v", err)
+		return
+	}
+
+	if len(b.Builds) != 2 || b.Builds[0].Hostname != "a01.rack1.example.com" || b.Builds[1].Hostname != "a02.rack1.example.com" || b.Counts["pending"] != 2 {
+		t.Errorf("Unexpected batch: %+v", b)
+		return
+	}
+
+	for _, bb := range b.Builds {
+		if j, found := w.jobs.jobByToken[bb.Token]; !found || j.Batch != b.ID || j.BuildTypeName != "rescue" {
+			t.Errorf("Unexpected job for %+v: %+v", bb, j)
+		}
+	}
+
+	// Builds that can't be started are reported, and the rest go ahead anyway.
+	b2, err := w.BuildBatch(BatchRequest{
+		Hostnames: []string{"missing.rack3.example.com", "A01.rack1.example.com"},
+		Selector:  &BatchSelector{Tag: "hypervisor", Plugin: "racks", Query: "example.com"},
+	})
+	if err != nil {
+		t.Errorf("Failed to build batch: %v", err)
+		return
+	}
+
+	if len(b2.Builds) != 3 || b2.Counts["not_started"] != 2 || b2.Counts["pending"] != 1 || b2.Builds[1].Hostname != "b01.rack2.example.com" || b2.Builds[1].Token == "" {
+		t.Errorf("Unexpected partially failed batch: %+v", b2)
+	}
+
+	if !strings.Contains(b2.Builds[0].Error, "must complete") || !strings.Contains(b2.Builds[2].Error, "not found") {
+		t.Errorf("Unexpected build errors: %+v", b2.Builds)
+	}
+
+	// Finished builds are left alone when the batch is cancelled.
+	if err := w.FinishBuild("a02.rack1.example.com", b.Builds[1].Token); err != nil {
+		t.Errorf("Failed to finish build: %v", err)
+	}
+
+	if b, err = w.CancelBatch(b.ID); err != nil || b.CancelledAt.IsZero() || b.Counts["terminated"] != 1 || b.Counts["completed"] != 1 || b.Builds[0].CancelError != "" {
+		t.Errorf("Unexpected cancelled batch: err(%v) %+v", err, b)
+	}
+
+	if got, err := w.GetBatch(b.ID); err != nil || got.Counts["terminated"] != 1 || got.Name != "rack1" {
+		t.Errorf("Unexpected batch: err(%v) %+v", err, got)
+	}
+
+	if _, err := w.CancelBatch("missing"); !errors.Is(err, ErrBatchNotFound) {
+		t.Errorf("Expected a missing batch, got %v", err)
+	}
+
+	// So are failed ones, which have already been cleaned up.
+	b3, err := w.BuildBatch(BatchRequest{Hostnames: []string{"a01.rack1.example.com"}, BuildTypeName: "rescue"})
+	if err != nil || b3.Builds[0].Token == "" {
+		t.Errorf("Failed to build batch: err(%v) %+v", err, b3)
+		return
+	}
+
+	if err := w.cleanUpJob(w.jobs.jobByToken[b3.Builds[0].Token], JobStatusFailed, "pre-build commands failed"); err != nil {
+		t.Errorf("Failed to fail build: %v", err)
+		return
+	}
+
+	if b3, err = w.CancelBatch(b3.ID); err != nil || b3.Counts["failed"] != 1 || b3.Builds[0].CancelError != "" {
+		t.Errorf("Unexpected cancelled batch with a failed build: err(%v) %+v", err, b3)
+	}
+
+	// Batches go with the last of their jobs.
+	w.CleanHistory()
+
+	if _, err := w.GetBatch(b.ID); !errors.Is(err, ErrBatchNotFound) {
+		t.Errorf("Expected the finished batch to be cleaned, got %v", err)
+	}
+
+	if _, err := w.GetBatch(b2.ID); err != nil {
+		t.Errorf("Batch with an active job was cleaned: %v", err)
+	}
+}
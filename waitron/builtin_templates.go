@@ -0,0 +1,150 @@
+package waitron
+
+import (
+	"sort"
+	"strings"
+
+	"waitron/machine"
+)
+
+/*
+	Templates that ship with waitron for the installer profiles.  They're loaded as builtin/<name>, after everything in templatepath,
+	so dropping a builtin/kickstart.ks.j2 into templatepath, or into any of the override directories, replaces the one here.
+	To change just a part of one, point the build type at a template of your own that extends it and overrides its blocks:
+
+		{% extends "builtin/kickstart.ks.j2" %}
+		{% block packages %}@^server-product-environment
+		{% endblock %}
+*/
+var builtinTemplates = map[string]string{
+	"kickstart.ks.j2": `# Kickstart for {{ machine.Hostname }}, generated by waitron for job {{ job.Token }}
+{% block install %}text
+{% if machine.Params.install_url %}url --url={{ machine.Params.install_url|default:"" }}
+{% endif %}lang {{ machine.Params.lang|default:"en_US.UTF-8" }}
+keyboard --vckeymap={{ machine.Params.keyboard|default:"us" }}
+timezone {{ machine.Params.timezone|default:"Etc/UTC" }} --utc
+{% if machine.Params.root_password_hash %}rootpw --iscrypted {{ machine.Params.root_password_hash|default:"" }}
+{% else %}rootpw --lock
+{% endif %}firstboot --disable
+reboot
+{% endblock %}
+# Network
+{% block network %}{{ machine|kickstart_network }}{% endblock %}
+# Storage
+{% block storage %}{{ machine|kickstart_storage }}{% endblock %}
+%packages
+{% block packages %}@^minimal-environment
+{% endblock %}%end
+
+%pre
+curl -s -d phase=pre -d percent=10 -d "message=kickstart started" {{ machine.BaseURL }}/progress/{{ machine.Hostname }}/{{ job.Token }} || true
+{% block pre %}{% endblock %}%end
+
+%post --log=/root/waitron-post.log
+{% block post %}{% endblock %}%end
+
+%post --nochroot
+curl -s {{ machine.BaseURL }}/done/{{ machine.Hostname }}/{{ job.Token }}
+%end
+`,
+
+	"autoinstall.yml.j2": `#cloud-config
+# Autoinstall for {{ machine.Hostname }}, generated by waitron for job {{ job.Token }}
+autoinstall:
+  version: 1
+{% block install %}  locale: {{ machine.Params.lang|default:"en_US.UTF-8" }}
+  keyboard:
+    layout: {{ machine.Params.keyboard|default:"us" }}
+  timezone: {{ machine.Params.timezone|default:"Etc/UTC" }}
+  identity:
+    hostname: {{ machine.ShortName }}
+    username: {{ machine.Params.username|default:"ubuntu" }}
+    password: "{{ machine.Params.password_hash|default:"!" }}"
+  ssh:
+    install-server: true
+{% endblock %}{% block network %}  {{ machine|netplan|indent:2 }}{% endblock %}{% block storage %}{% if machine.Storage.Disks %}  {{ machine|autoinstall_storage|indent:2 }}{% endif %}{% endblock %}  early-commands:
+    - curl -s -d phase=early -d percent=10 -d "message=autoinstall started" {{ machine.BaseURL }}/progress/{{ machine.Hostname }}/{{ job.Token }} || true
+{% block early_commands %}{% endblock %}  late-commands:
+{% block late_commands %}{% endblock %}    - curl -s {{ machine.BaseURL }}/done/{{ machine.Hostname }}/{{ job.Token }}
+`,
+
+	"butane.yml.j2": `# Butane for {{ machine.Hostname }}, generated by waitron for job {{ job.Token }}
+{% with variant=machine.Params.butane_variant|default:"fcos" %}variant: {{ variant }}
+version: {% if variant == "flatcar" %}1.0.0{% else %}1.4.0{% endif %}
+passwd:
+  users:
+    - name: core
+{% if machine.Params.ssh_authorized_keys %}      ssh_authorized_keys:
+{% for key in machine.Params.ssh_authorized_keys|default:""|split:"," %}{% if key %}        - {{ key|to_json }}
+{% endif %}{% endfor %}{% endif %}{% block users %}{% endblock %}storage:
+  files:
+    - path: /etc/hostname
+      mode: 0644
+      overwrite: true
+      contents:
+        inline: {{ machine.Hostname }}
+{% if variant == "fcos" %}{% for f in machine|nm_keyfiles %}    - path: /etc/NetworkManager/system-connections/{{ f.Name }}
+      mode: 0600
+      overwrite: true
+      contents:
+        inline: {{ f.Content|to_json }}
+{% endfor %}{% endif %}{% block files %}{% endblock %}systemd:
+  units:
+    - name: waitron-done.service
+      enabled: true
+      contents: |
+        [Unit]
+        Description=Tell waitron the build is done
+        Wants=network-online.target
+        After=network-online.target
+        ConditionPathExists=!/var/lib/waitron-done
+
+        [Service]
+        Type=oneshot
+        ExecStart=/usr/bin/curl -sf {{ machine.BaseURL }}/done/{{ machine.Hostname }}/{{ job.Token }}
+        ExecStartPost=/usr/bin/touch /var/lib/waitron-done
+
+        [Install]
+        WantedBy=multi-user.target
+{% block units %}{% endblock %}{% endwith %}`,
+}
+
+const builtinTemplateDir = "builtin/"
+
+/*
+	Returns the source of a built-in template, given its name as it would be loaded, e.g., builtin/kickstart.ks.j2
+*/
+func builtinTemplate(name string) (string, bool) {
+	if !strings.HasPrefix(name, builtinTemplateDir) {
+		return "", false
+	}
+
+	s, found := builtinTemplates[strings.TrimPrefix(name, builtinTemplateDir)]
+	return s, found
+}
+
+/*
+	The built-in templates a machine would render, sorted.
+*/
+func usedBuiltinTemplates(m *machine.Machine) []string {
+	found := make(map[string]bool)
+
+	files := []string{m.Preseed, m.Finish, m.UserData, m.VendorData, m.Butane}
+	for _, st := range m.Templates {
+		files = append(files, st.File)
+	}
+
+	for _, f := range files {
+		if _, isBuiltin := builtinTemplate(f); isBuiltin {
+			found[f] = true
+		}
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
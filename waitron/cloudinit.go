@@ -0,0 +1,59 @@
+package waitron
+
+import (
+	"fmt"
+
+	"waitron/config"
+
+	"gopkg.in/yaml.v2"
+)
+
+type cloudInitMetaData struct {
+	InstanceID    string `yaml:"instance-id"`
+	LocalHostname string `yaml:"local-hostname"`
+}
+
+/*
+	Returns one of the files of a NoCloud datasource for the ACTIVE job specified by the hostname and token.
+	Pointing an image at "ds=nocloud-net;s=<baseurl>/cloud-init/<hostname>/<token>/" lets cloud-init find all of them.
+
+	meta-data and network-config are generated from the machine.  user-data and vendor-data are rendered from the
+	user_data and vendor_data templates of the build type, if there are any.
+	None of these change the status of the job, since cloud-init is free to fetch them as often as it likes.
+*/
+func (w *Waitron) RenderCloudInit(hostname string, token string, item string) (string, error) {
+
+	j, _, err := w.getActiveJob(hostname, token)
+	if err != nil {
+		return "", err
+	}
+
+	w.addJobLog(j, fmt.Sprintf("cloud-init %s requested for job %s", item, j.Token), config.LogLevelInfo)
+
+	switch item {
+	case "meta-data":
+		b, err := yaml.Marshal(&cloudInitMetaData{InstanceID: j.Token, LocalHostname: j.Machine.Hostname})
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+
+	case "network-config":
+		return renderNetplanConfig(j.Machine)
+
+	case "user-data":
+		// cloud-init is happy with an empty config, but not with an empty file.
+		if j.Machine.UserData == "" {
+			return "#cloud-config\n", nil
+		}
+		return w.renderTemplate(j.Machine.UserData, item, j)
+
+	case "vendor-data":
+		if j.Machine.VendorData == "" {
+			return "", nil
+		}
+		return w.renderTemplate(j.Machine.VendorData, item, j)
+	}
+
+	return "", fmt.Errorf("cloud-init item '%s': %w", item, ErrTemplateNotFound)
+}
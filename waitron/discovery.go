@@ -0,0 +1,269 @@
+package waitron
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+/*
+	An unknown MAC that came looking for a PXE config.  It stays here until it's adopted, or until something,
+	like a registration with a hostname, gets it into a writable inventory plugin.
+*/
+type DiscoveredMachine struct {
+	MAC       string    `json:"mac"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     int       `json:"count"`
+	Source    string    `json:"source,omitempty"` // Whatever asked for the PXE config the last time, usually a pixiecore.
+
+	Hardware *HardwareReport `json:"hardware,omitempty"`
+}
+
+/*
+	Discovered machines, by normalized MAC.  They only live in memory, so a restart starts the table over.
+*/
+type discoveredMachines struct {
+	sync.Mutex
+	byMAC map[string]*DiscoveredMachine
+}
+
+/*
+	What to make of a discovered machine.
+*/
+type AdoptOptions struct {
+	Hostname      string `json:"hostname"`
+	BuildTypeName string `json:"build_type"`
+	Build         bool   `json:"build"` // Start a build once the machine has been stored.
+}
+
+var (
+	ErrDiscoveredNotFound = errors.New("no discovered machine")
+	ErrBadAdoption        = errors.New("bad adoption")
+	ErrAdoptionConflict   = errors.New("machine is already defined")
+)
+
+// Defaults for how many discovered machines are kept, and for how long after they were last seen.
+const (
+	defaultDiscoveredLimit  = 1000
+	defaultDiscoveredMaxAge = 24 * time.Hour
+)
+
+/*
+	Anything can ask for a PXE config, so the table is kept from growing without end.  Machines that haven't been seen
+	for discovered_max_age_secs are dropped, and if it's still full, the one seen longest ago makes room for a new one.
+	The caller must hold the discovered lock.
+*/
+func (w *Waitron) pruneDiscovered(now time.Time, room int) {
+	maxAge := defaultDiscoveredMaxAge
+	if w.config.DiscoveredMaxAgeSeconds > 0 {
+		maxAge = time.Duration(w.config.DiscoveredMaxAgeSeconds) * time.Second
+	}
+
+	limit := defaultDiscoveredLimit
+	if w.config.DiscoveredLimit > 0 {
+		limit = w.config.DiscoveredLimit
+	}
+
+	for mac, d := range w.discovered.byMAC {
+		if now.Sub(d.LastSeen) > maxAge {
+			delete(w.discovered.byMAC, mac)
+		}
+	}
+
+	for len(w.discovered.byMAC)+room > limit {
+		var oldest *DiscoveredMachine
+		for _, d := range w.discovered.byMAC {
+			if oldest == nil || d.LastSeen.Before(oldest.LastSeen) {
+				oldest = d
+			}
+		}
+
+		w.addLog(fmt.Sprintf("discovery table is full, dropping %s, last seen %s", oldest.MAC, oldest.LastSeen.Format(time.RFC3339)), config.LogLevelWarning)
+		delete(w.discovered.byMAC, oldest.MAC)
+	}
+}
+
+func (w *Waitron) discover(mac string, source string) {
+	now := time.Now()
+
+	w.discovered.Lock()
+	defer w.discovered.Unlock()
+
+	d, found := w.discovered.byMAC[mac]
+	if !found {
+		w.pruneDiscovered(now, 1)
+
+		d = &DiscoveredMachine{MAC: mac, FirstSeen: now}
+		w.discovered.byMAC[mac] = d
+
+		w.addLog(fmt.Sprintf("discovered unknown MAC %s from '%s'", mac, source), config.LogLevelInfo)
+	}
+
+	d.LastSeen = now
+	d.Count++
+	d.Source = source
+}
+
+/*
+	Returns every machine waiting to be adopted, oldest first, along with anything they've registered about themselves.
+*/
+func (w *Waitron) GetDiscovered() []DiscoveredMachine {
+	w.discovered.Lock()
+	w.pruneDiscovered(time.Now(), 0)
+	found := make([]DiscoveredMachine, 0, len(w.discovered.byMAC))
+	for _, d := range w.discovered.byMAC {
+		found = append(found, *d)
+	}
+	w.discovered.Unlock()
+
+	sort.Slice(found, func(i, j int) bool {
+		if found[i].FirstSeen.Equal(found[j].FirstSeen) {
+			return found[i].MAC < found[j].MAC
+		}
+		return found[i].FirstSeen.Before(found[j].FirstSeen)
+	})
+
+	for i := range found {
+		hr, err := w.GetHardware(found[i].MAC)
+		if err != nil {
+			if !errors.Is(err, ErrHardwareNotFound) {
+				w.addLog(fmt.Sprintf("failed to get hardware report for discovered MAC %s: %v", found[i].MAC, err), config.LogLevelWarning)
+			}
+			continue
+		}
+		found[i].Hardware = hr
+	}
+
+	return found
+}
+
+/*
+	Returns the names of the writable inventory plugins that already have a definition for the hostname.
+*/
+func (w *Waitron) writablePluginsWith(hostname string) ([]string, error) {
+	found := make([]string, 0)
+
+	for _, ap := range w.activePlugins {
+		if !ap.settings.WriteEnabled {
+			continue
+		}
+
+		m, err := ap.plugin.GetMachine(hostname, "")
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s failed to look up %s: %v", ap.settings.Name, hostname, err)
+		}
+
+		if m != nil {
+			found = append(found, ap.settings.Name)
+		}
+	}
+
+	return found, nil
+}
+
+/*
+	Gives a discovered machine a hostname and build type, and hands it to every writable inventory plugin, using what it registered
+	about itself, if anything.  If requested, a build is started for it once it's stored, and the token is returned.
+	If no plugin could store it, or a writable plugin already has the hostname, it stays discovered so it can be adopted again.
+*/
+func (w *Waitron) AdoptDiscovered(mac string, o AdoptOptions) (string, error) {
+	mac = normalizeMAC(mac)
+	hostname := strings.ToLower(o.Hostname)
+
+	if hostname == "" {
+		return "", fmt.Errorf("%w: no hostname for %s", ErrBadAdoption, mac)
+	}
+
+	if o.BuildTypeName == "" || o.BuildTypeName == "_unknown_" {
+		return "", fmt.Errorf("%w: no build type for %s", ErrBadAdoption, mac)
+	}
+
+	if _, found := w.config.BuildTypes[o.BuildTypeName]; !found {
+		return "", fmt.Errorf("%w: unknown build type '%s'", ErrBadAdoption, o.BuildTypeName)
+	}
+
+	// Taken out of the table right away, so two adoptions of the same machine can't both go through.
+	w.discovered.Lock()
+	d, found := w.discovered.byMAC[mac]
+	delete(w.discovered.byMAC, mac)
+	w.discovered.Unlock()
+
+	if !found {
+		return "", fmt.Errorf("%w for '%s'", ErrDiscoveredNotFound, mac)
+	}
+
+	m, _ := machine.New(hostname)
+
+	if hr, err := w.GetHardware(mac); err == nil {
+		r := *hr
+		r.Hostname = hostname
+		m = r.Machine()
+	}
+
+	hasMAC := false
+	for _, i := range m.Network {
+		if normalizeMAC(i.MacAddress) == mac {
+			hasMAC = true
+		}
+	}
+
+	if !hasMAC {
+		m.Network = append(m.Network, machine.Interface{MacAddress: mac})
+	}
+
+	m.BuildTypeName = o.BuildTypeName
+
+	/*
+		A definition that's already there is left alone, so it won't have the build type that was asked for.
+		Every plugin is checked before anything is written, so an adoption doesn't end up stored in some plugins and refused by others.
+	*/
+	stored, existing := 0, 0
+
+	defined, err := w.writablePluginsWith(hostname)
+	if err == nil && len(defined) > 0 {
+		err = fmt.Errorf("%w: %s in %s", ErrAdoptionConflict, hostname, strings.Join(defined, ", "))
+	}
+
+	if err == nil {
+		stored, existing, err = w.putMachine(m)
+	}
+
+	if err == nil && stored == 0 && existing > 0 {
+		err = fmt.Errorf("%w: %s in %d inventory plugins", ErrAdoptionConflict, hostname, existing)
+	} else if err == nil && stored == 0 {
+		err = errors.New("no writable inventory plugins")
+	} else if err == nil && existing > 0 {
+		// Something else defined it in the meantime.  It's stored elsewhere, so it's adopted all the same.
+		w.addLog(fmt.Sprintf("adopted %s as %s, but %d inventory plugins already had it and left it alone", mac, hostname, existing), config.LogLevelWarning)
+	}
+
+	if err != nil {
+		w.discovered.Lock()
+		if _, found := w.discovered.byMAC[mac]; !found {
+			w.discovered.byMAC[mac] = d
+		}
+		w.discovered.Unlock()
+
+		return "", fmt.Errorf("failed to adopt %s as %s: %w", mac, hostname, err)
+	}
+
+	w.addLog(fmt.Sprintf("adopted discovered MAC %s as %s with build type %s", mac, hostname, o.BuildTypeName), config.LogLevelInfo)
+
+	if !o.Build {
+		return "", nil
+	}
+
+	token, err := w.Build(hostname, o.BuildTypeName, nil)
+	if err != nil {
+		return "", fmt.Errorf("%s was adopted as %s, but its build couldn't be started: %w", mac, hostname, err)
+	}
+
+	return token, nil
+}
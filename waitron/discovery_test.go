@@ -0,0 +1,187 @@
+package waitron
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"waitron/config"
+	"waitron/inventoryplugins"
+	"waitron/machine"
+)
+
+func TestAdoptDiscovered(t *testing.T) {
+	w := New(&config.Config{
+		BaseURL: "http://waitron.example.com:9090",
+		BuildTypes: map[string]config.BuildType{
+			"_unknown_": config.BuildType{ImageURL: "http://images.example.com", Kernel: "register", Cmdline: "waitron_register={{ BaseURL }}/register/{{ MAC }}"},
+			"rescue":    config.BuildType{ImageURL: "http://images.example.com", Kernel: "rescue"},
+		},
+	})
+
+	plugin := &hardwarePlugin{}
+	w.activePlugins = append(w.activePlugins, activePlugin{plugin: plugin, settings: &config.MachineInventoryPluginSettings{Name: "writable", WriteEnabled: true}})
+
+	for _, source := range []string{"10.0.0.1", "10.0.0.2"} {
+		if _, err := w.GetPxeConfig("DE:AD:BE:EF:00:01", source); err != nil {
+			t.Errorf("Failed to get PXE config for unknown MAC: %v", err)
+			return
+		}
+	}
+
+	if _, err := w.GetPxeConfig("de:ad:be:ef:00:02", "10.0.0.1"); err != nil {
+		t.Errorf("Failed to get PXE config for unknown MAC: %v", err)
+		return
+	}
+
+	if err := w.RegisterHardware("deadbeef0001", HardwareReport{NICs: []HardwareNIC{HardwareNIC{Name: "eno1", MAC: "de:ad:be:ef:00:01"}}}); err != nil {
+		t.Errorf("Failed to register hardware: %v", err)
+		return
+	}
+
+	d := w.GetDiscovered()
+
+	if len(d) != 2 || d[0].MAC != "deadbeef0001" || d[1].MAC != "deadbeef0002" {
+		t.Errorf("Unexpected discovered machines: %+v", d)
+		return
+	}
+
+	if d[0].Count != 2 || d[0].Source != "10.0.0.2" || d[0].LastSeen.Before(d[0].FirstSeen) || d[0].Hardware == nil || d[1].Hardware != nil {
+		t.Errorf("Unexpected discovered machine: %+v", d[0])
+	}
+
+	tests := []struct {
+		mac string
+		o   AdoptOptions
+		err error
+	}{
+		{"deadbeef0001", AdoptOptions{BuildTypeName: "rescue"}, ErrBadAdoption},
+		{"deadbeef0001", AdoptOptions{Hostname: "new01.example.com"}, ErrBadAdoption},
+		{"deadbeef0001", AdoptOptions{Hostname: "new01.example.com", BuildTypeName: "_unknown_"}, ErrBadAdoption},
+		{"deadbeef0001", AdoptOptions{Hostname: "new01.example.com", BuildTypeName: "nope"}, ErrBadAdoption},
+		{"deadbeef0009", AdoptOptions{Hostname: "new01.example.com", BuildTypeName: "rescue"}, ErrDiscoveredNotFound},
+	}
+
+	for _, test := range tests {
+		if _, err := w.AdoptDiscovered(test.mac, test.o); !errors.Is(err, test.err) {
+			t.Errorf("Expected %v adopting %s with %+v, got %v", test.err, test.mac, test.o, err)
+		}
+	}
+
+	// A machine no plugin could store is still waiting.
+	plugin.err = errors.New("read-only database")
+
+	if _, err := w.AdoptDiscovered("deadbeef0002", AdoptOptions{Hostname: "new02.example.com", BuildTypeName: "rescue"}); err == nil {
+		t.Errorf("Adopted a machine no plugin could store")
+	}
+
+	if len(w.GetDiscovered()) != 2 {
+		t.Errorf("Machine that failed to be adopted was dropped: %+v", w.GetDiscovered())
+	}
+
+	// Neither is one that's already defined, since that definition doesn't have the build type asked for.
+	plugin.err = fmt.Errorf("%w: new02.example.com.yml", inventoryplugins.ErrMachineExists)
+
+	if _, err := w.AdoptDiscovered("deadbeef0002", AdoptOptions{Hostname: "new02.example.com", BuildTypeName: "rescue"}); !errors.Is(err, ErrAdoptionConflict) {
+		t.Errorf("Expected %v adopting a machine that's already defined, got %v", ErrAdoptionConflict, err)
+	}
+
+	if len(w.GetDiscovered()) != 2 {
+		t.Errorf("Machine that was already defined was dropped: %+v", w.GetDiscovered())
+	}
+
+	plugin.err = nil
+	plugin.put = nil
+
+	// Nothing is written anywhere if any writable plugin already has it.
+	other := &hardwarePlugin{put: []*machine.Machine{&machine.Machine{Hostname: "new02.example.com"}}}
+	w.activePlugins = append(w.activePlugins, activePlugin{plugin: other, settings: &config.MachineInventoryPluginSettings{Name: "other", WriteEnabled: true}})
+
+	if _, err := w.AdoptDiscovered("deadbeef0002", AdoptOptions{Hostname: "new02.example.com", BuildTypeName: "rescue"}); !errors.Is(err, ErrAdoptionConflict) || !strings.Contains(err.Error(), "other") {
+		t.Errorf("Expected %v naming the plugin that has it, got %v", ErrAdoptionConflict, err)
+	}
+
+	if len(plugin.put) != 0 || len(other.put) != 1 || len(w.GetDiscovered()) != 2 {
+		t.Errorf("Conflicting adoption was partly done: put(%d) other(%d) discovered(%+v)", len(plugin.put), len(other.put), w.GetDiscovered())
+	}
+
+	w.activePlugins = w.activePlugins[:len(w.activePlugins)-1]
+
+	token, err := w.AdoptDiscovered("DE-AD-BE-EF-00-01", AdoptOptions{Hostname: "New01.example.com", BuildTypeName: "rescue", Build: true})
+	if err != nil || token == "" {
+		t.Errorf("Failed to adopt and build: token(%s) %v", token, err)
+		return
+	}
+
+	if len(plugin.put) != 1 {
+		t.Errorf("Expected one machine to be put, got %d", len(plugin.put))
+		return
+	}
+
+	m := plugin.put[0]
+	if m.Hostname != "new01.example.com" || m.BuildTypeName != "rescue" || len(m.Network) != 1 || m.Network[0].Name != "eno1" {
+		t.Errorf("Unexpected adopted machine: %+v", m)
+	}
+
+	if status, _ := w.GetMachineStatus("new01.example.com"); status != "pending" {
+		t.Errorf("Expected a pending build for the adopted machine, got '%s'", status)
+	}
+
+	if d := w.GetDiscovered(); len(d) != 1 || d[0].MAC != "deadbeef0002" {
+		t.Errorf("Adopted machine is still discovered: %+v", d)
+	}
+
+	// Without a report, the machine only has the MAC it was seen with.
+	if _, err := w.AdoptDiscovered("deadbeef0002", AdoptOptions{Hostname: "new02.example.com", BuildTypeName: "rescue"}); err != nil {
+		t.Errorf("Failed to adopt: %v", err)
+		return
+	}
+
+	if m := plugin.put[1]; len(m.Network) != 1 || m.Network[0].MacAddress != "deadbeef0002" {
+		t.Errorf("Unexpected adopted machine: %+v", m)
+	}
+
+	// Now that inventory knows it, it isn't discovered again.
+	if _, err := w.GetPxeConfig("de:ad:be:ef:00:02", "10.0.0.1"); err == nil {
+		t.Errorf("Got an _unknown_ PXE config for an adopted machine")
+	}
+
+	if d := w.GetDiscovered(); len(d) != 0 {
+		t.Errorf("Expected nothing left discovered, got %+v", d)
+	}
+}
+
+func TestDiscoveredLimits(t *testing.T) {
+	w := New(&config.Config{DiscoveredLimit: 2, DiscoveredMaxAgeSeconds: 60})
+
+	w.discover("deadbeef0001", "10.0.0.1")
+	w.discover("deadbeef0002", "10.0.0.1")
+
+	w.discovered.Lock()
+	w.discovered.byMAC["deadbeef0001"].LastSeen = time.Now().Add(-30 * time.Second)
+	w.discovered.Unlock()
+
+	// The table is full, so the one seen longest ago makes room.
+	w.discover("deadbeef0003", "10.0.0.1")
+
+	if d := w.GetDiscovered(); len(d) != 2 || d[0].MAC != "deadbeef0002" || d[1].MAC != "deadbeef0003" {
+		t.Errorf("Unexpected discovered machines after going over the limit: %+v", d)
+	}
+
+	// Seeing one that's already there doesn't push anything out.
+	w.discover("deadbeef0002", "10.0.0.2")
+
+	if d := w.GetDiscovered(); len(d) != 2 {
+		t.Errorf("Unexpected discovered machines after seeing one again: %+v", d)
+	}
+
+	w.discovered.Lock()
+	w.discovered.byMAC["deadbeef0002"].LastSeen = time.Now().Add(-2 * time.Minute)
+	w.discovered.Unlock()
+
+	if d := w.GetDiscovered(); len(d) != 1 || d[0].MAC != "deadbeef0003" {
+		t.Errorf("Expected the machine not seen for too long to be dropped, got %+v", d)
+	}
+}
@@ -1,7 +1,19 @@
 package waitron
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
 	"regexp"
+	"strconv"
+	"strings"
+
+	"waitron/config"
+	"waitron/machine"
 
 	"github.com/flosch/pongo2"
 	"gopkg.in/yaml.v2"
@@ -20,6 +32,553 @@ func FilterFromYaml(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pong
 	return pongo2.AsSafeValue(out), nil
 }
 
+/*
+	from_yaml produces map[interface{}]interface{}, which encoding/json refuses to touch, so those get string keys first.
+*/
+func jsonCompatible(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			out[fmt.Sprint(k)] = jsonCompatible(val)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, val := range t {
+			out[i] = jsonCompatible(val)
+		}
+		return out
+	}
+
+	return v
+}
+
+/*
+	{{ machine.Params|to_json }}, or {{ machine.Params|to_json:2 }} to indent with two spaces.
+*/
+func FilterToJson(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	var b []byte
+	var err error
+
+	if indent := param.Integer(); indent > 0 {
+		b, err = json.MarshalIndent(jsonCompatible(in.Interface()), "", strings.Repeat(" ", indent))
+	} else {
+		b, err = json.Marshal(jsonCompatible(in.Interface()))
+	}
+
+	if err != nil {
+		return nil, &pongo2.Error{Sender: "filter:to_json", OrigError: err}
+	}
+
+	return pongo2.AsSafeValue(string(b)), nil
+}
+
+func FilterToYaml(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	b, err := yaml.Marshal(in.Interface())
+	if err != nil {
+		return nil, &pongo2.Error{Sender: "filter:to_yaml", OrigError: err}
+	}
+
+	return pongo2.AsSafeValue(string(b)), nil
+}
+
+/*
+	Numbers are kept as they were written rather than turned into floats, so {{ 1 }} doesn't come back out as 1.000000.
+*/
+func FilterFromJson(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	var out interface{}
+
+	d := json.NewDecoder(strings.NewReader(in.String()))
+	d.UseNumber()
+
+	if err := d.Decode(&out); err != nil {
+		return nil, &pongo2.Error{Sender: "filter:from_json", OrigError: err}
+	}
+
+	return pongo2.AsSafeValue(out), nil
+}
+
+func FilterB64Encode(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	return pongo2.AsSafeValue(base64.StdEncoding.EncodeToString([]byte(in.String()))), nil
+}
+
+func FilterB64Decode(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(in.String()))
+	if err != nil {
+		return nil, &pongo2.Error{Sender: "filter:b64decode", OrigError: err}
+	}
+
+	return pongo2.AsSafeValue(string(b)), nil
+}
+
+func FilterSha256(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	sum := sha256.Sum256([]byte(in.String()))
+	return pongo2.AsSafeValue(hex.EncodeToString(sum[:])), nil
+}
+
+/*
+	{{ machine.Params.root_password|password_hash }} gives a sha512-crypt hash, suitable for passwd/root-password-crypted.
+	{{ ...|password_hash:"yescrypt" }} and {{ ...|password_hash:"bcrypt" }} are also available.
+	Every render uses a new salt, so the output is different every time.
+*/
+func FilterPasswordHash(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	h, err := passwordHash(in.String(), param.String())
+	if err != nil {
+		return nil, &pongo2.Error{Sender: "filter:password_hash", OrigError: err}
+	}
+
+	return pongo2.AsSafeValue(h), nil
+}
+
+/*
+	The network filters take either a whole machine or just a list of its interfaces.
+	Without the machine, there are no nameservers or search domains to add.
+*/
+func networkFilterMachine(in *pongo2.Value, sender string) (*machine.Machine, *pongo2.Error) {
+	switch v := in.Interface().(type) {
+	case *machine.Machine:
+		return v, nil
+	case machine.Machine:
+		return &v, nil
+	case []machine.Interface:
+		return &machine.Machine{Network: v}, nil
+	}
+
+	return nil, &pongo2.Error{Sender: sender, OrigError: fmt.Errorf("expected a machine or a list of interfaces, got %T", in.Interface())}
+}
+
+func FilterNetplan(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	m, perr := networkFilterMachine(in, "filter:netplan")
+	if perr != nil {
+		return nil, perr
+	}
+
+	s, err := renderNetplanConfig(m)
+	if err != nil {
+		return nil, &pongo2.Error{Sender: "filter:netplan", OrigError: err}
+	}
+
+	return pongo2.AsSafeValue(s), nil
+}
+
+func FilterIfupdown(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	m, perr := networkFilterMachine(in, "filter:ifupdown")
+	if perr != nil {
+		return nil, perr
+	}
+
+	return pongo2.AsSafeValue(renderIfupdownConfig(m)), nil
+}
+
+/*
+	Returns a list of files, each with a Name and Content, so templates can write out one keyfile per device.
+*/
+func FilterNMKeyfiles(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	m, perr := networkFilterMachine(in, "filter:nm_keyfiles")
+	if perr != nil {
+		return nil, perr
+	}
+
+	return pongo2.AsValue(renderNMKeyfiles(m)), nil
+}
+
+func FilterKickstartNetwork(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	m, perr := networkFilterMachine(in, "filter:kickstart_network")
+	if perr != nil {
+		return nil, perr
+	}
+
+	return pongo2.AsSafeValue(renderKickstartNetwork(m)), nil
+}
+
+/*
+	The storage filters take either a whole machine or just its storage layout.
+*/
+func storageFilterLayout(in *pongo2.Value, sender string) (config.Storage, *pongo2.Error) {
+	switch v := in.Interface().(type) {
+	case *machine.Machine:
+		return v.Storage, nil
+	case machine.Machine:
+		return v.Storage, nil
+	case config.Storage:
+		return v, nil
+	case *config.Storage:
+		return *v, nil
+	}
+
+	return config.Storage{}, &pongo2.Error{Sender: sender, OrigError: fmt.Errorf("expected a machine or a storage layout, got %T", in.Interface())}
+}
+
+func FilterPartmanStorage(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	s, perr := storageFilterLayout(in, "filter:partman_storage")
+	if perr != nil {
+		return nil, perr
+	}
+
+	out, err := renderPartmanStorage(s)
+	if err != nil {
+		return nil, &pongo2.Error{Sender: "filter:partman_storage", OrigError: err}
+	}
+
+	return pongo2.AsSafeValue(out), nil
+}
+
+func FilterKickstartStorage(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	s, perr := storageFilterLayout(in, "filter:kickstart_storage")
+	if perr != nil {
+		return nil, perr
+	}
+
+	out, err := renderKickstartStorage(s)
+	if err != nil {
+		return nil, &pongo2.Error{Sender: "filter:kickstart_storage", OrigError: err}
+	}
+
+	return pongo2.AsSafeValue(out), nil
+}
+
+func FilterAutoinstallStorage(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	s, perr := storageFilterLayout(in, "filter:autoinstall_storage")
+	if perr != nil {
+		return nil, perr
+	}
+
+	out, err := renderAutoinstallStorage(s)
+	if err != nil {
+		return nil, &pongo2.Error{Sender: "filter:autoinstall_storage", OrigError: err}
+	}
+
+	return pongo2.AsSafeValue(out), nil
+}
+
+/*
+	Just like the jinja one.  {{ machine|netplan|indent:2 }} indents every line but the first by two spaces (four by default),
+	so that generated YAML can be dropped in under a key.  Empty lines are left alone.
+*/
+func FilterIndent(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	width := 4
+	if !param.IsNil() {
+		width = param.Integer()
+	}
+
+	lines := strings.Split(in.String(), "\n")
+	for idx := 1; idx < len(lines); idx++ {
+		if strings.TrimSpace(lines[idx]) != "" {
+			lines[idx] = strings.Repeat(" ", width) + lines[idx]
+		}
+	}
+
+	return pongo2.AsSafeValue(strings.Join(lines, "\n")), nil
+}
+
+/*
+	Takes a netmask in dotted or colon form, or a prefix length, and returns the mask.
+	Prefix lengths are taken as IPv4 unless v6 is set or they're too long to be IPv4.
+*/
+func parseMask(s string, v6 bool) (net.IPMask, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "/")
+
+	if ip := net.ParseIP(s); ip != nil {
+		m := net.IPMask(ip.To16())
+		if v4 := ip.To4(); v4 != nil && strings.Contains(s, ".") {
+			m = net.IPMask(v4)
+		}
+
+		if _, bits := m.Size(); bits == 0 {
+			return nil, fmt.Errorf("'%s' is not a valid netmask", s)
+		}
+
+		return m, nil
+	}
+
+	ones, err := strconv.Atoi(s)
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is neither a netmask nor a prefix length", s)
+	}
+
+	bits := 32
+	if v6 || ones > 32 {
+		bits = 128
+	}
+
+	if ones < 0 || ones > bits {
+		return nil, fmt.Errorf("prefix length %d is out of range", ones)
+	}
+
+	return net.CIDRMask(ones, bits), nil
+}
+
+/*
+	Most of the network filters want an address and a subnet.  They take either "address/prefix" on its own,
+	or a bare address with the prefix length or netmask as the filter param.
+*/
+func parseFilterIPNet(in *pongo2.Value, param *pongo2.Value) (net.IP, *net.IPNet, error) {
+	s := strings.TrimSpace(in.String())
+
+	if strings.Contains(s, "/") {
+		return net.ParseCIDR(s)
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, nil, fmt.Errorf("'%s' is not a valid IP address", s)
+	}
+
+	if param.IsNil() || param.String() == "" {
+		return nil, nil, fmt.Errorf("'%s' has no prefix length and none was passed to the filter", s)
+	}
+
+	v4 := ip.To4() != nil
+
+	m, err := parseMask(param.String(), !v4)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if v4 && len(m) == net.IPv4len {
+		ip = ip.To4()
+	} else if v4 || len(m) != net.IPv6len {
+		return nil, nil, fmt.Errorf("'%s' and netmask '%s' are different address families", s, param.String())
+	}
+
+	return ip, &net.IPNet{IP: ip.Mask(m), Mask: m}, nil
+}
+
+func networkFilterError(name string, err error) *pongo2.Error {
+	return &pongo2.Error{Sender: "filter:" + name, OrigError: err}
+}
+
+/*
+	{{ 24|cidr_to_netmask }} => 255.255.255.0, {{ 64|cidr_to_netmask:6 }} => ffff:ffff:ffff:ffff::
+*/
+func FilterCidrToNetmask(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	m, err := parseMask(in.String(), param.String() == "6")
+	if err != nil {
+		return nil, networkFilterError("cidr_to_netmask", err)
+	}
+
+	return pongo2.AsValue(net.IP(m).String()), nil
+}
+
+/*
+	{{ "255.255.255.0"|netmask_to_cidr }} => 24
+*/
+func FilterNetmaskToCidr(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	m, err := parseMask(in.String(), false)
+	if err != nil {
+		return nil, networkFilterError("netmask_to_cidr", err)
+	}
+
+	ones, bits := m.Size()
+	if bits == 0 {
+		return nil, networkFilterError("netmask_to_cidr", fmt.Errorf("'%s' is not a contiguous netmask", in.String()))
+	}
+
+	return pongo2.AsValue(ones), nil
+}
+
+/*
+	{{ "192.0.2.10/24"|network_address }} => 192.0.2.0, {{ ipc.IPAddress|network_address:ipc.Netmask }}
+*/
+func FilterNetworkAddress(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	_, n, err := parseFilterIPNet(in, param)
+	if err != nil {
+		return nil, networkFilterError("network_address", err)
+	}
+
+	return pongo2.AsValue(n.IP.String()), nil
+}
+
+/*
+	{{ "192.0.2.10/24"|broadcast }} => 192.0.2.255.  There's no such thing for IPv6.
+*/
+func FilterBroadcast(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	_, n, err := parseFilterIPNet(in, param)
+	if err != nil {
+		return nil, networkFilterError("broadcast", err)
+	}
+
+	ip := n.IP.To4()
+	if ip == nil {
+		return nil, networkFilterError("broadcast", fmt.Errorf("IPv6 networks have no broadcast address"))
+	}
+
+	b := make(net.IP, len(ip))
+	for i := range ip {
+		b[i] = ip[i] | ^n.Mask[i]
+	}
+
+	return pongo2.AsValue(b.String()), nil
+}
+
+/*
+	{{ "192.0.2.10"|ip_in_subnet:"192.0.2.0/24" }} => True
+*/
+func FilterIPInSubnet(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	ip := net.ParseIP(strings.TrimSpace(in.String()))
+	if ip == nil {
+		return nil, networkFilterError("ip_in_subnet", fmt.Errorf("'%s' is not a valid IP address", in.String()))
+	}
+
+	_, n, err := net.ParseCIDR(strings.TrimSpace(param.String()))
+	if err != nil {
+		return nil, networkFilterError("ip_in_subnet", err)
+	}
+
+	return pongo2.AsValue(n.Contains(ip)), nil
+}
+
+/*
+	{{ "192.0.2.0/24"|nth_host:1 }} => 192.0.2.1.  Negative numbers count back from the end of the subnet, so "-1" is the last address.
+	pongo2 can't parse negative numbers as filter params, so those have to be quoted.
+*/
+func FilterNthHost(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	// This one needs the param for the host number, so the subnet has to come in all at once.
+	_, n, err := parseFilterIPNet(in, pongo2.AsValue(nil))
+	if err != nil {
+		return nil, networkFilterError("nth_host", err)
+	}
+
+	ones, bits := n.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+
+	idx := big.NewInt(int64(param.Integer()))
+	if idx.Sign() < 0 {
+		idx.Add(idx, size)
+	}
+
+	if idx.Sign() < 0 || idx.Cmp(size) >= 0 {
+		return nil, networkFilterError("nth_host", fmt.Errorf("host %d is outside of %s", param.Integer(), n.String()))
+	}
+
+	addr := new(big.Int).Add(new(big.Int).SetBytes(n.IP), idx).Bytes()
+
+	out := make(net.IP, len(n.IP))
+	copy(out[len(out)-len(addr):], addr)
+
+	return pongo2.AsValue(out.String()), nil
+}
+
+/*
+	{{ "192.0.2.10"|reverse_dns }} => 10.2.0.192.in-addr.arpa.  IPv6 addresses are given in nibble form under ip6.arpa.
+*/
+func FilterReverseDNS(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	ip := net.ParseIP(strings.TrimSpace(in.String()))
+	if ip == nil {
+		return nil, networkFilterError("reverse_dns", fmt.Errorf("'%s' is not a valid IP address", in.String()))
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		return pongo2.AsValue(fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0])), nil
+	}
+
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&b, "%x.%x.", ip[i]&0xf, ip[i]>>4)
+	}
+	b.WriteString("ip6.arpa.")
+
+	return pongo2.AsValue(b.String()), nil
+}
+
+/*
+	Splits off a prefix length, if there is one, so the v6 filters can leave it alone.
+*/
+func splitIPv6Filter(in *pongo2.Value, name string) (net.IP, string, *pongo2.Error) {
+	s := strings.TrimSpace(in.String())
+	prefix := ""
+
+	if idx := strings.Index(s, "/"); idx >= 0 {
+		s, prefix = s[:idx], s[idx:]
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() != nil || !strings.Contains(s, ":") {
+		return nil, "", networkFilterError(name, fmt.Errorf("'%s' is not a valid IPv6 address", in.String()))
+	}
+
+	return ip, prefix, nil
+}
+
+/*
+	{{ "2001:db8::1"|ipv6_expand }} => 2001:0db8:0000:0000:0000:0000:0000:0001
+*/
+func FilterIPv6Expand(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	ip, prefix, perr := splitIPv6Filter(in, "ipv6_expand")
+	if perr != nil {
+		return nil, perr
+	}
+
+	groups := make([]string, 0, 8)
+	for i := 0; i < net.IPv6len; i += 2 {
+		groups = append(groups, fmt.Sprintf("%02x%02x", ip[i], ip[i+1]))
+	}
+
+	return pongo2.AsValue(strings.Join(groups, ":") + prefix), nil
+}
+
+/*
+	{{ "2001:0db8:0000:0000:0000:0000:0000:0001"|ipv6_compress }} => 2001:db8::1
+*/
+func FilterIPv6Compress(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	ip, prefix, perr := splitIPv6Filter(in, "ipv6_compress")
+	if perr != nil {
+		return nil, perr
+	}
+
+	return pongo2.AsValue(ip.String() + prefix), nil
+}
+
+/*
+	{{ mac|mac_format:"dash" }} => de-ad-be-ef-00-01.  Formats are colon, the default, dash, dot (deab.beef.0001), and bare.
+*/
+func FilterMacFormat(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	mac := colonMAC(in.String())
+
+	if _, err := net.ParseMAC(mac); err != nil {
+		return nil, networkFilterError("mac_format", fmt.Errorf("'%s' is not a valid MAC", in.String()))
+	}
+
+	bare := strings.Replace(mac, ":", "", -1)
+
+	switch param.String() {
+	case "", "colon":
+		return pongo2.AsValue(mac), nil
+	case "dash":
+		return pongo2.AsValue(strings.Replace(mac, ":", "-", -1)), nil
+	case "bare":
+		return pongo2.AsValue(bare), nil
+	case "dot":
+		groups := make([]string, 0, len(bare)/4)
+		for i := 0; i < len(bare); i += 4 {
+			groups = append(groups, bare[i:i+4])
+		}
+		return pongo2.AsValue(strings.Join(groups, ".")), nil
+	}
+
+	return nil, networkFilterError("mac_format", fmt.Errorf("unknown MAC format '%s'", param.String()))
+}
+
+/*
+	{% for interface in machine|interfaces_with_tag:"waitron_primary" %}.  Works on the machine or on its Network.
+*/
+func FilterInterfacesWithTag(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	m, perr := networkFilterMachine(in, "filter:interfaces_with_tag")
+	if perr != nil {
+		return nil, perr
+	}
+
+	out := make([]machine.Interface, 0, len(m.Network))
+	for _, iface := range m.Network {
+		if hasTag(iface.Tags, param.String()) {
+			out = append(out, iface)
+		}
+	}
+
+	return pongo2.AsValue(out), nil
+}
+
 type tagRegexReplaceNode struct {
 	position *pongo2.Token
 	args     []pongo2.IEvaluator
@@ -71,5 +630,31 @@ func TagRegexReplace(doc *pongo2.Parser, start *pongo2.Token, arguments *pongo2.
 
 func init() {
 	pongo2.RegisterFilter("from_yaml", FilterFromYaml)
+	pongo2.RegisterFilter("to_yaml", FilterToYaml)
+	pongo2.RegisterFilter("to_json", FilterToJson)
+	pongo2.RegisterFilter("from_json", FilterFromJson)
+	pongo2.RegisterFilter("b64encode", FilterB64Encode)
+	pongo2.RegisterFilter("b64decode", FilterB64Decode)
+	pongo2.RegisterFilter("sha256", FilterSha256)
+	pongo2.RegisterFilter("password_hash", FilterPasswordHash)
+	pongo2.RegisterFilter("netplan", FilterNetplan)
+	pongo2.RegisterFilter("ifupdown", FilterIfupdown)
+	pongo2.RegisterFilter("nm_keyfiles", FilterNMKeyfiles)
+	pongo2.RegisterFilter("kickstart_network", FilterKickstartNetwork)
+	pongo2.RegisterFilter("partman_storage", FilterPartmanStorage)
+	pongo2.RegisterFilter("kickstart_storage", FilterKickstartStorage)
+	pongo2.RegisterFilter("autoinstall_storage", FilterAutoinstallStorage)
+	pongo2.RegisterFilter("indent", FilterIndent)
+	pongo2.RegisterFilter("cidr_to_netmask", FilterCidrToNetmask)
+	pongo2.RegisterFilter("netmask_to_cidr", FilterNetmaskToCidr)
+	pongo2.RegisterFilter("network_address", FilterNetworkAddress)
+	pongo2.RegisterFilter("broadcast", FilterBroadcast)
+	pongo2.RegisterFilter("ip_in_subnet", FilterIPInSubnet)
+	pongo2.RegisterFilter("nth_host", FilterNthHost)
+	pongo2.RegisterFilter("reverse_dns", FilterReverseDNS)
+	pongo2.RegisterFilter("ipv6_expand", FilterIPv6Expand)
+	pongo2.RegisterFilter("ipv6_compress", FilterIPv6Compress)
+	pongo2.RegisterFilter("mac_format", FilterMacFormat)
+	pongo2.RegisterFilter("interfaces_with_tag", FilterInterfacesWithTag)
 	pongo2.RegisterTag("regex_replace", TagRegexReplace)
 }
@@ -0,0 +1,143 @@
+package waitron
+
+import (
+	"testing"
+
+	"waitron/machine"
+
+	"github.com/flosch/pongo2"
+)
+
+func TestNetworkFilterLibrary(t *testing.T) {
+	m := &machine.Machine{Hostname: "test01.prod"}
+	m.Network = []machine.Interface{
+		machine.Interface{Name: "eno1", Tags: []string{"waitron_primary"}},
+		machine.Interface{Name: "eno2"},
+		machine.Interface{Name: "eno3", Tags: []string{"storage", "waitron_primary"}},
+	}
+
+	ctx := pongo2.Context{"machine": m, "mac": "DE:AD:BE:EF:00:01"}
+
+	tests := []struct {
+		template string
+		expected string
+		fails    bool
+	}{
+		{template: `{{ 24|cidr_to_netmask }}`, expected: "255.255.255.0"},
+		{template: `{{ "/28"|cidr_to_netmask }}`, expected: "255.255.255.240"},
+		{template: `{{ 64|cidr_to_netmask:6 }}`, expected: "ffff:ffff:ffff:ffff::"},
+		{template: `{{ 96|cidr_to_netmask }}`, expected: "ffff:ffff:ffff:ffff:ffff:ffff::"},
+		{template: `{{ 129|cidr_to_netmask }}`, fails: true},
+		{template: `{{ "nope"|cidr_to_netmask }}`, fails: true},
+
+		{template: `{{ "255.255.255.0"|netmask_to_cidr }}`, expected: "24"},
+		{template: `{{ "255.255.255.255"|netmask_to_cidr }}`, expected: "32"},
+		{template: `{{ "ffff:ffff:ffff:ffff::"|netmask_to_cidr }}`, expected: "64"},
+		{template: `{{ "255.0.255.0"|netmask_to_cidr }}`, fails: true},
+
+		{template: `{{ "192.0.2.10/24"|network_address }}`, expected: "192.0.2.0"},
+		{template: `{{ "192.0.2.10"|network_address:"255.255.255.128" }}`, expected: "192.0.2.0"},
+		{template: `{{ "192.0.2.200"|network_address:25 }}`, expected: "192.0.2.128"},
+		{template: `{{ "2001:db8:1:2::10/48"|network_address }}`, expected: "2001:db8:1::"},
+		{template: `{{ "2001:db8::10"|network_address:64 }}`, expected: "2001:db8::"},
+		{template: `{{ "192.0.2.10"|network_address }}`, fails: true},
+		{template: `{{ "192.0.2.10"|network_address:"ffff::" }}`, fails: true},
+
+		{template: `{{ "192.0.2.10/24"|broadcast }}`, expected: "192.0.2.255"},
+		{template: `{{ "10.1.2.3"|broadcast:"255.255.0.0" }}`, expected: "10.1.255.255"},
+		{template: `{{ "2001:db8::10/64"|broadcast }}`, fails: true},
+
+		{template: `{{ "192.0.2.10"|ip_in_subnet:"192.0.2.0/24" }}`, expected: "True"},
+		{template: `{{ "192.0.3.10"|ip_in_subnet:"192.0.2.0/24" }}`, expected: "False"},
+		{template: `{{ "2001:db8::10"|ip_in_subnet:"2001:db8::/32" }}`, expected: "True"},
+		{template: `{{ "192.0.2.10"|ip_in_subnet:"nope" }}`, fails: true},
+
+		{template: `{{ "192.0.2.0/24"|nth_host:1 }}`, expected: "192.0.2.1"},
+		{template: `{{ "192.0.2.77/24"|nth_host:10 }}`, expected: "192.0.2.10"},
+		{template: `{{ "192.0.2.0/24"|nth_host:"-2" }}`, expected: "192.0.2.254"},
+		{template: `{{ "2001:db8::/64"|nth_host:255 }}`, expected: "2001:db8::ff"},
+		{template: `{{ "192.0.2.0/24"|nth_host:256 }}`, fails: true},
+
+		{template: `{{ "192.0.2.10"|reverse_dns }}`, expected: "10.2.0.192.in-addr.arpa."},
+		{template: `{{ "2001:db8::567:89ab"|reverse_dns }}`, expected: "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa."},
+		{template: `{{ "nope"|reverse_dns }}`, fails: true},
+
+		{template: `{{ "2001:db8::1"|ipv6_expand }}`, expected: "2001:0db8:0000:0000:0000:0000:0000:0001"},
+		{template: `{{ "2001:db8::/64"|ipv6_expand }}`, expected: "2001:0db8:0000:0000:0000:0000:0000:0000/64"},
+		{template: `{{ "192.0.2.1"|ipv6_expand }}`, fails: true},
+		{template: `{{ "2001:0db8:0000:0000:0000:0000:0000:0001"|ipv6_compress }}`, expected: "2001:db8::1"},
+		{template: `{{ "2001:DB8:0:0:1::/80"|ipv6_compress }}`, expected: "2001:db8:0:0:1::/80"},
+
+		{template: `{{ mac|mac_format }}`, expected: "de:ad:be:ef:00:01"},
+		{template: `{{ mac|mac_format:"dash" }}`, expected: "de-ad-be-ef-00-01"},
+		{template: `{{ mac|mac_format:"dot" }}`, expected: "dead.beef.0001"},
+		{template: `{{ "dead.beef.0001"|mac_format:"bare" }}`, expected: "deadbeef0001"},
+		{template: `{{ mac|mac_format:"nope" }}`, fails: true},
+		{template: `{{ "nope"|mac_format }}`, fails: true},
+
+		{template: `{% for i in machine|interfaces_with_tag:"waitron_primary" %}{{ i.Name }} {% endfor %}`, expected: "eno1 eno3 "},
+		{template: `{% for i in machine.Network|interfaces_with_tag:"storage" %}{{ i.Name }} {% endfor %}`, expected: "eno3 "},
+		{template: `{{ machine.Hostname|interfaces_with_tag:"storage" }}`, fails: true},
+	}
+
+	for _, test := range tests {
+		s, err := pongo2.RenderTemplateString(test.template, ctx)
+
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s should have failed but rendered '%s'", test.template, s)
+			}
+			continue
+		}
+
+		if err != nil || s != test.expected {
+			t.Errorf("%s: expected '%s', got '%s' err(%v)", test.template, test.expected, s, err)
+		}
+	}
+}
+
+func TestSerializationFilters(t *testing.T) {
+	ctx := pongo2.Context{
+		"params": map[string]string{"b": "2", "a": "1"},
+		"yml":    "disks: [sda, sdb]\nraid: {level: 1}\n",
+		"js":     `{"disks": ["sda", "sdb"], "raid": {"level": 1}}`,
+	}
+
+	tests := []struct {
+		template string
+		expected string
+		fails    bool
+	}{
+		{template: `{{ params|to_json }}`, expected: `{"a":"1","b":"2"}`},
+		{template: `{{ params|to_json:2 }}`, expected: "{\n  \"a\": \"1\",\n  \"b\": \"2\"\n}"},
+		{template: `{{ yml|from_yaml|to_json }}`, expected: `{"disks":["sda","sdb"],"raid":{"level":1}}`},
+		{template: `{{ params|to_yaml }}`, expected: "a: \"1\"\nb: \"2\"\n"},
+		{template: `{% with j = js|from_json %}{{ j.disks.1 }} {{ j.raid.level }}{% endwith %}`, expected: "sdb 1"},
+		{template: `{{ "nope"|from_json }}`, fails: true},
+
+		{template: `{{ "hello world"|b64encode }}`, expected: "aGVsbG8gd29ybGQ="},
+		{template: `{{ "aGVsbG8gd29ybGQ="|b64decode }}`, expected: "hello world"},
+		{template: `{{ "ZWNobyAiYSIgJj4gL3RtcC9i"|b64decode }}`, expected: `echo "a" &> /tmp/b`},
+		{template: `{{ "PGEgaHJlZj0ieCI+JjwvYT4="|b64decode }}`, expected: `<a href="x">&</a>`},
+		{template: `{{ "<a & b>"|b64encode|b64decode }}`, expected: "<a & b>"},
+		{template: `{{ "!!!"|b64decode }}`, fails: true},
+
+		{template: `{{ "hello world"|sha256 }}`, expected: "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"},
+		{template: `{{ "<a href=\"x\">&</a>"|sha256 }}`, expected: "987a3d678fef7217a48f372fc6d60e5d65ddb79a224c05484e1b5a943f455be0"},
+	}
+
+	for _, test := range tests {
+		s, err := pongo2.RenderTemplateString(test.template, ctx)
+
+		if test.fails {
+			if err == nil {
+				t.Errorf("%s should have failed but rendered '%s'", test.template, s)
+			}
+			continue
+		}
+
+		if err != nil || s != test.expected {
+			t.Errorf("%s: expected '%s', got '%s' err(%v)", test.template, test.expected, s, err)
+		}
+	}
+}
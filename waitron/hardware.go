@@ -0,0 +1,322 @@
+package waitron
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"waitron/config"
+	"waitron/inventoryplugins"
+	"waitron/machine"
+)
+
+/*
+	What a registration image found out about a machine.  Registration images get booted through the _unknown_ build type,
+	which only knows the MAC, so Hostname is only there if something told the image what the machine should be called.
+*/
+type HardwareReport struct {
+	MAC        string    `json:"mac"`
+	ReceivedAt time.Time `json:"received_at"`
+	Hostname   string    `json:"hostname,omitempty"`
+
+	DMI    HardwareDMI    `json:"dmi"`
+	CPUs   []HardwareCPU  `json:"cpus,omitempty"`
+	Memory HardwareMemory `json:"memory"`
+	Disks  []HardwareDisk `json:"disks,omitempty"`
+	NICs   []HardwareNIC  `json:"nics,omitempty"`
+}
+
+type HardwareDMI struct {
+	SystemVendor   string `json:"system_vendor,omitempty"`
+	SystemProduct  string `json:"system_product,omitempty"`
+	SystemSerial   string `json:"system_serial,omitempty"`
+	SystemUUID     string `json:"system_uuid,omitempty"`
+	BoardVendor    string `json:"board_vendor,omitempty"`
+	BoardProduct   string `json:"board_product,omitempty"`
+	BoardSerial    string `json:"board_serial,omitempty"`
+	ChassisSerial  string `json:"chassis_serial,omitempty"`
+	ChassisAssetID string `json:"chassis_asset_tag,omitempty"`
+	BIOSVendor     string `json:"bios_vendor,omitempty"`
+	BIOSVersion    string `json:"bios_version,omitempty"`
+}
+
+type HardwareCPU struct {
+	Model   string `json:"model,omitempty"`
+	Cores   int    `json:"cores,omitempty"`
+	Threads int    `json:"threads,omitempty"`
+	MHz     int    `json:"mhz,omitempty"`
+}
+
+type HardwareMemory struct {
+	TotalBytes int64             `json:"total_bytes,omitempty"`
+	DIMMs      []HardwareMemDIMM `json:"dimms,omitempty"`
+}
+
+type HardwareMemDIMM struct {
+	Locator   string `json:"locator,omitempty"`
+	SizeBytes int64  `json:"size_bytes,omitempty"`
+	Type      string `json:"type,omitempty"`
+	SpeedMTs  int    `json:"speed_mts,omitempty"`
+}
+
+type HardwareDisk struct {
+	Name       string `json:"name"`
+	Path       string `json:"path,omitempty"`
+	Serial     string `json:"serial,omitempty"`
+	Model      string `json:"model,omitempty"`
+	SizeBytes  int64  `json:"size_bytes,omitempty"`
+	Rotational bool   `json:"rotational,omitempty"`
+}
+
+type HardwareNIC struct {
+	Name      string        `json:"name"`
+	MAC       string        `json:"mac"`
+	Driver    string        `json:"driver,omitempty"`
+	SpeedMbps int           `json:"speed_mbps,omitempty"`
+	LLDP      *HardwareLLDP `json:"lldp,omitempty"`
+}
+
+/*
+	The switch on the other end of a NIC, as it announced itself over LLDP.
+*/
+type HardwareLLDP struct {
+	ChassisID       string `json:"chassis_id,omitempty"`
+	SystemName      string `json:"system_name,omitempty"`
+	PortID          string `json:"port_id,omitempty"`
+	PortDescription string `json:"port_description,omitempty"`
+	VlanID          int    `json:"vlan_id,omitempty"`
+}
+
+/*
+	Registered hardware reports, by normalized MAC.  With hardware_path set, every report is also written there, and
+	anything not in memory is looked for there, so reports survive restarts.
+*/
+type hardwareReports struct {
+	sync.RWMutex
+	byMAC map[string]*HardwareReport
+}
+
+var (
+	ErrHardwareNotFound  = errors.New("no hardware report")
+	ErrBadHardwareReport = errors.New("bad hardware report")
+)
+
+func normalizeMAC(mac string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+}
+
+func validMAC(mac string) bool {
+	if len(mac) != 12 {
+		return false
+	}
+
+	for _, c := range mac {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (w *Waitron) hardwareFile(mac string) string {
+	return path.Join(w.config.HardwarePath, mac+".json")
+}
+
+func (w *Waitron) storeHardware(r *HardwareReport) error {
+	w.hardware.Lock()
+	defer w.hardware.Unlock()
+
+	if w.config.HardwarePath != "" {
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		// Written to the side and renamed, so a crash never leaves half a report behind.
+		tmp := w.hardwareFile(r.MAC) + ".tmp"
+
+		if err = ioutil.WriteFile(tmp, b, 0644); err != nil {
+			return err
+		}
+
+		if err = os.Rename(tmp, w.hardwareFile(r.MAC)); err != nil {
+			return err
+		}
+	}
+
+	w.hardware.byMAC[r.MAC] = r
+
+	return nil
+}
+
+/*
+	Stores a hardware report for a MAC, and hands a machine made from it to every writable inventory plugin, if the report has a hostname.
+	The report is kept even if a plugin fails.
+*/
+func (w *Waitron) RegisterHardware(mac string, r HardwareReport) error {
+	mac = normalizeMAC(mac)
+
+	if !validMAC(mac) {
+		return fmt.Errorf("%w: invalid MAC '%s'", ErrBadHardwareReport, mac)
+	}
+
+	for _, nic := range r.NICs {
+		if !validMAC(normalizeMAC(nic.MAC)) {
+			return fmt.Errorf("%w: NIC '%s' has invalid MAC '%s'", ErrBadHardwareReport, nic.Name, nic.MAC)
+		}
+	}
+
+	r.MAC = mac
+	r.ReceivedAt = time.Now()
+	r.Hostname = strings.ToLower(r.Hostname)
+
+	if err := w.storeHardware(&r); err != nil {
+		return err
+	}
+
+	w.addLog(fmt.Sprintf("registered hardware for %s (%s %s, serial %s)", mac, r.DMI.SystemVendor, r.DMI.SystemProduct, r.DMI.SystemSerial), config.LogLevelInfo)
+
+	if r.Hostname == "" {
+		return nil
+	}
+
+	m := r.Machine()
+
+	stored, existing, err := w.putMachine(m)
+	if err != nil {
+		return fmt.Errorf("hardware for %s was registered, but %v", mac, err)
+	}
+
+	// Once something knows the machine, it's no longer waiting to be adopted.
+	if stored+existing > 0 {
+		w.discovered.Lock()
+		delete(w.discovered.byMAC, mac)
+		w.discovered.Unlock()
+	}
+
+	return nil
+}
+
+/*
+	Hands a machine to every writable inventory plugin, and returns how many stored it, and how many already had it and left it alone.
+	The error names the plugins that failed, if any did.
+*/
+func (w *Waitron) putMachine(m *machine.Machine) (int, int, error) {
+	stored, existing := 0, 0
+	failed := make([]string, 0)
+
+	for _, ap := range w.activePlugins {
+		if !ap.settings.WriteEnabled {
+			continue
+		}
+
+		if err := ap.plugin.PutMachine(m); err != nil {
+			if errors.Is(err, inventoryplugins.ErrMachineExists) {
+				w.addLog(fmt.Sprintf("plugin %s already has machine %s: %v", ap.settings.Name, m.Hostname, err), config.LogLevelInfo)
+				existing++
+				continue
+			}
+
+			w.addLog(fmt.Sprintf("plugin %s failed to store machine %s: %v", ap.settings.Name, m.Hostname, err), config.LogLevelError)
+			failed = append(failed, ap.settings.Name)
+			continue
+		}
+
+		w.addLog(fmt.Sprintf("plugin %s stored machine %s", ap.settings.Name, m.Hostname), config.LogLevelInfo)
+		stored++
+	}
+
+	if len(failed) > 0 {
+		return stored, existing, fmt.Errorf("plugins failed to store %s: %s", m.Hostname, strings.Join(failed, ", "))
+	}
+
+	return stored, existing, nil
+}
+
+/*
+	Returns the last hardware report registered for a MAC.
+*/
+func (w *Waitron) GetHardware(mac string) (*HardwareReport, error) {
+	mac = normalizeMAC(mac)
+
+	w.hardware.RLock()
+	r, found := w.hardware.byMAC[mac]
+	w.hardware.RUnlock()
+
+	if found {
+		return r, nil
+	}
+
+	if w.config.HardwarePath == "" || !validMAC(mac) {
+		return nil, fmt.Errorf("%w for '%s'", ErrHardwareNotFound, mac)
+	}
+
+	b, err := ioutil.ReadFile(w.hardwareFile(mac))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w for '%s'", ErrHardwareNotFound, mac)
+		}
+		return nil, err
+	}
+
+	r = &HardwareReport{}
+	if err = json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("%w for '%s': %v", ErrBadHardwareReport, mac, err)
+	}
+
+	// Something may have registered while the file was being read, and that wins.
+	w.hardware.Lock()
+	defer w.hardware.Unlock()
+
+	if newer, found := w.hardware.byMAC[mac]; found {
+		return newer, nil
+	}
+	w.hardware.byMAC[mac] = r
+
+	return r, nil
+}
+
+/*
+	A machine with what a report knows that inventory cares about: its NICs, and where they're plugged in, and what it is.
+*/
+func (r *HardwareReport) Machine() *machine.Machine {
+	m, _ := machine.New(r.Hostname)
+
+	for _, nic := range r.NICs {
+		i := machine.Interface{Name: nic.Name, MacAddress: nic.MAC}
+
+		if nic.LLDP != nil {
+			i.ZSideDevice = nic.LLDP.SystemName
+			i.ZSideDeviceInterface = nic.LLDP.PortID
+			i.VlanID = nic.LLDP.VlanID
+		}
+
+		m.Network = append(m.Network, i)
+	}
+
+	params := map[string]string{
+		"hw_vendor":  r.DMI.SystemVendor,
+		"hw_product": r.DMI.SystemProduct,
+		"hw_serial":  r.DMI.SystemSerial,
+	}
+
+	for k, v := range params {
+		if v == "" {
+			continue
+		}
+
+		if m.Params == nil {
+			m.Params = make(map[string]string)
+		}
+		m.Params[k] = v
+	}
+
+	return m
+}
@@ -0,0 +1,137 @@
+package waitron
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+type hardwarePlugin struct {
+	put []*machine.Machine
+	err error
+}
+
+func (p *hardwarePlugin) Init() error {
+	return nil
+}
+
+func (p *hardwarePlugin) GetMachine(hostname string, mac string) (*machine.Machine, error) {
+	for _, m := range p.put {
+		if hostname != "" && m.Hostname == hostname {
+			return m, nil
+		}
+
+		for _, i := range m.Network {
+			if mac != "" && normalizeMAC(i.MacAddress) == mac {
+				return m, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+func (p *hardwarePlugin) PutMachine(m *machine.Machine) error {
+	p.put = append(p.put, m)
+	return p.err
+}
+
+func (p *hardwarePlugin) Deinit() error {
+	return nil
+}
+
+func TestRegisterHardware(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-hardware")
+	if err != nil {
+		t.Errorf("Failed to create hardware dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	w := New(&config.Config{HardwarePath: dir})
+
+	writable, readOnly := &hardwarePlugin{}, &hardwarePlugin{}
+
+	w.activePlugins = append(w.activePlugins,
+		activePlugin{plugin: writable, settings: &config.MachineInventoryPluginSettings{Name: "writable", WriteEnabled: true}},
+		activePlugin{plugin: readOnly, settings: &config.MachineInventoryPluginSettings{Name: "readonly"}},
+	)
+
+	r := HardwareReport{
+		DMI:    HardwareDMI{SystemVendor: "Dell Inc.", SystemProduct: "PowerEdge R650", SystemSerial: "ABC1234"},
+		CPUs:   []HardwareCPU{HardwareCPU{Model: "Intel(R) Xeon(R) Gold 6338", Cores: 32, Threads: 64}},
+		Memory: HardwareMemory{TotalBytes: 256 << 30},
+		Disks:  []HardwareDisk{HardwareDisk{Name: "sda", Serial: "S3Z9NB0K123456", SizeBytes: 480 << 30}},
+		NICs: []HardwareNIC{
+			HardwareNIC{Name: "eno1", MAC: "DE:AD:BE:EF:00:01", LLDP: &HardwareLLDP{SystemName: "tor01.example.com", PortID: "Ethernet12", VlanID: 100}},
+			HardwareNIC{Name: "eno2", MAC: "de:ad:be:ef:00:02"},
+		},
+	}
+
+	// Without a hostname, there's nothing to give the plugins.
+	if err := w.RegisterHardware("DE-AD-BE-EF-00-01", r); err != nil {
+		t.Errorf("Failed to register hardware: %v", err)
+		return
+	}
+
+	if len(writable.put) != 0 {
+		t.Errorf("Machine without a hostname was put: %+v", writable.put)
+	}
+
+	r.Hostname = "New01.example.com"
+
+	if err := w.RegisterHardware("de:ad:be:ef:00:01", r); err != nil {
+		t.Errorf("Failed to register hardware: %v", err)
+		return
+	}
+
+	if len(writable.put) != 1 || len(readOnly.put) != 0 {
+		t.Errorf("Expected the machine to be put in only the writable plugin: writable(%d) readonly(%d)", len(writable.put), len(readOnly.put))
+		return
+	}
+
+	m := writable.put[0]
+	if m.Hostname != "new01.example.com" || len(m.Network) != 2 || m.Network[0].ZSideDevice != "tor01.example.com" || m.Network[0].ZSideDeviceInterface != "Ethernet12" || m.Params["hw_serial"] != "ABC1234" {
+		t.Errorf("Unexpected machine from hardware report: %+v", m)
+	}
+
+	// Reports survive a restart.
+	w = New(&config.Config{HardwarePath: dir})
+
+	got, err := w.GetHardware("deadbeef0001")
+	if err != nil || got.MAC != "deadbeef0001" || got.Hostname != "new01.example.com" || got.Disks[0].Serial != "S3Z9NB0K123456" || got.ReceivedAt.IsZero() {
+		t.Errorf("Unexpected hardware report after a restart: err(%v) %+v", err, got)
+	}
+
+	if _, err := w.GetHardware("de:ad:be:ef:00:09"); !errors.Is(err, ErrHardwareNotFound) {
+		t.Errorf("Expected no hardware report, got %v", err)
+	}
+
+	if err := w.RegisterHardware("not-a-mac", r); !errors.Is(err, ErrBadHardwareReport) {
+		t.Errorf("Expected a bad report for an invalid MAC, got %v", err)
+	}
+
+	r.NICs = append(r.NICs, HardwareNIC{Name: "eno3", MAC: "de:ad"})
+
+	if err := w.RegisterHardware("de:ad:be:ef:00:01", r); !errors.Is(err, ErrBadHardwareReport) {
+		t.Errorf("Expected a bad report for an invalid NIC MAC, got %v", err)
+	}
+
+	// The report is kept even if a plugin can't store the machine.
+	r.NICs = r.NICs[:2]
+	writable.err = errors.New("read-only database")
+
+	w.activePlugins = append(w.activePlugins, activePlugin{plugin: writable, settings: &config.MachineInventoryPluginSettings{Name: "writable", WriteEnabled: true}})
+
+	if err := w.RegisterHardware("de:ad:be:ef:00:02", r); err == nil || errors.Is(err, ErrBadHardwareReport) {
+		t.Errorf("Expected a plugin failure, got %v", err)
+	}
+
+	if _, err := w.GetHardware("de:ad:be:ef:00:02"); err != nil {
+		t.Errorf("Hardware report wasn't kept after a plugin failure: %v", err)
+	}
+}
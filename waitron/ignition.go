@@ -0,0 +1,494 @@
+package waitron
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"waitron/config"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	The part of Butane that waitron understands: users, files, directories, links, and systemd units.
+	Anything else in a Butane config is an error rather than something that quietly goes missing from the Ignition config.
+*/
+type butaneConfig struct {
+	Variant string        `yaml:"variant"`
+	Version string        `yaml:"version"`
+	Passwd  butanePasswd  `yaml:"passwd,omitempty"`
+	Storage butaneStorage `yaml:"storage,omitempty"`
+	Systemd butaneSystemd `yaml:"systemd,omitempty"`
+}
+
+type butanePasswd struct {
+	Users []butaneUser `yaml:"users,omitempty"`
+}
+
+type butaneUser struct {
+	Name              string   `yaml:"name"`
+	UID               *int     `yaml:"uid,omitempty"`
+	PasswordHash      string   `yaml:"password_hash,omitempty"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+	Groups            []string `yaml:"groups,omitempty"`
+	HomeDir           string   `yaml:"home_dir,omitempty"`
+	Shell             string   `yaml:"shell,omitempty"`
+}
+
+type butaneStorage struct {
+	Files       []butaneFile      `yaml:"files,omitempty"`
+	Directories []butaneDirectory `yaml:"directories,omitempty"`
+	Links       []butaneLink      `yaml:"links,omitempty"`
+}
+
+type butaneNodeOwner struct {
+	ID   *int   `yaml:"id,omitempty"`
+	Name string `yaml:"name,omitempty"`
+}
+
+type butaneNode struct {
+	Path      string           `yaml:"path"`
+	Overwrite *bool            `yaml:"overwrite,omitempty"`
+	User      *butaneNodeOwner `yaml:"user,omitempty"`
+	Group     *butaneNodeOwner `yaml:"group,omitempty"`
+}
+
+type butaneResource struct {
+	Inline       *string `yaml:"inline,omitempty"`
+	Source       string  `yaml:"source,omitempty"`
+	Local        string  `yaml:"local,omitempty"`
+	Compression  string  `yaml:"compression,omitempty"`
+	Verification struct {
+		Hash string `yaml:"hash,omitempty"`
+	} `yaml:"verification,omitempty"`
+}
+
+type butaneFile struct {
+	butaneNode `yaml:",inline"`
+	Mode       *int             `yaml:"mode,omitempty"`
+	Contents   *butaneResource  `yaml:"contents,omitempty"`
+	Append     []butaneResource `yaml:"append,omitempty"`
+}
+
+type butaneDirectory struct {
+	butaneNode `yaml:",inline"`
+	Mode       *int `yaml:"mode,omitempty"`
+}
+
+type butaneLink struct {
+	butaneNode `yaml:",inline"`
+	Target     string `yaml:"target"`
+	Hard       *bool  `yaml:"hard,omitempty"`
+}
+
+type butaneSystemd struct {
+	Units []butaneUnit `yaml:"units,omitempty"`
+}
+
+type butaneUnit struct {
+	Name     string         `yaml:"name"`
+	Enabled  *bool          `yaml:"enabled,omitempty"`
+	Mask     *bool          `yaml:"mask,omitempty"`
+	Contents *string        `yaml:"contents,omitempty"`
+	Dropins  []butaneDropin `yaml:"dropins,omitempty"`
+}
+
+type butaneDropin struct {
+	Name     string  `yaml:"name"`
+	Contents *string `yaml:"contents,omitempty"`
+}
+
+/*
+	The Ignition v3 config that comes out the other end.  Only what the Butane subset above can produce is here.
+*/
+type ignitionConfig struct {
+	Ignition struct {
+		Version string `json:"version"`
+	} `json:"ignition"`
+	Passwd  *ignitionPasswd  `json:"passwd,omitempty"`
+	Storage *ignitionStorage `json:"storage,omitempty"`
+	Systemd *ignitionSystemd `json:"systemd,omitempty"`
+}
+
+type ignitionPasswd struct {
+	Users []ignitionUser `json:"users,omitempty"`
+}
+
+type ignitionUser struct {
+	Name              string   `json:"name"`
+	UID               *int     `json:"uid,omitempty"`
+	PasswordHash      *string  `json:"passwordHash,omitempty"`
+	SSHAuthorizedKeys []string `json:"sshAuthorizedKeys,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	HomeDir           *string  `json:"homeDir,omitempty"`
+	Shell             *string  `json:"shell,omitempty"`
+}
+
+type ignitionStorage struct {
+	Files       []ignitionFile      `json:"files,omitempty"`
+	Directories []ignitionDirectory `json:"directories,omitempty"`
+	Links       []ignitionLink      `json:"links,omitempty"`
+}
+
+type ignitionNodeOwner struct {
+	ID   *int    `json:"id,omitempty"`
+	Name *string `json:"name,omitempty"`
+}
+
+type ignitionNode struct {
+	Path      string             `json:"path"`
+	Overwrite *bool              `json:"overwrite,omitempty"`
+	User      *ignitionNodeOwner `json:"user,omitempty"`
+	Group     *ignitionNodeOwner `json:"group,omitempty"`
+}
+
+type ignitionResource struct {
+	Source       *string `json:"source,omitempty"`
+	Compression  *string `json:"compression,omitempty"`
+	Verification *struct {
+		Hash *string `json:"hash,omitempty"`
+	} `json:"verification,omitempty"`
+}
+
+type ignitionFile struct {
+	ignitionNode
+	Mode     *int               `json:"mode,omitempty"`
+	Contents *ignitionResource  `json:"contents,omitempty"`
+	Append   []ignitionResource `json:"append,omitempty"`
+}
+
+type ignitionDirectory struct {
+	ignitionNode
+	Mode *int `json:"mode,omitempty"`
+}
+
+type ignitionLink struct {
+	ignitionNode
+	Target string `json:"target"`
+	Hard   *bool  `json:"hard,omitempty"`
+}
+
+type ignitionSystemd struct {
+	Units []ignitionUnit `json:"units,omitempty"`
+}
+
+type ignitionUnit struct {
+	Name     string           `json:"name"`
+	Enabled  *bool            `json:"enabled,omitempty"`
+	Mask     *bool            `json:"mask,omitempty"`
+	Contents *string          `json:"contents,omitempty"`
+	Dropins  []ignitionDropin `json:"dropins,omitempty"`
+}
+
+type ignitionDropin struct {
+	Name     string  `json:"name"`
+	Contents *string `json:"contents,omitempty"`
+}
+
+/*
+	The Ignition spec version each Butane variant and version translates to.
+*/
+var butaneIgnitionVersions = map[string]map[string]string{
+	"fcos": {
+		"1.0.0": "3.0.0",
+		"1.1.0": "3.1.0",
+		"1.2.0": "3.2.0",
+		"1.3.0": "3.2.0",
+		"1.4.0": "3.3.0",
+		"1.5.0": "3.4.0",
+	},
+	"flatcar": {
+		"1.0.0": "3.3.0",
+		"1.1.0": "3.4.0",
+	},
+}
+
+var ignitionSourceSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
+	"tftp":  true,
+	"s3":    true,
+	"gs":    true,
+	"arn":   true,
+	"data":  true,
+}
+
+var ignitionHashPattern = regexp.MustCompile(`^(sha256|sha512)-[0-9a-f]+$`)
+
+var systemdUnitSuffixes = []string{".service", ".socket", ".device", ".mount", ".automount", ".swap", ".target", ".path", ".timer", ".snapshot", ".slice", ".scope"}
+
+func stringOrNil(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func ignitionOwner(o *butaneNodeOwner) *ignitionNodeOwner {
+	if o == nil {
+		return nil
+	}
+	return &ignitionNodeOwner{ID: o.ID, Name: stringOrNil(o.Name)}
+}
+
+/*
+	Inline contents become data URLs, which is all Butane does with them too, minus the compression.
+*/
+func convertButaneResource(r butaneResource, where string) (ignitionResource, error) {
+	ir := ignitionResource{}
+
+	switch {
+	case r.Local != "":
+		return ir, fmt.Errorf("%s: local contents aren't supported, use inline or source", where)
+	case r.Inline != nil && r.Source != "":
+		return ir, fmt.Errorf("%s: only one of inline and source can be set", where)
+	case r.Inline != nil:
+		if r.Compression != "" {
+			return ir, fmt.Errorf("%s: compression only applies to source", where)
+		}
+		ir.Source = stringOrNil("data:," + url.PathEscape(*r.Inline))
+	case r.Source != "":
+		u, err := url.Parse(r.Source)
+		if err != nil || !ignitionSourceSchemes[u.Scheme] {
+			return ir, fmt.Errorf("%s: invalid source '%s'", where, r.Source)
+		}
+		ir.Source = stringOrNil(r.Source)
+	}
+
+	if r.Compression != "" && r.Compression != "gzip" {
+		return ir, fmt.Errorf("%s: unknown compression '%s'", where, r.Compression)
+	}
+	ir.Compression = stringOrNil(r.Compression)
+
+	if r.Verification.Hash != "" {
+		if ir.Source == nil || !ignitionHashPattern.MatchString(r.Verification.Hash) {
+			return ir, fmt.Errorf("%s: invalid verification hash '%s'", where, r.Verification.Hash)
+		}
+		ir.Verification = &struct {
+			Hash *string `json:"hash,omitempty"`
+		}{Hash: stringOrNil(r.Verification.Hash)}
+	}
+
+	return ir, nil
+}
+
+func checkIgnitionMode(mode *int, where string) error {
+	if mode != nil && (*mode < 0 || *mode > 07777) {
+		return fmt.Errorf("%s: invalid mode %o", where, *mode)
+	}
+	return nil
+}
+
+/*
+	Converts a Butane config to an Ignition config, checking along the way everything Ignition would otherwise only complain about
+	once the machine is already booting: paths that aren't absolute or show up more than once, bad modes and sources, and unit names systemd won't take.
+*/
+func butaneToIgnition(b []byte) (*ignitionConfig, error) {
+	bc := butaneConfig{}
+
+	if err := yaml.UnmarshalStrict(b, &bc); err != nil {
+		return nil, fmt.Errorf("invalid butane config: %v", err)
+	}
+
+	versions, found := butaneIgnitionVersions[bc.Variant]
+	if !found {
+		return nil, fmt.Errorf("unknown butane variant '%s'", bc.Variant)
+	}
+
+	ic := &ignitionConfig{}
+
+	if ic.Ignition.Version, found = versions[bc.Version]; !found {
+		return nil, fmt.Errorf("unknown butane version '%s' for variant %s", bc.Version, bc.Variant)
+	}
+
+	users := make(map[string]bool)
+
+	for idx, u := range bc.Passwd.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("passwd user %d has no name", idx+1)
+		}
+
+		if users[u.Name] {
+			return nil, fmt.Errorf("passwd user '%s' is listed more than once", u.Name)
+		}
+		users[u.Name] = true
+
+		if ic.Passwd == nil {
+			ic.Passwd = &ignitionPasswd{}
+		}
+
+		ic.Passwd.Users = append(ic.Passwd.Users, ignitionUser{
+			Name:              u.Name,
+			UID:               u.UID,
+			PasswordHash:      stringOrNil(u.PasswordHash),
+			SSHAuthorizedKeys: u.SSHAuthorizedKeys,
+			Groups:            u.Groups,
+			HomeDir:           stringOrNil(u.HomeDir),
+			Shell:             stringOrNil(u.Shell),
+		})
+	}
+
+	paths := make(map[string]bool)
+
+	node := func(n butaneNode, kind string) (ignitionNode, error) {
+		if !path.IsAbs(n.Path) || path.Clean(n.Path) != n.Path {
+			return ignitionNode{}, fmt.Errorf("storage %s '%s': path must be absolute and clean", kind, n.Path)
+		}
+
+		if paths[n.Path] {
+			return ignitionNode{}, fmt.Errorf("storage %s '%s': path is listed more than once", kind, n.Path)
+		}
+		paths[n.Path] = true
+
+		return ignitionNode{Path: n.Path, Overwrite: n.Overwrite, User: ignitionOwner(n.User), Group: ignitionOwner(n.Group)}, nil
+	}
+
+	storage := &ignitionStorage{}
+
+	for _, f := range bc.Storage.Files {
+		n, err := node(f.butaneNode, "file")
+		if err != nil {
+			return nil, err
+		}
+
+		where := "storage file '" + f.Path + "'"
+
+		if err := checkIgnitionMode(f.Mode, where); err != nil {
+			return nil, err
+		}
+
+		file := ignitionFile{ignitionNode: n, Mode: f.Mode}
+
+		if f.Contents != nil {
+			r, err := convertButaneResource(*f.Contents, where)
+			if err != nil {
+				return nil, err
+			}
+			file.Contents = &r
+		}
+
+		for _, a := range f.Append {
+			r, err := convertButaneResource(a, where)
+			if err != nil {
+				return nil, err
+			}
+			file.Append = append(file.Append, r)
+		}
+
+		storage.Files = append(storage.Files, file)
+	}
+
+	for _, d := range bc.Storage.Directories {
+		n, err := node(d.butaneNode, "directory")
+		if err != nil {
+			return nil, err
+		}
+
+		if err := checkIgnitionMode(d.Mode, "storage directory '"+d.Path+"'"); err != nil {
+			return nil, err
+		}
+
+		storage.Directories = append(storage.Directories, ignitionDirectory{ignitionNode: n, Mode: d.Mode})
+	}
+
+	for _, l := range bc.Storage.Links {
+		n, err := node(l.butaneNode, "link")
+		if err != nil {
+			return nil, err
+		}
+
+		if l.Target == "" {
+			return nil, fmt.Errorf("storage link '%s' has no target", l.Path)
+		}
+
+		storage.Links = append(storage.Links, ignitionLink{ignitionNode: n, Target: l.Target, Hard: l.Hard})
+	}
+
+	if len(storage.Files) > 0 || len(storage.Directories) > 0 || len(storage.Links) > 0 {
+		ic.Storage = storage
+	}
+
+	units := make(map[string]bool)
+
+	for _, u := range bc.Systemd.Units {
+		valid := false
+		for _, suffix := range systemdUnitSuffixes {
+			if strings.HasSuffix(u.Name, suffix) && len(u.Name) > len(suffix) {
+				valid = true
+				break
+			}
+		}
+
+		if !valid || strings.Contains(u.Name, "/") {
+			return nil, fmt.Errorf("invalid systemd unit name '%s'", u.Name)
+		}
+
+		if units[u.Name] {
+			return nil, fmt.Errorf("systemd unit '%s' is listed more than once", u.Name)
+		}
+		units[u.Name] = true
+
+		unit := ignitionUnit{Name: u.Name, Enabled: u.Enabled, Mask: u.Mask, Contents: u.Contents}
+
+		dropins := make(map[string]bool)
+
+		for _, d := range u.Dropins {
+			if !strings.HasSuffix(d.Name, ".conf") || strings.Contains(d.Name, "/") || dropins[d.Name] {
+				return nil, fmt.Errorf("systemd unit '%s' has an invalid or repeated dropin '%s'", u.Name, d.Name)
+			}
+			dropins[d.Name] = true
+
+			unit.Dropins = append(unit.Dropins, ignitionDropin{Name: d.Name, Contents: d.Contents})
+		}
+
+		if ic.Systemd == nil {
+			ic.Systemd = &ignitionSystemd{}
+		}
+		ic.Systemd.Units = append(ic.Systemd.Units, unit)
+	}
+
+	return ic, nil
+}
+
+/*
+	Returns the Ignition config for the ACTIVE job specified by the hostname and token, rendered from the butane template of its build type.
+	Like a preseed, fetching it moves the job to preseed, since Ignition fetching its config is about as close to the installer starting as it gets.
+*/
+func (w *Waitron) RenderIgnition(hostname string, token string) (string, error) {
+
+	j, _, err := w.getActiveJob(hostname, token)
+	if err != nil {
+		return "", err
+	}
+
+	if j.Machine.Butane == "" {
+		w.addJobLog(j, fmt.Sprintf("ignition requested for job %s without a butane template", j.Token), config.LogLevelWarning)
+		return "", fmt.Errorf("butane template: %w", ErrTemplateNotFound)
+	}
+
+	if err := w.setJobStatus(j, JobStatusPreseed, "processing "+j.Machine.Butane); err != nil {
+		return "", err
+	}
+
+	b, err := w.renderTemplate(j.Machine.Butane, "ignition", j)
+	if err != nil {
+		return "", err
+	}
+
+	ic, err := butaneToIgnition([]byte(b))
+	if err != nil {
+		w.addJobLog(j, fmt.Sprintf("butane template %s for job %s: %v", j.Machine.Butane, j.Token, err), config.LogLevelError)
+		return "", err
+	}
+
+	out, err := json.MarshalIndent(ic, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(out) + "\n", nil
+}
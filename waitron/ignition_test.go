@@ -0,0 +1,122 @@
+package waitron
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"waitron/config"
+)
+
+func TestRenderIgnition(t *testing.T) {
+	w := New(&config.Config{
+		TemplatePath: "/nonexistent",
+		BaseURL:      "http://waitron.example.com:9090",
+		BuildTypes: map[string]config.BuildType{
+			"fcos":  config.BuildType{Profile: "ignition", Cmdline: "ignition.firstboot ignition.platform.id=metal"},
+			"plain": config.BuildType{},
+		},
+	})
+
+	m, err := w.mergeMachine(profileTestMachine(), "fcos", []byte("params:\n  ssh_authorized_keys: ssh-ed25519 AAAA one@example.com,ssh-ed25519 BBBB two@example.com\n"))
+	if err != nil {
+		t.Errorf("Failed to merge machine: %v", err)
+		return
+	}
+
+	if m.Cmdline != "ignition.firstboot ignition.platform.id=metal ignition.config.url={{ BaseURL }}/ignition/{{ Hostname }}/{{ Token }}" {
+		t.Errorf("Unexpected cmdline: %s", m.Cmdline)
+	}
+
+	j := &Job{Status: JobStatusPending, BuildTypeName: "fcos", Machine: m, Token: "fcos"}
+
+	if err := w.addJob(j, j.Token, m.Hostname, nil, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	s, err := w.RenderIgnition(m.Hostname, j.Token)
+	if err != nil {
+		t.Errorf("Failed to render ignition: %v", err)
+		return
+	}
+
+	checkGolden(t, "ignition.json", s)
+
+	if err := json.Unmarshal([]byte(s), &map[string]interface{}{}); err != nil {
+		t.Errorf("Rendered ignition isn't valid JSON: %v", err)
+	}
+
+	if j.Status != JobStatusPreseed {
+		t.Errorf("Expected the job to be in preseed, got %s", j.Status)
+	}
+
+	if _, err := w.RenderIgnition(m.Hostname, "not-a-token"); err == nil {
+		t.Errorf("Rendered ignition for an unknown token")
+	}
+
+	m, _ = w.mergeMachine(profileTestMachine(), "plain", nil)
+	j = &Job{Status: JobStatusPending, BuildTypeName: "plain", Machine: m, Token: "plain"}
+
+	if err := w.addJob(j, j.Token, "plain.example.com", nil, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	if _, err := w.RenderIgnition("plain.example.com", j.Token); err == nil || !strings.Contains(err.Error(), "butane") {
+		t.Errorf("Expected an error for a build type without a butane template, got %v", err)
+	}
+}
+
+func TestButaneToIgnition(t *testing.T) {
+	tests := []struct {
+		butane string
+		result string
+		err    string
+	}{
+		{"variant: flatcar\nversion: 1.0.0\n", `{"ignition":{"version":"3.3.0"}}`, ""},
+		{
+			"variant: fcos\nversion: 1.5.0\nstorage:\n  files:\n    - path: /etc/motd\n      mode: 0644\n      contents: {inline: \"hi there/\"}\n  links:\n    - {path: /etc/localtime, target: ../usr/share/zoneinfo/UTC}\n",
+			`{"ignition":{"version":"3.4.0"},"storage":{"files":[{"path":"/etc/motd","mode":420,"contents":{"source":"data:,hi%20there%2F"}}],"links":[{"path":"/etc/localtime","target":"../usr/share/zoneinfo/UTC"}]}}`,
+			"",
+		},
+		{
+			"variant: fcos\nversion: 1.4.0\nsystemd:\n  units:\n    - name: docker.service\n      mask: true\n      dropins: [{name: override.conf, contents: \"[Service]\\n\"}]\n",
+			`{"ignition":{"version":"3.3.0"},"systemd":{"units":[{"name":"docker.service","mask":true,"dropins":[{"name":"override.conf","contents":"[Service]\n"}]}]}}`,
+			"",
+		},
+		{"variant: rhcos\nversion: 1.0.0\n", "", "unknown butane variant"},
+		{"variant: fcos\nversion: 9.9.9\n", "", "unknown butane version"},
+		{"variant: fcos\nversion: 1.4.0\nkernel_arguments: {}\n", "", "invalid butane config"},
+		{"variant: fcos\nversion: 1.4.0\npasswd:\n  users: [{name: core}, {name: core}]\n", "", "more than once"},
+		{"variant: fcos\nversion: 1.4.0\nstorage:\n  files: [{path: etc/motd}]\n", "", "absolute"},
+		{"variant: fcos\nversion: 1.4.0\nstorage:\n  files: [{path: /etc/motd}]\n  directories: [{path: /etc/motd}]\n", "", "more than once"},
+		{"variant: fcos\nversion: 1.4.0\nstorage:\n  files: [{path: /etc/motd, mode: 0100000}]\n", "", "invalid mode"},
+		{"variant: fcos\nversion: 1.4.0\nstorage:\n  files: [{path: /etc/motd, contents: {local: motd}}]\n", "", "local contents"},
+		{"variant: fcos\nversion: 1.4.0\nstorage:\n  files: [{path: /etc/motd, contents: {source: \"ftp://example.com/motd\"}}]\n", "", "invalid source"},
+		{"variant: fcos\nversion: 1.4.0\nstorage:\n  files: [{path: /etc/motd, contents: {source: \"https://example.com/motd\", verification: {hash: md5-abc}}}]\n", "", "invalid verification hash"},
+		{"variant: fcos\nversion: 1.4.0\nstorage:\n  links: [{path: /etc/localtime}]\n", "", "no target"},
+		{"variant: fcos\nversion: 1.4.0\nsystemd:\n  units: [{name: docker}]\n", "", "invalid systemd unit name"},
+		{"variant: fcos\nversion: 1.4.0\nsystemd:\n  units: [{name: docker.service, dropins: [{name: override}]}]\n", "", "dropin"},
+	}
+
+	for _, test := range tests {
+		ic, err := butaneToIgnition([]byte(test.butane))
+
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Expected an error containing '%s' for:\n%s\ngot: %v", test.err, test.butane, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Failed to convert:\n%s\n%v", test.butane, err)
+			continue
+		}
+
+		if b, _ := json.Marshal(ic); string(b) != test.result {
+			t.Errorf("Unexpected ignition for:\n%s\n%s", test.butane, b)
+		}
+	}
+}
@@ -0,0 +1,532 @@
+package waitron
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"waitron/config"
+)
+
+const (
+	ImageStatePending  = "pending"
+	ImageStateFetching = "fetching"
+	ImageStateVerified = "verified"
+	ImageStateFailed   = "failed"
+)
+
+// Failed images are fetched again when they're next needed, but not more often than this.
+const imageRetryInterval = time.Minute
+
+/*
+	Images are fetched one at a time, so a mirror that stops answering would hold up every image after it.
+	A download is given up on if it takes longer than this to connect, to get an answer, or to send anything more.
+*/
+const imageDownloadTimeout = 30 * time.Second
+
+/*
+	Where an image from a manifest is at.  Verified images are kept under staticspath, in images/<sha256>/<name>,
+	and served from [baseurl]/images/<sha256>/<name>.  Build types that list the same image with different URLs
+	just give it more places to be fetched from, tried in order until one of them has the right contents.
+*/
+type ImageStatus struct {
+	Name       string   `json:"name"`
+	URLs       []string `json:"urls"`
+	SHA256     string   `json:"sha256"`
+	BuildTypes []string `json:"build_types,omitempty"` // The build types that listed it.  The root config is _default_.
+
+	State       string    `json:"state"`
+	Error       string    `json:"error,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+	VerifiedAt  time.Time `json:"verified_at,omitempty"`
+}
+
+/*
+	Every image waitron has been asked to mirror, by <sha256>/<name>.  Anything that needs fetching goes through queue,
+	and is fetched, one at a time, once Run has been called.
+*/
+type imageMirror struct {
+	sync.RWMutex
+	byKey map[string]*ImageStatus
+	queue chan string
+
+	client      *http.Client
+	idleTimeout time.Duration
+}
+
+/*
+	There's no overall timeout, since a big image over a slow link can take as long as it takes, as long as it keeps coming.
+*/
+func newImageMirror() imageMirror {
+	return imageMirror{
+		byKey: make(map[string]*ImageStatus),
+		queue: make(chan string, 1000),
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           (&net.Dialer{Timeout: imageDownloadTimeout}).DialContext,
+			TLSHandshakeTimeout:   imageDownloadTimeout,
+			ResponseHeaderTimeout: imageDownloadTimeout,
+		}},
+		idleTimeout: imageDownloadTimeout,
+	}
+}
+
+/*
+	Cancels a download once nothing has been read for too long.
+*/
+type idleReader struct {
+	r     io.Reader
+	t     *time.Timer
+	idle  time.Duration
+	fired int32
+}
+
+func newIdleReader(r io.Reader, idle time.Duration, cancel func()) *idleReader {
+	ir := &idleReader{r: r, idle: idle}
+	ir.t = time.AfterFunc(idle, func() {
+		atomic.StoreInt32(&ir.fired, 1)
+		cancel()
+	})
+	return ir
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	ir.t.Reset(ir.idle)
+	return n, err
+}
+
+var (
+	ErrImageNotReady = errors.New("image not ready")
+	ErrImageNotFound = errors.New("image not found")
+)
+
+func imageKey(sha string, name string) string {
+	return strings.ToLower(sha) + "/" + name
+}
+
+func (w *Waitron) imageFile(key string) string {
+	return path.Join(w.config.StaticFilesPath, "images", key)
+}
+
+/*
+	Adds an image to the mirror if it isn't there yet, and queues it to be fetched if it needs to be.
+	Returns a copy of its status.
+*/
+func (w *Waitron) wantImage(i config.ImageArtifact, buildType string) ImageStatus {
+	key := imageKey(i.SHA256, i.Name)
+
+	w.images.Lock()
+	defer w.images.Unlock()
+
+	s, found := w.images.byKey[key]
+	if !found {
+		s = &ImageStatus{Name: i.Name, SHA256: strings.ToLower(i.SHA256), State: ImageStatePending}
+		w.images.byKey[key] = s
+	}
+
+	hasBuildType := false
+	for _, bt := range s.BuildTypes {
+		if bt == buildType {
+			hasBuildType = true
+		}
+	}
+
+	if !hasBuildType {
+		s.BuildTypes = append(s.BuildTypes, buildType)
+		sort.Strings(s.BuildTypes)
+	}
+
+	if err := i.Validate(); err != nil {
+		// An image with nowhere valid to be fetched from can only ever fail.
+		if len(s.URLs) == 0 {
+			s.State = ImageStateFailed
+			s.Error = err.Error()
+		}
+		return *s
+	}
+
+	hasURL := false
+	for _, u := range s.URLs {
+		if u == i.URL {
+			hasURL = true
+		}
+	}
+
+	// Somewhere new to fetch it from is worth a try right away.
+	if !hasURL {
+		s.URLs = append(s.URLs, i.URL)
+
+		if !found || s.State == ImageStateFailed {
+			s.State = ImageStatePending
+			w.queueImage(key)
+		}
+	}
+
+	if s.State == ImageStateFailed && !s.LastAttempt.IsZero() && time.Since(s.LastAttempt) > imageRetryInterval {
+		s.State = ImageStatePending
+		w.queueImage(key)
+	}
+
+	return *s
+}
+
+/*
+	The caller must hold the images lock.  If the queue is full, the image is marked failed, so it's queued again once it's wanted after imageRetryInterval.
+*/
+func (w *Waitron) queueImage(key string) {
+	select {
+	case w.images.queue <- key:
+	default:
+		w.addLog(fmt.Sprintf("image queue is full, %s will be fetched later", key), config.LogLevelWarning)
+		w.images.byKey[key].LastAttempt = time.Now()
+		w.images.byKey[key].State = ImageStateFailed
+		w.images.byKey[key].Error = "image queue is full"
+	}
+}
+
+/*
+	Adds the images of the root config and every build type to the mirror, and starts fetching them.
+*/
+func (w *Waitron) startImageMirror() {
+	for _, i := range w.config.Images {
+		w.wantImage(i, "_default_")
+	}
+
+	names := make([]string, 0, len(w.config.BuildTypes))
+	for name := range w.config.BuildTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, i := range w.config.BuildTypes[name].Images {
+			w.wantImage(i, name)
+		}
+	}
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		for {
+			select {
+			case <-w.done:
+				return
+			case key := <-w.images.queue:
+				w.fetchImage(key)
+			}
+		}
+	}()
+}
+
+func (w *Waitron) setImageState(key string, state string, err error, size int64) {
+	w.images.Lock()
+	defer w.images.Unlock()
+
+	s := w.images.byKey[key]
+	s.State = state
+	s.Error = ""
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	if state == ImageStateFetching {
+		s.LastAttempt = time.Now()
+	}
+
+	if state == ImageStateVerified {
+		s.Size = size
+		s.VerifiedAt = time.Now()
+	}
+}
+
+/*
+	Verifies the local copy of an image, and downloads it again if it's missing or doesn't match.
+*/
+func (w *Waitron) fetchImage(key string) {
+	w.images.RLock()
+	s := *w.images.byKey[key]
+	s.URLs = append([]string{}, s.URLs...)
+	w.images.RUnlock()
+
+	w.setImageState(key, ImageStateFetching, nil, 0)
+
+	size, err := w.verifyImage(key, s.SHA256)
+	if err == nil {
+		w.addLog(fmt.Sprintf("image %s is already mirrored", key), config.LogLevelDebug)
+		w.setImageState(key, ImageStateVerified, nil, size)
+		return
+	}
+
+	w.addLog(fmt.Sprintf("image %s needs fetching: %v", key, err), config.LogLevelInfo)
+
+	failures := make([]string, 0, len(s.URLs))
+
+	for _, u := range s.URLs {
+		if size, err = w.downloadImage(key, u, s.SHA256); err != nil {
+			w.addLog(fmt.Sprintf("failed to fetch image %s from %s: %v", key, u, err), config.LogLevelError)
+			failures = append(failures, fmt.Sprintf("%s: %v", u, err))
+			continue
+		}
+
+		w.addLog(fmt.Sprintf("fetched and verified image %s from %s", key, u), config.LogLevelInfo)
+		w.setImageState(key, ImageStateVerified, nil, size)
+		return
+	}
+
+	w.setImageState(key, ImageStateFailed, errors.New(strings.Join(failures, "; ")), 0)
+}
+
+func (w *Waitron) verifyImage(key string, sha string) (int64, error) {
+	if w.config.StaticFilesPath == "" {
+		return 0, errors.New("staticspath isn't set")
+	}
+
+	f, err := os.Open(w.imageFile(key))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, err
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != sha {
+		return 0, fmt.Errorf("sha256 is %s", got)
+	}
+
+	return size, nil
+}
+
+/*
+	Downloads an image next to where it goes, and only moves it into place once it's been verified,
+	so a partial or broken download is never served.
+*/
+func (w *Waitron) downloadImage(key string, url string, sha string) (int64, error) {
+	if w.config.StaticFilesPath == "" {
+		return 0, errors.New("staticspath isn't set")
+	}
+
+	file := w.imageFile(key)
+
+	if err := os.MkdirAll(path.Dir(file), 0755); err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Stopping waitron shouldn't have to wait on a big download.
+	finished := make(chan struct{})
+	defer close(finished)
+
+	go func() {
+		select {
+		case <-w.done:
+			cancel()
+		case <-finished:
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := w.images.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	tmp := file + ".part"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+
+	h := sha256.New()
+
+	body := newIdleReader(resp.Body, w.images.idleTimeout, cancel)
+	defer body.t.Stop()
+
+	size, err := io.Copy(io.MultiWriter(f, h), body)
+	if err != nil && atomic.LoadInt32(&body.fired) == 1 {
+		err = fmt.Errorf("nothing received for %s", w.images.idleTimeout)
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != sha {
+		return 0, fmt.Errorf("sha256 of download is %s, expected %s", got, sha)
+	}
+
+	if err = os.Rename(tmp, file); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+/*
+	Makes sure the local copy of a verified image is still there, and the size it was when it was verified, before it's handed out.
+	Hashing it every time would be too slow, so anything else is left to the next fetch.  If it's gone or changed,
+	the image goes back to pending and is fetched again.
+*/
+func (w *Waitron) checkImageFile(key string, size int64) error {
+	fi, err := os.Stat(w.imageFile(key))
+	if err == nil && fi.Size() != size {
+		err = fmt.Errorf("size is %d, expected %d", fi.Size(), size)
+	}
+
+	if err == nil {
+		return nil
+	}
+
+	w.addLog(fmt.Sprintf("verified image %s needs fetching again: %v", key, err), config.LogLevelWarning)
+
+	w.images.Lock()
+	defer w.images.Unlock()
+
+	// Something else may have already noticed.
+	if s := w.images.byKey[key]; s.State == ImageStateVerified {
+		s.State = ImageStatePending
+		s.Error = err.Error()
+		w.queueImage(key)
+	}
+
+	return err
+}
+
+/*
+	Returns every image in the mirror, sorted by name.
+*/
+func (w *Waitron) GetImages() []ImageStatus {
+	w.images.RLock()
+	images := make([]ImageStatus, 0, len(w.images.byKey))
+	for _, s := range w.images.byKey {
+		c := *s
+		c.URLs = append([]string{}, s.URLs...)
+		c.BuildTypes = append([]string{}, s.BuildTypes...)
+		images = append(images, c)
+	}
+	w.images.RUnlock()
+
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Name == images[j].Name {
+			return images[i].SHA256 < images[j].SHA256
+		}
+		return images[i].Name < images[j].Name
+	})
+
+	return images
+}
+
+/*
+	Returns the path of the local copy of an image, if it has been verified.
+*/
+func (w *Waitron) ImageFile(sha string, name string) (string, error) {
+	key := imageKey(sha, name)
+
+	w.images.RLock()
+	s, found := w.images.byKey[key]
+	verified := found && s.State == ImageStateVerified
+	var size int64
+	if verified {
+		size = s.Size
+	}
+	w.images.RUnlock()
+
+	if !verified {
+		return "", fmt.Errorf("%w: %s", ErrImageNotFound, key)
+	}
+
+	if err := w.checkImageFile(key, size); err != nil {
+		return "", fmt.Errorf("%w: %s: %v", ErrImageNotFound, key, err)
+	}
+
+	return w.imageFile(key), nil
+}
+
+/*
+	Works out the URLs a machine should boot.  Files listed in images are served from their verified local copies,
+	and anything else comes from imageURL, as it always has.  If a listed file hasn't been verified yet, nothing is served.
+*/
+func (w *Waitron) bootURLs(images []config.ImageArtifact, buildType string, imageURL string, kernel string, initrds []string) (string, []string, error) {
+	imageURL = strings.TrimRight(imageURL, "/")
+
+	byName := make(map[string]config.ImageArtifact, len(images))
+	for _, i := range images {
+		byName[i.Name] = i
+	}
+
+	if buildType == "" {
+		buildType = "_default_"
+	}
+
+	fileURL := func(file string) (string, error) {
+		i, found := byName[file]
+		if !found {
+			return imageURL + "/" + file, nil
+		}
+
+		s := w.wantImage(i, buildType)
+		if s.State != ImageStateVerified {
+			if s.Error != "" {
+				return "", fmt.Errorf("%w: %s is %s: %s", ErrImageNotReady, file, s.State, s.Error)
+			}
+			return "", fmt.Errorf("%w: %s is %s", ErrImageNotReady, file, s.State)
+		}
+
+		if err := w.checkImageFile(imageKey(s.SHA256, s.Name), s.Size); err != nil {
+			return "", fmt.Errorf("%w: %s needs fetching again: %v", ErrImageNotReady, file, err)
+		}
+
+		return strings.TrimRight(w.config.BaseURL, "/") + "/images/" + imageKey(s.SHA256, s.Name), nil
+	}
+
+	kernelURL, err := fileURL(kernel)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var initrdURLs []string
+	for _, initrd := range initrds {
+		u, err := fileURL(initrd)
+		if err != nil {
+			return "", nil, err
+		}
+		initrdURLs = append(initrdURLs, u)
+	}
+
+	return kernelURL, initrdURLs, nil
+}
@@ -0,0 +1,289 @@
+package waitron
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+func imageSHA(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// Waits for every image to be verified or failed, and returns false if they aren't within a few seconds.
+func waitForImages(w *Waitron) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		settled := true
+		for _, i := range w.GetImages() {
+			if i.State == ImageStatePending || i.State == ImageStateFetching {
+				settled = false
+			}
+		}
+
+		if settled {
+			return true
+		}
+
+		if time.Now().After(deadline) {
+			return false
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestImageMirror(t *testing.T) {
+	var downloads int32
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+
+		switch request.URL.Path {
+		case "/vmlinuz":
+			response.Write([]byte("kernel"))
+		case "/initrd.gz":
+			response.Write([]byte("initrd"))
+		case "/corrupt":
+			response.Write([]byte("not what was expected"))
+		default:
+			http.NotFound(response, request)
+		}
+	}))
+	defer mirror.Close()
+
+	dir, err := ioutil.TempDir("", "waitron-images")
+	if err != nil {
+		t.Errorf("Failed to create staticspath: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// Already mirrored, so it shouldn't be downloaded again.
+	if err := os.MkdirAll(path.Join(dir, "images", imageSHA("initrd")), 0755); err != nil {
+		t.Errorf("Failed to create image dir: %v", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "images", imageSHA("initrd"), "initrd.gz"), []byte("initrd"), 0644); err != nil {
+		t.Errorf("Failed to write image: %v", err)
+		return
+	}
+
+	w := New(&config.Config{
+		StaticFilesPath: dir,
+		BaseURL:         "http://waitron.example.com:9090",
+		BuildTypes: map[string]config.BuildType{
+			"good": config.BuildType{
+				ImageURL: "http://upstream.example.com/",
+				Kernel:   "vmlinuz",
+				Initrd:   []string{"initrd.gz", "extra.gz"},
+				Images: []config.ImageArtifact{
+					config.ImageArtifact{Name: "vmlinuz", URL: mirror.URL + "/vmlinuz", SHA256: imageSHA("kernel")},
+					config.ImageArtifact{Name: "initrd.gz", URL: mirror.URL + "/initrd.gz", SHA256: imageSHA("initrd")},
+				},
+			},
+			"bad": config.BuildType{
+				Kernel: "missing",
+				Images: []config.ImageArtifact{
+					config.ImageArtifact{Name: "vmlinuz", URL: mirror.URL + "/corrupt", SHA256: imageSHA("kernel")},
+					config.ImageArtifact{Name: "missing", URL: mirror.URL + "/missing", SHA256: imageSHA("missing")},
+					config.ImageArtifact{Name: "../escape", URL: mirror.URL + "/vmlinuz", SHA256: imageSHA("kernel")},
+				},
+			},
+		},
+	})
+
+	w.startImageMirror()
+	defer w.Stop()
+
+	if !waitForImages(w) {
+		t.Errorf("Images never settled: %+v", w.GetImages())
+		return
+	}
+
+	states := make([]string, 0)
+	for _, i := range w.GetImages() {
+		states = append(states, i.Name+":"+strings.Join(i.BuildTypes, ",")+":"+i.State)
+	}
+
+	// Both build types list the kernel, so the corrupt copy is tried first, and then the good one.
+	if strings.Join(states, " ") != "../escape:bad:failed initrd.gz:good:verified missing:bad:failed vmlinuz:bad,good:verified" {
+		t.Errorf("Unexpected image states: %s", strings.Join(states, " "))
+	}
+
+	// The initrd was already there, so only the two kernels and the missing image were downloaded.
+	if n := atomic.LoadInt32(&downloads); n != 3 {
+		t.Errorf("Expected 3 downloads, got %d", n)
+	}
+
+	if _, err := os.Stat(path.Join(dir, "images", imageSHA("kernel"), "vmlinuz")); err != nil {
+		t.Errorf("Verified kernel isn't in staticspath: %v", err)
+	}
+
+	if file, err := w.ImageFile(imageSHA("kernel"), "vmlinuz"); err != nil || file != path.Join(dir, "images", imageSHA("kernel"), "vmlinuz") {
+		t.Errorf("Unexpected image file: err(%v) %s", err, file)
+	}
+
+	if _, err := w.ImageFile(imageSHA("missing"), "missing"); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("Expected no file for a failed image, got %v", err)
+	}
+
+	m := &machine.Machine{Hostname: "good.example.com"}
+	m.BuildType = w.config.BuildTypes["good"]
+	m.Network = []machine.Interface{machine.Interface{MacAddress: "deadbeef0001"}}
+
+	j := &Job{Start: time.Now(), Status: JobStatusPending, BuildTypeName: "good", Machine: m, Token: "good"}
+
+	if err := w.addJob(j, j.Token, m.Hostname, []string{"deadbeef0001"}, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	c, err := w.GetPxeConfig("deadbeef0001", "")
+	if err != nil {
+		t.Errorf("Failed to get PXE config: %v", err)
+		return
+	}
+
+	if c.Kernel != "http://waitron.example.com:9090/images/"+imageSHA("kernel")+"/vmlinuz" ||
+		len(c.Initrd) != 2 || c.Initrd[0] != "http://waitron.example.com:9090/images/"+imageSHA("initrd")+"/initrd.gz" || c.Initrd[1] != "http://upstream.example.com/extra.gz" {
+		t.Errorf("Unexpected PXE config: %+v", c)
+	}
+
+	m = &machine.Machine{Hostname: "bad.example.com"}
+	m.BuildType = w.config.BuildTypes["bad"]
+	m.Network = []machine.Interface{machine.Interface{MacAddress: "deadbeef0002"}}
+
+	j = &Job{Start: time.Now(), Status: JobStatusPending, BuildTypeName: "bad", Machine: m, Token: "bad"}
+
+	if err := w.addJob(j, j.Token, m.Hostname, []string{"deadbeef0002"}, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	if _, err := w.GetPxeConfig("deadbeef0002", ""); !errors.Is(err, ErrImageNotReady) {
+		t.Errorf("Expected an unverified image to hold up the PXE config, got %v", err)
+	}
+
+	if j.Status != JobStatusPending || j.PxeServes != 0 {
+		t.Errorf("Unverified image changed the job: status(%s) serves(%d)", j.Status, j.PxeServes)
+	}
+}
+
+func TestImageDownloadIdle(t *testing.T) {
+	mirror := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("kern"))
+		response.(http.Flusher).Flush()
+
+		// And then nothing more, until the download is given up on.
+		<-request.Context().Done()
+	}))
+	defer mirror.Close()
+
+	dir, err := ioutil.TempDir("", "waitron-images")
+	if err != nil {
+		t.Errorf("Failed to create staticspath: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	w := New(&config.Config{StaticFilesPath: dir})
+	w.images.idleTimeout = 100 * time.Millisecond
+
+	key := imageKey(imageSHA("kernel"), "vmlinuz")
+
+	if _, err := w.downloadImage(key, mirror.URL+"/vmlinuz", imageSHA("kernel")); err == nil || !strings.Contains(err.Error(), "nothing received") {
+		t.Errorf("Expected a stalled download to be given up on, got %v", err)
+	}
+
+	if _, err := os.Stat(w.imageFile(key)); !os.IsNotExist(err) {
+		t.Errorf("Stalled download was kept: %v", err)
+	}
+}
+
+func TestImageFileGone(t *testing.T) {
+	var downloads int32
+
+	mirror := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		response.Write([]byte("kernel"))
+	}))
+	defer mirror.Close()
+
+	dir, err := ioutil.TempDir("", "waitron-images")
+	if err != nil {
+		t.Errorf("Failed to create staticspath: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	images := []config.ImageArtifact{config.ImageArtifact{Name: "vmlinuz", URL: mirror.URL + "/vmlinuz", SHA256: imageSHA("kernel")}}
+
+	w := New(&config.Config{StaticFilesPath: dir, BaseURL: "http://waitron.example.com:9090", BuildType: config.BuildType{Images: images}})
+
+	w.startImageMirror()
+	defer w.Stop()
+
+	if !waitForImages(w) {
+		t.Errorf("Images never settled: %+v", w.GetImages())
+		return
+	}
+
+	file := path.Join(dir, "images", imageSHA("kernel"), "vmlinuz")
+
+	if err := os.Remove(file); err != nil {
+		t.Errorf("Failed to remove image: %v", err)
+		return
+	}
+
+	// Verified, but gone, so it isn't handed out, and is fetched again.
+	if _, _, err := w.bootURLs(images, "", "", "vmlinuz", nil); !errors.Is(err, ErrImageNotReady) {
+		t.Errorf("Expected a missing image not to be served, got %v", err)
+	}
+
+	if !waitForImages(w) {
+		t.Errorf("Images never settled: %+v", w.GetImages())
+		return
+	}
+
+	if n := atomic.LoadInt32(&downloads); n != 2 {
+		t.Errorf("Expected 2 downloads, got %d", n)
+	}
+
+	if u, _, err := w.bootURLs(images, "", "", "vmlinuz", nil); err != nil || u != "http://waitron.example.com:9090/images/"+imageSHA("kernel")+"/vmlinuz" {
+		t.Errorf("Unexpected kernel URL after fetching again: err(%v) %s", err, u)
+	}
+
+	// A copy that changed size is no good either.
+	if err := ioutil.WriteFile(file, []byte("kernel, but longer"), 0644); err != nil {
+		t.Errorf("Failed to write image: %v", err)
+		return
+	}
+
+	if _, err := w.ImageFile(imageSHA("kernel"), "vmlinuz"); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("Expected a changed image not to be served, got %v", err)
+	}
+
+	if !waitForImages(w) {
+		t.Errorf("Images never settled: %+v", w.GetImages())
+		return
+	}
+
+	if data, err := ioutil.ReadFile(file); err != nil || string(data) != "kernel" {
+		t.Errorf("Changed image wasn't fetched again: err(%v) %s", err, data)
+	}
+}
@@ -0,0 +1,810 @@
+package waitron
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"waitron/config"
+	"waitron/machine"
+
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	What a build type gets for free by naming the installer it drives with "profile".
+	Templates, user_data, and butane are only filled in when the build type or machine didn't set their own,
+	and the cmdline only gets pointed at the installer config when it doesn't already point somewhere.
+*/
+type installProfile struct {
+	templates  map[string]config.StageTemplate
+	userData   string
+	butane     string
+	cmdlineArg string // The kernel argument that tells the installer where its config is.
+	cmdline    string
+}
+
+var installProfiles = map[string]installProfile{
+	"preseed": installProfile{},
+	"kickstart": installProfile{
+		templates: map[string]config.StageTemplate{
+			"kickstart": config.StageTemplate{File: "builtin/kickstart.ks.j2", Status: string(JobStatusPreseed)},
+		},
+		cmdlineArg: "inst.ks",
+		cmdline:    "inst.ks={{ BaseURL }}/template/kickstart/{{ Hostname }}/{{ Token }}",
+	},
+	"autoinstall": installProfile{
+		userData:   "builtin/autoinstall.yml.j2",
+		cmdlineArg: "ds",
+		cmdline:    "autoinstall ds=nocloud-net;s={{ BaseURL }}/cloud-init/{{ Hostname }}/{{ Token }}/",
+	},
+	"ignition": installProfile{
+		butane:     "builtin/butane.yml.j2",
+		cmdlineArg: "ignition.config.url",
+		cmdline:    "ignition.config.url={{ BaseURL }}/ignition/{{ Hostname }}/{{ Token }}",
+	},
+}
+
+func hasKernelArg(cmdline string, arg string) bool {
+	for _, f := range strings.Fields(cmdline) {
+		if f == arg || strings.HasPrefix(f, arg+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Fills in whatever the installer profile of a merged machine provides, and checks its storage layout.
+*/
+func applyInstallProfile(m *machine.Machine) error {
+	if err := m.Storage.Validate(); err != nil {
+		return err
+	}
+
+	if m.Profile == "" {
+		return nil
+	}
+
+	p, found := installProfiles[m.Profile]
+	if !found {
+		return fmt.Errorf("unknown installer profile '%s'", m.Profile)
+	}
+
+	for name, st := range p.templates {
+		if _, found := m.Templates[name]; found {
+			continue
+		}
+
+		if m.Templates == nil {
+			m.Templates = make(map[string]config.StageTemplate)
+		}
+		m.Templates[name] = st
+	}
+
+	if m.UserData == "" {
+		m.UserData = p.userData
+	}
+
+	if m.Butane == "" {
+		m.Butane = p.butane
+	}
+
+	if p.cmdline != "" && !hasKernelArg(m.Cmdline, p.cmdlineArg) {
+		m.Cmdline = strings.TrimSpace(m.Cmdline + " " + p.cmdline)
+	}
+
+	return nil
+}
+
+/*
+	Kickstart wants a plain netmask next to the address rather than a prefix.
+*/
+func cidrAddressAndMask(cidr string) (string, string) {
+	ip, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return cidr, ""
+	}
+
+	return ip.String(), net.IP(n.Mask).String()
+}
+
+/*
+	Renders kickstart network commands for a machine.
+	Kickstart only takes one address of each family per device, so only the first of each is used.
+	Devices are matched by MAC where there is one, and bond members are only configured through their bond.
+*/
+func renderKickstartNetwork(m *machine.Machine) string {
+	nc := machineNetConfig(m)
+
+	var b strings.Builder
+
+	if m.Hostname != "" {
+		fmt.Fprintf(&b, "network --hostname=%s\n", m.Hostname)
+	}
+
+	vlanParents := make(map[string]bool)
+	for _, d := range nc.Devices {
+		if d.Kind == netDeviceVlan {
+			vlanParents[d.Link] = true
+		}
+	}
+
+	for _, d := range nc.Devices {
+		if d.Bond != "" {
+			continue
+		}
+
+		args := []string{}
+
+		switch d.Kind {
+		case netDeviceVlan:
+			args = append(args, "--device="+d.Link, fmt.Sprintf("--vlanid=%d", d.VlanID), "--interfacename="+d.Name)
+		case netDeviceBond:
+			args = append(args, "--device="+d.Name, "--bondslaves="+strings.Join(d.Members, ","), fmt.Sprintf("--bondopts=mode=%s,miimon=%d", d.BondMode, bondMIIMonitor))
+		default:
+			if d.MAC != "" {
+				args = append(args, "--device="+d.MAC)
+			} else {
+				args = append(args, "--device="+d.Name)
+			}
+		}
+
+		switch {
+		case d.hasAddresses():
+			args = append(args, "--bootproto=static")
+
+			if len(d.Addresses4) > 0 {
+				ip, mask := cidrAddressAndMask(d.Addresses4[0])
+				args = append(args, "--ip="+ip, "--netmask="+mask)
+
+				if d.Gateway4 != "" {
+					args = append(args, "--gateway="+d.Gateway4)
+				}
+			} else {
+				args = append(args, "--noipv4")
+			}
+
+			if len(d.Addresses6) > 0 {
+				args = append(args, "--ipv6="+d.Addresses6[0])
+
+				if d.Gateway6 != "" {
+					args = append(args, "--ipv6gateway="+d.Gateway6)
+				}
+			} else {
+				args = append(args, "--noipv6")
+			}
+
+			if len(nc.Nameservers) > 0 {
+				args = append(args, "--nameserver="+strings.Join(nc.Nameservers, ","))
+			}
+		case vlanParents[d.Name]:
+			// Only here for what sits on top of it.
+			args = append(args, "--noipv4", "--noipv6")
+		default:
+			args = append(args, "--bootproto=dhcp")
+		}
+
+		args = append(args, "--onboot=yes", "--activate")
+
+		fmt.Fprintf(&b, "network %s\n", strings.Join(args, " "))
+	}
+
+	return b.String()
+}
+
+/*
+	Kickstart is happy with plain names like sda, but paths like /dev/disk/by-id/... have to stay paths.
+*/
+func kickstartDisk(d config.StorageDisk) (string, error) {
+	if d.Device == "" {
+		return "", fmt.Errorf("kickstart can't find storage disk '%s' by serial or size, it needs a device", d)
+	}
+
+	if name := strings.TrimPrefix(d.Device, "/dev/"); !strings.Contains(name, "/") {
+		return name, nil
+	}
+	return d.Device, nil
+}
+
+func storageMiB(size int64) int64 {
+	mib := size / (1024 * 1024)
+	if size%(1024*1024) != 0 {
+		mib++
+	}
+
+	return mib
+}
+
+/*
+	The size options of a kickstart part or logvol.
+*/
+func kickstartSize(size int64, rest bool) string {
+	if rest {
+		return "--size=1 --grow"
+	}
+	return fmt.Sprintf("--size=%d", storageMiB(size))
+}
+
+/*
+	The name kickstart knows a raid member or physical volume by.
+*/
+func kickstartMember(kind string, disk int, partition int) string {
+	return fmt.Sprintf("%s.d%dp%d", kind, disk, partition+1)
+}
+
+/*
+	Renders kickstart storage commands for a layout.  Without any disks in the layout, anaconda gets to work it out with autopart.
+	Either way, every disk it's told about is wiped.
+*/
+func renderKickstartStorage(s config.Storage) (string, error) {
+	if err := s.Validate(); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+
+	b.WriteString("zerombr\n")
+
+	if len(s.Disks) == 0 {
+		b.WriteString("clearpart --all --initlabel\nautopart\nbootloader --location=mbr\n")
+		return b.String(), nil
+	}
+
+	disks := make([]string, 0, len(s.Disks))
+	table := s.Disks[0].PartitionTable()
+
+	for _, d := range s.Disks {
+		disk, err := kickstartDisk(d)
+		if err != nil {
+			return "", err
+		}
+		disks = append(disks, disk)
+
+		if d.PartitionTable() != table {
+			table = ""
+		}
+	}
+
+	fmt.Fprintf(&b, "ignoredisk --only-use=%s\n", strings.Join(disks, ","))
+
+	if table != "" {
+		fmt.Fprintf(&b, "clearpart --all --initlabel --drives=%s --disklabel=%s\n", strings.Join(disks, ","), table)
+	} else {
+		fmt.Fprintf(&b, "clearpart --all --initlabel --drives=%s\n", strings.Join(disks, ","))
+	}
+
+	fmt.Fprintf(&b, "bootloader --location=mbr --boot-drive=%s\n", disks[0])
+
+	pvs := make(map[string][]string)
+
+	for idx, d := range s.Disks {
+		for pidx, p := range d.Partitions {
+			size, rest, err := p.Bytes()
+			if err != nil {
+				return "", err
+			}
+
+			mount, fstype := p.Mount, "--fstype="+p.Filesystem
+
+			switch {
+			case p.Raid != "":
+				mount, fstype = kickstartMember("raid", idx, pidx), ""
+			case p.VolumeGroup != "":
+				mount, fstype = kickstartMember("pv", idx, pidx), ""
+				pvs[p.VolumeGroup] = append(pvs[p.VolumeGroup], mount)
+			case p.IsSwap():
+				mount = "swap"
+			case p.IsBIOSBoot():
+				mount = "biosboot"
+			case p.IsESP():
+				fstype = "--fstype=efi"
+			}
+
+			args := []string{"part", mount}
+			if fstype != "" {
+				args = append(args, fstype)
+			}
+			args = append(args, kickstartSize(size, rest), "--ondisk="+disks[idx])
+
+			fmt.Fprintf(&b, "%s\n", strings.Join(args, " "))
+		}
+	}
+
+	for _, r := range s.Raids {
+		level, err := r.RaidLevel()
+		if err != nil {
+			return "", err
+		}
+
+		args := []string{"raid", r.Mount}
+
+		switch {
+		case r.VolumeGroup != "":
+			args[1] = "pv." + r.Name
+			pvs[r.VolumeGroup] = append(pvs[r.VolumeGroup], args[1])
+		case r.IsSwap():
+			args[1] = "swap"
+		}
+
+		args = append(args, "--device="+r.Name, fmt.Sprintf("--level=RAID%d", level))
+
+		if r.VolumeGroup == "" {
+			args = append(args, "--fstype="+r.Filesystem)
+		}
+
+		for _, m := range s.RaidMembers(r.Name) {
+			args = append(args, kickstartMember("raid", m[0], m[1]))
+		}
+
+		fmt.Fprintf(&b, "%s\n", strings.Join(args, " "))
+	}
+
+	for _, vg := range s.VolumeGroups {
+		fmt.Fprintf(&b, "volgroup %s %s\n", vg.Name, strings.Join(pvs[vg.Name], " "))
+
+		for _, lv := range vg.LogicalVolumes {
+			size, rest, err := lv.Bytes()
+			if err != nil {
+				return "", err
+			}
+
+			mount := lv.Mount
+			if lv.IsSwap() {
+				mount = "swap"
+			}
+
+			fmt.Fprintf(&b, "logvol %s --vgname=%s --name=%s --fstype=%s %s\n", mount, vg.Name, lv.Name, lv.Filesystem, kickstartSize(size, rest))
+		}
+	}
+
+	return b.String(), nil
+}
+
+/*
+	One entry of the curtin storage config used by autoinstall.
+	Everything is in a single struct, rather than one per type, so that the list comes out in order.
+*/
+type curtinStorageAction struct {
+	Type       string            `yaml:"type"`
+	ID         string            `yaml:"id"`
+	Name       string            `yaml:"name,omitempty"`
+	Path       string            `yaml:"path,omitempty"`
+	Serial     string            `yaml:"serial,omitempty"`
+	Match      map[string]string `yaml:"match,omitempty"`
+	Ptable     string            `yaml:"ptable,omitempty"`
+	Wipe       string            `yaml:"wipe,omitempty"`
+	Device     string            `yaml:"device,omitempty"`
+	Number     int               `yaml:"number,omitempty"`
+	Size       int64             `yaml:"size,omitempty"`
+	Flag       string            `yaml:"flag,omitempty"`
+	RaidLevel  *int              `yaml:"raidlevel,omitempty"`
+	Devices    []string          `yaml:"devices,omitempty"`
+	Volgroup   string            `yaml:"volgroup,omitempty"`
+	Volume     string            `yaml:"volume,omitempty"`
+	Fstype     string            `yaml:"fstype,omitempty"`
+	GrubDevice bool              `yaml:"grub_device,omitempty"`
+	Preserve   *bool             `yaml:"preserve,omitempty"`
+}
+
+type curtinStorage struct {
+	Storage struct {
+		Config []curtinStorageAction `yaml:"config"`
+	} `yaml:"storage"`
+}
+
+/*
+	Renders the storage section of an autoinstall config for a layout, or nothing at all to let subiquity use its default layout.
+	grub goes on the EFI system partition if there is one, otherwise on the first disk with a biosboot partition, otherwise on the first disk.
+	Disks without a device are matched by serial, or by size, by subiquity.
+*/
+func renderAutoinstallStorage(s config.Storage) (string, error) {
+	if err := s.Validate(); err != nil {
+		return "", err
+	}
+
+	if len(s.Disks) == 0 {
+		return "", nil
+	}
+
+	preserve := false
+
+	cs := curtinStorage{}
+	actions := make([]curtinStorageAction, 0)
+	mounts := make([]curtinStorageAction, 0)
+
+	// Formats and mounts whatever ends up with a filesystem on it.
+	format := func(id string, fstype string, mount string) {
+		actions = append(actions, curtinStorageAction{
+			Type:     "format",
+			ID:       id + "-format",
+			Volume:   id,
+			Fstype:   fstype,
+			Preserve: &preserve,
+		})
+
+		if fstype == "swap" {
+			mount = "none"
+		}
+
+		mounts = append(mounts, curtinStorageAction{
+			Type:   "mount",
+			ID:     id + "-mount",
+			Device: id + "-format",
+			Path:   mount,
+		})
+	}
+
+	grubPartition, grubDisk := -1, -1
+
+	for idx, d := range s.Disks {
+		for _, p := range d.Partitions {
+			if p.IsESP() && grubPartition < 0 {
+				grubPartition = idx
+			}
+			if p.IsBIOSBoot() && grubDisk < 0 {
+				grubDisk = idx
+			}
+		}
+	}
+
+	if grubPartition < 0 && grubDisk < 0 {
+		grubDisk = 0
+	}
+
+	members := make(map[string][]string)
+
+	for idx, d := range s.Disks {
+		diskID := fmt.Sprintf("disk%d", idx)
+
+		disk := curtinStorageAction{
+			Type:       "disk",
+			ID:         diskID,
+			Path:       d.Device,
+			Serial:     d.Serial,
+			Ptable:     d.PartitionTable(),
+			Wipe:       "superblock-recursive",
+			GrubDevice: grubPartition < 0 && grubDisk == idx,
+			Preserve:   &preserve,
+		}
+
+		if disk.Path != "" && !strings.HasPrefix(disk.Path, "/") {
+			disk.Path = "/dev/" + disk.Path
+		}
+
+		if d.Device == "" && d.Serial == "" {
+			disk.Match = map[string]string{"size": d.Size}
+		}
+
+		actions = append(actions, disk)
+
+		espDone := false
+
+		for pidx, p := range d.Partitions {
+			size, rest, err := p.Bytes()
+			if err != nil {
+				return "", err
+			}
+
+			if rest {
+				size = -1
+			}
+
+			partID := fmt.Sprintf("%s-part%d", diskID, pidx+1)
+
+			part := curtinStorageAction{
+				Type:     "partition",
+				ID:       partID,
+				Device:   diskID,
+				Number:   pidx + 1,
+				Size:     size,
+				Wipe:     "superblock",
+				Preserve: &preserve,
+			}
+
+			switch {
+			case p.IsBIOSBoot():
+				part.Flag = "bios_grub"
+			case p.IsSwap():
+				part.Flag = "swap"
+			case p.IsESP():
+				part.Flag = "boot"
+				part.GrubDevice = grubPartition == idx && !espDone
+				espDone = true
+			}
+
+			actions = append(actions, part)
+
+			switch {
+			case p.Raid != "":
+				members["raid-"+p.Raid] = append(members["raid-"+p.Raid], partID)
+			case p.VolumeGroup != "":
+				members["vg-"+p.VolumeGroup] = append(members["vg-"+p.VolumeGroup], partID)
+			case p.IsBIOSBoot():
+			case p.IsESP():
+				format(partID, "fat32", p.Mount)
+			default:
+				format(partID, p.Filesystem, p.Mount)
+			}
+		}
+	}
+
+	for _, r := range s.Raids {
+		level, err := r.RaidLevel()
+		if err != nil {
+			return "", err
+		}
+
+		raidID := "raid-" + r.Name
+
+		actions = append(actions, curtinStorageAction{
+			Type:      "raid",
+			ID:        raidID,
+			Name:      r.Name,
+			RaidLevel: &level,
+			Devices:   members[raidID],
+			Preserve:  &preserve,
+		})
+
+		if r.VolumeGroup != "" {
+			members["vg-"+r.VolumeGroup] = append(members["vg-"+r.VolumeGroup], raidID)
+			continue
+		}
+
+		format(raidID, r.Filesystem, r.Mount)
+	}
+
+	for _, vg := range s.VolumeGroups {
+		vgID := "vg-" + vg.Name
+
+		actions = append(actions, curtinStorageAction{
+			Type:     "lvm_volgroup",
+			ID:       vgID,
+			Name:     vg.Name,
+			Devices:  members[vgID],
+			Preserve: &preserve,
+		})
+
+		for _, lv := range vg.LogicalVolumes {
+			size, _, err := lv.Bytes()
+			if err != nil {
+				return "", err
+			}
+
+			lvID := vgID + "-" + lv.Name
+
+			// Without a size, curtin gives the logical volume whatever is left.
+			actions = append(actions, curtinStorageAction{
+				Type:     "lvm_partition",
+				ID:       lvID,
+				Name:     lv.Name,
+				Volgroup: vgID,
+				Size:     size,
+				Preserve: &preserve,
+			})
+
+			format(lvID, lv.Filesystem, lv.Mount)
+		}
+	}
+
+	// Mounts go last, parents first, so that nothing gets mounted before everything it needs has been formatted and mounted.
+	sort.SliceStable(mounts, func(i, j int) bool { return mounts[i].Path < mounts[j].Path })
+
+	cs.Storage.Config = append(actions, mounts...)
+
+	out, err := yaml.Marshal(&cs)
+	if err != nil {
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+/*
+	partman sizes are in megabytes of a million bytes, as min, priority, and max.
+*/
+func partmanSize(size int64, rest bool) string {
+	if rest {
+		return "1 1000000000 1000000000"
+	}
+
+	mb := (size + 999999) / 1000000
+	return fmt.Sprintf("%d %d %d", mb, mb, mb)
+}
+
+/*
+	What partman calls a partition of a disk, e.g., /dev/sda1, /dev/nvme0n1p1, or /dev/disk/by-id/...-part1.
+*/
+func partmanPartition(disk string, number int) string {
+	switch {
+	case strings.HasPrefix(disk, "/dev/disk/"):
+		return fmt.Sprintf("%s-part%d", disk, number)
+	case disk != "" && disk[len(disk)-1] >= '0' && disk[len(disk)-1] <= '9':
+		return fmt.Sprintf("%sp%d", disk, number)
+	}
+	return fmt.Sprintf("%s%d", disk, number)
+}
+
+const partmanConfirm = `d-i partman-partitioning/confirm_write_new_label boolean true
+d-i partman/choose_partition select finish
+d-i partman/confirm boolean true
+d-i partman/confirm_nooverwrite boolean true
+`
+
+/*
+	Renders the partitioning part of a preseed for a layout.  Without any disks in the layout, partman gets its atomic recipe.
+	partman applies one recipe to every disk it's given, so every disk has to be partitioned the same way, which is how raid is usually done anyway.
+	It also only builds one volume group, and, to keep the numbering of partitions predictable for raid, only uses primary partitions.
+*/
+func renderPartmanStorage(s config.Storage) (string, error) {
+	if err := s.Validate(); err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+
+	if len(s.Disks) == 0 {
+		b.WriteString("d-i partman-auto/method string regular\nd-i partman-auto/choose_recipe select atomic\n")
+		b.WriteString(partmanConfirm)
+		return b.String(), nil
+	}
+
+	if len(s.VolumeGroups) > 1 {
+		return "", fmt.Errorf("partman can only build one volume group")
+	}
+
+	first := s.Disks[0]
+	disks := make([]string, 0, len(s.Disks))
+
+	for _, d := range s.Disks {
+		if d.Device == "" {
+			return "", fmt.Errorf("partman can't find storage disk '%s' by serial or size, it needs a device", d)
+		}
+
+		if d.PartitionTable() != first.PartitionTable() || len(d.Partitions) != len(first.Partitions) {
+			return "", fmt.Errorf("partman partitions every disk the same way, but storage disk '%s' differs from '%s'", d, first)
+		}
+
+		for idx := range d.Partitions {
+			if d.Partitions[idx] != first.Partitions[idx] {
+				return "", fmt.Errorf("partman partitions every disk the same way, but storage disk '%s' differs from '%s'", d, first)
+			}
+		}
+
+		if d.PartitionTable() == "msdos" && len(d.Partitions) > 4 {
+			return "", fmt.Errorf("partman only gets primary partitions, so storage disk '%s' can't have more than 4 with msdos", d)
+		}
+
+		disk := d.Device
+		if !strings.HasPrefix(disk, "/") {
+			disk = "/dev/" + disk
+		}
+		disks = append(disks, disk)
+	}
+
+	method := "regular"
+	switch {
+	case len(s.Raids) > 0:
+		method = "raid"
+	case len(s.VolumeGroups) > 0:
+		method = "lvm"
+	}
+
+	fmt.Fprintf(&b, "d-i partman-auto/disk string %s\n", strings.Join(disks, " "))
+	fmt.Fprintf(&b, "d-i partman-auto/method string %s\n", method)
+
+	if first.PartitionTable() == "gpt" {
+		for _, q := range []string{"partman-basicfilesystems", "partman-partitioning", "partman"} {
+			fmt.Fprintf(&b, "d-i %s/choose_label string gpt\nd-i %s/default_label string gpt\n", q, q)
+		}
+	}
+
+	for _, p := range first.Partitions {
+		if p.IsESP() {
+			b.WriteString("d-i partman-efi/non_efi_system boolean true\n")
+			break
+		}
+	}
+
+	b.WriteString(`d-i partman-auto/purge_lvm_from_device boolean true
+d-i partman-lvm/device_remove_lvm boolean true
+d-i partman-md/device_remove_md boolean true
+d-i partman-lvm/confirm boolean true
+d-i partman-lvm/confirm_nooverwrite boolean true
+d-i partman-basicfilesystems/no_swap boolean false
+`)
+
+	if len(s.VolumeGroups) > 0 {
+		fmt.Fprintf(&b, "d-i partman-auto-lvm/new_vg_name string %s\nd-i partman-auto-lvm/guided_size string max\n", s.VolumeGroups[0].Name)
+	}
+
+	recipe := []string{"waitron ::"}
+
+	// The filesystem partman is told about, and how to make it.
+	filesystem := func(fs string, mount string) (string, string) {
+		if fs == "swap" {
+			return "linux-swap", "method{ swap } format{ }"
+		}
+		return fs, fmt.Sprintf("method{ format } format{ } use_filesystem{ } filesystem{ %s } mountpoint{ %s }", fs, mount)
+	}
+
+	for _, p := range first.Partitions {
+		size, rest, err := p.Bytes()
+		if err != nil {
+			return "", err
+		}
+
+		var what string
+
+		switch {
+		case p.IsBIOSBoot():
+			what = "free $bios_boot{ } method{ biosgrub }"
+		case p.IsESP():
+			what = "free $iflabel{ gpt } $reusemethod{ } method{ efi } format{ }"
+		case p.Raid != "":
+			what = "raid $primary{ } method{ raid }"
+		case p.VolumeGroup != "":
+			what = fmt.Sprintf("lvm $primary{ } $defaultignore{ } method{ lvm } vg_name{ %s }", p.VolumeGroup)
+		default:
+			fs, how := filesystem(p.Filesystem, p.Mount)
+			what = fs + " $primary{ } " + how
+		}
+
+		recipe = append(recipe, fmt.Sprintf("%s %s .", partmanSize(size, rest), what))
+	}
+
+	for _, vg := range s.VolumeGroups {
+		for _, lv := range vg.LogicalVolumes {
+			size, rest, err := lv.Bytes()
+			if err != nil {
+				return "", err
+			}
+
+			fs, how := filesystem(lv.Filesystem, lv.Mount)
+			recipe = append(recipe, fmt.Sprintf("%s %s $lvmok{ } in_vg{ %s } lv_name{ %s } %s .", partmanSize(size, rest), fs, vg.Name, lv.Name, how))
+		}
+	}
+
+	b.WriteString("d-i partman-auto/choose_recipe select waitron\n")
+	fmt.Fprintf(&b, "d-i partman-auto/expert_recipe string \\\n    %s\n", strings.Join(recipe, " \\\n    "))
+
+	if len(s.Raids) > 0 {
+		raids := make([]string, 0, len(s.Raids))
+
+		for _, r := range s.Raids {
+			level, err := r.RaidLevel()
+			if err != nil {
+				return "", err
+			}
+
+			fs, mount := r.Filesystem, r.Mount
+
+			switch {
+			case r.VolumeGroup != "":
+				fs, mount = "lvm", "-"
+			case r.IsSwap():
+				mount = "-"
+			}
+
+			members := s.RaidMembers(r.Name)
+			devices := make([]string, 0, len(members))
+
+			for _, m := range members {
+				devices = append(devices, partmanPartition(disks[m[0]], m[1]+1))
+			}
+
+			raids = append(raids, fmt.Sprintf("%d %d 0 %s %s %s .", level, len(members), fs, mount, strings.Join(devices, "#")))
+		}
+
+		fmt.Fprintf(&b, "d-i partman-auto-raid/recipe string \\\n    %s\n", strings.Join(raids, " \\\n    "))
+	}
+
+	b.WriteString(partmanConfirm)
+
+	if len(s.Raids) > 0 {
+		b.WriteString("d-i partman-md/confirm boolean true\nd-i partman-md/confirm_nooverwrite boolean true\nd-i mdadm/boot_degraded boolean false\n")
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,267 @@
+package waitron
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"waitron/config"
+	"waitron/machine"
+
+	"gopkg.in/yaml.v2"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata with the current output")
+
+/*
+	Compares got with testdata/<name>, or rewrites testdata/<name> with got if the tests were run with -update.
+*/
+func checkGolden(t *testing.T, name string, got string) {
+	file := path.Join("testdata", name)
+
+	if *updateGolden {
+		if err := ioutil.WriteFile(file, []byte(got), 0644); err != nil {
+			t.Errorf("Failed to update %s: %v", file, err)
+		}
+		return
+	}
+
+	expected, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Errorf("Failed to read %s: %v", file, err)
+		return
+	}
+
+	if got != string(expected) {
+		t.Errorf("Output doesn't match %s, run the tests with -update if that's expected:\n%s", file, got)
+	}
+}
+
+func profileTestMachine() *machine.Machine {
+	m, _ := machine.New("db01.example.com")
+
+	m.Params = map[string]string{"nameservers": "192.0.2.53 192.0.2.54", "install_url": "http://mirror.example.com/rhel/9/BaseOS/x86_64/os/"}
+	m.Network = []machine.Interface{
+		machine.Interface{Name: "eno1", MacAddress: "de:ad:be:ef:00:01", Tags: []string{"bond:bond0", "bond_mode:802.3ad"}},
+		machine.Interface{Name: "eno2", MacAddress: "de:ad:be:ef:00:02", Tags: []string{"bond:bond0"}},
+		machine.Interface{
+			Name:       "bond0",
+			Addresses4: []machine.IPConfig{machine.IPConfig{IPAddress: "192.0.2.10", Cidr: "24"}},
+			Addresses6: []machine.IPConfig{machine.IPConfig{IPAddress: "2001:db8::10", Cidr: "64"}},
+			Gateway4:   "192.0.2.1",
+			Gateway6:   "2001:db8::1",
+		},
+		machine.Interface{Name: "bond0.100", Addresses4: []machine.IPConfig{machine.IPConfig{IPAddress: "198.51.100.10", Netmask: "255.255.255.0"}}},
+		machine.Interface{Name: "ipmi", MacAddress: "de:ad:be:ef:00:03", Tags: []string{"waitron_ipmi"}},
+	}
+	m.Storage = config.Storage{
+		Disks: []config.StorageDisk{
+			config.StorageDisk{
+				Device: "sda",
+				Partitions: []config.StoragePartition{
+					config.StoragePartition{Size: "1M", Filesystem: "biosboot"},
+					config.StoragePartition{Size: "512M", Filesystem: "vfat", Mount: "/boot/efi"},
+					config.StoragePartition{Size: "1G", Filesystem: "ext4", Mount: "/boot"},
+					config.StoragePartition{Size: "8G", Filesystem: "swap"},
+					config.StoragePartition{Filesystem: "xfs", Mount: "/"},
+				},
+			},
+			config.StorageDisk{
+				Device:     "/dev/disk/by-path/pci-0000:00:17.0-ata-2",
+				Partitions: []config.StoragePartition{config.StoragePartition{Size: "rest", Filesystem: "xfs", Mount: "/var/lib/data"}},
+			},
+		},
+	}
+
+	return m
+}
+
+func TestInstallProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-templates")
+	if err != nil {
+		t.Errorf("Failed to create template dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	w := New(&config.Config{
+		TemplatePath: dir,
+		BaseURL:      "http://waitron.example.com:9090",
+		BuildTypes: map[string]config.BuildType{
+			"rhel":   config.BuildType{Profile: "kickstart", Cmdline: "console=ttyS0"},
+			"ubuntu": config.BuildType{Profile: "autoinstall", Cmdline: "console=ttyS0 ds=nocloud-net;s=http://elsewhere/"},
+			"broken": config.BuildType{Profile: "jumpstart"},
+		},
+	})
+
+	tests := []struct {
+		buildType string
+		item      string
+		cmdline   string
+		golden    string
+	}{
+		{"rhel", "kickstart", "console=ttyS0 inst.ks={{ BaseURL }}/template/kickstart/{{ Hostname }}/{{ Token }}", "kickstart.ks"},
+		{"ubuntu", "user-data", "console=ttyS0 ds=nocloud-net;s=http://elsewhere/", "autoinstall.yml"},
+	}
+
+	for _, test := range tests {
+		m, err := w.mergeMachine(profileTestMachine(), test.buildType, nil)
+		if err != nil {
+			t.Errorf("Failed to merge machine for %s: %v", test.buildType, err)
+			continue
+		}
+
+		if m.Cmdline != test.cmdline {
+			t.Errorf("Unexpected cmdline for %s: %s", test.buildType, m.Cmdline)
+		}
+
+		j := &Job{Status: JobStatusPending, BuildTypeName: test.buildType, Machine: m, Token: test.buildType}
+
+		if err := w.addJob(j, j.Token, m.Hostname, nil, false); err != nil {
+			t.Errorf("Failed to add job: %v", err)
+			return
+		}
+
+		var s string
+
+		if test.item == "user-data" {
+			s, err = w.RenderCloudInit(m.Hostname, j.Token, test.item)
+		} else {
+			s, err = w.RenderStageTemplate(j.Token, test.item)
+		}
+
+		if err != nil {
+			t.Errorf("Failed to render %s for %s: %v", test.item, test.buildType, err)
+			continue
+		}
+
+		checkGolden(t, test.golden, s)
+
+		if test.item == "user-data" {
+			if err := yaml.Unmarshal([]byte(s), &map[string]interface{}{}); err != nil {
+				t.Errorf("Rendered autoinstall isn't valid YAML: %v", err)
+			}
+		}
+
+		if err = w.CancelBuild(m.Hostname, j.Token); err != nil {
+			t.Errorf("Failed to cancel job: %v", err)
+		}
+	}
+
+	if _, err := w.mergeMachine(profileTestMachine(), "broken", nil); err == nil || !strings.Contains(err.Error(), "jumpstart") {
+		t.Errorf("Expected an error for an unknown profile, got %v", err)
+	}
+
+	// Replacing a block of a built-in template, from a template in a subdirectory, and replacing a built-in template entirely.
+	if err = writeTemplates(dir, map[string]string{
+		"kickstart/server.ks.j2": `{% extends "builtin/kickstart.ks.j2" %}{% block packages %}@^server-product-environment
+{% endblock %}`,
+		"build_types/other/builtin/kickstart.ks.j2": `replaced`,
+	}); err != nil {
+		t.Errorf("Failed to write templates: %v", err)
+		return
+	}
+
+	m, err := w.mergeMachine(profileTestMachine(), "rhel", []byte("templates:\n  kickstart: {file: kickstart/server.ks.j2, status: preseed}\n"))
+	if err != nil || m.Templates["kickstart"].File != "kickstart/server.ks.j2" {
+		t.Errorf("Profile template replaced the one of the machine: err(%v) %+v", err, m.Templates)
+		return
+	}
+
+	j := &Job{Status: JobStatusPending, BuildTypeName: "rhel", Machine: m, Token: "rhel-extended"}
+
+	if s, err := w.renderTemplate(m.Templates["kickstart"].File, "kickstart", j); err != nil || !strings.Contains(s, "%packages\n@^server-product-environment\n%end") {
+		t.Errorf("Unexpected render of an extended built-in template: err(%v) result(%s)", err, s)
+	}
+
+	j = &Job{Status: JobStatusPending, BuildTypeName: "other", Machine: m, Token: "other-replaced"}
+
+	if s, err := w.renderTemplate("builtin/kickstart.ks.j2", "kickstart", j); err != nil || s != "replaced" {
+		t.Errorf("Unexpected render of a replaced built-in template: err(%v) result(%s)", err, s)
+	}
+}
+
+func TestKickstartStorageDefault(t *testing.T) {
+	s, err := renderKickstartStorage(config.Storage{})
+	if err != nil || s != "zerombr\nclearpart --all --initlabel\nautopart\nbootloader --location=mbr\n" {
+		t.Errorf("Unexpected default kickstart storage: err(%v) result(%s)", err, s)
+	}
+
+	if s, err := renderAutoinstallStorage(config.Storage{}); err != nil || s != "" {
+		t.Errorf("Unexpected default autoinstall storage: err(%v) result(%s)", err, s)
+	}
+}
+
+func TestStorageRaidLVM(t *testing.T) {
+	s := config.Storage{}
+
+	if err := yaml.Unmarshal([]byte(`
+disks:
+  - device: sda
+    partitions: &mirrored
+      - {size: 1M, filesystem: biosboot}
+      - {size: 1G, raid: md0}
+      - {raid: md1}
+  - device: sdb
+    partitions: *mirrored
+raids:
+  - {name: md0, level: 1, filesystem: ext4, mount: /boot}
+  - {name: md1, level: raid1, volume_group: vg0}
+volume_groups:
+  - name: vg0
+    logical_volumes:
+      - {name: root, size: 20G, filesystem: xfs, mount: /}
+      - {name: swap, size: 4G, filesystem: swap}
+      - {name: srv, filesystem: xfs, mount: /srv}
+`), &s); err != nil {
+		t.Errorf("Failed to load storage layout: %v", err)
+		return
+	}
+
+	renderers := []struct {
+		render func(config.Storage) (string, error)
+		golden string
+	}{
+		{renderPartmanStorage, "storage-raid-lvm.preseed"},
+		{renderKickstartStorage, "storage-raid-lvm.ks"},
+		{renderAutoinstallStorage, "storage-raid-lvm.yml"},
+	}
+
+	for _, r := range renderers {
+		out, err := r.render(s)
+		if err != nil {
+			t.Errorf("Failed to render %s: %v", r.golden, err)
+			continue
+		}
+
+		checkGolden(t, r.golden, out)
+	}
+
+	// Only autoinstall can find disks by serial or size.
+	s = config.Storage{Disks: []config.StorageDisk{
+		config.StorageDisk{Serial: "S3Z9NB0K123456", Partitions: []config.StoragePartition{config.StoragePartition{Filesystem: "ext4", Mount: "/"}}},
+		config.StorageDisk{Size: "largest", Partitions: []config.StoragePartition{config.StoragePartition{Filesystem: "xfs", Mount: "/srv"}}},
+	}}
+
+	if out, err := renderAutoinstallStorage(s); err != nil || !strings.Contains(out, "serial: S3Z9NB0K123456") || !strings.Contains(out, "match:\n      size: largest") {
+		t.Errorf("Unexpected autoinstall storage for disks matched by serial and size: err(%v) result(%s)", err, out)
+	}
+
+	if _, err := renderKickstartStorage(s); err == nil || !strings.Contains(err.Error(), "needs a device") {
+		t.Errorf("Expected kickstart to need a device, got %v", err)
+	}
+
+	if _, err := renderPartmanStorage(s); err == nil || !strings.Contains(err.Error(), "needs a device") {
+		t.Errorf("Expected partman to need a device, got %v", err)
+	}
+
+	// partman only has the one recipe for every disk.
+	s.Disks[0].Device, s.Disks[1].Device = "sda", "sdb"
+
+	if _, err := renderPartmanStorage(s); err == nil || !strings.Contains(err.Error(), "same way") {
+		t.Errorf("Expected partman to refuse different disks, got %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package waitron
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"waitron/config"
+)
+
+const defaultJobLogLines = 500
+
+type JobLogEntry struct {
+	Time    time.Time
+	Level   string
+	Message string
+}
+
+func (e JobLogEntry) String() string {
+	return fmt.Sprintf("%s [%s] %s", e.Time.Format(time.RFC3339), e.Level, e.Message)
+}
+
+/*
+	A bounded ring of log lines attached to a single job.
+	Everything logged in the context of a job ends up here as well as in the global log,
+	so that a single build can be inspected without grepping for its token.
+*/
+type JobLog struct {
+	sync.Mutex `json:"-"`
+
+	entries []JobLogEntry
+	next    int    // Position in entries of the next write.
+	total   uint64 // Number of entries ever written.  Doubles as a sequence number for followers.
+
+	updated chan struct{} // Closed and replaced on every write to wake up followers.
+}
+
+func newJobLog(size int) *JobLog {
+	if size <= 0 {
+		size = defaultJobLogLines
+	}
+
+	return &JobLog{
+		entries: make([]JobLogEntry, 0, size),
+		updated: make(chan struct{}),
+	}
+}
+
+func (l *JobLog) add(s string, lvl config.LogLevel) {
+	l.Lock()
+	defer l.Unlock()
+
+	e := JobLogEntry{Time: time.Now(), Level: lvl.String(), Message: s}
+
+	if len(l.entries) < cap(l.entries) {
+		l.entries = append(l.entries, e)
+	} else {
+		l.entries[l.next] = e
+	}
+
+	l.next = (l.next + 1) % cap(l.entries)
+	l.total++
+
+	close(l.updated)
+	l.updated = make(chan struct{})
+}
+
+/*
+	A log is serialized as its buffered entries, oldest first, so it goes wherever the job it belongs to goes.
+*/
+func (l *JobLog) MarshalJSON() ([]byte, error) {
+	entries, _, _ := l.since(0)
+	return json.Marshal(entries)
+}
+
+/*
+	Restores a serialized log.  The buffer is at least as big as the default, so a restored job can keep logging.
+*/
+func (l *JobLog) UnmarshalJSON(b []byte) error {
+	entries := make([]JobLogEntry, 0)
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+
+	size := defaultJobLogLines
+	if len(entries) > size {
+		size = len(entries)
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.entries = append(make([]JobLogEntry, 0, size), entries...)
+	l.next = len(entries) % size
+	l.total = uint64(len(entries))
+	l.updated = make(chan struct{})
+
+	return nil
+}
+
+/*
+	Returns all entries written at or after the sequence number seq that are still in the buffer,
+	the sequence number to use for the next call, and a channel that will be closed on the next write.
+*/
+func (l *JobLog) since(seq uint64) ([]JobLogEntry, uint64, <-chan struct{}) {
+	l.Lock()
+	defer l.Unlock()
+
+	oldest := l.total - uint64(len(l.entries))
+
+	if seq < oldest {
+		seq = oldest
+	} else if seq > l.total {
+		seq = l.total
+	}
+
+	out := make([]JobLogEntry, 0, l.total-seq)
+
+	// The oldest entry sits at l.next once the ring has wrapped, and at 0 before that.
+	start := 0
+	if len(l.entries) == cap(l.entries) {
+		start = l.next
+	}
+
+	for i := seq - oldest; i < uint64(len(l.entries)); i++ {
+		out = append(out, l.entries[(start+int(i))%len(l.entries)])
+	}
+
+	return out, l.total, l.updated
+}
+
+/*
+	Log to the global log and to the log buffer of the job.
+	Job logs are small and only exist to help with a single build, so they keep INFO and above
+	even if the global log level is quieter.
+*/
+func (w *Waitron) addJobLog(j *Job, s string, l config.LogLevel) bool {
+
+	// Some jobs, such as the ones used for _unknown_ builds, are never registered and don't carry a log.
+	if j != nil && j.Log != nil && (l <= w.config.LogLevel || l <= config.LogLevelInfo) {
+		j.Log.add(w.secrets.redact(s), l)
+	}
+
+	return w.addLog(s, l)
+}
+
+/*
+	Returns a log function, in the same form that is handed to plugins, that writes to the log of the job.
+*/
+func (w *Waitron) jobLogger(j *Job) func(string, config.LogLevel) bool {
+	return func(s string, l config.LogLevel) bool {
+		return w.addJobLog(j, s, l)
+	}
+}
+
+/*
+	Returns the buffered log lines for the job specified by the token, whether or not it's currently active.
+*/
+func (w *Waitron) GetJobLog(token string) ([]JobLogEntry, error) {
+	w.history.RLock()
+	j, found := w.history.jobByToken[token]
+	w.history.RUnlock()
+
+	if !found || j.Log == nil {
+		return nil, fmt.Errorf("job '%s' not found", token)
+	}
+
+	entries, _, _ := j.Log.since(0)
+
+	return entries, nil
+}
+
+/*
+	Passes every buffered log line of the job, and then every new line as it arrives, to f.
+	This returns once the job is no longer active and all of its lines have been passed along,
+	when the context is done, or when f returns an error.
+*/
+func (w *Waitron) FollowJobLog(ctx context.Context, token string, f func(JobLogEntry) error) error {
+	w.history.RLock()
+	j, found := w.history.jobByToken[token]
+	w.history.RUnlock()
+
+	if !found || j.Log == nil {
+		return fmt.Errorf("job '%s' not found", token)
+	}
+
+	var seq uint64
+
+	for {
+		// Check for activity before draining so that lines written during clean-up are never missed.
+		_, active, _ := w.getActiveJob("", token)
+
+		entries, next, updated := j.Log.since(seq)
+		seq = next
+
+		for _, e := range entries {
+			if err := f(e); err != nil {
+				return err
+			}
+		}
+
+		if !active {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-updated:
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package waitron
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"waitron/config"
+)
+
+func TestJobLogRing(t *testing.T) {
+	l := newJobLog(3)
+
+	if entries, next, _ := l.since(0); len(entries) != 0 || next != 0 {
+		t.Errorf("New job log was not empty: %v %d", entries, next)
+		return
+	}
+
+	for i := 0; i < 5; i++ {
+		l.add(fmt.Sprintf("line %d", i), config.LogLevelInfo)
+	}
+
+	entries, next, _ := l.since(0)
+
+	if next != 5 {
+		t.Errorf("Unexpected sequence number after wrapping: %d", next)
+		return
+	}
+
+	if len(entries) != 3 || entries[0].Message != "line 2" || entries[2].Message != "line 4" {
+		t.Errorf("Unexpected entries after wrapping: %v", entries)
+		return
+	}
+
+	if entries, _, _ = l.since(4); len(entries) != 1 || entries[0].Message != "line 4" {
+		t.Errorf("Unexpected entries when reading from the middle of the ring: %v", entries)
+		return
+	}
+
+	_, _, updated := l.since(next)
+	l.add("line 5", config.LogLevelInfo)
+
+	select {
+	case <-updated:
+	default:
+		t.Errorf("Followers were not notified of a new line")
+	}
+}
+
+func TestJobLogJSON(t *testing.T) {
+	j := &Job{Token: "test", Log: newJobLog(3)}
+
+	for i := 0; i < 5; i++ {
+		j.Log.add(fmt.Sprintf("line %d", i), config.LogLevelInfo)
+	}
+
+	b, err := json.Marshal(j)
+	if err != nil {
+		t.Errorf("Failed to marshal job: %v", err)
+		return
+	}
+
+	restored := &Job{}
+	if err := json.Unmarshal(b, restored); err != nil {
+		t.Errorf("Failed to unmarshal job: %v", err)
+		return
+	}
+
+	if restored.Log == nil {
+		t.Errorf("Log didn't travel with the job: %s", b)
+		return
+	}
+
+	entries, next, _ := restored.Log.since(0)
+	if next != 3 || len(entries) != 3 || entries[0].Message != "line 2" || entries[2].Message != "line 4" {
+		t.Errorf("Unexpected restored entries: %d %v", next, entries)
+		return
+	}
+
+	// The restored log keeps going.
+	restored.Log.add("line 5", config.LogLevelInfo)
+
+	if entries, _, _ := restored.Log.since(3); len(entries) != 1 || entries[0].Message != "line 5" {
+		t.Errorf("Unexpected entries after restoring: %v", entries)
+	}
+}
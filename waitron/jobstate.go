@@ -0,0 +1,153 @@
+package waitron
+
+import (
+	"fmt"
+	"time"
+
+	"waitron/config"
+)
+
+type JobStatus string
+
+const (
+	JobStatusQueued     JobStatus = "queued"
+	JobStatusPending    JobStatus = "pending"
+	JobStatusInstalling JobStatus = "installing"
+	JobStatusPreseed    JobStatus = "preseed"
+	JobStatusFinish     JobStatus = "finish"
+	JobStatusStale      JobStatus = "stale"
+	JobStatusFailed     JobStatus = "failed"
+	JobStatusCompleted  JobStatus = "completed"
+	JobStatusTerminated JobStatus = "terminated"
+)
+
+/*
+	Every status a job is permitted to move to from its current status.
+	Staying in the same status is always permitted and isn't recorded as a transition.
+	Completed and terminated jobs are finished and can't go anywhere.
+*/
+var jobStatusTransitions = map[JobStatus][]JobStatus{
+	JobStatusQueued:     {JobStatusPending, JobStatusTerminated},
+	JobStatusPending:    {JobStatusQueued, JobStatusInstalling, JobStatusPreseed, JobStatusFinish, JobStatusStale, JobStatusFailed, JobStatusCompleted, JobStatusTerminated},
+	JobStatusInstalling: {JobStatusPreseed, JobStatusFinish, JobStatusStale, JobStatusFailed, JobStatusCompleted, JobStatusTerminated},
+	JobStatusPreseed:    {JobStatusInstalling, JobStatusFinish, JobStatusStale, JobStatusFailed, JobStatusCompleted, JobStatusTerminated},
+	JobStatusFinish:     {JobStatusInstalling, JobStatusStale, JobStatusFailed, JobStatusCompleted, JobStatusTerminated},
+	JobStatusStale:      {JobStatusPending, JobStatusInstalling, JobStatusPreseed, JobStatusFinish, JobStatusFailed, JobStatusCompleted, JobStatusTerminated},
+	JobStatusFailed:     {JobStatusTerminated},
+	JobStatusCompleted:  {},
+	JobStatusTerminated: {},
+}
+
+type JobTransition struct {
+	From   JobStatus
+	To     JobStatus
+	Time   time.Time
+	Reason string
+}
+
+/*
+	Returned whenever something attempts to move a job to a status that isn't permitted from its current one.
+*/
+type JobTransitionError struct {
+	Token string
+	From  JobStatus
+	To    JobStatus
+}
+
+func (e *JobTransitionError) Error() string {
+	return fmt.Sprintf("job '%s' cannot move from '%s' to '%s'", e.Token, e.From, e.To)
+}
+
+/*
+	Hooks are called, in the order they were added, after every recorded transition of every job.
+	They are called without any job locks held, but they are called synchronously, so they should be quick.
+*/
+type JobTransitionHook func(j *Job, t JobTransition)
+
+func (w *Waitron) AddJobTransitionHook(h JobTransitionHook) {
+	w.transitionHooksLock.Lock()
+	defer w.transitionHooksLock.Unlock()
+
+	w.transitionHooks = append(w.transitionHooks, h)
+}
+
+func canTransition(from JobStatus, to JobStatus) bool {
+	if from == to {
+		return true
+	}
+
+	for _, s := range jobStatusTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+	Checks whether a job could currently move to the specified status without changing anything.
+*/
+func (w *Waitron) checkJobStatus(j *Job, to JobStatus) error {
+	j.RLock()
+	defer j.RUnlock()
+
+	if !canTransition(j.Status, to) {
+		return &JobTransitionError{Token: j.Token, From: j.Status, To: to}
+	}
+
+	return nil
+}
+
+/*
+	Moves a job to a new status, recording the transition and notifying any hooks.
+	The job must not be locked by the caller.
+*/
+func (w *Waitron) setJobStatus(j *Job, to JobStatus, reason string) error {
+	j.Lock()
+
+	from := j.Status
+
+	if !canTransition(from, to) {
+		j.Unlock()
+
+		err := &JobTransitionError{Token: j.Token, From: from, To: to}
+		w.addJobLog(j, err.Error(), config.LogLevelWarning)
+
+		return err
+	}
+
+	j.StatusReason = reason
+
+	if from == to {
+		j.Unlock()
+		return nil
+	}
+
+	t := JobTransition{From: from, To: to, Time: time.Now(), Reason: reason}
+
+	j.Status = to
+	j.Transitions = append(j.Transitions, t)
+
+	j.Unlock()
+
+	w.runTransitionHooks(j, t)
+
+	return nil
+}
+
+/*
+	Logs a transition that has already been recorded on the job and passes it along to any hooks.
+	The job must not be locked by the caller.
+*/
+func (w *Waitron) runTransitionHooks(j *Job, t JobTransition) {
+	w.addJobLog(j, fmt.Sprintf("job %s moved from '%s' to '%s': %s", j.Token, t.From, t.To, t.Reason), config.LogLevelInfo)
+
+	w.transitionHooksLock.RLock()
+	hooks := w.transitionHooks
+	w.transitionHooksLock.RUnlock()
+
+	for _, h := range hooks {
+		h(j, t)
+	}
+}
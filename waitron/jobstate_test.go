@@ -0,0 +1,64 @@
+package waitron
+
+import (
+	"errors"
+	"testing"
+
+	"waitron/config"
+)
+
+func TestJobStatusTransitions(t *testing.T) {
+	w := New(&config.Config{})
+
+	seen := make([]JobTransition, 0)
+	w.AddJobTransitionHook(func(j *Job, jt JobTransition) {
+		seen = append(seen, jt)
+	})
+
+	j := &Job{Token: "test", Status: JobStatusPending}
+
+	for _, s := range []JobStatus{JobStatusInstalling, JobStatusInstalling, JobStatusPreseed, JobStatusFinish, JobStatusFailed} {
+		if err := w.setJobStatus(j, s, "testing"); err != nil {
+			t.Errorf("Legal transition to %s was rejected: %v", s, err)
+			return
+		}
+	}
+
+	if len(j.Transitions) != 4 || len(seen) != 4 {
+		t.Errorf("Unexpected transitions recorded: job(%v) hooks(%v)", j.Transitions, seen)
+		return
+	}
+
+	if seen[3].From != JobStatusFinish || seen[3].To != JobStatusFailed || seen[3].Time.IsZero() {
+		t.Errorf("Unexpected transition passed to hook: %v", seen[3])
+		return
+	}
+
+	err := w.setJobStatus(j, JobStatusPreseed, "late template request")
+
+	var te *JobTransitionError
+	if !errors.As(err, &te) {
+		t.Errorf("Failed job was permitted to move back to preseed: %v", err)
+		return
+	}
+
+	if j.Status != JobStatusFailed || len(j.Transitions) != 4 {
+		t.Errorf("Rejected transition changed the job: %s %v", j.Status, j.Transitions)
+		return
+	}
+
+	if err := w.checkJobStatus(j, JobStatusTerminated); err != nil {
+		t.Errorf("Failed job can't be terminated: %v", err)
+		return
+	}
+
+	if err := w.setJobStatus(j, JobStatusTerminated, "cancelled"); err != nil {
+		t.Errorf("Failed job can't be terminated: %v", err)
+		return
+	}
+
+	if err := w.checkJobStatus(j, JobStatusCompleted); err == nil {
+		t.Errorf("Terminated job was permitted to complete")
+		return
+	}
+}
@@ -0,0 +1,974 @@
+package waitron
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"waitron/config"
+	"waitron/machine"
+
+	"github.com/flosch/pongo2"
+)
+
+const (
+	LintParse     = "parse"
+	LintInclude   = "include"
+	LintUndefined = "undefined"
+	LintRender    = "render"
+)
+
+/*
+	Something wrong with a template.  BuildTypes lists every build type the problem showed up with, when linting across build types.
+*/
+type LintIssue struct {
+	Template   string
+	Line       int `json:",omitempty"`
+	Column     int `json:",omitempty"`
+	Kind       string
+	Message    string
+	BuildTypes []string `json:",omitempty"`
+}
+
+func (i LintIssue) String() string {
+	s := i.Template
+	if i.Line > 0 {
+		s += fmt.Sprintf(":%d:%d", i.Line, i.Column)
+	}
+
+	s += fmt.Sprintf(": %s: %s", i.Kind, i.Message)
+
+	if len(i.BuildTypes) > 0 {
+		s += " (build types: " + strings.Join(i.BuildTypes, ", ") + ")"
+	}
+
+	return s
+}
+
+var (
+	lintBlocks = regexp.MustCompile(`(?s)\{\{(.*?)\}\}|\{%-?(.*?)-?%\}|\{#.*?#\}`)
+
+	lintKeywords = map[string]bool{
+		"and": true, "or": true, "not": true, "in": true, "is": true,
+		"true": true, "false": true, "True": true, "False": true, "None": true, "nil": true,
+		"as": true, "with": true, "only": true, "if_exists": true, "reversed": true, "sorted": true,
+		"silent": true, "fake": true, "on": true, "off": true,
+	}
+
+	// Tags whose arguments are names rather than variables, or that wrap content that isn't a template.
+	lintSkippedTags = map[string]bool{
+		"block": true, "filter": true, "autoescape": true, "lorem": true, "templatetag": true, "ssi": true,
+		"else": true, "empty": true, "comment": true, "verbatim": true, "spaceless": true,
+	}
+
+	lintGuardFilters = map[string]bool{"default": true, "default_if_none": true}
+)
+
+/*
+	What the linter knows about a value.  If v is valid, the actual value is known.
+	Otherwise, only its type is.  If neither is, anything goes.
+*/
+type lintValue struct {
+	v reflect.Value
+	t reflect.Type
+}
+
+func (lv lintValue) known() bool {
+	return lv.v.IsValid() || lv.t != nil
+}
+
+func lintValueOf(i interface{}) lintValue {
+	if i == nil {
+		return lintValue{}
+	}
+
+	v := reflect.ValueOf(i)
+	return lintValue{v: v, t: v.Type()}
+}
+
+/*
+	Follows pointers and interfaces as far as they go.  A nil pointer still has a type to check against.
+*/
+func (lv lintValue) deref() lintValue {
+	for lv.v.IsValid() {
+		switch lv.v.Kind() {
+		case reflect.Ptr:
+			if lv.v.IsNil() {
+				return lintValue{t: lv.v.Type().Elem()}.deref()
+			}
+			lv.v = lv.v.Elem()
+		case reflect.Interface:
+			if lv.v.IsNil() {
+				return lintValue{}
+			}
+			lv.v = lv.v.Elem()
+		default:
+			lv.t = lv.v.Type()
+			return lv
+		}
+		lv.t = lv.v.Type()
+	}
+
+	for lv.t != nil && lv.t.Kind() == reflect.Ptr {
+		lv.t = lv.t.Elem()
+	}
+
+	if lv.t != nil && lv.t.Kind() == reflect.Interface {
+		return lintValue{}
+	}
+
+	return lv
+}
+
+/*
+	Resolves a single part of a variable the same way pongo2 does.
+	Returns a reason if the part can't possibly resolve to something.  Missing map keys are fine if guarded.
+*/
+func (lv lintValue) part(p string, guarded bool) (lintValue, string) {
+
+	// pongo2 looks for methods before following pointers.
+	if lv.v.IsValid() && lv.v.MethodByName(p).IsValid() {
+		return lintValue{}, ""
+	}
+	if lv.t != nil {
+		if _, found := lv.t.MethodByName(p); found {
+			return lintValue{}, ""
+		}
+	}
+
+	lv = lv.deref()
+	if !lv.known() {
+		return lv, ""
+	}
+
+	idx, err := strconv.Atoi(p)
+	isIndex := err == nil
+
+	switch lv.t.Kind() {
+	case reflect.Struct:
+		if isIndex {
+			break
+		}
+
+		sf, found := lv.t.FieldByName(p)
+		if !found {
+			return lv, fmt.Sprintf("%s has no field %s", lv.t, p)
+		}
+
+		if lv.v.IsValid() {
+			return lintValue{v: lv.v.FieldByIndex(sf.Index), t: sf.Type}, ""
+		}
+		return lintValue{t: sf.Type}, ""
+
+	case reflect.Map:
+		if lv.t.Key().Kind() != reflect.String {
+			return lintValue{}, ""
+		}
+
+		if !lv.v.IsValid() {
+			return lintValue{t: lv.t.Elem()}, ""
+		}
+
+		mv := lv.v.MapIndex(reflect.ValueOf(p).Convert(lv.t.Key()))
+		if !mv.IsValid() {
+			if guarded {
+				return lintValue{}, ""
+			}
+			return lv, "no such key"
+		}
+
+		return lintValue{v: mv, t: mv.Type()}, ""
+
+	case reflect.Slice, reflect.Array:
+		if !isIndex {
+			break
+		}
+
+		// Past the end is just empty to pongo2, but the type is still worth checking against.
+		if lv.v.IsValid() && idx >= 0 && idx < lv.v.Len() {
+			ev := lv.v.Index(idx)
+			return lintValue{v: ev, t: ev.Type()}, ""
+		}
+		return lintValue{t: lv.t.Elem()}, ""
+
+	case reflect.String:
+		if isIndex {
+			return lintValue{}, ""
+		}
+	}
+
+	return lv, fmt.Sprintf("can't look up %s on %s", p, lv.t.Kind())
+}
+
+/*
+	A reference to a variable found in a template, e.g., machine.Network.0.Name
+*/
+type lintRef struct {
+	parts   []string
+	offset  int
+	guarded bool // Missing map keys are expected, like in {% if machine.Params.x %} or {{ machine.Params.x|default:"y" }}
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+func skipSpace(s string, i int) int {
+	for i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n' || s[i] == '\r') {
+		i++
+	}
+	return i
+}
+
+/*
+	Pulls all variable references out of an expression.  Names that get assigned to, like the "a" in "with a=b", are returned separately.
+	It's not a parser, but it doesn't need to be.
+*/
+func lintExpressionRefs(expr string, offset int, guarded bool) ([]lintRef, []string) {
+	refs := []lintRef{}
+	assigned := []string{}
+
+	prev := byte(0)
+
+	for i := 0; i < len(expr); {
+		c := expr[i]
+
+		switch {
+		case c == '"' || c == '\'':
+			i++
+			for i < len(expr) && expr[i] != c {
+				if expr[i] == '\\' {
+					i++
+				}
+				i++
+			}
+			i++
+			prev = c
+
+		case c >= '0' && c <= '9':
+			for i < len(expr) && (isIdentChar(expr[i]) || expr[i] == '.') {
+				i++
+			}
+			prev = '0'
+
+		case isIdentStart(c):
+			start := i
+			parts := []string{}
+
+			for {
+				j := i
+				for j < len(expr) && isIdentChar(expr[j]) {
+					j++
+				}
+				parts = append(parts, expr[i:j])
+				i = j
+
+				if i+1 < len(expr) && expr[i] == '.' && isIdentChar(expr[i+1]) {
+					i++
+					continue
+				}
+
+				// Subscripts, like x[0] or x["key"].
+				if i < len(expr) && expr[i] == '[' {
+					j = skipSpace(expr, i+1)
+					end := strings.IndexByte(expr[j:], ']')
+					if end < 0 {
+						break
+					}
+					key := strings.TrimSpace(expr[j : j+end])
+					key = strings.Trim(key, `"'`)
+					if key == "" {
+						break
+					}
+					parts = append(parts, key)
+					i = j + end + 1
+
+					if i+1 < len(expr) && expr[i] == '.' && isIdentChar(expr[i+1]) {
+						i++
+						continue
+					}
+				}
+
+				break
+			}
+
+			next := skipSpace(expr, i)
+			isAssignment := next < len(expr) && expr[next] == '=' && (next+1 >= len(expr) || expr[next+1] != '=')
+
+			switch {
+			case prev == '|':
+				// Filter name.
+			case isAssignment && len(parts) == 1:
+				assigned = append(assigned, parts[0])
+			case len(parts) == 1 && lintKeywords[parts[0]]:
+			default:
+				g := guarded
+				if next < len(expr) && expr[next] == '|' {
+					fs := skipSpace(expr, next+1)
+					f := fs
+					for f < len(expr) && isIdentChar(expr[f]) {
+						f++
+					}
+					g = g || lintGuardFilters[expr[fs:f]]
+				}
+				refs = append(refs, lintRef{parts: parts, offset: offset + start, guarded: g})
+			}
+			prev = 'a'
+
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		default:
+			prev = c
+			i++
+		}
+	}
+
+	return refs, assigned
+}
+
+/*
+	Splits a tag like "for x in y" into its name and arguments, along with where the arguments start.
+*/
+func lintTag(content string, offset int) (string, string, int) {
+	i := skipSpace(content, 0)
+	j := i
+	for j < len(content) && isIdentChar(content[j]) {
+		j++
+	}
+
+	return content[i:j], content[j:], offset + j
+}
+
+var (
+	lintWordRE  = regexp.MustCompile(`\b(in|as)\b`)
+	lintIdentRE = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
+	lintOnlyRE  = regexp.MustCompile(`\bonly\b`)
+)
+
+/*
+	Checks a template against a context without rendering it.
+	Everything referenced has to exist in the context, or have been set in the template by the time it's used.
+*/
+type templateLinter struct {
+	name   string
+	source string
+	loader *templateLoader // Where includes are looked for.  Includes aren't checked without one.
+
+	ctx    pongo2.Context
+	locals map[string]lintValue
+
+	visiting map[string]bool // Files being linted further up the chain of includes, so a template including itself doesn't go on forever.
+	included map[string]bool // Every template that was included or extended along the way, if anyone wants to know.
+
+	issues []LintIssue
+}
+
+func newTemplateLinter(name string, source string, loader *templateLoader, ctx pongo2.Context, included map[string]bool) *templateLinter {
+	tl := &templateLinter{
+		name:     name,
+		source:   source,
+		loader:   loader,
+		ctx:      ctx,
+		locals:   make(map[string]lintValue),
+		visiting: make(map[string]bool),
+		included: included,
+	}
+
+	if loader != nil {
+		if file, err := loader.resolve(name); err == nil {
+			tl.visiting[file] = true
+		}
+	}
+
+	return tl
+}
+
+func (tl *templateLinter) position(offset int) (int, int) {
+	before := tl.source[:offset]
+	line := strings.Count(before, "\n") + 1
+	col := offset - strings.LastIndex(before, "\n")
+
+	return line, col
+}
+
+func (tl *templateLinter) add(offset int, kind string, msg string) {
+	line, col := tl.position(offset)
+	tl.issues = append(tl.issues, LintIssue{Template: tl.name, Line: line, Column: col, Kind: kind, Message: msg})
+}
+
+/*
+	Resolves a reference against the context and locals, adding an issue if it can't be resolved.
+*/
+func (tl *templateLinter) resolve(r lintRef) lintValue {
+	lv, found := tl.locals[r.parts[0]]
+	if !found {
+		var v interface{}
+		if v, found = tl.ctx[r.parts[0]]; !found {
+			tl.add(r.offset, LintUndefined, fmt.Sprintf("'%s' is undefined", r.parts[0]))
+			return lintValue{}
+		}
+		lv = lintValueOf(v)
+	}
+
+	for idx, p := range r.parts[1:] {
+		if !lv.known() {
+			return lv
+		}
+
+		var reason string
+		if lv, reason = lv.part(p, r.guarded); reason != "" {
+			tl.add(r.offset, LintUndefined, fmt.Sprintf("'%s' is undefined (%s)", strings.Join(r.parts[:idx+2], "."), reason))
+			return lintValue{}
+		}
+	}
+
+	return lv
+}
+
+func (tl *templateLinter) expression(expr string, offset int, guarded bool) []lintValue {
+	refs, assigned := lintExpressionRefs(expr, offset, guarded)
+
+	values := make([]lintValue, 0, len(refs))
+	for _, r := range refs {
+		values = append(values, tl.resolve(r))
+	}
+
+	for _, a := range assigned {
+		tl.locals[a] = lintValue{}
+	}
+
+	return values
+}
+
+/*
+	Returns the value of an expression if it's nothing but a single variable, so that names bound to it keep a type.
+*/
+func (tl *templateLinter) singleValue(expr string, offset int) lintValue {
+	values := tl.expression(expr, offset, false)
+
+	if strings.ContainsAny(expr, "|(+-*/%") || len(values) != 1 {
+		return lintValue{}
+	}
+
+	return values[0]
+}
+
+func (tl *templateLinter) include(args string, offset int) {
+	args = strings.TrimSpace(args)
+	if args == "" || (args[0] != '"' && args[0] != '\'') {
+		tl.expression(args, offset, false)
+		return
+	}
+
+	end := strings.IndexByte(args[1:], args[0])
+	if end < 0 {
+		return
+	}
+
+	file := args[1 : end+1]
+	rest := args[end+2:]
+
+	if !tl.exists(file) {
+		if !strings.Contains(rest, "if_exists") {
+			tl.add(offset, LintInclude, fmt.Sprintf("'%s' does not exist", file))
+		}
+		return
+	}
+
+	// The included template sees everything this one does, unless it's included with "only".
+	ctx := tl.ctx
+	locals := make(map[string]lintValue, len(tl.locals))
+
+	if lintOnlyRE.MatchString(rest) {
+		ctx = pongo2.Context{}
+	} else {
+		for k, v := range tl.locals {
+			locals[k] = v
+		}
+	}
+
+	// The names being passed in are only set for the included template.
+	if idx := strings.Index(rest, "with"); idx >= 0 {
+		refs, assigned := lintExpressionRefs(rest[idx+4:], offset, false)
+		for _, r := range refs {
+			tl.resolve(r)
+		}
+
+		for _, a := range assigned {
+			locals[a] = lintValue{}
+		}
+	}
+
+	tl.lintIncluded(file, ctx, locals)
+}
+
+/*
+	Lints an included, extended, or imported template with what it would be rendered with.
+*/
+func (tl *templateLinter) lintIncluded(file string, ctx pongo2.Context, locals map[string]lintValue) {
+	if tl.loader == nil {
+		return
+	}
+
+	name := tl.loader.Abs(tl.name, file)
+
+	if tl.included != nil {
+		tl.included[name] = true
+	}
+
+	// Problems reading or parsing it are found when it's rendered.
+	p, b, err := tl.loader.read(name)
+	if err != nil || tl.visiting[p] {
+		return
+	}
+
+	tl.visiting[p] = true
+	defer delete(tl.visiting, p)
+
+	child := &templateLinter{
+		name:     name,
+		source:   string(b),
+		loader:   tl.loader,
+		ctx:      ctx,
+		locals:   locals,
+		visiting: tl.visiting,
+		included: tl.included,
+	}
+
+	// A template included more than once only needs its problems reported once.
+	for _, i := range child.lint() {
+		found := false
+		for _, ei := range tl.issues {
+			if ei.Template == i.Template && ei.Line == i.Line && ei.Column == i.Column && ei.Kind == i.Kind && ei.Message == i.Message {
+				found = true
+			}
+		}
+
+		if !found {
+			tl.issues = append(tl.issues, i)
+		}
+	}
+}
+
+func (tl *templateLinter) exists(file string) bool {
+	if tl.loader == nil {
+		return true
+	}
+
+	_, err := tl.loader.resolve(tl.loader.Abs(tl.name, file))
+	return err == nil
+}
+
+/*
+	Binds the names of a "for" loop to the elements of what's being looped over.
+*/
+func (tl *templateLinter) forLoop(args string, offset int) {
+	loc := lintWordRE.FindStringIndex(args)
+	if loc == nil || args[loc[0]:loc[1]] != "in" {
+		tl.expression(args, offset, false)
+		return
+	}
+
+	names := strings.Split(args[:loc[0]], ",")
+	over := tl.singleValue(args[loc[1]:], offset+loc[1]).deref()
+
+	key, elem := lintValue{}, lintValue{}
+
+	if over.known() {
+		switch over.t.Kind() {
+		case reflect.Slice, reflect.Array:
+			if over.v.IsValid() && over.v.Len() > 0 {
+				ev := over.v.Index(0)
+				elem = lintValue{v: ev, t: ev.Type()}
+			} else {
+				elem = lintValue{t: over.t.Elem()}
+			}
+			key = elem
+		case reflect.Map:
+			key = lintValue{t: over.t.Key()}
+			elem = lintValue{t: over.t.Elem()}
+		}
+	}
+
+	tl.locals["forloop"] = lintValue{}
+
+	for idx, n := range names {
+		n = strings.TrimSpace(n)
+		switch {
+		case len(names) == 1:
+			tl.locals[n] = key
+		case idx == 0:
+			tl.locals[n] = key
+		default:
+			tl.locals[n] = elem
+		}
+	}
+}
+
+func (tl *templateLinter) tag(content string, offset int) {
+	name, args, argOffset := lintTag(content, offset)
+
+	switch {
+	case strings.HasPrefix(name, "end") || lintSkippedTags[name]:
+
+	case name == "if" || name == "elif" || name == "ifequal" || name == "ifnotequal":
+		tl.expression(args, argOffset, true)
+
+	case name == "for":
+		tl.forLoop(args, argOffset)
+
+	case name == "with" || name == "set":
+		loc := lintWordRE.FindStringIndex(args)
+		if name == "with" && loc != nil && args[loc[0]:loc[1]] == "as" {
+			v := tl.singleValue(args[:loc[0]], argOffset)
+			tl.locals[strings.TrimSpace(args[loc[1]:])] = v
+			return
+		}
+
+		// "set a = b" and "with a=b c=d" bind a and c.
+		if eq := strings.IndexByte(args, '='); name == "set" && eq > 0 {
+			v := tl.singleValue(args[eq+1:], argOffset+eq+1)
+			tl.locals[strings.TrimSpace(args[:eq])] = v
+			return
+		}
+
+		tl.expression(args, argOffset, false)
+
+	case name == "include" || name == "extends":
+		tl.include(args, argOffset)
+
+	case name == "import":
+		_, assigned := lintExpressionRefs(args, argOffset, false)
+		for _, a := range assigned {
+			tl.locals[a] = lintValue{}
+		}
+		for _, w := range lintIdentRE.FindAllString(args, -1) {
+			if !lintKeywords[w] {
+				tl.locals[w] = lintValue{}
+			}
+		}
+		tl.include(args, argOffset)
+
+	case name == "macro":
+		for _, w := range lintIdentRE.FindAllString(args, -1) {
+			tl.locals[w] = lintValue{}
+		}
+
+	case name == "cycle" || name == "now":
+		loc := lintWordRE.FindAllStringIndex(args, -1)
+		if len(loc) > 0 && args[loc[len(loc)-1][0]:loc[len(loc)-1][1]] == "as" {
+			last := loc[len(loc)-1]
+			fields := strings.Fields(args[last[1]:])
+			if len(fields) > 0 {
+				tl.locals[fields[0]] = lintValue{}
+			}
+			args = args[:last[0]]
+		}
+		tl.expression(args, argOffset, false)
+
+	default:
+		tl.expression(args, argOffset, false)
+	}
+}
+
+/*
+	Looks at every block in the template, in order, so that names are bound before they're used.
+	Anything between comment or verbatim tags is ignored.
+*/
+func (tl *templateLinter) lint() []LintIssue {
+	skipUntil := ""
+
+	for _, m := range lintBlocks.FindAllStringSubmatchIndex(tl.source, -1) {
+		if m[4] >= 0 {
+			content := tl.source[m[4]:m[5]]
+			name, _, _ := lintTag(content, m[4])
+
+			if skipUntil != "" {
+				if name == skipUntil {
+					skipUntil = ""
+				}
+				continue
+			}
+
+			if name == "comment" || name == "verbatim" {
+				skipUntil = "end" + name
+				continue
+			}
+
+			tl.tag(content, m[4])
+			continue
+		}
+
+		if skipUntil != "" {
+			continue
+		}
+
+		if m[2] >= 0 {
+			tl.expression(tl.source[m[2]:m[3]], m[2], false)
+		}
+	}
+
+	return tl.issues
+}
+
+/*
+	Checks template source against the context that it would be rendered with.
+*/
+func lintTemplateSource(name string, source string, loader *templateLoader, ctx pongo2.Context) []LintIssue {
+	return newTemplateLinter(name, source, loader, ctx, nil).lint()
+}
+
+/*
+	When strict_templates is on, anything that references something undefined fails to render instead of rendering as empty.
+	That goes for everything the template includes or extends, too.
+*/
+func (w *Waitron) checkStrict(name string, source string, loader *templateLoader, ctx pongo2.Context) error {
+	if !w.config.StrictTemplates {
+		return nil
+	}
+
+	issues := lintTemplateSource(name, source, loader, ctx)
+	if len(issues) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, 0, len(issues))
+	for _, i := range issues {
+		msgs = append(msgs, i.String())
+	}
+
+	return fmt.Errorf("strict_templates: %s", strings.Join(msgs, "; "))
+}
+
+/*
+	Used in place of secret() while linting, so that linting never needs real secrets.
+*/
+func lintSecret(p string) *pongo2.Value {
+	return pongo2.AsSafeValue("<secret:" + p + ">")
+}
+
+/*
+	A machine with a little of everything set, for linting templates without a real machine.
+*/
+func lintSampleMachine() *machine.Machine {
+	m, _ := machine.New("lint01.example.com")
+
+	m.IpmiAddressRaw = "192.0.2.250"
+	m.Network = []machine.Interface{
+		machine.Interface{
+			Name:       "eth0",
+			MacAddress: "de:ad:be:ef:00:01",
+			Addresses4: []machine.IPConfig{machine.IPConfig{IPAddress: "192.0.2.10", Netmask: "255.255.255.0", Cidr: "24"}},
+			Addresses6: []machine.IPConfig{machine.IPConfig{IPAddress: "2001:db8::10", Netmask: "ffff:ffff:ffff:ffff::", Cidr: "64"}},
+			Gateway4:   "192.0.2.1",
+			Gateway6:   "2001:db8::1",
+		},
+	}
+
+	return m
+}
+
+/*
+	Lints every template in templatepath, plus the cmdline and build commands, against every build type.
+	Templates are found through the same chain of override directories that a build would use, and problems are reported against the file that was actually used.
+	If hostname is empty, a sample machine is used, otherwise the machine is looked up just like it would be for a build.
+	The same problem showing up for several build types is only reported once.
+*/
+func (w *Waitron) LintTemplates(hostname string) ([]LintIssue, error) {
+
+	buildTypeNames := []string{""}
+	for name := range w.config.BuildTypes {
+		// _unknown_ builds never have a machine.
+		if name != "_unknown_" {
+			buildTypeNames = append(buildTypeNames, name)
+		}
+	}
+	sort.Strings(buildTypeNames)
+
+	issues := []LintIssue{}
+	seen := make(map[string]int)
+
+	add := func(bt string, found []LintIssue) {
+		if bt == "" {
+			bt = "default"
+		}
+
+		for _, i := range found {
+			k := fmt.Sprintf("%s:%d:%d:%s:%s", i.Template, i.Line, i.Column, i.Kind, i.Message)
+			if idx, ok := seen[k]; ok {
+				issues[idx].BuildTypes = append(issues[idx].BuildTypes, bt)
+				continue
+			}
+
+			i.BuildTypes = []string{bt}
+			seen[k] = len(issues)
+			issues = append(issues, i)
+		}
+	}
+
+	for _, bt := range buildTypeNames {
+		var m *machine.Machine
+		var err error
+
+		if hostname == "" {
+			m, err = w.mergeMachine(lintSampleMachine(), bt, nil)
+		} else {
+			m, err = w.GetMergedMachine(hostname, "", bt, nil)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		j := &Job{Status: JobStatusPending, BuildTypeName: bt, Machine: m, Token: previewToken}
+
+		set, loader := w.templateSet(j)
+
+		names, err := loader.names()
+		if err != nil {
+			return nil, err
+		}
+
+		tplCtx := w.templateContext(j)
+		tplCtx["secret"] = lintSecret
+
+		included := make(map[string]bool)
+		byName := make(map[string][]LintIssue)
+
+		for _, name := range names {
+			byName[name] = w.lintTemplateFile(name, set, loader, tplCtx, included)
+		}
+
+		// Built-in templates are only linted for the build types that use them, and only if they haven't been overridden.
+		for _, name := range usedBuiltinTemplates(m) {
+			if file, err := loader.resolve(name); err == nil && strings.HasPrefix(file, builtinTemplatePath) {
+				names = append(names, name)
+				byName[name] = w.lintTemplateFile(name, set, loader, tplCtx, included)
+			}
+		}
+
+		cmdCtx := w.cmdlineContext(j)
+		cmdCtx["secret"] = lintSecret
+		other := lintString("cmdline", m.Cmdline, set, loader, cmdCtx, included)
+
+		bcCtx := w.buildCommandContext(j)
+		bcCtx["secret"] = lintSecret
+
+		for _, cl := range []struct {
+			name     string
+			commands []config.BuildCommand
+		}{
+			{"prebuild_commands", m.PreBuildCommands},
+			{"pxeevent_commands", m.PxeEventCommands},
+			{"postbuild_commands", m.PostBuildCommands},
+			{"cancelbuild_commands", m.CancelBuildCommands},
+			{"stalebuild_commands", m.StaleBuildCommands},
+		} {
+			for idx, bc := range cl.commands {
+				other = append(other, lintString(fmt.Sprintf("%s[%d]", cl.name, idx), bc.Command, set, loader, bcCtx, included)...)
+			}
+		}
+
+		/*
+			Partials usually rely on names set by whatever includes them, like loop variables or "with", so on their own,
+			they'd be full of undefined names.  They're linted through the templates that include them instead,
+			and on their own, only whether they parse matters.
+		*/
+		for _, name := range names {
+			found := byName[name]
+
+			if included[name] {
+				found = make([]LintIssue, 0)
+				for _, i := range byName[name] {
+					if i.Kind == LintParse {
+						found = append(found, i)
+					}
+				}
+			}
+
+			add(bt, found)
+		}
+
+		add(bt, other)
+	}
+
+	return issues, nil
+}
+
+/*
+	Overrides are reported as the file that was used, e.g., build_types/rescue/preseed.j2
+*/
+func lintReportedName(loader *templateLoader, name string) string {
+	file, err := loader.resolve(name)
+	if err != nil {
+		return name
+	}
+
+	if strings.HasPrefix(file, builtinTemplatePath) {
+		return file
+	}
+
+	if rel, err := filepath.Rel(loader.root, file); err == nil {
+		return filepath.ToSlash(rel)
+	}
+
+	return name
+}
+
+func (w *Waitron) lintTemplateFile(name string, set *pongo2.TemplateSet, loader *templateLoader, ctx pongo2.Context, included map[string]bool) []LintIssue {
+	_, b, err := loader.read(name)
+	if err != nil {
+		return []LintIssue{LintIssue{Template: name, Kind: LintParse, Message: err.Error()}}
+	}
+
+	issues := newTemplateLinter(name, string(b), loader, ctx, included).lint()
+
+	tpl, err := set.FromFile(name)
+	if err != nil {
+		issues = append(issues, lintPongoIssue(name, LintParse, err))
+	} else if _, err = tpl.Execute(ctx); err != nil {
+		issues = append(issues, lintPongoIssue(name, LintRender, err))
+	}
+
+	// Problems in what it includes are reported against the files they're in.
+	for idx := range issues {
+		issues[idx].Template = lintReportedName(loader, issues[idx].Template)
+	}
+
+	return issues
+}
+
+func lintString(name string, source string, set *pongo2.TemplateSet, loader *templateLoader, ctx pongo2.Context, included map[string]bool) []LintIssue {
+	issues := newTemplateLinter("", source, loader, ctx, included).lint()
+
+	tpl, err := set.FromString(source)
+	if err != nil {
+		issues = append(issues, lintPongoIssue(name, LintParse, err))
+	} else if _, err = tpl.Execute(ctx); err != nil {
+		issues = append(issues, lintPongoIssue(name, LintRender, err))
+	}
+
+	for idx := range issues {
+		if issues[idx].Template == "" {
+			issues[idx].Template = name
+		} else {
+			issues[idx].Template = lintReportedName(loader, issues[idx].Template)
+		}
+	}
+
+	return issues
+}
+
+func lintPongoIssue(name string, kind string, err error) LintIssue {
+	re := newRenderError(name, err)
+	return LintIssue{Template: name, Line: re.Line, Column: re.Column, Kind: kind, Message: re.Error}
+}
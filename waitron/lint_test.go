@@ -0,0 +1,228 @@
+package waitron
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"waitron/config"
+	"waitron/machine"
+
+	"github.com/flosch/pongo2"
+)
+
+func TestLintTemplateSource(t *testing.T) {
+	m := lintSampleMachine()
+	m.Params = map[string]string{"nameservers": "8.8.8.8"}
+
+	j := &Job{Machine: m, Token: previewToken}
+
+	w := New(&config.Config{})
+	ctx := w.templateContext(j)
+
+	tests := []struct {
+		name   string
+		source string
+		issues []string
+	}{
+		{"clean", `{{ machine.Hostname }} {{ machine.Params.nameservers }} {{ Token }} {{ secret("a/b") }}`, nil},
+		{"typo in params", "line\n  {{ machine.Params.nameserver }}", []string{"2:6 'machine.Params.nameserver' is undefined (no such key)"}},
+		{"typo in field", `{{ machine.Hostnme }}`, []string{"1:4 'machine.Hostnme' is undefined (machine.Machine has no field Hostnme)"}},
+		{"undefined variable", `{{ nope|upper }}`, []string{"1:4 'nope' is undefined"}},
+		{"guarded by default", `{{ machine.Params.nope | default:"x" }}{{ machine.Params.a|default: machine.Params.b|default:"c" }}`, nil},
+		{"guarded by if", `{% if machine.Params.nope %}{{ machine.Params.nope }}{% endif %}`, []string{"1:32 'machine.Params.nope' is undefined (no such key)"}},
+		{"if still checks fields", `{% if machine.Parms.nope %}{% endif %}`, []string{"1:7 'machine.Parms' is undefined (machine.Machine has no field Parms)"}},
+		{"for loop over machine", `{% for i in machine.Network %}{{ i.Name }}{{ i.Addresses4.0.Cidr }}{{ i.Nmae }}{{ forloop.Counter }}{% endfor %}`, []string{"1:71 'i.Nmae' is undefined (machine.Interface has no field Nmae)"}},
+		{"for loop over nothing", `{% for i in machine.Network.5.Addresses6 %}{{ i.IPAddress }}{{ i.Ip }}{% endfor %}`, []string{"1:64 'i.Ip' is undefined (machine.IPConfig has no field Ip)"}},
+		{"with and set", `{% with cc = machine.Params.nameservers|upper %}{{ cc.x }}{% endwith %}{% with machine.Network.0 as n %}{{ n.Name }}{{ n.Nope }}{% endwith %}{% set x = 1 %}{{ x }}`, []string{"1:120 'n.Nope' is undefined (machine.Interface has no field Nope)"}},
+		{"strings and numbers", `{{ "machine.Nope" }}{{ 1.5 }}{% if "x" in machine.Network.0.Tags and not False %}{% endif %}`, nil},
+		{"comments", `{# {{ nope }} #}{% comment %}{{ nope }}{% endcomment %}`, nil},
+		{"missing include", `{% include "nope.j2" %}{% include "nope.j2" if_exists %}`, []string{"1:11 'nope.j2' does not exist"}},
+		{"pointers", `{{ job.Machine.Hostname }}{{ job.Machine.Nope }}`, []string{"1:30 'job.Machine.Nope' is undefined (machine.Machine has no field Nope)"}},
+	}
+
+	for _, test := range tests {
+		issues := lintTemplateSource(test.name, test.source, newTemplateLoader("", "", "", ""), ctx)
+
+		got := []string{}
+		for _, i := range issues {
+			got = append(got, fmt.Sprintf("%d:%d %s", i.Line, i.Column, i.Message))
+		}
+
+		if strings.Join(got, "|") != strings.Join(test.issues, "|") {
+			t.Errorf("%s: unexpected issues %q, expected %q", test.name, got, test.issues)
+		}
+	}
+}
+
+func TestLintTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-templates")
+	if err != nil {
+		t.Errorf("Failed to create template dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.Mkdir(path.Join(dir, "parts"), 0755); err != nil {
+		t.Errorf("Failed to create template dir: %v", err)
+		return
+	}
+
+	for name, content := range map[string]string{
+		"preseed.j2":       "{{ machine.Params.mirror }}\n{% include \"parts/disks.j2\" %}",
+		"parts/disks.j2":   "{{ machine.Hostname }}",
+		"loop.j2":          "{% for i in machine.Network %}{% include \"parts/nic.j2\" with dev=i.Name %}{% endfor %}{{ dev }}",
+		"parts/nic.j2":     "{{ i.MacAddress }} {{ dev }} {{ machine.Params.nameservr }}",
+		"broken.j2":        "{% if %}",
+		"missing_inc.j2":   "{% include \"parts/nope.j2\" %}",
+		"bad_filter.j2":    "{{ machine.Hostname|nth_host:\"1\" }}",
+		"secret_params.j2": "{{ secret(\"a/b\") }}",
+	} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Errorf("Failed to write template: %v", err)
+			return
+		}
+	}
+
+	w := New(&config.Config{
+		TemplatePath: dir,
+		BuildType:    config.BuildType{Cmdline: "{{ Hostname }}", PreBuildCommands: []config.BuildCommand{{Command: "{{ machine.Nope }}"}}},
+		BuildTypes: map[string]config.BuildType{
+			"mirrored":  config.BuildType{Params: map[string]string{"mirror": "http://mirror"}},
+			"_unknown_": config.BuildType{Cmdline: "{{ MAC }}"},
+		},
+	})
+
+	issues, err := w.LintTemplates("")
+	if err != nil {
+		t.Errorf("Failed to lint: %v", err)
+		return
+	}
+
+	got := []string{}
+	for _, i := range issues {
+		got = append(got, fmt.Sprintf("%s %s %s", i.Template, i.Kind, strings.Join(i.BuildTypes, ",")))
+	}
+
+	expected := []string{
+		"bad_filter.j2 render default,mirrored",
+		"broken.j2 parse default,mirrored",
+		"parts/nic.j2 undefined default,mirrored",
+		"loop.j2 undefined default,mirrored",
+		"missing_inc.j2 include default,mirrored",
+		"missing_inc.j2 parse default,mirrored",
+		"preseed.j2 undefined default",
+		"prebuild_commands[0] undefined default,mirrored",
+	}
+
+	if strings.Join(got, "|") != strings.Join(expected, "|") {
+		t.Errorf("Unexpected lint issues:\n%s", strings.Join(got, "\n"))
+	}
+}
+
+func TestStrictTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-templates")
+	if err != nil {
+		t.Errorf("Failed to create template dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(path.Join(dir, "preseed.j2"), []byte("mirror={{ machine.Params.mirorr }}"), 0644); err != nil {
+		t.Errorf("Failed to write template: %v", err)
+		return
+	}
+
+	for _, strict := range []bool{false, true} {
+		w := New(&config.Config{TemplatePath: dir, StrictTemplates: strict})
+
+		m := &machine.Machine{Hostname: "test01.prod"}
+		m.Preseed = "preseed.j2"
+		m.Params = map[string]string{"mirror": "http://mirror"}
+
+		j := &Job{Status: JobStatusPending, Machine: m, Token: "test"}
+
+		if err := w.addJob(j, j.Token, m.Hostname, []string{"deadbeef"}, false); err != nil {
+			t.Errorf("Failed to add job: %v", err)
+			return
+		}
+
+		s, err := w.RenderStageTemplate("test", "preseed")
+
+		if !strict && (err != nil || s != "mirror=") {
+			t.Errorf("Unexpected render without strict_templates: err(%v) result(%s)", err, s)
+		}
+
+		if strict && (err == nil || !strings.Contains(err.Error(), "machine.Params.mirorr")) {
+			t.Errorf("Unexpected render with strict_templates: err(%v) result(%s)", err, s)
+		}
+	}
+}
+
+func TestStrictTemplateIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-templates")
+	if err != nil {
+		t.Errorf("Failed to create template dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"good.j2":     "a {% include \"good_dns.j2\" with server=\"1.1.1.1\" %}",
+		"good_dns.j2": "{{ machine.Params.nameserver }} {{ server }}",
+		"bad.j2":      "{% extends \"base.j2\" %}",
+		"base.j2":     "a {% include \"bad_dns.j2\" with server=\"1.1.1.1\" %}",
+		"bad_dns.j2":  "{{ machine.Params.nameservr }} {{ server }}",
+		"loop_a.j2":   "{% include \"loop_b.j2\" %}",
+		"loop_b.j2":   "{{ nope }}{% include \"loop_a.j2\" %}",
+	} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Errorf("Failed to write template: %v", err)
+			return
+		}
+	}
+
+	w := New(&config.Config{TemplatePath: dir, StrictTemplates: true})
+
+	tests := []struct {
+		template string
+		expected string
+		err      string
+	}{
+		{template: "good.j2", expected: "a 8.8.8.8 1.1.1.1"},
+		// Undefined names are just as undefined in whatever a template includes or extends.
+		{template: "bad.j2", err: "bad_dns.j2:1:4: undefined: 'machine.Params.nameservr'"},
+	}
+
+	for idx, test := range tests {
+		m := &machine.Machine{Hostname: fmt.Sprintf("test%02d.prod", idx)}
+		m.Preseed = test.template
+		m.Params = map[string]string{"nameserver": "8.8.8.8"}
+
+		j := &Job{Status: JobStatusPending, Machine: m, Token: m.Hostname}
+
+		if err := w.addJob(j, j.Token, m.Hostname, []string{fmt.Sprintf("deadbeef%04d", idx)}, false); err != nil {
+			t.Errorf("Failed to add job: %v", err)
+			return
+		}
+
+		s, err := w.RenderStageTemplate(j.Token, "preseed")
+
+		if test.err == "" && (err != nil || s != test.expected) {
+			t.Errorf("%s: expected '%s', got err(%v) result(%s)", test.template, test.expected, err, s)
+		}
+
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected an error with '%s', got err(%v) result(%s)", test.template, test.err, err, s)
+		}
+	}
+
+	// pongo2 can't render templates that include each other, but linting them shouldn't go on forever either.
+	issues := lintTemplateSource("loop_a.j2", "{% include \"loop_b.j2\" %}", newTemplateLoader(dir, "", "", ""), pongo2.Context{})
+	if len(issues) != 1 || issues[0].String() != "loop_b.j2:1:4: undefined: 'nope' is undefined" {
+		t.Errorf("Unexpected lint issues for templates that include each other: %v", issues)
+	}
+}
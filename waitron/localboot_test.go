@@ -0,0 +1,109 @@
+package waitron
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+func TestLocalBoot(t *testing.T) {
+	w := New(&config.Config{
+		BuildTypes: map[string]config.BuildType{
+			"_unknown_": config.BuildType{ImageURL: "unknown.com", Kernel: "register"},
+		},
+	})
+
+	m := &machine.Machine{Hostname: "test01.prod"}
+	m.ImageURL = "image.com"
+	m.Kernel = "popcorn"
+	m.PxeServeLimit = 2
+	m.LocalBootGraceSeconds = 60
+	m.Network = []machine.Interface{machine.Interface{MacAddress: "deadbeef0001"}, machine.Interface{MacAddress: "deadbeef0002"}}
+
+	j := &Job{Start: time.Now(), Status: JobStatusPending, Machine: m, Token: "test"}
+
+	if err := w.addJob(j, j.Token, m.Hostname, []string{"deadbeef0001", "deadbeef0002"}, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	// Both NICs count against the same limit.
+	for _, mac := range []string{"de:ad:be:ef:00:01", "de:ad:be:ef:00:02"} {
+		if c, err := w.GetPxeConfig(mac, ""); err != nil || c.Kernel != "image.com/popcorn" {
+			t.Errorf("Failed to get PXE config for %s: err(%v) %+v", mac, err, c)
+			return
+		}
+	}
+
+	if _, err := w.GetPxeConfig("de:ad:be:ef:00:01", ""); !errors.Is(err, ErrLocalBoot) {
+		t.Errorf("Expected a local boot past the serve limit, got %v", err)
+	}
+
+	if j.PxeServes != 2 || j.Status != JobStatusInstalling {
+		t.Errorf("Unexpected job after the serve limit: serves(%d) status(%s)", j.PxeServes, j.Status)
+	}
+
+	if err := w.FinishBuild(m.Hostname, j.Token); err != nil {
+		t.Errorf("Failed to finish build: %v", err)
+		return
+	}
+
+	// Recently built MACs boot locally instead of ending up in _unknown_.
+	if _, err := w.GetPxeConfig("de:ad:be:ef:00:02", ""); !errors.Is(err, ErrLocalBoot) {
+		t.Errorf("Expected a local boot in the grace window, got %v", err)
+	}
+
+	w.jobs.Lock()
+	w.jobs.localBootUntil["deadbeef0002"] = time.Now().Add(-time.Second)
+	w.jobs.Unlock()
+
+	if c, err := w.GetPxeConfig("de:ad:be:ef:00:02", ""); err != nil || c.Kernel != "unknown.com/register" {
+		t.Errorf("Expected _unknown_ after the grace window, got err(%v) %+v", err, c)
+	}
+
+	if _, found := w.jobs.localBootUntil["deadbeef0002"]; found {
+		t.Errorf("Expired grace window was kept")
+	}
+
+	// A new build for the machine takes its MACs back right away.
+	m.PxeServeLimit = 0
+	j = &Job{Start: time.Now(), Status: JobStatusPending, Machine: m, Token: "test2"}
+
+	if err := w.addJob(j, j.Token, m.Hostname, []string{"deadbeef0001", "deadbeef0002"}, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	if c, err := w.GetPxeConfig("de:ad:be:ef:00:01", ""); err != nil || c.Kernel != "image.com/popcorn" {
+		t.Errorf("Failed to get PXE config for a rebuild in the grace window: err(%v) %+v", err, c)
+	}
+}
+
+func TestPxeServeNotCountedOnFailedRender(t *testing.T) {
+	w := New(&config.Config{})
+
+	m := &machine.Machine{Hostname: "test01.prod"}
+	m.ImageURL = "image.com"
+	m.Kernel = "popcorn"
+	m.Cmdline = "console={{ broken"
+	m.PxeServeLimit = 1
+	m.Network = []machine.Interface{machine.Interface{MacAddress: "deadbeef0001"}}
+
+	j := &Job{Start: time.Now(), Status: JobStatusPending, Machine: m, Token: "test"}
+
+	if err := w.addJob(j, j.Token, m.Hostname, []string{"deadbeef0001"}, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	if _, err := w.GetPxeConfig("de:ad:be:ef:00:01", ""); err == nil || errors.Is(err, ErrLocalBoot) {
+		t.Errorf("Expected a failed render, got %v", err)
+	}
+
+	if j.PxeServes != 0 {
+		t.Errorf("A cmdline that didn't render used up a serve: serves(%d)", j.PxeServes)
+	}
+}
@@ -0,0 +1,582 @@
+package waitron
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"waitron/machine"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v2"
+)
+
+/*
+	The pieces of a netplan/cloud-init "version 2" network config that we know how to fill in from machine.Network.
+*/
+type netplanNameservers struct {
+	Addresses []string `yaml:"addresses,omitempty"`
+	Search    []string `yaml:"search,omitempty"`
+}
+
+type netplanBondParameters struct {
+	Mode               string `yaml:"mode,omitempty"`
+	MIIMonitorInterval int    `yaml:"mii-monitor-interval,omitempty"`
+}
+
+type netplanInterface struct {
+	Match       map[string]string      `yaml:"match,omitempty"`
+	SetName     string                 `yaml:"set-name,omitempty"`
+	ID          int                    `yaml:"id,omitempty"`
+	Link        string                 `yaml:"link,omitempty"`
+	Interfaces  []string               `yaml:"interfaces,omitempty"`
+	Parameters  *netplanBondParameters `yaml:"parameters,omitempty"`
+	DHCP4       bool                   `yaml:"dhcp4"`
+	DHCP6       bool                   `yaml:"dhcp6"`
+	AcceptRA    *bool                  `yaml:"accept-ra,omitempty"`
+	Addresses   []string               `yaml:"addresses,omitempty"`
+	Gateway4    string                 `yaml:"gateway4,omitempty"`
+	Gateway6    string                 `yaml:"gateway6,omitempty"`
+	Nameservers *netplanNameservers    `yaml:"nameservers,omitempty"`
+}
+
+type netplanNetwork struct {
+	Version   int                         `yaml:"version"`
+	Ethernets map[string]netplanInterface `yaml:"ethernets,omitempty"`
+	Bonds     map[string]netplanInterface `yaml:"bonds,omitempty"`
+	Vlans     map[string]netplanInterface `yaml:"vlans,omitempty"`
+}
+
+type netplanConfig struct {
+	Network netplanNetwork `yaml:"network"`
+}
+
+/*
+	Formats a MAC, however it was stored, as lower-case, colon-separated octets.
+	Job MACs are normalized down to bare hex, which is what most network configs don't want.
+*/
+func colonMAC(mac string) string {
+	mac = strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(mac))
+
+	if len(mac)%2 != 0 {
+		return mac
+	}
+
+	parts := make([]string, 0, len(mac)/2)
+	for i := 0; i < len(mac); i += 2 {
+		parts = append(parts, mac[i:i+2])
+	}
+
+	return strings.Join(parts, ":")
+}
+
+/*
+	Returns the address in address/prefix form, working out the prefix from the netmask if that's all we have.
+*/
+func ipConfigCIDR(ipc machine.IPConfig) string {
+	if ipc.Cidr != "" {
+		return ipc.IPAddress + "/" + ipc.Cidr
+	}
+
+	if mask := net.ParseIP(ipc.Netmask); mask != nil {
+		m := net.IPMask(mask.To16())
+		if v4 := mask.To4(); v4 != nil && net.ParseIP(ipc.IPAddress).To4() != nil {
+			m = net.IPMask(v4)
+		}
+
+		if ones, bits := m.Size(); bits != 0 {
+			return ipc.IPAddress + "/" + strconv.Itoa(ones)
+		}
+	}
+
+	return ipc.IPAddress
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+	Returns whatever follows the prefix in the first tag that has it, e.g., "bond0" from "bond:bond0".
+*/
+func tagValue(tags []string, prefix string) string {
+	for _, t := range tags {
+		if strings.HasPrefix(t, prefix) {
+			return strings.TrimPrefix(t, prefix)
+		}
+	}
+	return ""
+}
+
+/*
+	Interfaces named like "eno1.100" are treated as VLAN sub-interfaces of "eno1".
+	The VLAN ID comes from VlanID if it's set and from the name otherwise.
+*/
+func vlanParent(iface machine.Interface) (string, int, bool) {
+	idx := strings.LastIndex(iface.Name, ".")
+	if idx <= 0 {
+		return "", 0, false
+	}
+
+	id, err := strconv.Atoi(iface.Name[idx+1:])
+	if err != nil {
+		return "", 0, false
+	}
+
+	if iface.VlanID > 0 {
+		id = iface.VlanID
+	}
+
+	return iface.Name[:idx], id, true
+}
+
+const (
+	netDeviceEthernet = "ethernet"
+	netDeviceBond     = "bond"
+	netDeviceVlan     = "vlan"
+)
+
+const (
+	defaultBondMode = "active-backup"
+	bondMIIMonitor  = 100
+)
+
+/*
+	A single device to configure, worked out from machine.Network.
+	Every one of the config renderers works from these so that they can't disagree about what a machine looks like.
+*/
+type netDevice struct {
+	Name       string
+	Kind       string
+	MAC        string   // Colon-separated.  Devices without one are matched by name.
+	Addresses4 []string // In address/prefix form.
+	Addresses6 []string
+	Gateway4   string
+	Gateway6   string
+
+	Link   string // For VLANs, the device the VLAN sits on.
+	VlanID int
+
+	Bond     string   // For bond members, the bond they belong to.
+	Members  []string // For bonds.
+	BondMode string
+}
+
+func (d *netDevice) hasAddresses() bool {
+	return len(d.Addresses4) > 0 || len(d.Addresses6) > 0
+}
+
+type netConfig struct {
+	Devices     []*netDevice // Ethernets first, then bonds, then VLANs, so that everything comes after what it depends on.
+	Nameservers []string
+	Search      []string
+}
+
+/*
+	Works out every device that needs configuring for a machine.
+
+	Interfaces tagged waitron_ipmi are skipped.
+	Interfaces named like "eno1.100" are VLANs on "eno1".
+	Interfaces tagged "bond:<name>" are members of the bond <name>, which is created if there's no interface with that name.
+	The bond mode comes from a "bond_mode:<mode>" tag on the bond or on any of its members.
+	Interfaces with neither a MAC nor any addresses are skipped unless something else depends on them.
+
+	Nameservers come from the "nameservers" param, which can be separated by spaces or commas, and the domain is used as the search domain.
+*/
+func machineNetConfig(m *machine.Machine) netConfig {
+	nc := netConfig{
+		Nameservers: strings.FieldsFunc(m.Params["nameservers"], func(r rune) bool { return r == ' ' || r == ',' }),
+	}
+
+	if m.Domain != "" {
+		nc.Search = []string{m.Domain}
+	}
+
+	devices := make([]*netDevice, 0, len(m.Network))
+	byName := make(map[string]*netDevice)
+
+	for _, iface := range m.Network {
+		if hasTag(iface.Tags, "waitron_ipmi") || iface.Name == "" {
+			continue
+		}
+
+		if _, found := byName[iface.Name]; found {
+			continue
+		}
+
+		d := &netDevice{
+			Name:     iface.Name,
+			Kind:     netDeviceEthernet,
+			Gateway4: iface.Gateway4,
+			Gateway6: iface.Gateway6,
+			Bond:     tagValue(iface.Tags, "bond:"),
+			BondMode: tagValue(iface.Tags, "bond_mode:"),
+		}
+
+		if iface.MacAddress != "" {
+			d.MAC = colonMAC(iface.MacAddress)
+		}
+
+		for _, ipc := range iface.Addresses4 {
+			d.Addresses4 = append(d.Addresses4, ipConfigCIDR(ipc))
+		}
+
+		for _, ipc := range iface.Addresses6 {
+			d.Addresses6 = append(d.Addresses6, ipConfigCIDR(ipc))
+		}
+
+		if link, id, isVlan := vlanParent(iface); isVlan {
+			d.Kind = netDeviceVlan
+			d.Link = link
+			d.VlanID = id
+		}
+
+		devices = append(devices, d)
+		byName[d.Name] = d
+	}
+
+	// Anything that's depended on but wasn't in the list still needs to be configured.
+	depend := func(name string, kind string) *netDevice {
+		d, found := byName[name]
+		if !found {
+			d = &netDevice{Name: name, Kind: kind}
+			devices = append(devices, d)
+			byName[name] = d
+		}
+		return d
+	}
+
+	needed := make(map[string]bool)
+
+	for _, d := range devices {
+		if d.Bond == "" || d.Bond == d.Name || d.Kind != netDeviceEthernet {
+			d.Bond = ""
+			continue
+		}
+
+		b := depend(d.Bond, netDeviceBond)
+		b.Kind = netDeviceBond
+		b.Members = append(b.Members, d.Name)
+
+		if b.BondMode == "" {
+			b.BondMode = d.BondMode
+		}
+
+		needed[d.Name] = true
+		needed[b.Name] = true
+	}
+
+	for _, d := range devices {
+		if d.Kind == netDeviceVlan {
+			depend(d.Link, netDeviceEthernet)
+			needed[d.Link] = true
+		}
+	}
+
+	nc.Devices = make([]*netDevice, 0, len(devices))
+
+	for _, d := range devices {
+		if d.Kind == netDeviceBond && d.BondMode == "" {
+			d.BondMode = defaultBondMode
+		}
+
+		if d.Kind == netDeviceEthernet && d.MAC == "" && !d.hasAddresses() && !needed[d.Name] {
+			continue
+		}
+
+		nc.Devices = append(nc.Devices, d)
+	}
+
+	rank := map[string]int{netDeviceEthernet: 0, netDeviceBond: 1, netDeviceVlan: 2}
+
+	sort.SliceStable(nc.Devices, func(i, j int) bool {
+		return rank[nc.Devices[i].Kind] < rank[nc.Devices[j].Kind]
+	})
+
+	return nc
+}
+
+/*
+	Builds a version 2 network config, usable by both cloud-init and netplan, from the interfaces of a machine.
+*/
+func buildNetplanConfig(m *machine.Machine) netplanConfig {
+	cfg := netplanConfig{
+		Network: netplanNetwork{
+			Version:   2,
+			Ethernets: make(map[string]netplanInterface),
+			Bonds:     make(map[string]netplanInterface),
+			Vlans:     make(map[string]netplanInterface),
+		},
+	}
+
+	nc := machineNetConfig(m)
+
+	var nameservers *netplanNameservers
+	if len(nc.Nameservers) > 0 || len(nc.Search) > 0 {
+		nameservers = &netplanNameservers{Addresses: nc.Nameservers, Search: nc.Search}
+	}
+
+	acceptRA := false
+
+	for _, d := range nc.Devices {
+		ni := netplanInterface{
+			Addresses: append(append([]string{}, d.Addresses4...), d.Addresses6...),
+			Gateway4:  d.Gateway4,
+			Gateway6:  d.Gateway6,
+		}
+
+		if len(ni.Addresses) == 0 {
+			ni.Addresses = nil
+		} else {
+			ni.Nameservers = nameservers
+		}
+
+		// Statically configured v6 shouldn't also pick up addresses and routes from RAs.
+		if len(d.Addresses6) > 0 {
+			ni.AcceptRA = &acceptRA
+		}
+
+		switch d.Kind {
+		case netDeviceVlan:
+			ni.ID = d.VlanID
+			ni.Link = d.Link
+			cfg.Network.Vlans[d.Name] = ni
+		case netDeviceBond:
+			ni.Interfaces = d.Members
+			ni.Parameters = &netplanBondParameters{Mode: d.BondMode, MIIMonitorInterval: bondMIIMonitor}
+			cfg.Network.Bonds[d.Name] = ni
+		default:
+			if d.MAC != "" {
+				ni.Match = map[string]string{"macaddress": d.MAC}
+				ni.SetName = d.Name
+			}
+			cfg.Network.Ethernets[d.Name] = ni
+		}
+	}
+
+	return cfg
+}
+
+func renderNetplanConfig(m *machine.Machine) (string, error) {
+	b, err := yaml.Marshal(buildNetplanConfig(m))
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+type ifupdownStanza struct {
+	family  string
+	method  string
+	options []string
+}
+
+/*
+	Renders a Debian /etc/network/interfaces file for a machine.
+	ifupdown can't match interfaces by MAC, so MACs are only noted in comments, and the names need to already be right.
+	Each address gets its own stanza because older versions of ifupdown only allow one per stanza.
+*/
+func renderIfupdownConfig(m *machine.Machine) string {
+	nc := machineNetConfig(m)
+
+	var b strings.Builder
+
+	b.WriteString("auto lo\niface lo inet loopback\n")
+
+	for _, d := range nc.Devices {
+		stanzas := make([]ifupdownStanza, 0, len(d.Addresses4)+len(d.Addresses6)+1)
+
+		for idx, a := range d.Addresses4 {
+			st := ifupdownStanza{family: "inet", method: "static", options: []string{"address " + a}}
+			if idx == 0 && d.Gateway4 != "" {
+				st.options = append(st.options, "gateway "+d.Gateway4)
+			}
+			stanzas = append(stanzas, st)
+		}
+
+		for idx, a := range d.Addresses6 {
+			st := ifupdownStanza{family: "inet6", method: "static", options: []string{"address " + a}}
+			if idx == 0 {
+				if d.Gateway6 != "" {
+					st.options = append(st.options, "gateway "+d.Gateway6)
+				}
+				st.options = append(st.options, "accept_ra 0")
+			}
+			stanzas = append(stanzas, st)
+		}
+
+		if len(stanzas) == 0 {
+			stanzas = append(stanzas, ifupdownStanza{family: "inet", method: "manual"})
+		} else {
+			if len(nc.Nameservers) > 0 {
+				stanzas[0].options = append(stanzas[0].options, "dns-nameservers "+strings.Join(nc.Nameservers, " "))
+			}
+			if len(nc.Search) > 0 {
+				stanzas[0].options = append(stanzas[0].options, "dns-search "+strings.Join(nc.Search, " "))
+			}
+		}
+
+		switch {
+		case d.Kind == netDeviceVlan:
+			stanzas[0].options = append(stanzas[0].options, "vlan-raw-device "+d.Link)
+		case d.Kind == netDeviceBond:
+			stanzas[0].options = append(stanzas[0].options,
+				"bond-slaves "+strings.Join(d.Members, " "),
+				"bond-mode "+d.BondMode,
+				fmt.Sprintf("bond-miimon %d", bondMIIMonitor))
+		case d.Bond != "":
+			stanzas[0].options = append(stanzas[0].options, "bond-master "+d.Bond)
+		}
+
+		b.WriteString("\n")
+
+		if d.MAC != "" {
+			fmt.Fprintf(&b, "# %s\n", d.MAC)
+		}
+
+		fmt.Fprintf(&b, "auto %s\n", d.Name)
+
+		for _, st := range stanzas {
+			fmt.Fprintf(&b, "iface %s %s %s\n", d.Name, st.family, st.method)
+			for _, o := range st.options {
+				fmt.Fprintf(&b, "    %s\n", o)
+			}
+		}
+	}
+
+	return b.String()
+}
+
+/*
+	A generated config file and the name it should be saved as.
+*/
+type NetworkFile struct {
+	Name    string
+	Content string
+}
+
+/*
+	Connection UUIDs are derived from the hostname and device name so that they don't change every time the config is rendered.
+*/
+func nmConnectionUUID(m *machine.Machine, name string) string {
+	return uuid.NewSHA1(uuid.NameSpaceOID, []byte(m.Hostname+"/"+name)).String()
+}
+
+/*
+	Renders one NetworkManager keyfile per device of a machine.
+	The files belong in /etc/NetworkManager/system-connections/ and NetworkManager ignores them unless they're mode 0600.
+*/
+func renderNMKeyfiles(m *machine.Machine) []NetworkFile {
+	nc := machineNetConfig(m)
+
+	files := make([]NetworkFile, 0, len(nc.Devices))
+
+	for _, d := range nc.Devices {
+		var b strings.Builder
+
+		fmt.Fprintf(&b, "[connection]\nid=%s\nuuid=%s\ntype=%s\n", d.Name, nmConnectionUUID(m, d.Name), d.Kind)
+
+		// Ethernets with a MAC are matched by it since NetworkManager can't rename them.
+		if d.Kind != netDeviceEthernet || d.MAC == "" {
+			fmt.Fprintf(&b, "interface-name=%s\n", d.Name)
+		}
+
+		if d.Bond != "" {
+			fmt.Fprintf(&b, "master=%s\nslave-type=bond\n", d.Bond)
+		}
+
+		b.WriteString("autoconnect=true\n")
+
+		switch d.Kind {
+		case netDeviceVlan:
+			fmt.Fprintf(&b, "\n[vlan]\nid=%d\nparent=%s\n", d.VlanID, nmConnectionUUID(m, d.Link))
+		case netDeviceBond:
+			fmt.Fprintf(&b, "\n[bond]\nmode=%s\nmiimon=%d\n", d.BondMode, bondMIIMonitor)
+		default:
+			b.WriteString("\n[ethernet]\n")
+			if d.MAC != "" {
+				fmt.Fprintf(&b, "mac-address=%s\n", d.MAC)
+			}
+		}
+
+		// Bond members don't get any IP config of their own.
+		if d.Bond == "" {
+			writeNMIPSection(&b, "ipv4", "disabled", d.Addresses4, d.Gateway4, nc)
+			writeNMIPSection(&b, "ipv6", "ignore", d.Addresses6, d.Gateway6, nc)
+		}
+
+		files = append(files, NetworkFile{Name: d.Name + ".nmconnection", Content: b.String()})
+	}
+
+	return files
+}
+
+func writeNMIPSection(b *strings.Builder, section string, unconfigured string, addresses []string, gateway string, nc netConfig) {
+	fmt.Fprintf(b, "\n[%s]\n", section)
+
+	if len(addresses) == 0 {
+		fmt.Fprintf(b, "method=%s\n", unconfigured)
+		return
+	}
+
+	b.WriteString("method=manual\n")
+
+	for idx, a := range addresses {
+		if idx == 0 && gateway != "" {
+			a += "," + gateway
+		}
+		fmt.Fprintf(b, "address%d=%s\n", idx+1, a)
+	}
+
+	// Only the nameservers of the right family belong in each section.
+	dns := make([]string, 0, len(nc.Nameservers))
+	for _, ns := range nc.Nameservers {
+		if ip := net.ParseIP(ns); ip != nil && (ip.To4() != nil) == (section == "ipv4") {
+			dns = append(dns, ns+";")
+		}
+	}
+
+	if len(dns) > 0 {
+		fmt.Fprintf(b, "dns=%s\n", strings.Join(dns, ""))
+	}
+
+	if len(nc.Search) > 0 {
+		fmt.Fprintf(b, "dns-search=%s;\n", strings.Join(nc.Search, ";"))
+	}
+}
+
+/*
+	Returns the network config of the ACTIVE job specified by the hostname and token in the requested format:
+	"netplan", "interfaces" for ifupdown, or "networkmanager", which is a JSON list of keyfiles since there's one per device.
+*/
+func (w *Waitron) RenderNetworkConfig(hostname string, token string, format string) (string, error) {
+
+	j, _, err := w.getActiveJob(hostname, token)
+	if err != nil {
+		return "", err
+	}
+
+	switch format {
+	case "netplan":
+		return renderNetplanConfig(j.Machine)
+	case "interfaces":
+		return renderIfupdownConfig(j.Machine), nil
+	case "networkmanager":
+		b, err := json.Marshal(renderNMKeyfiles(j.Machine))
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+
+	return "", fmt.Errorf("network config format '%s': %w", format, ErrTemplateNotFound)
+}
@@ -0,0 +1,231 @@
+package waitron
+
+import (
+	"strings"
+	"testing"
+
+	"waitron/config"
+	"waitron/machine"
+
+	"github.com/flosch/pongo2"
+	"gopkg.in/yaml.v2"
+)
+
+func TestNetplanConfig(t *testing.T) {
+	m := &machine.Machine{Hostname: "test01.prod", Domain: "prod"}
+	m.Params = map[string]string{"nameservers": "192.0.2.53, 192.0.2.54"}
+	m.Network = []machine.Interface{
+		machine.Interface{
+			Name:       "eno1",
+			MacAddress: "DE:AD:BE:EF:00:01",
+			Addresses4: []machine.IPConfig{machine.IPConfig{IPAddress: "192.0.2.10", Netmask: "255.255.255.0"}},
+			Addresses6: []machine.IPConfig{machine.IPConfig{IPAddress: "2001:db8::10", Cidr: "64"}},
+			Gateway4:   "192.0.2.1",
+			Gateway6:   "2001:db8::1",
+		},
+		machine.Interface{
+			Name:       "eno2.100",
+			Addresses4: []machine.IPConfig{machine.IPConfig{IPAddress: "198.51.100.10", Cidr: "24"}},
+		},
+		machine.Interface{Name: "ipmi", MacAddress: "deadbeef0002", Tags: []string{"waitron_ipmi"}},
+		machine.Interface{Name: "eno3"},
+	}
+
+	cfg := buildNetplanConfig(m)
+
+	if len(cfg.Network.Ethernets) != 2 || len(cfg.Network.Vlans) != 1 {
+		t.Errorf("Unexpected interfaces in network config: %+v", cfg.Network)
+		return
+	}
+
+	eno1 := cfg.Network.Ethernets["eno1"]
+
+	if eno1.Match["macaddress"] != "de:ad:be:ef:00:01" || eno1.SetName != "eno1" {
+		t.Errorf("Interface not matched by MAC: %+v", eno1)
+		return
+	}
+
+	if len(eno1.Addresses) != 2 || eno1.Addresses[0] != "192.0.2.10/24" || eno1.Addresses[1] != "2001:db8::10/64" {
+		t.Errorf("Unexpected addresses: %v", eno1.Addresses)
+		return
+	}
+
+	if eno1.Gateway4 != "192.0.2.1" || eno1.Gateway6 != "2001:db8::1" || eno1.AcceptRA == nil || *eno1.AcceptRA {
+		t.Errorf("Unexpected gateways or accept-ra: %+v", eno1)
+		return
+	}
+
+	if eno1.Nameservers == nil || len(eno1.Nameservers.Addresses) != 2 || eno1.Nameservers.Search[0] != "prod" {
+		t.Errorf("Unexpected nameservers: %+v", eno1.Nameservers)
+		return
+	}
+
+	if _, found := cfg.Network.Ethernets["eno2"]; !found {
+		t.Errorf("VLAN parent missing from ethernets")
+		return
+	}
+
+	if vlan := cfg.Network.Vlans["eno2.100"]; vlan.ID != 100 || vlan.Link != "eno2" {
+		t.Errorf("Unexpected VLAN config: %+v", vlan)
+		return
+	}
+
+	s, err := renderNetplanConfig(m)
+	if err != nil || !strings.HasPrefix(s, "network:\n  version: 2\n") {
+		t.Errorf("Unexpected rendered network config: err(%v) config(%s)", err, s)
+		return
+	}
+}
+
+func bondedMachine() *machine.Machine {
+	m := &machine.Machine{Hostname: "test01.prod", Domain: "prod"}
+	m.Params = map[string]string{"nameservers": "192.0.2.53 2001:db8::53"}
+	m.Network = []machine.Interface{
+		machine.Interface{Name: "eno1", MacAddress: "deadbeef0001", Tags: []string{"bond:bond0", "bond_mode:802.3ad"}},
+		machine.Interface{Name: "eno2", MacAddress: "deadbeef0002", Tags: []string{"bond:bond0"}},
+		machine.Interface{Name: "bond0", Addresses4: []machine.IPConfig{machine.IPConfig{IPAddress: "192.0.2.10", Cidr: "24"}}, Gateway4: "192.0.2.1"},
+		machine.Interface{Name: "bond0.100", Addresses6: []machine.IPConfig{machine.IPConfig{IPAddress: "2001:db8::10", Cidr: "64"}}, Gateway6: "2001:db8::1"},
+	}
+	return m
+}
+
+func TestNetplanBonds(t *testing.T) {
+	cfg := buildNetplanConfig(bondedMachine())
+
+	bond, found := cfg.Network.Bonds["bond0"]
+	if !found || len(bond.Interfaces) != 2 || bond.Parameters == nil || bond.Parameters.Mode != "802.3ad" {
+		t.Errorf("Unexpected bond config: %+v", bond)
+		return
+	}
+
+	if len(bond.Addresses) != 1 || bond.Gateway4 != "192.0.2.1" {
+		t.Errorf("Bond missing its addresses: %+v", bond)
+		return
+	}
+
+	if eno1 := cfg.Network.Ethernets["eno1"]; len(eno1.Addresses) != 0 || eno1.Match["macaddress"] != "de:ad:be:ef:00:01" {
+		t.Errorf("Unexpected bond member config: %+v", eno1)
+		return
+	}
+
+	if vlan := cfg.Network.Vlans["bond0.100"]; vlan.Link != "bond0" || vlan.ID != 100 {
+		t.Errorf("Unexpected VLAN on bond config: %+v", vlan)
+		return
+	}
+}
+
+func TestIfupdownConfig(t *testing.T) {
+	s := renderIfupdownConfig(bondedMachine())
+
+	for _, expected := range []string{
+		"auto lo\niface lo inet loopback\n",
+		"# de:ad:be:ef:00:01\nauto eno1\niface eno1 inet manual\n    bond-master bond0\n",
+		"iface bond0 inet static\n    address 192.0.2.10/24\n    gateway 192.0.2.1\n    dns-nameservers 192.0.2.53 2001:db8::53\n    dns-search prod\n    bond-slaves eno1 eno2\n    bond-mode 802.3ad\n",
+		"iface bond0.100 inet6 static\n    address 2001:db8::10/64\n    gateway 2001:db8::1\n",
+		"    vlan-raw-device bond0\n",
+	} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("Missing %q from interfaces:\n%s", expected, s)
+			return
+		}
+	}
+}
+
+func TestNMKeyfiles(t *testing.T) {
+	m := bondedMachine()
+	files := renderNMKeyfiles(m)
+
+	if len(files) != 4 || files[2].Name != "bond0.nmconnection" {
+		t.Errorf("Unexpected keyfiles: %+v", files)
+		return
+	}
+
+	if !strings.Contains(files[0].Content, "master=bond0\nslave-type=bond\n") || strings.Contains(files[0].Content, "[ipv4]") {
+		t.Errorf("Unexpected bond member keyfile:\n%s", files[0].Content)
+		return
+	}
+
+	if !strings.Contains(files[2].Content, "address1=192.0.2.10/24,192.0.2.1\ndns=192.0.2.53;\n") {
+		t.Errorf("Unexpected bond keyfile:\n%s", files[2].Content)
+		return
+	}
+
+	// The VLAN refers to the bond by the same UUID every time.
+	if !strings.Contains(files[3].Content, "parent="+nmConnectionUUID(m, "bond0")+"\n") || nmConnectionUUID(m, "bond0") != nmConnectionUUID(bondedMachine(), "bond0") {
+		t.Errorf("Unexpected VLAN keyfile:\n%s", files[3].Content)
+		return
+	}
+}
+
+func TestNetworkFilters(t *testing.T) {
+	m := bondedMachine()
+
+	for tpl, expected := range map[string]string{
+		"{{ machine|netplan }}":                                       "mode: 802.3ad",
+		"{{ machine.Network|ifupdown }}":                              "bond-slaves eno1 eno2",
+		"{% for f in machine|nm_keyfiles %}{{ f.Name }} {% endfor %}": "eno1.nmconnection eno2.nmconnection bond0.nmconnection bond0.100.nmconnection ",
+	} {
+		s, err := pongo2.RenderTemplateString(tpl, pongo2.Context{"machine": m})
+		if err != nil || !strings.Contains(s, expected) {
+			t.Errorf("Unexpected result from %s: err(%v) result(%s)", tpl, err, s)
+			return
+		}
+	}
+
+	if _, err := pongo2.RenderTemplateString("{{ machine.Hostname|netplan }}", pongo2.Context{"machine": m}); err == nil {
+		t.Errorf("Rendered netplan from a string")
+		return
+	}
+}
+
+func TestRenderCloudInit(t *testing.T) {
+	w := New(&config.Config{})
+
+	m := &machine.Machine{Hostname: "test01.prod"}
+	m.Network = []machine.Interface{machine.Interface{Name: "eno1", MacAddress: "deadbeef0001"}}
+
+	j := &Job{Status: JobStatusInstalling, Machine: m, Token: "test"}
+
+	if err := w.addJob(j, j.Token, m.Hostname, []string{"deadbeef0001"}, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	s, err := w.RenderCloudInit("test01.prod", "test", "meta-data")
+	if err != nil {
+		t.Errorf("Failed to render meta-data: %v", err)
+		return
+	}
+
+	md := cloudInitMetaData{}
+	if err = yaml.Unmarshal([]byte(s), &md); err != nil || md.InstanceID != "test" || md.LocalHostname != "test01.prod" {
+		t.Errorf("Unexpected meta-data: err(%v) meta-data(%s)", err, s)
+		return
+	}
+
+	if s, err = w.RenderCloudInit("test01.prod", "test", "user-data"); err != nil || s != "#cloud-config\n" {
+		t.Errorf("Unexpected default user-data: err(%v) user-data(%s)", err, s)
+		return
+	}
+
+	if s, err = w.RenderCloudInit("test01.prod", "test", "network-config"); err != nil || !strings.Contains(s, "macaddress: de:ad:be:ef:00:01") {
+		t.Errorf("Unexpected network-config: err(%v) network-config(%s)", err, s)
+		return
+	}
+
+	if _, err = w.RenderCloudInit("test01.prod", "test", "nope"); err == nil {
+		t.Errorf("Rendered unknown cloud-init item")
+		return
+	}
+
+	if _, err = w.RenderCloudInit("test01.prod", "not-a-token", "meta-data"); err == nil {
+		t.Errorf("Rendered cloud-init item for unknown job")
+		return
+	}
+
+	// None of this should have moved the job along.
+	if j.Status != JobStatusInstalling {
+		t.Errorf("Rendering cloud-init items changed the job status to %s", j.Status)
+		return
+	}
+}
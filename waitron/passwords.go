@@ -0,0 +1,188 @@
+package waitron
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"fmt"
+	"strconv"
+
+	"waitron/yescrypt"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const cryptItoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const (
+	sha512CryptDefaultRounds = 5000
+	sha512CryptMaxSaltLen    = 16
+
+	// The same cost libxcrypt picks by default for new yescrypt hashes.
+	yescryptDefaultSetting = "$y$j9T$"
+)
+
+/*
+	Random salt, already in the crypt alphabet.
+*/
+func cryptSalt(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	for i := range b {
+		b[i] = cryptItoa64[b[i]&0x3f]
+	}
+
+	return string(b), nil
+}
+
+/*
+	SHA-512 based crypt, as described at https://www.akkadia.org/drepper/SHA-crypt.txt, and what "$6$" means in a shadow file.
+*/
+func sha512Crypt(key []byte, salt []byte, rounds int) string {
+	if len(salt) > sha512CryptMaxSaltLen {
+		salt = salt[:sha512CryptMaxSaltLen]
+	}
+
+	alt := sha512.New()
+	alt.Write(key)
+	alt.Write(salt)
+	alt.Write(key)
+	altSum := alt.Sum(nil)
+
+	a := sha512.New()
+	a.Write(key)
+	a.Write(salt)
+
+	i := len(key)
+	for ; i > sha512.Size; i -= sha512.Size {
+		a.Write(altSum)
+	}
+	a.Write(altSum[:i])
+
+	for i = len(key); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(altSum)
+		} else {
+			a.Write(key)
+		}
+	}
+
+	c := a.Sum(nil)
+
+	dp := sha512.New()
+	for i = 0; i < len(key); i++ {
+		dp.Write(key)
+	}
+	p := repeatTo(dp.Sum(nil), len(key))
+
+	ds := sha512.New()
+	for i = 0; i < 16+int(c[0]); i++ {
+		ds.Write(salt)
+	}
+	s := repeatTo(ds.Sum(nil), len(salt))
+
+	for i = 0; i < rounds; i++ {
+		h := sha512.New()
+
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+
+		if i%3 != 0 {
+			h.Write(s)
+		}
+
+		if i%7 != 0 {
+			h.Write(p)
+		}
+
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+
+		c = h.Sum(nil)
+	}
+
+	out := []byte("$6$")
+	if rounds != sha512CryptDefaultRounds {
+		out = append(out, "rounds="+strconv.Itoa(rounds)+"$"...)
+	}
+
+	out = append(out, salt...)
+	out = append(out, '$')
+
+	// The digest isn't encoded in order, but in groups of bytes i, i+21 and i+42, rotated a little more for each group.
+	for idx := 0; idx < 21; idx++ {
+		g := [3]int{idx, idx + 21, idx + 42}
+		r := idx % 3
+		out = appendCrypt64(out, uint32(c[g[r]])<<16|uint32(c[g[(r+1)%3]])<<8|uint32(c[g[(r+2)%3]]), 4)
+	}
+	out = appendCrypt64(out, uint32(c[63]), 2)
+
+	return string(out)
+}
+
+func repeatTo(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:minOf(len(b), n-len(out))]...)
+	}
+	return out
+}
+
+func minOf(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func appendCrypt64(out []byte, w uint32, n int) []byte {
+	for ; n > 0; n-- {
+		out = append(out, cryptItoa64[w&0x3f])
+		w >>= 6
+	}
+	return out
+}
+
+/*
+	Hashes a password with a new random salt.
+	sha512 and yescrypt are what installers and /etc/shadow want, and bcrypt is what cloud-init's hashed_passwd usually gets.
+*/
+func passwordHash(password string, scheme string) (string, error) {
+	switch scheme {
+	case "", "sha512", "sha512-crypt":
+		salt, err := cryptSalt(sha512CryptMaxSaltLen)
+		if err != nil {
+			return "", err
+		}
+		return sha512Crypt([]byte(password), []byte(salt), sha512CryptDefaultRounds), nil
+
+	case "yescrypt":
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+
+		h, err := yescrypt.Hash([]byte(password), append([]byte(yescryptDefaultSetting), yescrypt.Encode64(b)...))
+		if err != nil {
+			return "", err
+		}
+		return string(h), nil
+
+	case "bcrypt":
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(h), nil
+	}
+
+	return "", fmt.Errorf("unknown password hash scheme '%s'", scheme)
+}
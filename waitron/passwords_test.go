@@ -0,0 +1,68 @@
+package waitron
+
+import (
+	"strings"
+	"testing"
+
+	"waitron/yescrypt"
+
+	"github.com/flosch/pongo2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordHashes(t *testing.T) {
+	// Expected hashes come from libxcrypt's crypt(3).
+	sha512Tests := []struct {
+		password string
+		salt     string
+		rounds   int
+		expected string
+	}{
+		{password: "Hello world!", salt: "saltstring", rounds: 5000, expected: "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{password: "", salt: "abc", rounds: 5000, expected: "$6$abc$mJP3a6FyA8uCnzRtlnNypPwjnvpi5TP9qOrInzrfDmwxUQG38PkpCPdqfTb8JQfAngapMxeim4AZ..hSdRRzD."},
+		{password: strings.Repeat("x", 200), salt: "0123456789abcdefXYZ", rounds: 1000, expected: "$6$rounds=1000$0123456789abcdef$7DmgiDLZCfTc6NxYO4iWOBhs6PBzow6c1u6u8MmeQAswA0NsU0JsYsJLzMjAva.9iZwhyXXKhuHVO6C9MB1bt1"},
+	}
+
+	for _, test := range sha512Tests {
+		if h := sha512Crypt([]byte(test.password), []byte(test.salt), test.rounds); h != test.expected {
+			t.Errorf("Unexpected sha512-crypt hash for '%s': %s", test.password, h)
+		}
+	}
+
+	yescryptTests := []struct {
+		password string
+		setting  string
+		expected string
+	}{
+		{password: "password", setting: "$y$j9T$saltsalt$", expected: "$y$j9T$saltsalt$0ZRt7zd0gn9pQsq3yDeuwj9hFSoqeo/y42wyzM0m.d0"},
+		{password: "correct horse", setting: "$y$j9T$abcdefghijklmnopqrstu.", expected: "$y$j9T$abcdefghijklmnopqrstu.$pk06PwnbQa631foWNYhw6N.E9wx6lICleH/SnT.xzi0"},
+	}
+
+	for _, test := range yescryptTests {
+		if h, err := yescrypt.Hash([]byte(test.password), []byte(test.setting)); err != nil || string(h) != test.expected {
+			t.Errorf("Unexpected yescrypt hash for '%s': err(%v) hash(%s)", test.password, err, h)
+		}
+	}
+
+	// The filter salts randomly, so check that its output verifies rather than what it is.
+	ctx := pongo2.Context{"pw": "s3cret"}
+
+	h, err := pongo2.RenderTemplateString(`{{ pw|password_hash }}`, ctx)
+	if parts := strings.Split(h, "$"); err != nil || len(parts) != 4 || sha512Crypt([]byte("s3cret"), []byte(parts[2]), 5000) != h {
+		t.Errorf("Unexpected sha512-crypt hash from filter: err(%v) hash(%s)", err, h)
+	}
+
+	h, err = pongo2.RenderTemplateString(`{{ pw|password_hash:"yescrypt" }}`, ctx)
+	if again, yerr := yescrypt.Hash([]byte("s3cret"), []byte(h)); err != nil || yerr != nil || string(again) != h || !strings.HasPrefix(h, "$y$j9T$") {
+		t.Errorf("Unexpected yescrypt hash from filter: err(%v) yerr(%v) hash(%s)", err, yerr, h)
+	}
+
+	h, err = pongo2.RenderTemplateString(`{{ pw|password_hash:"bcrypt" }}`, ctx)
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(h), []byte("s3cret")) != nil {
+		t.Errorf("Unexpected bcrypt hash from filter: err(%v) hash(%s)", err, h)
+	}
+
+	if _, err = pongo2.RenderTemplateString(`{{ pw|password_hash:"md5" }}`, ctx); err == nil {
+		t.Errorf("Hashed password with unknown scheme")
+	}
+}
@@ -0,0 +1,176 @@
+package waitron
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"waitron/config"
+
+	"github.com/flosch/pongo2"
+)
+
+// Handed to templates in place of a real job token during previews, so that previews are easy to diff.
+const previewToken = "00000000-0000-0000-0000-000000000000"
+
+/*
+	Where rendering something went wrong.  Line and Column are only known for errors that pongo2 can place.
+*/
+type RenderError struct {
+	Template string
+	Line     int    `json:",omitempty"`
+	Column   int    `json:",omitempty"`
+	Near     string `json:",omitempty"`
+	Error    string
+}
+
+func (e RenderError) String() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("%s line %d col %d: %s", e.Template, e.Line, e.Column, e.Error)
+	}
+	return fmt.Sprintf("%s: %s", e.Template, e.Error)
+}
+
+/*
+	Everything a build would render, without any of it actually happening.
+	Commands are keyed by the name of the command list in the config.
+*/
+type RenderPreview struct {
+	Hostname      string
+	BuildTypeName string
+	Template      string              `json:",omitempty"`
+	Cmdline       string              `json:",omitempty"`
+	Result        string              `json:",omitempty"`
+	Commands      map[string][]string `json:",omitempty"`
+	Errors        []RenderError       `json:",omitempty"`
+}
+
+func newRenderError(name string, err error) RenderError {
+	re := RenderError{Template: name, Error: err.Error()}
+
+	var pe *pongo2.Error
+	if errors.As(err, &pe) {
+		re.Line = pe.Line
+		re.Column = pe.Column
+
+		if pe.Token != nil {
+			re.Near = pe.Token.Val
+		}
+
+		if pe.OrigError != nil {
+			re.Error = pe.OrigError.Error()
+		}
+	}
+
+	return re
+}
+
+/*
+	Renders the cmdline, every build command list, and the named stage template for a machine as if a build had been requested,
+	but without creating a job, running commands, or changing anything.
+	"cmdline" can be used as the template name to skip rendering a stage template.
+
+	Rendering problems are collected in the Errors of the preview rather than returned, so that everything that can be rendered is.
+	Secrets are redacted from the results.
+*/
+func (w *Waitron) RenderPreview(templateName string, hostname string, buildTypeName string, machineDefinitionOverride []byte) (*RenderPreview, error) {
+
+	hostname = strings.ToLower(hostname)
+
+	j := &Job{
+		Start:         time.Now(),
+		Status:        JobStatusPending,
+		BuildTypeName: buildTypeName,
+		Token:         previewToken,
+		Log:           newJobLog(w.config.JobLogLines),
+	}
+
+	w.addJobLog(j, fmt.Sprintf("rendering preview of %s for %s", templateName, hostname), config.LogLevelInfo)
+
+	m, err := w.getMergedMachine(hostname, "", buildTypeName, machineDefinitionOverride, w.jobLogger(j))
+	if err != nil {
+		return nil, err
+	}
+
+	j.Machine = m
+
+	set, loader := w.templateSet(j)
+
+	st, found := config.StageTemplate{}, false
+	if templateName != "cmdline" {
+		if st, found = stageTemplate(m, templateName); !found {
+			return nil, fmt.Errorf("template '%s': %w", templateName, ErrTemplateNotFound)
+		}
+	}
+
+	p := &RenderPreview{
+		Hostname:      hostname,
+		BuildTypeName: buildTypeName,
+		Commands:      make(map[string][]string),
+	}
+
+	if s, err := w.renderPreviewString("cmdline", m.Cmdline, set, loader, w.cmdlineContext(j)); err != nil {
+		p.Errors = append(p.Errors, newRenderError("cmdline", err))
+	} else {
+		p.Cmdline = s
+	}
+
+	commandLists := []struct {
+		name     string
+		commands []config.BuildCommand
+	}{
+		{"prebuild_commands", m.PreBuildCommands},
+		{"pxeevent_commands", m.PxeEventCommands},
+		{"postbuild_commands", m.PostBuildCommands},
+		{"cancelbuild_commands", m.CancelBuildCommands},
+		{"stalebuild_commands", m.StaleBuildCommands},
+	}
+
+	for _, cl := range commandLists {
+		for idx, bc := range cl.commands {
+			name := fmt.Sprintf("%s[%d]", cl.name, idx)
+
+			s, err := w.renderPreviewString(name, bc.Command, set, loader, w.buildCommandContext(j))
+			if err != nil {
+				p.Errors = append(p.Errors, newRenderError(name, err))
+				continue
+			}
+
+			p.Commands[cl.name] = append(p.Commands[cl.name], s)
+		}
+	}
+
+	if found {
+		p.Template = st.File
+
+		if s, err := w.renderTemplate(st.File, templateName, j); err != nil {
+			p.Errors = append(p.Errors, newRenderError(st.File, err))
+		} else {
+			p.Result = w.secrets.redact(s)
+		}
+	}
+
+	for idx := range p.Errors {
+		p.Errors[idx].Error = w.secrets.redact(p.Errors[idx].Error)
+	}
+
+	return p, nil
+}
+
+func (w *Waitron) renderPreviewString(name string, s string, set *pongo2.TemplateSet, loader *templateLoader, ctx pongo2.Context) (string, error) {
+	tpl, err := w.templateFromString(set, loader, name, s)
+	if err != nil {
+		return "", err
+	}
+
+	if err = w.checkStrict(name, s, loader, ctx); err != nil {
+		return "", err
+	}
+
+	if s, err = tpl.Execute(ctx); err != nil {
+		return "", err
+	}
+
+	return w.secrets.redact(s), nil
+}
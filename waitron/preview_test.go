@@ -0,0 +1,115 @@
+package waitron
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+type previewPlugin struct {
+}
+
+func (p *previewPlugin) Init() error {
+	return nil
+}
+
+func (p *previewPlugin) GetMachine(hostname string, mac string) (*machine.Machine, error) {
+	if hostname == "test01.prod" {
+		return &machine.Machine{Hostname: "test01.prod", ShortName: "test01"}, nil
+	}
+	return nil, nil
+}
+
+func (p *previewPlugin) PutMachine(m *machine.Machine) error {
+	return nil
+}
+
+func (p *previewPlugin) Deinit() error {
+	return nil
+}
+
+func TestRenderPreview(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-templates")
+	if err != nil {
+		t.Errorf("Failed to create template dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{"preseed.j2": "preseed {{ machine.ShortName }} {{ Token }}", "broken.j2": "line one\n{{ machine.Hostname }"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Errorf("Failed to write template: %v", err)
+			return
+		}
+	}
+
+	w := New(&config.Config{
+		TemplatePath: dir,
+		BuildType: config.BuildType{
+			Cmdline:          "hostname={{ Hostname }}",
+			Preseed:          "preseed.j2",
+			PreBuildCommands: []config.BuildCommand{{Command: "touch /tmp/{{ machine.ShortName }}"}},
+		},
+		BuildTypes: map[string]config.BuildType{
+			"broken": config.BuildType{
+				Cmdline:           "{% if %}",
+				Templates:         map[string]config.StageTemplate{"broken": {File: "broken.j2"}},
+				PostBuildCommands: []config.BuildCommand{{Command: "echo ok"}},
+			},
+		},
+	})
+
+	w.activePlugins = append(w.activePlugins, activePlugin{plugin: &previewPlugin{}, settings: &config.MachineInventoryPluginSettings{Name: "preview"}})
+
+	p, err := w.RenderPreview("preseed", "TEST01.prod", "", nil)
+	if err != nil {
+		t.Errorf("Failed to render preview: %v", err)
+		return
+	}
+
+	if p.Cmdline != "hostname=test01.prod" || p.Result != "preseed test01 "+previewToken || len(p.Errors) != 0 {
+		t.Errorf("Unexpected preview: %+v", p)
+		return
+	}
+
+	if c := p.Commands["prebuild_commands"]; len(c) != 1 || c[0] != "touch /tmp/test01" {
+		t.Errorf("Unexpected prebuild commands in preview: %v", c)
+		return
+	}
+
+	// Nothing about a preview should leave a job behind.
+	if _, found, _ := w.getActiveJob("test01.prod", ""); found {
+		t.Errorf("Preview created a job")
+		return
+	}
+
+	p, err = w.RenderPreview("broken", "test01.prod", "broken", []byte("shortname: override01"))
+	if err != nil {
+		t.Errorf("Failed to render preview with errors: %v", err)
+		return
+	}
+
+	if len(p.Errors) != 2 || p.Errors[0].Template != "cmdline" || p.Errors[1].Template != "broken.j2" || p.Errors[1].Line != 2 {
+		t.Errorf("Unexpected preview errors: %+v", p.Errors)
+		return
+	}
+
+	if c := p.Commands["postbuild_commands"]; len(c) != 1 || c[0] != "echo ok" {
+		t.Errorf("Commands were not rendered alongside errors: %v", p.Commands)
+		return
+	}
+
+	if _, err = w.RenderPreview("nope", "test01.prod", "", nil); !errors.Is(err, ErrTemplateNotFound) {
+		t.Errorf("Unexpected error for undeclared template: %v", err)
+		return
+	}
+
+	if p, err = w.RenderPreview("cmdline", "test01.prod", "", nil); err != nil || p.Template != "" || p.Cmdline == "" {
+		t.Errorf("Unexpected cmdline-only preview: err(%v) %+v", err, p)
+	}
+}
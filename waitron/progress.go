@@ -0,0 +1,56 @@
+package waitron
+
+import (
+	"fmt"
+	"time"
+
+	"waitron/config"
+)
+
+// How many progress reports are kept with a job.  Older reports are dropped first.
+const maxProgressEvents = 200
+
+type ProgressEvent struct {
+	Time    time.Time
+	Phase   string
+	Percent int
+	Message string
+}
+
+/*
+	Record a progress report from an installer against the ACTIVE job specified by the hostname and token.
+	If the machine was configured with progress_resets_stale_timer, the report also restarts the stale-build clock.
+*/
+func (w *Waitron) ReportProgress(hostname string, token string, p ProgressEvent) error {
+
+	j, _, err := w.getActiveJob(hostname, token)
+	if err != nil {
+		return err
+	}
+
+	if p.Percent < 0 || p.Percent > 100 {
+		return fmt.Errorf("progress percentage must be between 0 and 100, got %d", p.Percent)
+	}
+
+	if p.Phase == "" {
+		p.Phase = "progress"
+	}
+
+	p.Time = time.Now()
+
+	j.Lock()
+
+	j.Progress = append(j.Progress, p)
+	if len(j.Progress) > maxProgressEvents {
+		j.Progress = j.Progress[len(j.Progress)-maxProgressEvents:]
+	}
+
+	j.LastProgress = p.Time
+	j.StatusReason = fmt.Sprintf("%s (%d%%)", p.Phase, p.Percent)
+
+	j.Unlock()
+
+	w.addJobLog(j, fmt.Sprintf("progress reported for job %s: %s %d%% %s", j.Token, p.Phase, p.Percent, p.Message), config.LogLevelInfo)
+
+	return nil
+}
@@ -0,0 +1,196 @@
+package waitron
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"waitron/config"
+)
+
+type concurrencyLimit struct {
+	key   string
+	limit int
+}
+
+/*
+	Works out every concurrency limit from the config that applies to a job.
+	A limit of zero or less means no limit, so those are left out.
+*/
+func (w *Waitron) concurrencyLimitsForJob(j *Job) []concurrencyLimit {
+	c := w.config.BuildConcurrency
+
+	limits := make([]concurrencyLimit, 0, 2+len(c.PerGroup))
+
+	if c.Global > 0 {
+		limits = append(limits, concurrencyLimit{key: "global", limit: c.Global})
+	}
+
+	// A machine can select its own build type, and that's the one it will really be built with.
+	buildTypeName := j.BuildTypeName
+	if j.Machine.BuildTypeName != "" {
+		buildTypeName = j.Machine.BuildTypeName
+	}
+
+	if l := c.PerBuildType[buildTypeName]; l > 0 {
+		limits = append(limits, concurrencyLimit{key: "build_type:" + buildTypeName, limit: l})
+	}
+
+	for _, g := range c.PerGroup {
+		if g.Limit <= 0 {
+			continue
+		}
+
+		value := ""
+
+		switch {
+		case g.Key == "domain":
+			value = j.Machine.Domain
+		case strings.HasPrefix(g.Key, "params."):
+			value = j.Machine.Params[strings.TrimPrefix(g.Key, "params.")]
+		default:
+			w.addJobLog(j, fmt.Sprintf("ignoring unknown build concurrency group key '%s'", g.Key), config.LogLevelWarning)
+		}
+
+		// Machines without a value for the key aren't part of any group.
+		if value != "" {
+			limits = append(limits, concurrencyLimit{key: g.Key + "=" + value, limit: g.Limit})
+		}
+	}
+
+	return limits
+}
+
+/*
+	Counts active, non-queued, jobs for every concurrency key in use.
+	The jobs lock must be held by the caller.
+*/
+func (w *Waitron) activeJobCounts() map[string]int {
+	counts := make(map[string]int)
+
+	for _, j := range w.jobs.jobByToken {
+		// QueuePosition is only ever changed while holding the jobs lock.
+		if j.QueuePosition > 0 {
+			continue
+		}
+
+		for _, l := range j.concurrencyLimits {
+			counts[l.key]++
+		}
+	}
+
+	return counts
+}
+
+func fitsConcurrencyLimits(j *Job, counts map[string]int) bool {
+	for _, l := range j.concurrencyLimits {
+		if counts[l.key] >= l.limit {
+			return false
+		}
+	}
+
+	return true
+}
+
+/*
+	Decides whether a new, not yet added, job can start right away or needs to wait in the queue.
+	If it's queued, the transition is returned so that hooks can be told about it once the jobs lock is released.
+	The jobs lock must be held by the caller.
+*/
+func (w *Waitron) queueIfOverLimits(j *Job) *JobTransition {
+	j.concurrencyLimits = w.concurrencyLimitsForJob(j)
+
+	if len(j.concurrencyLimits) == 0 {
+		return nil
+	}
+
+	// Just like promotion, a job that fits all of its own limits isn't held up by queued jobs that are blocked by theirs.
+	if fitsConcurrencyLimits(j, w.activeJobCounts()) {
+		return nil
+	}
+
+	w.jobs.queue = append(w.jobs.queue, j)
+
+	// Nothing else can see the job yet.
+	t := JobTransition{From: j.Status, To: JobStatusQueued, Time: time.Now(), Reason: "build concurrency limit reached"}
+	j.Status = JobStatusQueued
+	j.StatusReason = t.Reason
+	j.Transitions = append(j.Transitions, t)
+	j.QueuePosition = len(w.jobs.queue)
+
+	return &t
+}
+
+/*
+	Removes a job from the queue if it's in there.
+	The jobs lock must be held by the caller.
+*/
+func (w *Waitron) dequeueJob(j *Job) {
+	for idx, qj := range w.jobs.queue {
+		if qj == j {
+			w.jobs.queue = append(w.jobs.queue[:idx], w.jobs.queue[idx+1:]...)
+			break
+		}
+	}
+
+	j.Lock()
+	j.QueuePosition = 0
+	j.Unlock()
+
+	w.renumberQueue()
+}
+
+/*
+	The jobs lock must be held by the caller.
+*/
+func (w *Waitron) renumberQueue() {
+	for idx, qj := range w.jobs.queue {
+		qj.Lock()
+		qj.QueuePosition = idx + 1
+		qj.Unlock()
+	}
+}
+
+/*
+	Starts as many queued jobs as the concurrency limits allow, oldest first.
+	A job that is still blocked by one of its own limits doesn't hold up jobs behind it that aren't.
+*/
+func (w *Waitron) promoteQueuedJobs() {
+	w.jobs.Lock()
+
+	counts := w.activeJobCounts()
+	promoted := make([]*Job, 0)
+	remaining := make([]*Job, 0, len(w.jobs.queue))
+
+	for _, j := range w.jobs.queue {
+		if !fitsConcurrencyLimits(j, counts) {
+			remaining = append(remaining, j)
+			continue
+		}
+
+		for _, l := range j.concurrencyLimits {
+			counts[l.key]++
+		}
+
+		j.Lock()
+		j.QueuePosition = 0
+		j.Unlock()
+
+		promoted = append(promoted, j)
+	}
+
+	w.jobs.queue = remaining
+	w.renumberQueue()
+
+	w.jobs.Unlock()
+
+	for _, j := range promoted {
+		if err := w.setJobStatus(j, JobStatusPending, "promoted from build queue"); err != nil {
+			w.addJobLog(j, err.Error(), config.LogLevelError)
+			continue
+		}
+
+		// Pre-build commands were held back while the job was queued.  They can be slow, and whatever freed up the slot shouldn't wait on them.
+		go w.runPreBuildCommands(j)
+	}
+}
@@ -0,0 +1,151 @@
+package waitron
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+func newQueueTestJob(w *Waitron, hostname string, rack string) *Job {
+	m, _ := machine.New(hostname)
+	m.Params = map[string]string{"rack": rack}
+
+	j := &Job{Start: time.Now(), Status: JobStatusPending, Machine: m, Token: hostname}
+	w.addJob(j, j.Token, m.Hostname, []string{}, false)
+
+	return j
+}
+
+func TestBuildQueue(t *testing.T) {
+	w := New(&config.Config{
+		BuildConcurrency: config.BuildConcurrency{
+			Global: 2,
+			PerGroup: []config.GroupConcurrencyLimit{
+				config.GroupConcurrencyLimit{Key: "params.rack", Limit: 1},
+			},
+		},
+	})
+
+	a1 := newQueueTestJob(w, "a1.prod", "a")
+	a2 := newQueueTestJob(w, "a2.prod", "a")
+	b1 := newQueueTestJob(w, "b1.prod", "b")
+	c1 := newQueueTestJob(w, "c1.prod", "c")
+
+	if a1.Status != JobStatusPending || a1.QueuePosition != 0 {
+		t.Errorf("First job was not started right away: %s %d", a1.Status, a1.QueuePosition)
+		return
+	}
+
+	if a2.Status != JobStatusQueued || a2.QueuePosition != 1 {
+		t.Errorf("Job over the group limit was not queued: %s %d", a2.Status, a2.QueuePosition)
+		return
+	}
+
+	// b1 fits every limit of its own, so it isn't held up by a2, but that takes the last global slot.
+	if b1.Status != JobStatusPending || b1.QueuePosition != 0 {
+		t.Errorf("Job that fits its limits was queued: %s %d", b1.Status, b1.QueuePosition)
+		return
+	}
+
+	if c1.Status != JobStatusQueued || c1.QueuePosition != 2 {
+		t.Errorf("Job over the global limit was not queued: %s %d", c1.Status, c1.QueuePosition)
+		return
+	}
+
+	if err := w.cleanUpJob(a1, JobStatusCompleted, "done"); err != nil {
+		t.Errorf("Failed to clean up job: %v", err)
+		return
+	}
+
+	// a2 now fits, and the global limit keeps c1 waiting.
+	if a2.Status != JobStatusPending {
+		t.Errorf("Queued job was not promoted: %s", a2.Status)
+		return
+	}
+
+	if c1.Status != JobStatusQueued || c1.QueuePosition != 1 {
+		t.Errorf("Queue was not renumbered: %s %d", c1.Status, c1.QueuePosition)
+		return
+	}
+
+	if err := w.cleanUpJob(c1, JobStatusTerminated, "cancelled"); err != nil {
+		t.Errorf("Failed to cancel queued job: %v", err)
+		return
+	}
+
+	if len(w.jobs.queue) != 0 {
+		t.Errorf("Cancelled job was left in the queue")
+		return
+	}
+}
+
+func TestQueuedPreBuildCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-queue")
+	if err != nil {
+		t.Errorf("Failed to create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ran := path.Join(dir, "prebuild")
+
+	w := New(&config.Config{
+		BuildType: config.BuildType{
+			PreBuildCommands: []config.BuildCommand{{Command: "#!/bin/sh\necho {{ machine.ShortName }} >> " + ran, ErrorsFatal: true}},
+		},
+		BuildConcurrency: config.BuildConcurrency{Global: 1},
+	})
+
+	w.activePlugins = append(w.activePlugins, activePlugin{plugin: &rackPlugin{machines: map[string][]string{
+		"q01.prod": []string{},
+		"q02.prod": []string{},
+	}}, settings: &config.MachineInventoryPluginSettings{Name: "racks"}})
+
+	runs := func() string {
+		b, _ := ioutil.ReadFile(ran)
+		return strings.TrimSpace(string(b))
+	}
+
+	token1, err := w.Build("q01.prod", "", nil)
+	if err != nil {
+		t.Errorf("Failed to build: %v", err)
+		return
+	}
+
+	if _, err := w.Build("q02.prod", "", nil); err != nil {
+		t.Errorf("Failed to build: %v", err)
+		return
+	}
+
+	// The queued machine isn't touched until it's promoted.
+	if got := runs(); got != "q01" {
+		t.Errorf("Unexpected pre-build commands before promotion: %q", got)
+		return
+	}
+
+	if err := w.FinishBuild("q01.prod", token1); err != nil {
+		t.Errorf("Failed to finish build: %v", err)
+		return
+	}
+
+	// Promoted jobs have their pre-build commands run in the background.
+	for i := 0; i < 100 && runs() != "q01\nq02"; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	if got := runs(); got != "q01\nq02" {
+		t.Errorf("Pre-build commands didn't run exactly once per job: %q", got)
+	}
+
+	if status, err := w.GetMachineStatus("q02.prod"); err != nil || status != string(JobStatusPending) {
+		t.Errorf("Promoted job is %s: %v", status, err)
+	}
+}
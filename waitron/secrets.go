@@ -0,0 +1,151 @@
+package waitron
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"waitron/config"
+	"waitron/secrets"
+
+	"github.com/flosch/pongo2"
+)
+
+const redactedSecret = "***"
+
+type activeSecretsProvider struct {
+	provider secrets.SecretsProvider
+	settings *config.SecretsProviderSettings
+}
+
+/*
+	Holds on to every secret value that has been handed out so it can be scrubbed from anything we show to people.
+	Values are kept longest first so that a secret containing another secret is replaced as a whole.
+*/
+type secretRedactor struct {
+	sync.RWMutex
+	values []string
+}
+
+func (r *secretRedactor) add(v string) {
+	if v == "" {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	for _, existing := range r.values {
+		if existing == v {
+			return
+		}
+	}
+
+	r.values = append(r.values, v)
+	sort.SliceStable(r.values, func(i, j int) bool { return len(r.values[i]) > len(r.values[j]) })
+}
+
+func (r *secretRedactor) redact(s string) string {
+	r.RLock()
+	defer r.RUnlock()
+
+	for _, v := range r.values {
+		s = strings.Replace(s, v, redactedSecret, -1)
+	}
+
+	return s
+}
+
+/*
+	Same as redact, but also catches values that were escaped on their way into JSON.
+*/
+func (r *secretRedactor) redactJSON(b []byte) []byte {
+	r.RLock()
+	defer r.RUnlock()
+
+	if len(r.values) == 0 {
+		return b
+	}
+
+	s := string(b)
+	for _, v := range r.values {
+		if e, err := json.Marshal(v); err == nil {
+			s = strings.Replace(s, string(e[1:len(e)-1]), redactedSecret, -1)
+		}
+		s = strings.Replace(s, v, redactedSecret, -1)
+	}
+
+	return []byte(s)
+}
+
+/*
+	Create an array of secrets provider instances.  Only enabled providers will be loaded.
+*/
+func (w *Waitron) initSecretsProviders() error {
+	for idx := 0; idx < len(w.config.SecretsProviders); idx++ {
+
+		cp := &(w.config.SecretsProviders[idx])
+
+		if !cp.Disabled {
+
+			p, err := secrets.GetProvider(cp.Type, cp, w.config, w.addLog)
+
+			if err != nil {
+				return err
+			}
+
+			if err = p.Init(); err != nil {
+				return fmt.Errorf("failed to init secrets provider %s: %v", cp.Name, err)
+			}
+
+			w.activeSecretsProviders = append(w.activeSecretsProviders, activeSecretsProvider{provider: p, settings: cp})
+		}
+	}
+	return nil
+}
+
+/*
+	Asks each of the secrets providers, in order, for the secret at "path/key".
+	Anything found is remembered so that it can be redacted from logs and job details later.
+*/
+func (w *Waitron) GetSecret(p string) (string, error) {
+	path, key, err := secrets.SplitPath(p)
+	if err != nil {
+		return "", err
+	}
+
+	for _, ap := range w.activeSecretsProviders {
+		v, found, err := ap.provider.GetSecret(path, key)
+
+		if err != nil {
+			return "", fmt.Errorf("secrets provider %s failed to look up '%s': %v", ap.settings.Name, p, err)
+		}
+
+		if found {
+			w.secrets.add(v)
+			return v, nil
+		}
+	}
+
+	return "", fmt.Errorf("secret '%s' not found", p)
+}
+
+/*
+	Returns the secret() function handed to templates and commands.
+	Only the path of the secret ever makes it into the logs.
+*/
+func (w *Waitron) secretFunc(j *Job) func(string) (*pongo2.Value, error) {
+	return func(p string) (*pongo2.Value, error) {
+		v, err := w.GetSecret(p)
+		if err != nil {
+			w.addJobLog(j, err.Error(), config.LogLevelError)
+			return nil, err
+		}
+
+		w.addJobLog(j, fmt.Sprintf("secret '%s' used", p), config.LogLevelDebug)
+
+		return pongo2.AsSafeValue(v), nil
+	}
+}
@@ -0,0 +1,82 @@
+package waitron
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+func TestSecretTemplateFunction(t *testing.T) {
+	os.Setenv("WAITRON_SECRET_HOSTS_TEST01_ROOT_PASSWORD", `hun"ter2`)
+	defer os.Unsetenv("WAITRON_SECRET_HOSTS_TEST01_ROOT_PASSWORD")
+
+	dir, err := ioutil.TempDir("", "waitron-templates")
+	if err != nil {
+		t.Errorf("Failed to create template dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(path.Join(dir, "preseed.j2"), []byte(`pw={{ secret("hosts/test01/root_password") }}`), 0644); err != nil {
+		t.Errorf("Failed to write template: %v", err)
+		return
+	}
+
+	if err := ioutil.WriteFile(path.Join(dir, "finish.j2"), []byte(`{{ secret("hosts/test01/nope") }}`), 0644); err != nil {
+		t.Errorf("Failed to write template: %v", err)
+		return
+	}
+
+	w := New(&config.Config{TemplatePath: dir, SecretsProviders: []config.SecretsProviderSettings{{Name: "env", Type: "env"}}})
+
+	if err := w.Init(); err != nil {
+		t.Errorf("Failed to init: %v", err)
+		return
+	}
+
+	m := &machine.Machine{Hostname: "test01.prod"}
+	m.Preseed = "preseed.j2"
+	m.Finish = "finish.j2"
+
+	j := &Job{Status: JobStatusPending, Machine: m, Token: "test", Log: newJobLog(10)}
+
+	if err := w.addJob(j, j.Token, m.Hostname, []string{"deadbeef"}, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	if s, err := w.RenderStageTemplate("test", "preseed"); err != nil || s != `pw=hun"ter2` {
+		t.Errorf("Unexpected render with secret: err(%v) result(%s)", err, s)
+		return
+	}
+
+	if _, err := w.RenderStageTemplate("test", "finish"); err == nil {
+		t.Errorf("Rendered template with a secret that doesn't exist")
+		return
+	}
+
+	w.addJobLog(j, `command: useradd -p hun"ter2`, config.LogLevelInfo)
+	j.StatusReason = `failed with hun"ter2`
+
+	entries, _, _ := j.Log.since(0)
+	for _, e := range entries {
+		if strings.Contains(e.Message, "hunter2") || strings.Contains(e.Message, `hun"ter2`) {
+			t.Errorf("Secret was not redacted from the job log: %s", e.Message)
+		}
+	}
+
+	b, err := w.GetJobBlob("test")
+	if err != nil {
+		t.Errorf("Failed to get job blob: %v", err)
+		return
+	}
+
+	if strings.Contains(string(b), "ter2") || !strings.Contains(string(b), redactedSecret) {
+		t.Errorf("Secret was not redacted from the job: %s", b)
+	}
+}
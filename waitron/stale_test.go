@@ -0,0 +1,156 @@
+package waitron
+
+import (
+	"testing"
+	"time"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+func TestStaleJobs(t *testing.T) {
+	w := New(&config.Config{})
+
+	m := &machine.Machine{Hostname: "test01.prod"}
+	m.StaleBuildThresholdSeconds = 60
+	m.StaleBuildFailThresholdSeconds = 120
+	m.ProgressResetsStaleTimer = true
+	m.Network = []machine.Interface{machine.Interface{MacAddress: "deadbeef"}}
+
+	start := time.Now()
+
+	j := &Job{Start: start, Status: JobStatusInstalling, Machine: m, Token: "test"}
+
+	if err := w.addJob(j, j.Token, m.Hostname, []string{"deadbeef"}, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	w.checkForStaleJob(j, start.Add(30*time.Second))
+
+	if j.Status != JobStatusInstalling {
+		t.Errorf("Job marked %s before crossing the stale threshold", j.Status)
+		return
+	}
+
+	w.checkForStaleJob(j, start.Add(61*time.Second))
+
+	if j.Status != JobStatusStale || j.staleCommandsLastRun.IsZero() {
+		t.Errorf("Job not marked stale after crossing the threshold: %s", j.Status)
+		return
+	}
+
+	// Stale commands run once unless a repeat interval is set.
+	lastRun := j.staleCommandsLastRun
+	w.checkForStaleJob(j, start.Add(90*time.Second))
+
+	if !j.staleCommandsLastRun.Equal(lastRun) {
+		t.Errorf("Stale commands were run again without a repeat interval")
+		return
+	}
+
+	// Progress pushes the clock back, so the job should return to where it was.
+	j.LastProgress = start.Add(80 * time.Second)
+	w.checkForStaleJob(j, start.Add(100*time.Second))
+
+	if j.Status != JobStatusInstalling {
+		t.Errorf("Job did not recover from stale after progress: %s", j.Status)
+		return
+	}
+
+	w.checkForStaleJob(j, start.Add(141*time.Second))
+	w.checkForStaleJob(j, start.Add(141*time.Second+121*time.Second))
+
+	if j.Status != JobStatusFailed {
+		t.Errorf("Job was not failed after crossing the fail threshold: %s", j.Status)
+		return
+	}
+
+	// Clean-up happens in the background after the cancel commands.
+	for i := 0; i < 100; i++ {
+		if _, found, _ := w.getActiveJob("", j.Token); !found {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w.jobs.RLock()
+	_, macFound := w.jobs.jobByMAC["deadbeef"]
+	_, hostFound := w.jobs.jobByHostname[m.Hostname]
+	w.jobs.RUnlock()
+
+	if macFound || hostFound {
+		t.Errorf("Failed stale job was not cleaned up: mac(%v) host(%v)", macFound, hostFound)
+		return
+	}
+}
+
+func TestStaleJobMovesOn(t *testing.T) {
+	w := New(&config.Config{})
+
+	m := &machine.Machine{Hostname: "test02.prod"}
+	m.StaleBuildThresholdSeconds = 60
+	m.StaleBuildFailThresholdSeconds = 120
+	m.Network = []machine.Interface{machine.Interface{MacAddress: "deadbeef02"}}
+
+	start := time.Now()
+
+	j := &Job{Start: start, Status: JobStatusInstalling, Machine: m, Token: "test02"}
+
+	if err := w.addJob(j, j.Token, m.Hostname, []string{"deadbeef02"}, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	w.checkForStaleJob(j, start.Add(61*time.Second))
+
+	if j.Status != JobStatusStale {
+		t.Errorf("Job not marked stale after crossing the threshold: %s", j.Status)
+		return
+	}
+
+	staleSince, lastRun := j.staleSince, j.staleCommandsLastRun
+
+	// Still stale, so nothing about when it was flagged changes.
+	w.checkForStaleJob(j, start.Add(90*time.Second))
+
+	if !j.staleSince.Equal(staleSince) || !j.staleCommandsLastRun.Equal(lastRun) {
+		t.Errorf("Stale job was flagged again")
+		return
+	}
+
+	// The machine fetches its finish template, which moves the job out of stale.
+	if err := w.setJobStatus(j, JobStatusFinish, "finish template rendered"); err != nil {
+		t.Errorf("Failed to move job out of stale: %v", err)
+		return
+	}
+	j.Transitions[len(j.Transitions)-1].Time = start.Add(100 * time.Second)
+
+	w.checkForStaleJob(j, start.Add(101*time.Second))
+
+	if j.Status != JobStatusFinish || !j.staleSince.IsZero() {
+		t.Errorf("Job that moved on was marked stale again right away: %s", j.Status)
+		return
+	}
+
+	// The clock started over when it moved on.
+	w.checkForStaleJob(j, start.Add(159*time.Second))
+
+	if j.Status != JobStatusFinish {
+		t.Errorf("Job marked %s before crossing the threshold again", j.Status)
+		return
+	}
+
+	w.checkForStaleJob(j, start.Add(161*time.Second))
+
+	if j.Status != JobStatusStale || !j.staleSince.Equal(start.Add(161*time.Second)) {
+		t.Errorf("Job not marked stale after crossing the threshold again: %s", j.Status)
+		return
+	}
+
+	w.checkForStaleJob(j, start.Add(281*time.Second))
+
+	if j.Status != JobStatusFailed {
+		t.Errorf("Job was not failed after crossing the fail threshold: %s", j.Status)
+	}
+}
@@ -0,0 +1,316 @@
+package waitron
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+var (
+	ErrStaticFileNotFound   = errors.New("file not found")
+	ErrStaticFileNeedsToken = errors.New("templated file needs the token of an active job")
+)
+
+/*
+	A file from staticspath, ready to be served.  Files ending in .j2 are templates, rendered for the job whose token was given,
+	and are served without the .j2.
+*/
+type StaticFile struct {
+	Name    string
+	ModTime time.Time
+	Size    int64
+	SHA256  string
+	Content io.ReadSeeker
+
+	job    *Job // The job the download is counted against, if any.
+	closer io.Closer
+}
+
+func (f *StaticFile) Close() error {
+	if f.closer == nil {
+		return nil
+	}
+	return f.closer.Close()
+}
+
+/*
+	What a job has downloaded from staticspath, per file.  Bytes adds up everything sent, so a download resumed with ranges
+	is complete once the ranges add up to the whole file.
+*/
+type FileDownload struct {
+	File      string
+	Size      int64
+	Requests  int
+	Bytes     int64
+	Completed bool
+	Last      time.Time
+}
+
+type staticSum struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+/*
+	A file being hashed.  Anyone else asking for the same version of it waits for done, instead of hashing it too.
+*/
+type staticSumCall struct {
+	done chan struct{}
+	s    staticSum
+	err  error
+}
+
+/*
+	The sha256 of every static file that has been served, by path, so big files are only hashed again when they change.
+	Files being hashed are in hashing, so that a burst of machines asking for the same new file only hashes it once.
+*/
+type staticSums struct {
+	sync.Mutex
+	byPath  map[string]staticSum
+	hashing map[string]*staticSumCall
+}
+
+func (w *Waitron) staticSum(file string, f *os.File, info os.FileInfo) (string, error) {
+	w.staticSums.Lock()
+
+	if s, found := w.staticSums.byPath[file]; found && s.size == info.Size() && s.modTime.Equal(info.ModTime()) {
+		w.staticSums.Unlock()
+		return s.sum, nil
+	}
+
+	if c, found := w.staticSums.hashing[file]; found && c.s.size == info.Size() && c.s.modTime.Equal(info.ModTime()) {
+		w.staticSums.Unlock()
+		<-c.done
+		return c.s.sum, c.err
+	}
+
+	c := &staticSumCall{done: make(chan struct{}), s: staticSum{size: info.Size(), modTime: info.ModTime()}}
+	w.staticSums.hashing[file] = c
+	w.staticSums.Unlock()
+
+	h := sha256.New()
+	if _, c.err = io.Copy(h, f); c.err == nil {
+		_, c.err = f.Seek(0, io.SeekStart)
+	}
+
+	c.s.sum = hex.EncodeToString(h.Sum(nil))
+
+	w.staticSums.Lock()
+	if c.err == nil {
+		w.staticSums.byPath[file] = c.s
+	}
+
+	// The file could have changed while this was hashing, and something else started hashing the new version.
+	if w.staticSums.hashing[file] == c {
+		delete(w.staticSums.hashing, file)
+	}
+	w.staticSums.Unlock()
+
+	close(c.done)
+
+	if c.err != nil {
+		return "", c.err
+	}
+
+	return c.s.sum, nil
+}
+
+/*
+	Finds the job a download belongs to: the one with the token, if there is one, or else the one with an interface that has the address.
+*/
+func (w *Waitron) downloadJob(token string, address string) *Job {
+	w.jobs.RLock()
+	defer w.jobs.RUnlock()
+
+	if token != "" {
+		return w.jobs.jobByToken[token]
+	}
+
+	if address == "" {
+		return nil
+	}
+
+	// The machine details of a job don't change once it's been added, so they're safe to read without the job lock.
+	for _, j := range w.jobs.jobByToken {
+		for _, iface := range j.Machine.Network {
+			for _, addresses := range [][]machine.IPConfig{iface.Addresses4, iface.Addresses6} {
+				for _, a := range addresses {
+					if a.IPAddress == address {
+						return j
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+/*
+	Opens a file from staticspath.  Directories, and anything hidden, aren't served.
+	Downloads are counted against the job with the token, or, without a token, against whatever job has an interface with the address.
+	Templated files need the token of an active job.
+*/
+func (w *Waitron) OpenStaticFile(name string, token string, address string) (*StaticFile, error) {
+	if w.config.StaticFilesPath == "" {
+		return nil, fmt.Errorf("%w: %s", ErrStaticFileNotFound, name)
+	}
+
+	// Rooted before it's cleaned, so nothing can climb out of staticspath.
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || strings.HasPrefix(part, ".") {
+			return nil, fmt.Errorf("%w: %s", ErrStaticFileNotFound, name)
+		}
+	}
+
+	j := w.downloadJob(token, address)
+
+	file := path.Join(w.config.StaticFilesPath, name)
+
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrStaticFileNotFound, name)
+		}
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	if info.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s", ErrStaticFileNotFound, name)
+	}
+
+	if strings.HasSuffix(name, ".j2") {
+		defer f.Close()
+
+		if token == "" || j == nil {
+			return nil, fmt.Errorf("%w: %s", ErrStaticFileNeedsToken, name)
+		}
+
+		source, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+
+		rendered, err := w.renderStaticFile(name, string(source), j)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256([]byte(rendered))
+
+		return &StaticFile{
+			Name:    strings.TrimSuffix(name, ".j2"),
+			ModTime: info.ModTime(),
+			Size:    int64(len(rendered)),
+			SHA256:  hex.EncodeToString(sum[:]),
+			Content: bytes.NewReader([]byte(rendered)),
+			job:     j,
+		}, nil
+	}
+
+	sum, err := w.staticSum(file, f, info)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &StaticFile{Name: name, ModTime: info.ModTime(), Size: info.Size(), SHA256: sum, Content: f, job: j, closer: f}, nil
+}
+
+func (w *Waitron) renderStaticFile(name string, source string, j *Job) (string, error) {
+	j.RLock()
+	defer j.RUnlock()
+
+	set, loader := w.templateSet(j)
+
+	tpl, err := w.templateFromString(set, loader, name, source)
+	if err != nil {
+		w.addJobLog(j, fmt.Sprintf("failed to parse static file %s: %v", name, err), config.LogLevelError)
+		return "", err
+	}
+
+	ctx := w.templateContext(j)
+
+	if err = w.checkStrict(name, source, loader, ctx); err != nil {
+		w.addJobLog(j, fmt.Sprintf("failed to render static file %s: %v", name, err), config.LogLevelError)
+		return "", err
+	}
+
+	rendered, err := tpl.Execute(ctx)
+	if err != nil {
+		w.addJobLog(j, fmt.Sprintf("failed to render static file %s: %v", name, err), config.LogLevelError)
+		return "", err
+	}
+
+	return rendered, nil
+}
+
+/*
+	Counts what was sent of a static file against the job that fetched it, if there was one.
+*/
+func (w *Waitron) RecordDownload(f *StaticFile, sent int64) {
+	j := f.job
+	if j == nil {
+		return
+	}
+
+	j.Lock()
+
+	var d *FileDownload
+	for i := range j.Downloads {
+		if j.Downloads[i].File == f.Name {
+			d = &j.Downloads[i]
+		}
+	}
+
+	if d == nil {
+		j.Downloads = append(j.Downloads, FileDownload{File: f.Name})
+		d = &j.Downloads[len(j.Downloads)-1]
+	}
+
+	// A file that changed size since it was last downloaded starts over.
+	if d.Size != f.Size {
+		d.Size = f.Size
+		d.Bytes = 0
+		d.Completed = false
+	}
+
+	d.Requests++
+	d.Bytes += sent
+	d.Last = time.Now()
+
+	completed := !d.Completed && d.Bytes >= d.Size
+	if completed {
+		d.Completed = true
+	}
+
+	j.Unlock()
+
+	w.addJobLog(j, fmt.Sprintf("sent %d bytes of %s (%d bytes)", sent, f.Name, f.Size), config.LogLevelDebug)
+
+	if completed {
+		w.addJobLog(j, fmt.Sprintf("%s downloaded", f.Name), config.LogLevelInfo)
+	}
+}
@@ -0,0 +1,177 @@
+package waitron
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+func TestStaticFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-files")
+	if err != nil {
+		t.Errorf("Failed to create staticspath: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(path.Join(dir, "ubuntu/focal"), 0755)
+	ioutil.WriteFile(path.Join(dir, "ubuntu/focal/linux"), []byte("0123456789"), 0644)
+	ioutil.WriteFile(path.Join(dir, "preseed.cfg.j2"), []byte("d-i netcfg/get_hostname string {{ machine.ShortName }} {{ job.Token }}"), 0644)
+	ioutil.WriteFile(path.Join(dir, ".secret"), []byte("hidden"), 0644)
+
+	w := New(&config.Config{StaticFilesPath: dir})
+
+	m, _ := machine.New("test01.prod")
+	m.Network = []machine.Interface{machine.Interface{MacAddress: "deadbeef0001", Addresses4: []machine.IPConfig{machine.IPConfig{IPAddress: "10.0.0.5"}}}}
+
+	j := &Job{Start: time.Now(), Status: JobStatusInstalling, Machine: m, Token: "test"}
+
+	if err := w.addJob(j, j.Token, m.Hostname, []string{"deadbeef0001"}, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	f, err := w.OpenStaticFile("/preseed.cfg.j2", j.Token, "")
+	if err != nil {
+		t.Errorf("Failed to open templated file: %v", err)
+		return
+	}
+
+	b, _ := ioutil.ReadAll(f.Content)
+	if f.Name != "preseed.cfg" || string(b) != "d-i netcfg/get_hostname string test01 test" || f.Size != int64(len(b)) || len(f.SHA256) != 64 {
+		t.Errorf("Unexpected templated file: %+v %s", f, b)
+	}
+	f.Close()
+
+	if _, err := w.OpenStaticFile("preseed.cfg.j2", "not-a-token", ""); !errors.Is(err, ErrStaticFileNeedsToken) {
+		t.Errorf("Expected a templated file to need a valid token, got %v", err)
+	}
+
+	for _, name := range []string{".secret", "ubuntu/../.secret", "ubuntu/focal", "../../../etc/passwd"} {
+		if _, err := w.OpenStaticFile(name, "", ""); !errors.Is(err, ErrStaticFileNotFound) {
+			t.Errorf("Expected %s not to be served, got %v", name, err)
+		}
+	}
+
+	// Without a token, downloads are counted against the job with the address.  A resumed download completes the file.
+	for _, sent := range []int64{4, 6} {
+		f, err := w.OpenStaticFile("ubuntu/focal/linux", "", "10.0.0.5")
+		if err != nil {
+			t.Errorf("Failed to open file: %v", err)
+			return
+		}
+
+		if f.SHA256 != "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882" {
+			t.Errorf("Unexpected sha256: %s", f.SHA256)
+		}
+
+		w.RecordDownload(f, sent)
+		f.Close()
+
+		if d := j.Downloads[0]; d.File != "ubuntu/focal/linux" || d.Completed != (sent == 6) {
+			t.Errorf("Unexpected download after %d bytes: %+v", sent, d)
+		}
+	}
+
+	if d := j.Downloads[0]; d.Requests != 2 || d.Bytes != 10 || d.Size != 10 {
+		t.Errorf("Unexpected download: %+v", d)
+	}
+
+	// Someone else's download isn't counted against anything.
+	f, _ = w.OpenStaticFile("ubuntu/focal/linux", "", "10.0.0.99")
+	w.RecordDownload(f, 10)
+	f.Close()
+
+	if len(j.Downloads) != 1 || j.Downloads[0].Requests != 2 {
+		t.Errorf("Download from another address was counted: %+v", j.Downloads)
+	}
+
+	// A changed file is hashed again.
+	ioutil.WriteFile(path.Join(dir, "ubuntu/focal/linux"), []byte("changed"), 0644)
+	os.Chtimes(path.Join(dir, "ubuntu/focal/linux"), time.Now(), time.Now().Add(time.Minute))
+
+	f, _ = w.OpenStaticFile("ubuntu/focal/linux", "", "")
+	if f.SHA256 == "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882" || f.Size != 7 {
+		t.Errorf("Changed file wasn't hashed again: %+v", f)
+	}
+	f.Close()
+}
+
+func TestStaticSumShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-files")
+	if err != nil {
+		t.Errorf("Failed to create staticspath: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	file := path.Join(dir, "linux")
+	ioutil.WriteFile(file, []byte("0123456789"), 0644)
+
+	w := New(&config.Config{StaticFilesPath: dir})
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Errorf("Failed to open file: %v", err)
+		return
+	}
+	defer f.Close()
+
+	info, _ := f.Stat()
+
+	// Something else is already hashing the file, so this waits for it instead of hashing it again.
+	c := &staticSumCall{done: make(chan struct{}), s: staticSum{size: info.Size(), modTime: info.ModTime()}}
+	w.staticSums.hashing[file] = c
+
+	got := make(chan string, 1)
+	go func() {
+		sum, _ := w.staticSum(file, f, info)
+		got <- sum
+	}()
+
+	select {
+	case sum := <-got:
+		t.Errorf("Didn't wait for the hash in progress, got %s", sum)
+		return
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.s.sum = "shared"
+	close(c.done)
+
+	if sum := <-got; sum != "shared" {
+		t.Errorf("Expected the shared sum, got %s", sum)
+	}
+
+	delete(w.staticSums.hashing, file)
+
+	// A burst of first requests all get the same sum, and nothing is left hashing.
+	sums := make(chan string, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			f, err := w.OpenStaticFile("/linux", "", "")
+			if err != nil {
+				sums <- err.Error()
+				return
+			}
+			defer f.Close()
+			sums <- f.SHA256
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		if sum := <-sums; sum != "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882" {
+			t.Errorf("Unexpected sum: %s", sum)
+		}
+	}
+
+	if len(w.staticSums.hashing) != 0 {
+		t.Errorf("Hashes were left in progress: %+v", w.staticSums.hashing)
+	}
+}
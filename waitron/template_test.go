@@ -0,0 +1,88 @@
+package waitron
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+func TestRenderStageTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-templates")
+	if err != nil {
+		t.Errorf("Failed to create template dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{"preseed.j2": "preseed {{ Token }}", "motd.j2": "motd {{ machine.Hostname }}", "disks.j2": "disks"} {
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Errorf("Failed to write template: %v", err)
+			return
+		}
+	}
+
+	w := New(&config.Config{TemplatePath: dir})
+
+	m := &machine.Machine{Hostname: "test01.prod"}
+	m.Preseed = "preseed.j2"
+	m.Templates = map[string]config.StageTemplate{
+		"motd":         config.StageTemplate{File: "motd.j2"},
+		"partitioning": config.StageTemplate{File: "disks.j2", Status: "installing"},
+		"broken":       config.StageTemplate{File: "disks.j2", Status: "completed"},
+	}
+
+	j := &Job{Status: JobStatusPending, Machine: m, Token: "test"}
+
+	if err := w.addJob(j, j.Token, m.Hostname, []string{"deadbeef"}, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	if s, err := w.RenderStageTemplate("test", "motd"); err != nil || s != "motd test01.prod" || j.Status != JobStatusPending {
+		t.Errorf("Unexpected render of template without status: err(%v) result(%s) status(%s)", err, s, j.Status)
+		return
+	}
+
+	if s, err := w.RenderStageTemplate("test", "partitioning"); err != nil || s != "disks" || j.Status != JobStatusInstalling {
+		t.Errorf("Unexpected render of template with status: err(%v) result(%s) status(%s)", err, s, j.Status)
+		return
+	}
+
+	if s, err := w.RenderStageTemplate("test", "preseed"); err != nil || s != "preseed test" || j.Status != JobStatusPreseed {
+		t.Errorf("Unexpected render of preseed: err(%v) result(%s) status(%s)", err, s, j.Status)
+		return
+	}
+
+	// finish isn't set, so it's just as unknown as anything else.
+	for _, name := range []string{"finish", "nope"} {
+		if _, err := w.RenderStageTemplate("test", name); !errors.Is(err, ErrTemplateNotFound) {
+			t.Errorf("Unexpected error for undeclared template %s: %v", name, err)
+			return
+		}
+	}
+
+	if _, err := w.RenderStageTemplate("test", "broken"); err == nil || j.Status != JobStatusPreseed {
+		t.Errorf("Rendered template with a status that isn't permitted: status(%s)", j.Status)
+		return
+	}
+}
+
+func TestCheckStageTemplates(t *testing.T) {
+	for status, ok := range map[string]bool{"": true, "installing": true, "finish": true, "instaling": false, "completed": false} {
+		w := New(&config.Config{
+			BuildType: config.BuildType{Templates: map[string]config.StageTemplate{"motd": config.StageTemplate{File: "motd.j2"}}},
+			BuildTypes: map[string]config.BuildType{
+				"default": config.BuildType{Templates: map[string]config.StageTemplate{"partitioning": config.StageTemplate{File: "disks.j2", Status: status}}},
+			},
+		})
+
+		if err := w.Init(); (err == nil) != ok {
+			t.Errorf("Unexpected init with template status '%s': %v", status, err)
+		}
+	}
+}
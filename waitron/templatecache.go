@@ -0,0 +1,236 @@
+package waitron
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"waitron/config"
+
+	"github.com/flosch/pongo2"
+	"github.com/fsnotify/fsnotify"
+)
+
+/*
+	Returned when a template, cmdline, or build command can't be parsed.  That's a problem with the config or templatepath,
+	not with the request, so the API reports it as such.
+*/
+type TemplateParseError struct {
+	Name string
+	Err  error
+}
+
+func (e *TemplateParseError) Error() string {
+	return fmt.Sprintf("failed to parse template %s: %v", e.Name, e.Err)
+}
+
+func (e *TemplateParseError) Unwrap() error {
+	return e.Err
+}
+
+/*
+	Compiled templates, so that a PXE storm doesn't mean reparsing the same cmdline and preseed for every request.
+
+	Sets are kept per loader chain, because includes get pulled in at parse time through the chain of whoever is being rendered.
+	Files are keyed by chain and name, and strings by chain and a hash of their content, so a changed cmdline in the config never hits a stale entry.
+
+	Files can change underneath us, and includes and extends make it hard to know which compiled templates depend on which files,
+	so any change anywhere under templatepath just throws everything away.  Caching is only on while something is watching templatepath.
+*/
+type templateCache struct {
+	sync.RWMutex
+	enabled    bool
+	generation uint64
+	sets       map[string]*pongo2.TemplateSet
+	templates  map[string]*pongo2.Template
+}
+
+func (tc *templateCache) flush() {
+	tc.Lock()
+	defer tc.Unlock()
+
+	tc.generation++
+	tc.sets = make(map[string]*pongo2.TemplateSet)
+	tc.templates = make(map[string]*pongo2.Template)
+}
+
+func (tc *templateCache) setEnabled(enabled bool) {
+	tc.Lock()
+	tc.enabled = enabled
+	tc.Unlock()
+
+	tc.flush()
+}
+
+/*
+	The set for a loader chain.  Sets are cheap, and filters and tags are registered globally, so when caching is off a new one each time is fine.
+*/
+func (tc *templateCache) set(l *templateLoader) *pongo2.TemplateSet {
+	key := l.key()
+
+	tc.RLock()
+	set, found := tc.sets[key]
+	enabled := tc.enabled
+	tc.RUnlock()
+
+	if found {
+		return set
+	}
+
+	set = pongo2.NewSet("waitron", l)
+
+	if enabled {
+		tc.Lock()
+		if existing, found := tc.sets[key]; found {
+			set = existing
+		} else if tc.sets != nil {
+			tc.sets[key] = set
+		}
+		tc.Unlock()
+	}
+
+	return set
+}
+
+/*
+	Returns the compiled template for key, calling compile if there isn't one yet.
+	Anything compiled while the cache was being flushed might have been read before the change, so it's handed back but not kept.
+*/
+func (tc *templateCache) get(key string, compile func() (*pongo2.Template, error)) (*pongo2.Template, error) {
+	tc.RLock()
+	tpl, found := tc.templates[key]
+	enabled := tc.enabled
+	generation := tc.generation
+	tc.RUnlock()
+
+	if found {
+		return tpl, nil
+	}
+
+	tpl, err := compile()
+	if err != nil || !enabled {
+		return tpl, err
+	}
+
+	tc.Lock()
+	if tc.generation == generation && tc.templates != nil {
+		tc.templates[key] = tpl
+	}
+	tc.Unlock()
+
+	return tpl, nil
+}
+
+func (l *templateLoader) key() string {
+	return strings.Join(l.dirs, "\x00")
+}
+
+/*
+	Compiles, or fetches the compiled version of, the named template file for the set of the loader.
+*/
+func (w *Waitron) templateFromFile(set *pongo2.TemplateSet, l *templateLoader, name string) (*pongo2.Template, error) {
+	return w.templates.get(l.key()+"\x00file\x00"+name, func() (*pongo2.Template, error) {
+		tpl, err := set.FromFile(name)
+		if err != nil {
+			return nil, &TemplateParseError{Name: name, Err: err}
+		}
+		return tpl, nil
+	})
+}
+
+/*
+	Same as templateFromFile, but for things like cmdlines and build commands that come from the config rather than a file.
+*/
+func (w *Waitron) templateFromString(set *pongo2.TemplateSet, l *templateLoader, name string, s string) (*pongo2.Template, error) {
+	sum := sha256.Sum256([]byte(s))
+
+	return w.templates.get(l.key()+"\x00string\x00"+hex.EncodeToString(sum[:]), func() (*pongo2.Template, error) {
+		tpl, err := set.FromString(s)
+		if err != nil {
+			return nil, &TemplateParseError{Name: name, Err: err}
+		}
+		return tpl, nil
+	})
+}
+
+/*
+	Watches templatepath, and every directory under it, and flushes the template cache whenever anything changes.
+	If templatepath can't be watched, templates are simply parsed on every render like they always were.
+*/
+func (w *Waitron) watchTemplates() error {
+	if w.config.TemplatePath == "" {
+		return fmt.Errorf("no templatepath configured")
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err = watchTemplateDirs(watcher, w.config.TemplatePath); err != nil {
+		watcher.Close()
+		return err
+	}
+
+	w.templates.setEnabled(true)
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		defer watcher.Close()
+
+		for {
+			select {
+			case <-w.done:
+				return
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					w.templates.setEnabled(false)
+					return
+				}
+
+				if ev.Op&fsnotify.Create != 0 {
+					if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+						if err = watchTemplateDirs(watcher, ev.Name); err != nil {
+							w.addLog(fmt.Sprintf("template cache disabled, unable to watch %s: %v", ev.Name, err), config.LogLevelWarning)
+							w.templates.setEnabled(false)
+							return
+						}
+					}
+				}
+
+				w.addLog(fmt.Sprintf("template cache flushed after change to %s", ev.Name), config.LogLevelDebug)
+				w.templates.flush()
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					w.templates.setEnabled(false)
+					return
+				}
+
+				// Events might have been dropped, so there's no telling what's stale.
+				w.addLog(fmt.Sprintf("template watcher error: %v", err), config.LogLevelWarning)
+				w.templates.flush()
+			}
+		}
+	}()
+
+	return nil
+}
+
+func watchTemplateDirs(watcher *fsnotify.Watcher, root string) error {
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() {
+			return watcher.Add(p)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,184 @@
+package waitron
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+func writeTemplates(dir string, templates map[string]string) error {
+	for name, content := range templates {
+		if err := os.MkdirAll(path.Dir(path.Join(dir, name)), 0755); err != nil {
+			return err
+		}
+
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestTemplateCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-templates")
+	if err != nil {
+		t.Errorf("Failed to create template dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if err = writeTemplates(dir, map[string]string{
+		"preseed.j2":     `v1 {% include "parts/disk.j2" %}`,
+		"parts/disk.j2":  `sda`,
+		"broken.j2":      `{% if %}`,
+		"groups/.keep":   ``,
+		"machines/.keep": ``,
+	}); err != nil {
+		t.Errorf("Failed to write templates: %v", err)
+		return
+	}
+
+	w := New(&config.Config{TemplatePath: dir, StaleBuildCheckFrequency: 3600})
+	if err = w.Run(); err != nil {
+		t.Errorf("Failed to run: %v", err)
+		return
+	}
+	defer w.Stop()
+
+	m, _ := machine.New("db01.example.com")
+	m.Hostname = "db01.example.com"
+	m.Cmdline = "console={{ Hostname }}"
+
+	j := &Job{Status: JobStatusPending, Machine: m, Token: "token"}
+
+	if s, err := w.renderTemplate("preseed.j2", "preseed", j); err != nil || s != "v1 sda" {
+		t.Errorf("Unexpected render: err(%v) result(%s)", err, s)
+		return
+	}
+
+	w.templates.RLock()
+	cached := len(w.templates.templates)
+	w.templates.RUnlock()
+
+	if cached != 1 {
+		t.Errorf("Expected the template to be cached, found %d cached templates", cached)
+	}
+
+	// Changes are picked up asynchronously, so give the watcher a moment.
+	waitForRender := func(expected string) {
+		s := ""
+		for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+			if s, err = w.renderTemplate("preseed.j2", "preseed", j); err == nil && s == expected {
+				return
+			}
+		}
+		t.Errorf("Render never became %s: err(%v) result(%s)", expected, err, s)
+	}
+
+	// Included files count as changes to the templates that include them.
+	if err = writeTemplates(dir, map[string]string{"parts/disk.j2": `nvme`}); err != nil {
+		t.Errorf("Failed to write templates: %v", err)
+		return
+	}
+	waitForRender("v1 nvme")
+
+	// So do files in override directories that didn't exist when the cache was filled.
+	if err = writeTemplates(dir, map[string]string{"machines/db01.example.com/parts/disk.j2": `md0`}); err != nil {
+		t.Errorf("Failed to write templates: %v", err)
+		return
+	}
+	waitForRender("v1 md0")
+
+	var pe *TemplateParseError
+
+	if _, err = w.renderTemplate("broken.j2", "preseed", j); !errors.As(err, &pe) {
+		t.Errorf("Expected a parse error for a broken template, got %v", err)
+	}
+
+	set, loader := w.templateSet(j)
+	if _, err = w.templateFromString(set, loader, "cmdline", "{{ Hostname"); !errors.As(err, &pe) || pe.Name != "cmdline" {
+		t.Errorf("Expected a parse error for a broken cmdline, got %v", err)
+	}
+}
+
+/*
+A PXE storm is every machine in a rack asking for its cmdline and preseed at the same time.
+*/
+func benchmarkPxeStorm(b *testing.B, cached bool) {
+	dir, err := ioutil.TempDir("", "waitron-templates")
+	if err != nil {
+		b.Fatalf("Failed to create template dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var body strings.Builder
+	for idx := 0; idx < 50; idx++ {
+		fmt.Fprintf(&body, "d-i preseed/late_command string echo {{ machine.Hostname }} {{ job.Token }} step%d >> /target/root/steps\n", idx)
+	}
+
+	if err = writeTemplates(dir, map[string]string{
+		"preseed.j2": body.String() + `{% include "parts/disks.j2" %}` + "\n" +
+			`{% for iface in machine.Network %}d-i netcfg/choose_interface select {{ iface.Name }}{% endfor %}`,
+		"parts/disks.j2": `{% if machine.Params.disk %}d-i partman-auto/disk string {{ machine.Params.disk }}{% else %}d-i partman-auto/disk string /dev/sda{% endif %}`,
+	}); err != nil {
+		b.Fatalf("Failed to write templates: %v", err)
+	}
+
+	w := New(&config.Config{TemplatePath: dir})
+	w.templates.setEnabled(cached)
+
+	jobs := make([]*Job, 0, 64)
+	for idx := 0; idx < cap(jobs); idx++ {
+		m, _ := machine.New(fmt.Sprintf("node%02d.example.com", idx))
+		m.Hostname = fmt.Sprintf("node%02d.example.com", idx)
+		m.Cmdline = "interface=auto url={{ BaseURL }}/template/preseed/{{ Hostname }}/{{ Token }} ramdisk_size=10800 root=/dev/rd/0 rw auto hostname={{ Hostname }} console-setup/ask_detect=false"
+		m.Params = map[string]string{"disk": "/dev/nvme0n1"}
+
+		jobs = append(jobs, &Job{Status: JobStatusPending, Machine: m, Token: fmt.Sprintf("job%d", idx)})
+	}
+
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		idx := 0
+		for pb.Next() {
+			j := jobs[idx%len(jobs)]
+			idx++
+
+			j.RLock()
+			set, loader := w.templateSet(j)
+			tpl, err := w.templateFromString(set, loader, "cmdline", j.Machine.Cmdline)
+			if err == nil {
+				_, err = tpl.Execute(w.cmdlineContext(j))
+			}
+			j.RUnlock()
+
+			if err != nil {
+				b.Errorf("Failed to render cmdline: %v", err)
+				return
+			}
+
+			if _, err = w.renderTemplate("preseed.j2", "preseed", j); err != nil {
+				b.Errorf("Failed to render preseed: %v", err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkPxeStormCached(b *testing.B) {
+	benchmarkPxeStorm(b, true)
+}
+
+func BenchmarkPxeStormUncached(b *testing.B) {
+	benchmarkPxeStorm(b, false)
+}
@@ -0,0 +1,226 @@
+package waitron
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"waitron/machine"
+
+	"github.com/flosch/pongo2"
+)
+
+// The directories under templatepath that hold overrides rather than templates of their own.
+var templateOverrideDirs = []string{"machines", "build_types", "groups"}
+
+// What the built-in templates resolve to, since they don't have a file.
+const builtinTemplatePath = "builtin:"
+
+/*
+	Finds templates by looking through a chain of directories, most specific first:
+
+		templatepath/machines/<hostname>/
+		templatepath/build_types/<build type>/
+		templatepath/groups/<domain>/
+		templatepath/
+
+	Names stay relative to templatepath, so that includes and extends go through the same chain as the template that asked for them.
+	Includes are relative to the template doing the including, just like they always were.
+	Anything not found in the chain falls back to the built-in templates.
+*/
+type templateLoader struct {
+	root string
+	dirs []string
+}
+
+/*
+	Keeps anything that came from a machine or a request from walking out of its directory.
+*/
+func templatePathComponent(s string) bool {
+	return s != "" && s != "." && s != ".." && !strings.ContainsAny(s, `/\`)
+}
+
+func newTemplateLoader(root string, hostname string, buildTypeName string, domain string) *templateLoader {
+	l := &templateLoader{root: root}
+
+	overrides := []struct {
+		dir  string
+		name string
+	}{
+		{"machines", hostname},
+		{"build_types", buildTypeName},
+		{"groups", domain},
+	}
+
+	// Only directories that exist make it into the chain, so machines without any overrides of their own share compiled templates.
+	for _, o := range overrides {
+		if !templatePathComponent(o.name) {
+			continue
+		}
+
+		d := filepath.Join(root, o.dir, o.name)
+		if fi, err := os.Stat(d); err == nil && fi.IsDir() {
+			l.dirs = append(l.dirs, d)
+		}
+	}
+
+	l.dirs = append(l.dirs, root)
+
+	return l
+}
+
+/*
+	The loader for a machine.  A machine can pick its own build type, and that wins over the one the job was requested with.
+*/
+func (w *Waitron) machineTemplateLoader(m *machine.Machine, buildTypeName string) *templateLoader {
+	if m == nil {
+		return newTemplateLoader(w.config.TemplatePath, "", buildTypeName, "")
+	}
+
+	if m.BuildTypeName != "" {
+		buildTypeName = m.BuildTypeName
+	}
+
+	return newTemplateLoader(w.config.TemplatePath, m.Hostname, buildTypeName, m.Domain)
+}
+
+/*
+	A template set that loads everything through the chain of the job.
+*/
+func (w *Waitron) templateSet(j *Job) (*pongo2.TemplateSet, *templateLoader) {
+	l := w.machineTemplateLoader(j.Machine, j.BuildTypeName)
+
+	return w.templates.set(l), l
+}
+
+func (l *templateLoader) Abs(base string, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+
+	// The built-in templates are the same wherever they're extended or included from.
+	if _, found := builtinTemplate(name); found {
+		return name
+	}
+
+	if base != "" && !filepath.IsAbs(base) {
+		name = path.Join(path.Dir(base), name)
+	}
+
+	return path.Clean(name)
+}
+
+/*
+	Returns the path of the file that will actually be used for the template.
+*/
+func (l *templateLoader) resolve(name string) (string, error) {
+	if filepath.IsAbs(name) {
+		_, err := os.Stat(name)
+		return name, err
+	}
+
+	name = path.Clean(name)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", fmt.Errorf("template '%s' is outside of the template path", name)
+	}
+
+	for _, d := range l.dirs {
+		p := filepath.Join(d, name)
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() {
+			return p, nil
+		}
+	}
+
+	if _, found := builtinTemplate(name); found {
+		return builtinTemplatePath + name, nil
+	}
+
+	return "", fmt.Errorf("template '%s': %w", name, ErrTemplateNotFound)
+}
+
+/*
+	Returns the path of the file that will be used for the template, and what's in it.
+*/
+func (l *templateLoader) read(name string) (string, []byte, error) {
+	p, err := l.resolve(name)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if strings.HasPrefix(p, builtinTemplatePath) {
+		s, _ := builtinTemplate(strings.TrimPrefix(p, builtinTemplatePath))
+		return p, []byte(s), nil
+	}
+
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return p, b, nil
+}
+
+func (l *templateLoader) Get(name string) (io.Reader, error) {
+	_, b, err := l.read(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(b), nil
+}
+
+/*
+	Every template name that can be loaded through the chain, sorted.
+	Anything in the override directories only counts through the chain, not as a template of its own.
+*/
+func (l *templateLoader) names() ([]string, error) {
+	found := make(map[string]bool)
+
+	for _, d := range l.dirs {
+		err := filepath.Walk(d, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && p == d {
+					return nil
+				}
+				return err
+			}
+
+			rel, err := filepath.Rel(d, p)
+			if err != nil {
+				return err
+			}
+
+			if fi.IsDir() {
+				if d == l.root {
+					for _, od := range templateOverrideDirs {
+						if rel == od {
+							return filepath.SkipDir
+						}
+					}
+				}
+				return nil
+			}
+
+			found[filepath.ToSlash(rel)] = true
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(found))
+	for n := range found {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
@@ -0,0 +1,99 @@
+package waitron
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"waitron/config"
+	"waitron/machine"
+)
+
+func TestTemplateHierarchy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-templates")
+	if err != nil {
+		t.Errorf("Failed to create template dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range map[string]string{
+		"preseed.j2":                             `root {% include "parts/disks.j2" %}`,
+		"finish.j2":                              `{% extends "base.j2" %}{% block body %}finish{% endblock %}`,
+		"base.j2":                                `base:{% block body %}{% endblock %}`,
+		"escape.j2":                              `{% include "../secret.j2" %}`,
+		"parts/disks.j2":                         `{% include "sda.j2" %}`,
+		"parts/sda.j2":                           `sda`,
+		"groups/example.com/parts/sda.j2":        `group-sda`,
+		"build_types/rescue/preseed.j2":          `rescue {% include "parts/disks.j2" %}`,
+		"build_types/rescue/base.j2":             `rescue-base:{% block body %}{% endblock %}`,
+		"machines/db01.example.com/parts/sda.j2": `nvme`,
+	} {
+		if err := os.MkdirAll(path.Dir(path.Join(dir, name)), 0755); err != nil {
+			t.Errorf("Failed to create template dir: %v", err)
+			return
+		}
+
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Errorf("Failed to write template: %v", err)
+			return
+		}
+	}
+
+	w := New(&config.Config{TemplatePath: dir})
+
+	tests := []struct {
+		hostname  string
+		buildType string
+		template  string
+		expected  string
+	}{
+		{"web01.example.org", "", "preseed", "root sda"},
+		{"web01.example.com", "", "preseed", "root group-sda"},
+		{"db01.example.com", "", "preseed", "root nvme"},
+		{"db01.example.com", "rescue", "preseed", "rescue nvme"},
+		{"web01.example.org", "rescue", "finish", "rescue-base:finish"},
+		{"web01.example.org", "", "finish", "base:finish"},
+		{"../../etc", "", "preseed", "root sda"},
+	}
+
+	for idx, test := range tests {
+		m, _ := machine.New(test.hostname)
+		m.Hostname = test.hostname
+		m.Preseed = "preseed.j2"
+		m.Finish = "finish.j2"
+
+		j := &Job{Status: JobStatusPending, BuildTypeName: test.buildType, Machine: m, Token: fmt.Sprintf("job%d", idx)}
+
+		// Some hostnames are tested more than once, and only one job can be active for a hostname.
+		if err := w.addJob(j, j.Token, j.Token, nil, false); err != nil {
+			t.Errorf("Failed to add job: %v", err)
+			return
+		}
+
+		if s, err := w.RenderStageTemplate(j.Token, test.template); err != nil || s != test.expected {
+			t.Errorf("Unexpected render of %s for %s (%s): err(%v) result(%s), expected %s", test.template, test.hostname, test.buildType, err, s, test.expected)
+		}
+	}
+
+	m, _ := machine.New("web01.example.org")
+	m.Templates = map[string]config.StageTemplate{"escape": {File: "escape.j2"}}
+
+	j := &Job{Status: JobStatusPending, Machine: m, Token: "escape"}
+	if err := w.addJob(j, j.Token, m.Hostname, nil, false); err != nil {
+		t.Errorf("Failed to add job: %v", err)
+		return
+	}
+
+	if _, err := w.RenderStageTemplate("escape", "escape"); err == nil {
+		t.Errorf("Template was allowed to include something outside of the template path")
+	}
+
+	names, err := w.machineTemplateLoader(m, "rescue").names()
+	if err != nil || strings.Join(names, ",") != "base.j2,escape.j2,finish.j2,parts/disks.j2,parts/sda.j2,preseed.j2" {
+		t.Errorf("Unexpected template names: err(%v) %v", err, names)
+	}
+}
@@ -9,7 +9,7 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"path"
+	"sort"
 	"strings"
 	"sync"
 	"syscall"
@@ -32,6 +32,12 @@ import (
 		move some of the Job* stuff to a separate package and make the rest of the fields public, or stop exporting the struct and also just make the properties private.
 */
 
+// Returned when something asks for a template, or something rendered like one, that doesn't exist.
+var ErrTemplateNotFound = errors.New("template not found")
+
+// Returned instead of a PXE config when a MAC should boot from its local disk.
+var ErrLocalBoot = errors.New("boot from local disk")
+
 // PixieConfig boot configuration
 type PixieConfig struct {
 	Kernel  string   `json:"kernel" description:"The kernel file"`
@@ -44,6 +50,9 @@ type Jobs struct {
 	jobByToken    map[string]*Job
 	jobByMAC      map[string]*Job
 	jobByHostname map[string]*Job
+	queue         []*Job // Jobs waiting on build concurrency limits, oldest first.
+
+	localBootUntil map[string]time.Time // MACs of recently completed jobs, and until when they're told to boot locally.
 }
 
 type JobsHistory struct {
@@ -56,14 +65,31 @@ type Job struct {
 	End   time.Time
 
 	sync.RWMutex `json:"-"`
-	Status       string
+	Status       JobStatus
 	StatusReason string
+	Transitions  []JobTransition // Every status change of the job, oldest first.
 
 	BuildTypeName        string
 	Machine              *machine.Machine
 	TriggerMacRaw        string // The MAC that actually came in looking for a PXE boot.
 	TriggerMacNormalized string
 	Token                string
+	Batch                string `json:",omitempty"` // The ID of the batch the job was started by, if any.
+
+	PxeServes int // How many times the installer has been served.
+
+	Downloads []FileDownload // Files fetched from staticspath, in the order they were first fetched.
+
+	Progress     []ProgressEvent // Installer-reported progress, oldest first.
+	LastProgress time.Time
+
+	QueuePosition     int `json:",omitempty"` // 1-based position in the build queue while the job is queued.
+	concurrencyLimits []concurrencyLimit
+
+	staleSince           time.Time
+	staleCommandsLastRun time.Time
+
+	Log *JobLog `json:",omitempty"` // Serialized as its buffered lines, oldest first.
 }
 
 type activePlugin struct {
@@ -84,6 +110,20 @@ type Waitron struct {
 
 	activePlugins []activePlugin
 
+	activeSecretsProviders []activeSecretsProvider
+	secrets                secretRedactor
+
+	templates templateCache
+
+	hardware   hardwareReports
+	discovered discoveredMachines
+	images     imageMirror
+	staticSums staticSums
+	batches    batches
+
+	transitionHooksLock sync.RWMutex
+	transitionHooks     []JobTransitionHook
+
 	logs chan string
 }
 
@@ -96,7 +136,16 @@ func New(c *config.Config) *Waitron {
 		done:                  make(chan struct{}, 1),
 		wg:                    sync.WaitGroup{},
 		activePlugins:         make([]activePlugin, 0, 1),
-		logs:                  make(chan string, 1000),
+		templates: templateCache{
+			sets:      make(map[string]*pongo2.TemplateSet),
+			templates: make(map[string]*pongo2.Template),
+		},
+		hardware:   hardwareReports{byMAC: make(map[string]*HardwareReport)},
+		discovered: discoveredMachines{byMAC: make(map[string]*DiscoveredMachine)},
+		images:     newImageMirror(),
+		staticSums: staticSums{byPath: make(map[string]staticSum), hashing: make(map[string]*staticSumCall)},
+		batches:    batches{byID: make(map[string]*Batch)},
+		logs:       make(chan string, 1000),
 	}
 
 	w.history.jobByToken = make(map[string]*Job)
@@ -104,6 +153,7 @@ func New(c *config.Config) *Waitron {
 	w.jobs.jobByToken = make(map[string]*Job)
 	w.jobs.jobByMAC = make(map[string]*Job)
 	w.jobs.jobByHostname = make(map[string]*Job)
+	w.jobs.localBootUntil = make(map[string]time.Time)
 
 	return w
 }
@@ -118,7 +168,7 @@ func (w *Waitron) addLog(s string, l config.LogLevel) bool {
 	}
 
 	select {
-	case w.logs <- fmt.Sprintf("[%s] %s", l, s):
+	case w.logs <- fmt.Sprintf("[%s] %s", l, w.secrets.redact(s)):
 		return true
 	default:
 		return false
@@ -180,6 +230,14 @@ func (w *Waitron) Init() error {
 		return err
 	}
 
+	if err := w.initSecretsProviders(); err != nil {
+		return err
+	}
+
+	if err := w.checkStageTemplates(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -223,6 +281,12 @@ func (w *Waitron) Run() error {
 
 	}()
 
+	w.startImageMirror()
+
+	if err := w.watchTemplates(); err != nil {
+		w.addLog(fmt.Sprintf("template cache disabled, unable to watch templatepath: %v", err), config.LogLevelWarning)
+	}
+
 	return nil
 }
 
@@ -237,24 +301,140 @@ func (w *Waitron) Stop() error {
 }
 
 /*
-	Loop through all active jobs and run stale-commands for any that have crossed their StaleBuildThresholdSeconds
+	Loop through all active jobs and handle any that have crossed their StaleBuildThresholdSeconds.
 */
 func (w *Waitron) checkForStaleJobs() {
 
-	staleJobs := make([]*Job, 0)
-
 	w.jobs.RLock()
+	jobs := make([]*Job, 0, len(w.jobs.jobByToken))
 	for _, j := range w.jobs.jobByToken {
-		if j.Machine.StaleBuildThresholdSeconds > 0 && int(time.Now().Sub(j.Start).Seconds()) >= j.Machine.StaleBuildThresholdSeconds {
-			staleJobs = append(staleJobs, j)
-		}
+		jobs = append(jobs, j)
 	}
 	w.jobs.RUnlock()
 
-	for _, j := range staleJobs {
+	now := time.Now()
+
+	for _, j := range jobs {
+		w.checkForStaleJob(j, now)
+	}
+}
+
+/*
+	A job that crosses its stale threshold is marked stale and has its stale-commands run once,
+	or again every StaleBuildCommandsRepeatSeconds if that's set.
+	If StaleBuildFailThresholdSeconds is set and the job is still stale that long after being marked,
+	it's failed, its cancel-commands are run, and it's cleaned up.
+	A stale job that falls back under the threshold, because progress was reported, returns to the status it had before.
+	A stale job that moves on by itself, like by fetching its finish template, starts the clock over from there.
+*/
+func (w *Waitron) checkForStaleJob(j *Job, now time.Time) {
+
+	j.Lock()
+
+	// Time spent waiting in the build queue doesn't count, and neither does anything before the job last left stale.
+	clockStart := j.Start
+	for _, t := range j.Transitions {
+		if (t.From == JobStatusQueued || t.From == JobStatusStale) && t.Time.After(clockStart) {
+			clockStart = t.Time
+		}
+	}
+
+	// Whether a job has been flagged is kept apart from its status, so a flagged job is only ever flagged once.
+	flagged := !j.staleSince.IsZero()
+
+	if flagged && j.Status != JobStatusStale {
+		j.staleSince = time.Time{}
+		j.staleCommandsLastRun = time.Time{}
+		flagged = false
+	}
+
+	// Installers that report progress can keep long builds from being flagged, if the machine allows it.
+	if j.Machine.ProgressResetsStaleTimer && j.LastProgress.After(clockStart) {
+		clockStart = j.LastProgress
+	}
+
+	threshold := time.Duration(j.Machine.StaleBuildThresholdSeconds) * time.Second
+	failThreshold := time.Duration(j.Machine.StaleBuildFailThresholdSeconds) * time.Second
+	repeat := time.Duration(j.Machine.StaleBuildCommandsRepeatSeconds) * time.Second
+
+	isStale := j.Machine.StaleBuildThresholdSeconds > 0 && now.Sub(clockStart) >= threshold
+
+	markStale, runCommands, failJob, recover := false, false, false, false
+
+	switch {
+	case !flagged:
+		markStale = isStale && canTransition(j.Status, JobStatusStale)
+		runCommands = markStale
+	case !isStale:
+		recover = true
+		j.staleSince = time.Time{}
+		j.staleCommandsLastRun = time.Time{}
+	case failThreshold > 0 && now.Sub(j.staleSince) >= failThreshold:
+		failJob = true
+	case repeat > 0 && now.Sub(j.staleCommandsLastRun) >= repeat:
+		runCommands = true
+	}
+
+	if markStale {
+		j.staleSince = now
+	}
+
+	if runCommands {
+		j.staleCommandsLastRun = now
+	}
+
+	// The status a stale job should return to is wherever it was before it was marked.
+	previousStatus := JobStatusInstalling
+	for idx := len(j.Transitions) - 1; idx >= 0; idx-- {
+		if j.Transitions[idx].To == JobStatusStale {
+			previousStatus = j.Transitions[idx].From
+			break
+		}
+	}
+
+	j.Unlock()
+
+	if recover {
+		if err := w.setJobStatus(j, previousStatus, "progress reported after the build was marked stale"); err != nil {
+			w.addJobLog(j, err.Error(), config.LogLevelError)
+		}
+		return
+	}
+
+	if markStale {
+		if err := w.setJobStatus(j, JobStatusStale, "stale build threshold exceeded"); err != nil {
+			w.addJobLog(j, err.Error(), config.LogLevelError)
+			return
+		}
+	}
+
+	if runCommands {
 		go func() {
+			w.addJobLog(j, fmt.Sprintf("running stale-build commands for job %s", j.Token), config.LogLevelInfo)
+
 			if err := w.runBuildCommands(j, j.Machine.StaleBuildCommands); err != nil {
-				w.addLog(err.Error(), config.LogLevelError)
+				w.addJobLog(j, err.Error(), config.LogLevelError)
+			}
+		}()
+	}
+
+	if failJob {
+		// Failing the job right away keeps the next check from picking it up again while the cancel-commands run.
+		if err := w.setJobStatus(j, JobStatusFailed, "stale build fail threshold exceeded"); err != nil {
+			w.addJobLog(j, err.Error(), config.LogLevelError)
+			return
+		}
+
+		go func() {
+			w.addJobLog(j, fmt.Sprintf("running cancel-build commands for stale job %s", j.Token), config.LogLevelInfo)
+
+			// The job is going away either way, so errors here are only logged.
+			if err := w.runBuildCommands(j, j.Machine.CancelBuildCommands); err != nil {
+				w.addJobLog(j, err.Error(), config.LogLevelError)
+			}
+
+			if err := w.cleanUpJob(j, JobStatusFailed, "stale build fail threshold exceeded"); err != nil {
+				w.addJobLog(j, err.Error(), config.LogLevelError)
 			}
 		}()
 	}
@@ -331,13 +511,22 @@ func (w *Waitron) runBuildCommands(j *Job, b []config.BuildCommand) error {
 			buildCommand.TimeoutSeconds = 5
 		}
 
-		tpl, err := pongo2.FromString(buildCommand.Command)
+		j.RLock()
+		set, loader := w.templateSet(j)
+		j.RUnlock()
+
+		tpl, err := w.templateFromString(set, loader, "build command", buildCommand.Command)
 		if err != nil {
 			return err
 		}
 
+		cmdline := ""
+
 		j.RLock()
-		cmdline, err := tpl.Execute(pongo2.Context{"job": j, "machine": j.Machine, "token": j.Token})
+		ctx := w.buildCommandContext(j)
+		if err = w.checkStrict("build command", buildCommand.Command, loader, ctx); err == nil {
+			cmdline, err = tpl.Execute(ctx)
+		}
 		j.RUnlock()
 
 		if err != nil {
@@ -345,7 +534,7 @@ func (w *Waitron) runBuildCommands(j *Job, b []config.BuildCommand) error {
 		}
 
 		if buildCommand.ShouldLog {
-			w.addLog(cmdline, config.LogLevelInfo)
+			w.addJobLog(j, cmdline, config.LogLevelInfo)
 		}
 
 		// Now actually execute the command and return err if ErrorsFatal
@@ -353,20 +542,53 @@ func (w *Waitron) runBuildCommands(j *Job, b []config.BuildCommand) error {
 
 		if err != nil {
 			if buildCommand.ErrorsFatal {
-				return errors.New(err.Error() + ":" + string(out))
+				w.addJobLog(j, "build command failed: "+err.Error()+":"+string(out), config.LogLevelError)
+				return errors.New(w.secrets.redact(err.Error() + ":" + string(out)))
 			} else {
-				w.addLog(err.Error()+":"+string(out), config.LogLevelWarning)
+				w.addJobLog(j, err.Error()+":"+string(out), config.LogLevelWarning)
 			}
+		} else if buildCommand.ShouldLog {
+			w.addJobLog(j, "build command output: "+string(out), config.LogLevelDebug)
 		}
 	}
 
 	return nil
 }
 
+/*
+	How a build should be started.
+*/
+type BuildOptions struct {
+	Force bool   // Take over MACs that other active jobs are using, instead of refusing to start.
+	Batch string // The ID of the batch the build is part of, if any.
+}
+
+/*
+	Returned when a new job would have the hostname of an active job, or would use MACs that active jobs are already using.
+	MACs is empty when it's the hostname that collided.
+*/
+type JobCollisionError struct {
+	Hostname string
+	MACs     []string
+	Tokens   []string // The active jobs that were collided with.
+}
+
+func (e *JobCollisionError) Error() string {
+	if len(e.MACs) == 0 {
+		return fmt.Sprintf("active job %s for '%s' must complete or be terminated before new job", strings.Join(e.Tokens, ", "), e.Hostname)
+	}
+
+	return fmt.Sprintf("MACs of '%s' are in use by active jobs %s: %s", e.Hostname, strings.Join(e.Tokens, ", "), strings.Join(e.MACs, ", "))
+}
+
 /*
 	Create a register a new job for the specified hostname, and optionally the build type.
 */
 func (w *Waitron) Build(hostname string, buildTypeName string, machineDefinitionOverride []byte) (string, error) {
+	return w.BuildWithOptions(hostname, buildTypeName, machineDefinitionOverride, BuildOptions{})
+}
+
+func (w *Waitron) BuildWithOptions(hostname string, buildTypeName string, machineDefinitionOverride []byte, o BuildOptions) (string, error) {
 	/*
 		Since the details of a BuildType can also exist directly in the root config,
 		an empty build-type can be assumed to mean we'll use that.
@@ -383,49 +605,53 @@ func (w *Waitron) Build(hostname string, buildTypeName string, machineDefinition
 		If not present, then it will be set from buildType - This must happen so that when the macaddress comes in for the pxe config, we will know what to serve.
 	*/
 
-	w.addLog(fmt.Sprintf("looking for already active job for '%s'", hostname), config.LogLevelDebug)
-
-	// Error or not, if an existing job was found, no new job permitted.
-	if _, found, _ := w.getActiveJob(hostname, ""); found {
-		return "", fmt.Errorf("active job for '%s' must complete or be terminated before new job", hostname)
-	}
-
-	// Generate a job token, which can optionally be used to authenticate requests.
-	token := uuid.New().String()
-
-	w.addLog(fmt.Sprintf("%s job token generated: %s", hostname, token), config.LogLevelInfo)
-
 	hostname = strings.ToLower(hostname)
 
-	w.addLog(fmt.Sprintf("retrieving complied machine details for job %s", token), config.LogLevelDebug)
+	w.addLog(fmt.Sprintf("looking for already active job for '%s'", hostname), config.LogLevelDebug)
 
-	// Get the compiled machine details from any config, build type, and plugins being used
-	foundMachine, err := w.GetMergedMachine(hostname, "", buildTypeName, machineDefinitionOverride)
+	/*
+		This is only an early way out, so that nothing gets set up for a job that can't be added.
+		addJob checks again, since another job could have been added while this one was being set up.
+	*/
+	w.jobs.RLock()
+	err := w.jobCollision(hostname, nil, false)
+	w.jobs.RUnlock()
 
 	if err != nil {
 		return "", err
 	}
 
-	// Prep the new Job
+	// Generate a job token, which can optionally be used to authenticate requests.
+	token := uuid.New().String()
+
+	// Prep the new Job.  It's created early so that everything logged while setting it up is kept with it.
 	j := &Job{
 		Start:         time.Now(),
 		RWMutex:       sync.RWMutex{},
-		Status:        "pending",
+		Status:        JobStatusPending,
 		StatusReason:  "",
-		Machine:       foundMachine,
 		BuildTypeName: buildTypeName,
 		Token:         token,
+		Batch:         o.Batch,
+		Log:           newJobLog(w.config.JobLogLines),
 	}
 
-	w.addLog(fmt.Sprintf("running pre-build commands for job %s", token), config.LogLevelDebug)
+	j.Transitions = []JobTransition{JobTransition{To: JobStatusPending, Time: j.Start, Reason: "job created"}}
 
-	// Perform any desired operations needed prior to setting build mode.
-	if err := w.runBuildCommands(j, j.Machine.PreBuildCommands); err != nil {
-		w.addLog(fmt.Sprintf("pre-build commands for %s returned errors %v", token, err), config.LogLevelDebug)
+	w.addJobLog(j, fmt.Sprintf("%s job token generated: %s", hostname, token), config.LogLevelInfo)
+
+	w.addJobLog(j, fmt.Sprintf("retrieving complied machine details for job %s", token), config.LogLevelDebug)
+
+	// Get the compiled machine details from any config, build type, and plugins being used
+	foundMachine, err := w.getMergedMachine(hostname, "", buildTypeName, machineDefinitionOverride, w.jobLogger(j))
+
+	if err != nil {
 		return "", err
 	}
 
-	w.addLog(fmt.Sprintf("normalizing macs for job %s", token), config.LogLevelDebug)
+	j.Machine = foundMachine
+
+	w.addJobLog(j, fmt.Sprintf("normalizing macs for job %s", token), config.LogLevelDebug)
 
 	// normalize interface MAC addresses
 	macs := make([]string, 0, len(j.Machine.Network))
@@ -438,28 +664,74 @@ func (w *Waitron) Build(hostname string, buildTypeName string, machineDefinition
 		}
 	}
 
-	w.addLog(fmt.Sprintf("adding job %s", token), config.LogLevelDebug)
+	w.addJobLog(j, fmt.Sprintf("adding job %s", token), config.LogLevelDebug)
 
-	if err = w.addJob(j, token, hostname, macs); err != nil {
+	/*
+		Added before the pre-build commands, since those usually do things like setting a machine to PXE boot,
+		and that shouldn't happen for a machine that collides with another job, or that has to wait in the queue.
+	*/
+	if err = w.addJob(j, token, hostname, macs, o.Force); err != nil {
+		w.addJobLog(j, fmt.Sprintf("job %s not added: %v", token, err), config.LogLevelWarning)
 		return "", err
 	}
 
-	w.addLog(fmt.Sprintf("job %s added", token), config.LogLevelInfo)
+	/*
+		A job can only be queued by addJob, but it can be promoted again at any time after that,
+		so it's whether it was queued at all that decides who runs its pre-build commands.
+	*/
+	j.RLock()
+	queuePosition := j.QueuePosition
+	queued := false
+	for _, t := range j.Transitions {
+		if t.To == JobStatusQueued {
+			queued = true
+		}
+	}
+	j.RUnlock()
+
+	if queued {
+		// Its pre-build commands are run once it's promoted.
+		w.addJobLog(j, fmt.Sprintf("job %s queued at position %d", token, queuePosition), config.LogLevelInfo)
+	} else if err := w.runPreBuildCommands(j); err != nil {
+		return "", err
+	}
+
+	w.addJobLog(j, fmt.Sprintf("job %s added", token), config.LogLevelInfo)
 
 	return token, nil
 }
 
+/*
+	Runs the pre-build commands of a job that's been added and isn't queued.  If they fail, the job is failed and cleaned up.
+*/
+func (w *Waitron) runPreBuildCommands(j *Job) error {
+	w.addJobLog(j, fmt.Sprintf("running pre-build commands for job %s", j.Token), config.LogLevelDebug)
+
+	// Perform any desired operations needed prior to setting build mode.
+	if err := w.runBuildCommands(j, j.Machine.PreBuildCommands); err != nil {
+		w.addJobLog(j, fmt.Sprintf("pre-build commands for %s returned errors %v", j.Token, err), config.LogLevelDebug)
+
+		if cerr := w.cleanUpJob(j, JobStatusFailed, "pre-build commands failed"); cerr != nil {
+			w.addJobLog(j, cerr.Error(), config.LogLevelError)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
 /*
 	This produces a Machine with data compiled from all enabled plugins.
 	This is not pulling data from Waitron.  It's pulling external data,
 	compiling it, and returning that.
 */
-func (w *Waitron) getMergedInventoryMachine(hostname string, mac string) (*machine.Machine, error) {
+func (w *Waitron) getMergedInventoryMachine(hostname string, mac string, lf func(string, config.LogLevel) bool) (*machine.Machine, error) {
 	m := &machine.Machine{}
 
 	anyFound := false
 
-	w.addLog(fmt.Sprintf("looping through %d active plugins", len(w.activePlugins)), config.LogLevelInfo)
+	lf(fmt.Sprintf("looping through %d active plugins", len(w.activePlugins)), config.LogLevelInfo)
 
 	/*
 		Take the hostname and start looping through the inventory plugins
@@ -479,11 +751,15 @@ func (w *Waitron) getMergedInventoryMachine(hostname string, mac string) (*machi
 		pm, err := ap.plugin.GetMachine(hostname, mac)
 
 		if err != nil {
-			w.addLog(fmt.Sprintf("failed to get machine from plugin in: %v", err), config.LogLevelInfo)
+			lf(fmt.Sprintf("failed to get machine from plugin in: %v", err), config.LogLevelInfo)
 			return nil, err
 		}
 
-		if pm != nil {
+		if pm == nil {
+			lf(fmt.Sprintf("plugin %s returned no details for '%s' '%s'", ap.settings.Name, hostname, mac), config.LogLevelDebug)
+		} else {
+			lf(fmt.Sprintf("plugin %s returned details for '%s' '%s'", ap.settings.Name, hostname, mac), config.LogLevelDebug)
+
 			// Just keep merging in details that we find
 			if b, err := yaml.Marshal(pm); err == nil {
 
@@ -501,7 +777,7 @@ func (w *Waitron) getMergedInventoryMachine(hostname string, mac string) (*machi
 				}
 			} else {
 				// Just log.  Don't let one plugin break everything.
-				w.addLog(fmt.Sprintf("failed to marshal plugin data during machine merging: %v", err), config.LogLevelError)
+				lf(fmt.Sprintf("failed to marshal plugin data during machine merging: %v", err), config.LogLevelError)
 				continue
 			}
 
@@ -517,7 +793,7 @@ func (w *Waitron) getMergedInventoryMachine(hostname string, mac string) (*machi
 
 	// Bail out if we didn't find the machine anywhere.
 	if !anyFound {
-		w.addLog(fmt.Sprintf("machine not found in any non-supplemental plugin"), config.LogLevelDebug)
+		lf(fmt.Sprintf("machine not found in any non-supplemental plugin"), config.LogLevelDebug)
 		return nil, nil
 	}
 
@@ -528,6 +804,10 @@ func (w *Waitron) getMergedInventoryMachine(hostname string, mac string) (*machi
   This produces the final merge machine with config and build type details.
 */
 func (w *Waitron) GetMergedMachine(hostname string, mac string, buildTypeName string, machineDefinitionOverride []byte) (*machine.Machine, error) {
+	return w.getMergedMachine(hostname, mac, buildTypeName, machineDefinitionOverride, w.addLog)
+}
+
+func (w *Waitron) getMergedMachine(hostname string, mac string, buildTypeName string, machineDefinitionOverride []byte, lf func(string, config.LogLevel) bool) (*machine.Machine, error) {
 
 	/*
 		We need the "merge" order to go config -> build type -> machine -> machineDefinition (something passed in from a cli etc that will override everything.)
@@ -535,9 +815,7 @@ func (w *Waitron) GetMergedMachine(hostname string, mac string, buildTypeName st
 		so we need to take the initial machine compile from plugins, then create a new base machine and start merging
 		things in the order we want because we wouldn't know the true final build type until after the plugins have provided all the details.
 	*/
-	baseMachine := &machine.Machine{}
-
-	foundMachine, err := w.getMergedInventoryMachine(hostname, mac)
+	foundMachine, err := w.getMergedInventoryMachine(hostname, mac, lf)
 
 	if err != nil {
 		return nil, err
@@ -547,6 +825,16 @@ func (w *Waitron) GetMergedMachine(hostname string, mac string, buildTypeName st
 		return nil, fmt.Errorf("'%s' '%s' not found using any active plugin", hostname, mac)
 	}
 
+	return w.mergeMachine(foundMachine, buildTypeName, machineDefinitionOverride)
+}
+
+/*
+	Merges the config, build type, machine, and any overriding machine definition, in that order, into a new machine.
+*/
+func (w *Waitron) mergeMachine(foundMachine *machine.Machine, buildTypeName string, machineDefinitionOverride []byte) (*machine.Machine, error) {
+
+	baseMachine := &machine.Machine{}
+
 	// Merge in the "global" config.  The marshal/unmarshal combo looks funny, but we've given up completely on speed at this point.
 	if c, err := yaml.Marshal(w.config); err == nil {
 		if err = yaml.Unmarshal(c, baseMachine); err != nil {
@@ -588,11 +876,15 @@ func (w *Waitron) GetMergedMachine(hostname string, mac string, buildTypeName st
 
 	// Finally, merge in any overriding machine-specific details that were passed in.
 	if machineDefinitionOverride != nil {
-		if err = yaml.Unmarshal(machineDefinitionOverride, baseMachine); err != nil {
+		if err := yaml.Unmarshal(machineDefinitionOverride, baseMachine); err != nil {
 			return nil, err
 		}
 	}
 
+	if err := applyInstallProfile(baseMachine); err != nil {
+		return nil, err
+	}
+
 	return baseMachine, nil
 }
 
@@ -608,7 +900,7 @@ func (w *Waitron) GetMachineStatus(hostname string) (string, error) {
 	j.RLock()
 	defer j.RUnlock()
 
-	return j.Status, nil
+	return string(j.Status), nil
 }
 
 /*
@@ -623,7 +915,7 @@ func (w *Waitron) GetActiveJobStatus(token string) (string, error) {
 	j.RLock()
 	defer j.RUnlock()
 
-	return j.Status, nil
+	return string(j.Status), nil
 }
 
 /*
@@ -642,20 +934,33 @@ func (w *Waitron) GetJobStatus(token string) (string, error) {
 	j.RLock()
 	defer j.RUnlock()
 
-	return j.Status, nil
+	return string(j.Status), nil
 }
 
 /*
 	Adds a new build job
 */
-func (w *Waitron) addJob(j *Job, token string, hostname string, macs []string) error {
+func (w *Waitron) addJob(j *Job, token string, hostname string, macs []string, force bool) error {
 	w.jobs.Lock()
-	defer w.jobs.Unlock()
+
+	// Checked while holding the jobs lock so that two new jobs can't both claim the same hostname or MACs.
+	if err := w.jobCollision(hostname, macs, force); err != nil {
+		w.jobs.Unlock()
+		return err
+	}
+
+	// This has to happen while holding the jobs lock so that two new jobs can't both take the last open slot.
+	queued := w.queueIfOverLimits(j)
 
 	w.jobs.jobByToken[token] = j
 	w.jobs.jobByHostname[hostname] = j
 
+	taken := make(map[*Job][]string)
+
 	for _, mac := range macs {
+		if other, found := w.jobs.jobByMAC[mac]; found && other != j {
+			taken[other] = append(taken[other], mac)
+		}
 		w.jobs.jobByMAC[mac] = j
 	}
 
@@ -663,6 +968,56 @@ func (w *Waitron) addJob(j *Job, token string, hostname string, macs []string) e
 	w.history.jobByToken[token] = j
 	w.history.Unlock()
 
+	w.jobs.Unlock()
+
+	for other, otherMACs := range taken {
+		msg := fmt.Sprintf("job %s for '%s' took over MACs %s from job %s", token, hostname, strings.Join(otherMACs, ", "), other.Token)
+		w.addJobLog(j, msg, config.LogLevelWarning)
+		w.addJobLog(other, msg, config.LogLevelWarning)
+	}
+
+	if queued != nil {
+		w.runTransitionHooks(j, *queued)
+	}
+
+	return nil
+}
+
+/*
+	Returns a *JobCollisionError if an active job has the hostname, or, unless forced, is using any of the MACs.
+	The caller must hold the jobs lock.
+*/
+func (w *Waitron) jobCollision(hostname string, macs []string, force bool) error {
+	// The token of a job never changes, so it's safe to read without the job lock.
+	if other, found := w.jobs.jobByHostname[hostname]; found {
+		return &JobCollisionError{Hostname: hostname, Tokens: []string{other.Token}}
+	}
+
+	if force {
+		return nil
+	}
+
+	e := &JobCollisionError{Hostname: hostname}
+	seen := make(map[*Job]bool)
+
+	for _, mac := range macs {
+		other, found := w.jobs.jobByMAC[mac]
+		if !found {
+			continue
+		}
+
+		e.MACs = append(e.MACs, mac)
+
+		if !seen[other] {
+			seen[other] = true
+			e.Tokens = append(e.Tokens, other.Token)
+		}
+	}
+
+	if len(e.MACs) > 0 {
+		return e
+	}
+
 	return nil
 }
 
@@ -709,9 +1064,9 @@ func (w *Waitron) getActiveJob(hostname string, token string) (*Job, bool, error
 	This is simply a hook to allow power users to load in special "registration" OS images that they can use
 	to, for example, collect and register machine details for new machines into their inventory management system.
 */
-func (w *Waitron) getPxeConfigForUnknown(b *config.BuildType, macaddress string) (PixieConfig, error) {
+func (w *Waitron) getPxeConfigForUnknown(b *config.BuildType, macaddress string, source string) (PixieConfig, error) {
 
-	m, err := w.getMergedInventoryMachine("", macaddress)
+	m, err := w.getMergedInventoryMachine("", macaddress, w.addLog)
 
 	if err != nil {
 		return PixieConfig{}, err
@@ -722,6 +1077,8 @@ func (w *Waitron) getPxeConfigForUnknown(b *config.BuildType, macaddress string)
 		return PixieConfig{}, fmt.Errorf("job not found for  '%s' and _unknown_ builds not requested", macaddress)
 	}
 
+	w.discover(macaddress, source)
+
 	w.addLog(fmt.Sprintf("running unknown-build commands for job %s", macaddress), config.LogLevelDebug)
 
 	// Perform any desired operations when an unknown MAC is seen.
@@ -748,34 +1105,44 @@ func (w *Waitron) getPxeConfigForUnknown(b *config.BuildType, macaddress string)
 
 	cmdline = b.Cmdline
 
-	tpl, err := pongo2.FromString(cmdline)
+	// There's no machine, so includes only come from build_types/_unknown_/ and the root of templatepath.
+	set, loader := w.templateSet(&Job{BuildTypeName: "_unknown_"})
+
+	tpl, err := w.templateFromString(set, loader, "cmdline", cmdline)
 	if err != nil {
 		return pixieConfig, err
 	}
 
-	cmdline, err = tpl.Execute(pongo2.Context{"machine": b, "BaseURL": w.config.BaseURL, "Hostname": macaddress, "MAC": macaddress})
+	cmdline, err = tpl.Execute(pongo2.Context{"machine": b, "BaseURL": w.config.BaseURL, "Hostname": macaddress, "MAC": macaddress, "secret": w.secretFunc(nil)})
 
 	if err != nil {
 		return pixieConfig, err
 	}
 
-	imageURL := strings.TrimRight(b.ImageURL, "/")
-
-	pixieConfig.Kernel = imageURL + "/" + b.Kernel
-	for _, initrd := range b.Initrd {
-		pixieConfig.Initrd = append(pixieConfig.Initrd, imageURL+"/"+initrd)
+	if pixieConfig.Kernel, pixieConfig.Initrd, err = w.bootURLs(b.Images, "_unknown_", b.ImageURL, b.Kernel, b.Initrd); err != nil {
+		w.addLog(fmt.Sprintf("not sending _unknown_ details to %s: %v", macaddress, err), config.LogLevelWarning)
+		return PixieConfig{}, err
 	}
 	pixieConfig.Cmdline = cmdline
 
 	return pixieConfig, nil
 }
 
+/*
+	Logs that a job's installer has been served as many times as it's allowed to be, and returns the ErrLocalBoot to send back.
+*/
+func (w *Waitron) pxeServeLimitReached(j *Job, pxeServes int, macaddress string) error {
+	w.addJobLog(j, fmt.Sprintf("installer already served %d times for job %s, telling %s to boot locally", pxeServes, j.Token, macaddress), config.LogLevelInfo)
+	return fmt.Errorf("%w: installer already served %d times for job %s", ErrLocalBoot, pxeServes, j.Token)
+}
+
 /*
 	Retrieves the PXE config based on the details of the job related to the specified MAC.
 	This will/should be called when Waitron receives a request from something pixiecore, which is basically forwarding along
-	the MAC from the DHCP request.
+	the MAC from the DHCP request.  The source is whatever asked, usually the address of the pixiecore, and is only
+	used to record where unknown MACs were seen.
 */
-func (w *Waitron) GetPxeConfig(macaddress string) (PixieConfig, error) {
+func (w *Waitron) GetPxeConfig(macaddress string, source string) (PixieConfig, error) {
 
 	// Normalize the MAC
 	r := strings.NewReplacer(":", "", "-", "", ".", "")
@@ -784,11 +1151,26 @@ func (w *Waitron) GetPxeConfig(macaddress string) (PixieConfig, error) {
 	// Look up the *Job by MAC
 	w.jobs.RLock()
 	j, found := w.jobs.jobByMAC[normMacaddress]
+	localBootUntil, recentlyBuilt := w.jobs.localBootUntil[normMacaddress]
 	w.jobs.RUnlock()
 
+	// A machine that just finished building may still try PXE first, and it shouldn't end up in _unknown_.
+	if !found && recentlyBuilt {
+		if time.Now().Before(localBootUntil) {
+			w.addLog(fmt.Sprintf("telling recently built %s to boot locally", normMacaddress), config.LogLevelInfo)
+			return PixieConfig{}, fmt.Errorf("%w: '%s' was built recently", ErrLocalBoot, normMacaddress)
+		}
+
+		w.jobs.Lock()
+		if until, stillThere := w.jobs.localBootUntil[normMacaddress]; stillThere && !time.Now().Before(until) {
+			delete(w.jobs.localBootUntil, normMacaddress)
+		}
+		w.jobs.Unlock()
+	}
+
 	if !found {
 		if uBuild, ok := w.config.BuildTypes["_unknown_"]; ok {
-			return w.getPxeConfigForUnknown(&uBuild, normMacaddress)
+			return w.getPxeConfigForUnknown(&uBuild, normMacaddress, source)
 		} else {
 			return PixieConfig{}, fmt.Errorf("job not found for  '%s'", normMacaddress)
 		}
@@ -807,16 +1189,46 @@ func (w *Waitron) GetPxeConfig(macaddress string) (PixieConfig, error) {
 	*/
 	uniquePxeRequest := false
 
+	// Don't bother building anything for a job that can't be installing, such as one that has already failed.
+	if err := w.checkJobStatus(j, JobStatusInstalling); err != nil {
+		return pixieConfig, err
+	}
+
+	// Nothing is served until every image the machine boots has been verified.  The machine will just try again later.
+	kernelURL, initrdURLs, err := w.bootURLs(j.Machine.Images, j.BuildTypeName, j.Machine.ImageURL, j.Machine.Kernel, j.Machine.Initrd)
+	if err != nil {
+		w.addJobLog(j, fmt.Sprintf("not sending PXE config to %s: %v", macaddress, err), config.LogLevelWarning)
+		return pixieConfig, err
+	}
+
+	/*
+		Past the limit, the installer has probably already done its part, and the machine is back in PXE because it comes before the disk in the boot order.
+		This is only a quick check so nothing gets rendered for nothing.  The serve is counted once the cmdline has rendered.
+	*/
+	j.RLock()
+	pxeServes := j.PxeServes
+	j.RUnlock()
+
+	if j.Machine.PxeServeLimit > 0 && pxeServes >= j.Machine.PxeServeLimit {
+		return pixieConfig, w.pxeServeLimitReached(j, pxeServes, macaddress)
+	}
+
 	j.RLock()
 
 	cmdline := j.Machine.Cmdline
 
-	tpl, err := pongo2.FromString(cmdline)
+	set, loader := w.templateSet(j)
+
+	tpl, err := w.templateFromString(set, loader, "cmdline", cmdline)
 	if err != nil {
+		j.RUnlock()
 		return pixieConfig, err
 	}
 
-	cmdline, err = tpl.Execute(pongo2.Context{"machine": j.Machine, "BaseURL": j.Machine.BaseURL, "Hostname": j.Machine.Hostname, "Token": j.Token})
+	ctx := w.cmdlineContext(j)
+	if err = w.checkStrict("cmdline", cmdline, loader, ctx); err == nil {
+		cmdline, err = tpl.Execute(ctx)
+	}
 
 	j.RUnlock()
 	j.Lock()
@@ -826,32 +1238,45 @@ func (w *Waitron) GetPxeConfig(macaddress string) (PixieConfig, error) {
 		makes me too nervous.  It just feels too dead-lockish.
 	*/
 
+	/*
+		A cmdline that didn't render never got to the machine, so it doesn't use up a serve.
+		The limit is checked again here, since another request could have taken the last serve while this one was rendering.
+	*/
+	if err == nil {
+		pxeServes = j.PxeServes
+		if j.Machine.PxeServeLimit > 0 && pxeServes >= j.Machine.PxeServeLimit {
+			j.Unlock()
+			return pixieConfig, w.pxeServeLimitReached(j, pxeServes, macaddress)
+		}
+		j.PxeServes++
+	}
+
 	if j.TriggerMacRaw != macaddress {
 		uniquePxeRequest = true
 		j.TriggerMacRaw = macaddress
 		j.TriggerMacNormalized = normMacaddress
 	}
 
+	j.Unlock()
+
 	if err != nil {
-		j.Status = "failed"
-		j.StatusReason = "pxe config build failed"
+		w.addJobLog(j, fmt.Sprintf("failed to build PXE config for %s: %v", macaddress, err), config.LogLevelError)
 
-		j.Unlock()
+		if serr := w.setJobStatus(j, JobStatusFailed, "pxe config build failed"); serr != nil {
+			w.addJobLog(j, serr.Error(), config.LogLevelError)
+		}
 
 		return pixieConfig, err
-	} else {
-		j.Status = "installing"
-		j.StatusReason = "pxe config sent"
 	}
 
-	j.Unlock()
+	if err := w.setJobStatus(j, JobStatusInstalling, "pxe config sent"); err != nil {
+		return pixieConfig, err
+	}
 
-	imageURL := strings.TrimRight(j.Machine.ImageURL, "/")
+	w.addJobLog(j, fmt.Sprintf("PXE request received from %s for job %s", macaddress, j.Token), config.LogLevelInfo)
 
-	pixieConfig.Kernel = imageURL + "/" + j.Machine.Kernel
-	for _, initrd := range j.Machine.Initrd {
-		pixieConfig.Initrd = append(pixieConfig.Initrd, imageURL+"/"+initrd)
-	}
+	pixieConfig.Kernel = kernelURL
+	pixieConfig.Initrd = initrdURLs
 	pixieConfig.Cmdline = cmdline
 
 	/*
@@ -864,12 +1289,12 @@ func (w *Waitron) GetPxeConfig(macaddress string) (PixieConfig, error) {
 	if uniquePxeRequest {
 		go func() {
 			if err := w.runBuildCommands(j, j.Machine.PxeEventCommands); err != nil {
-				w.addLog(fmt.Sprintf("pxe-event commands for %s returned errors %v", macaddress, err), config.LogLevelError)
+				w.addJobLog(j, fmt.Sprintf("pxe-event commands for %s returned errors %v", macaddress, err), config.LogLevelError)
 			}
 		}()
 	}
 
-	w.addLog(fmt.Sprintf("PXE config for %s: %v", macaddress, pixieConfig), config.LogLevelDebug)
+	w.addJobLog(j, fmt.Sprintf("PXE config for %s: %v", macaddress, pixieConfig), config.LogLevelDebug)
 
 	return pixieConfig, nil
 }
@@ -877,28 +1302,66 @@ func (w *Waitron) GetPxeConfig(macaddress string) (PixieConfig, error) {
 /*
 	Clean up the references to the job, excluding from the job history
 */
-func (w *Waitron) cleanUpJob(j *Job, status string) error {
+func (w *Waitron) cleanUpJob(j *Job, status JobStatus, reason string) error {
 	// Take the list of all macs found in that Jobs Machine->Network
 	// Use host, token, and list of MACs to clean out the details from Jobs
 
+	if err := w.setJobStatus(j, status, reason); err != nil {
+		return err
+	}
+
 	j.Lock()
-	j.Status = status
-	j.StatusReason = ""
 	j.End = time.Now()
 	j.Unlock()
 
-	j.RLock()
-	defer j.RUnlock()
-
+	/*
+		The machine details of a job don't change once it's been added, so they're safe to read without the job lock.
+		Holding the job lock while waiting on the jobs lock would invert the order used when looping through jobs.
+	*/
 	w.jobs.Lock()
-	defer w.jobs.Unlock()
 
+	// Only entries that are still this job's go, since a forced build might have taken over some of its MACs.
 	for _, iface := range j.Machine.Network {
-		delete(w.jobs.jobByMAC, iface.MacAddress)
+		if w.jobs.jobByMAC[iface.MacAddress] == j {
+			delete(w.jobs.jobByMAC, iface.MacAddress)
+		}
 	}
 
-	delete(w.jobs.jobByToken, j.Token)
-	delete(w.jobs.jobByHostname, j.Machine.Hostname)
+	if w.jobs.jobByToken[j.Token] == j {
+		delete(w.jobs.jobByToken, j.Token)
+	}
+
+	if w.jobs.jobByHostname[j.Machine.Hostname] == j {
+		delete(w.jobs.jobByHostname, j.Machine.Hostname)
+	}
+
+	now := time.Now()
+
+	for mac, until := range w.jobs.localBootUntil {
+		if !now.Before(until) {
+			delete(w.jobs.localBootUntil, mac)
+		}
+	}
+
+	if status == JobStatusCompleted && j.Machine.LocalBootGraceSeconds > 0 {
+		until := now.Add(time.Duration(j.Machine.LocalBootGraceSeconds) * time.Second)
+
+		for _, iface := range j.Machine.Network {
+			if iface.MacAddress != "" {
+				w.jobs.localBootUntil[iface.MacAddress] = until
+			}
+		}
+	}
+
+	w.dequeueJob(j)
+
+	w.jobs.Unlock()
+
+	// Logged after the job is gone from the active indexes so that anyone following the job log can see that it's over.
+	w.addJobLog(j, fmt.Sprintf("job %s cleaned up with status %s", j.Token, status), config.LogLevelInfo)
+
+	// A slot might have just opened up for something in the queue.
+	w.promoteQueuedJobs()
 
 	return nil
 }
@@ -914,12 +1377,19 @@ func (w *Waitron) FinishBuild(hostname string, token string) error {
 		return err
 	}
 
+	// Don't run any post-build commands for a job that can't be completed.
+	if err := w.checkJobStatus(j, JobStatusCompleted); err != nil {
+		return err
+	}
+
+	w.addJobLog(j, fmt.Sprintf("running post-build commands for job %s", j.Token), config.LogLevelDebug)
+
 	if err := w.runBuildCommands(j, j.Machine.PostBuildCommands); err != nil {
 		return err
 	}
 
 	// Run clean-up if all finish commands were successful (or non-fatal).
-	return w.cleanUpJob(j, "completed")
+	return w.cleanUpJob(j, JobStatusCompleted, "build completed")
 }
 
 /*
@@ -933,12 +1403,18 @@ func (w *Waitron) CancelBuild(hostname string, token string) error {
 		return err
 	}
 
+	if err := w.checkJobStatus(j, JobStatusTerminated); err != nil {
+		return err
+	}
+
+	w.addJobLog(j, fmt.Sprintf("running cancel-build commands for job %s", j.Token), config.LogLevelDebug)
+
 	if err := w.runBuildCommands(j, j.Machine.CancelBuildCommands); err != nil {
 		return err
 	}
 
 	// Run clean-up if all cancel commands were successful (or non-fatal).
-	return w.cleanUpJob(j, "terminated")
+	return w.cleanUpJob(j, JobStatusTerminated, "build cancelled")
 }
 
 /*
@@ -948,18 +1424,21 @@ func (w *Waitron) CancelBuild(hostname string, token string) error {
 func (w *Waitron) CleanHistory() error {
 	// Loop through all items in JobsHistory and check existence in Waitron.jobs.JobByToken
 	// If not found, it's either completed or terminated and can be cleaned out.
-	w.history.Lock()
-	defer w.history.Unlock()
-
+	// Jobs before history, the same order addJob takes them in.
 	w.jobs.RLock()
 	defer w.jobs.RUnlock()
 
+	w.history.Lock()
+	defer w.history.Unlock()
+
 	for token := range w.history.jobByToken {
 		if _, found := w.jobs.jobByToken[token]; !found {
 			delete(w.history.jobByToken, token)
 		}
 	}
 
+	w.cleanBatches()
+
 	/*
 		We're not invalidating the history cache here.
 		Cleaning history will clean out complete jobs, which doesn't seem much different from
@@ -1021,6 +1500,8 @@ func (w *Waitron) GetJobsHistoryBlob() ([]byte, error) {
 			return b, err
 		}
 
+		b = w.secrets.redactJSON(b)
+
 		w.historyBlobCache = append(w.historyBlobCache, ',')
 		w.historyBlobCache = append(w.historyBlobCache, b...) // So it's not _quite_ as bad as it looks? --> https://stackoverflow.com/questions/16248241/concatenate-two-slices-in-go#comment40751903_16248257
 	}
@@ -1054,11 +1535,13 @@ func (w *Waitron) GetJobBlob(token string) ([]byte, error) {
 		return []byte{}, err
 	}
 
-	return b, nil
+	return w.secrets.redactJSON(b), nil
 }
 
 /*
 	Returns a fully rendered template for the ACTIVE job specified by the token.
+	The template can be any of those declared in the templates of the machine, plus preseed and finish,
+	which are always available as long as they're set.
 */
 func (w *Waitron) RenderStageTemplate(token string, templateStage string) (string, error) {
 
@@ -1067,14 +1550,103 @@ func (w *Waitron) RenderStageTemplate(token string, templateStage string) (strin
 		return "", err
 	}
 
-	// Render preseed as default
-	templateName := j.Machine.Preseed
+	st, found := stageTemplate(j.Machine, templateStage)
+	if !found {
+		w.addJobLog(j, fmt.Sprintf("template %s not declared for job %s", templateStage, j.Token), config.LogLevelWarning)
+		return "", fmt.Errorf("template '%s': %w", templateStage, ErrTemplateNotFound)
+	}
+
+	if st.Status != "" {
+		status := JobStatus(st.Status)
+
+		if !stageTemplateStatuses[status] {
+			return "", fmt.Errorf("template '%s' has invalid status '%s'", templateStage, st.Status)
+		}
+
+		if err := w.setJobStatus(j, status, "processing "+st.File); err != nil {
+			return "", err
+		}
+	}
+
+	return w.renderTemplate(st.File, templateStage, j)
+}
+
+/*
+	The statuses that rendering a template can move a job to.  Anything that would end a job has to go through done or cancel.
+*/
+var stageTemplateStatuses = map[JobStatus]bool{
+	JobStatusInstalling: true,
+	JobStatusPreseed:    true,
+	JobStatusFinish:     true,
+}
+
+/*
+	Checks the status of every template in the config and build types, so a typo stops waitron from starting
+	instead of failing a build when the machine gets to that template.  Templates from inventory plugins can only be checked when they're rendered.
+*/
+func (w *Waitron) checkStageTemplates() error {
+	check := func(buildTypeName string, templates map[string]config.StageTemplate) error {
+		names := make([]string, 0, len(templates))
+		for name := range templates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			status := JobStatus(templates[name].Status)
+
+			if status == "" {
+				continue
+			}
+
+			if _, known := jobStatusTransitions[status]; !known {
+				return fmt.Errorf("template '%s' of build type '%s' has unknown status '%s'", name, buildTypeName, status)
+			}
+
+			if !stageTemplateStatuses[status] {
+				return fmt.Errorf("template '%s' of build type '%s' has status '%s', which templates can't move jobs to", name, buildTypeName, status)
+			}
+		}
+
+		return nil
+	}
+
+	if err := check("_default_", w.config.Templates); err != nil {
+		return err
+	}
+
+	buildTypeNames := make([]string, 0, len(w.config.BuildTypes))
+	for name := range w.config.BuildTypes {
+		buildTypeNames = append(buildTypeNames, name)
+	}
+	sort.Strings(buildTypeNames)
+
+	for _, name := range buildTypeNames {
+		if err := check(name, w.config.BuildTypes[name].Templates); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
 
-	if templateStage == "finish" {
-		templateName = j.Machine.Finish
+/*
+	Looks up a named template for a machine.
+	Anything in the templates of the machine wins, so preseed and finish can be given a different status or none at all.
+*/
+func stageTemplate(m *machine.Machine, name string) (config.StageTemplate, bool) {
+	if st, found := m.Templates[name]; found && st.File != "" {
+		return st, true
 	}
 
-	return w.renderTemplate(templateName, templateStage, j)
+	switch {
+	case name == "preseed" && m.Preseed != "":
+		return config.StageTemplate{File: m.Preseed, Status: string(JobStatusPreseed)}, true
+	case name == "finish" && m.Finish != "":
+		return config.StageTemplate{File: m.Finish, Status: string(JobStatusFinish)}, true
+	}
+
+	return config.StageTemplate{}, false
 }
 
 /*
@@ -1082,23 +1654,59 @@ func (w *Waitron) RenderStageTemplate(token string, templateStage string) (strin
 */
 func (w *Waitron) renderTemplate(templateName string, templateStage string, j *Job) (string, error) {
 
-	j.Lock()
-	j.Status = templateStage
-	j.StatusReason = "processing " + templateName
-	j.Unlock()
-
 	j.RLock()
 	defer j.RUnlock()
 
-	templateName = path.Join(w.config.TemplatePath, templateName)
-	if _, err := os.Stat(templateName); err != nil {
+	set, loader := w.templateSet(j)
+
+	file, err := loader.resolve(templateName)
+	if err != nil {
+		w.addJobLog(j, fmt.Sprintf("template %s for stage %s does not exist", templateName, templateStage), config.LogLevelError)
 		return "", errors.New("Template does not exist")
 	}
 
-	var tpl = pongo2.Must(pongo2.FromFile(templateName))
-	result, err := tpl.Execute(pongo2.Context{"job": j, "machine": j.Machine, "config": w.config, "Token": j.Token})
+	w.addJobLog(j, fmt.Sprintf("rendering template %s for stage %s", file, templateStage), config.LogLevelInfo)
+
+	tpl, err := w.templateFromFile(set, loader, templateName)
 	if err != nil {
+		w.addJobLog(j, fmt.Sprintf("%v (%s)", err, file), config.LogLevelError)
+		return "", err
+	}
+
+	ctx := w.templateContext(j)
+
+	if w.config.StrictTemplates {
+		_, source, err := loader.read(templateName)
+		if err != nil {
+			return "", err
+		}
+
+		if err = w.checkStrict(templateName, string(source), loader, ctx); err != nil {
+			w.addJobLog(j, fmt.Sprintf("failed to render template %s: %v", file, err), config.LogLevelError)
+			return "", err
+		}
+	}
+
+	result, err := tpl.Execute(ctx)
+	if err != nil {
+		w.addJobLog(j, fmt.Sprintf("failed to render template %s: %v", file, err), config.LogLevelError)
 		return "", err
 	}
 	return result, err
 }
+
+/*
+	What build commands, cmdlines, and templates of a job get to see when they're rendered.
+	The job must be at least read-locked by the caller.
+*/
+func (w *Waitron) buildCommandContext(j *Job) pongo2.Context {
+	return pongo2.Context{"job": j, "machine": j.Machine, "token": j.Token, "secret": w.secretFunc(j)}
+}
+
+func (w *Waitron) cmdlineContext(j *Job) pongo2.Context {
+	return pongo2.Context{"machine": j.Machine, "BaseURL": j.Machine.BaseURL, "Hostname": j.Machine.Hostname, "Token": j.Token, "secret": w.secretFunc(j)}
+}
+
+func (w *Waitron) templateContext(j *Job) pongo2.Context {
+	return pongo2.Context{"job": j, "machine": j.Machine, "config": w.config, "Token": j.Token, "secret": w.secretFunc(j)}
+}
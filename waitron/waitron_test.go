@@ -1,6 +1,8 @@
 package waitron_test
 
 import (
+	"errors"
+	"strings"
 	"testing"
 
 	"waitron/config"
@@ -183,6 +185,18 @@ func TestWaitron(t *testing.T) {
 
 	/******************************************************************/
 
+	if entries, err := w.GetJobLog(token); err != nil || len(entries) == 0 {
+		t.Errorf("Failed to get job log for known token: err(%v) entries(%v)", err, entries)
+		return
+	}
+
+	if _, err := w.GetJobLog("not-a-token"); err == nil {
+		t.Errorf("Returned job log for unknown token")
+		return
+	}
+
+	/******************************************************************/
+
 	status, err := w.GetJobStatus(token)
 	if err != nil {
 		t.Errorf("Failed to get job status: %v", err)
@@ -209,26 +223,26 @@ func TestWaitron(t *testing.T) {
 
 	/******************************************************************/
 
-	if _, err = w.GetPxeConfig("de:ad:c0:de:ca:fe"); err == nil {
+	if _, err = w.GetPxeConfig("de:ad:c0:de:ca:fe", ""); err == nil {
 		t.Errorf("Returned PXE config for unknown MAC")
 		return
 	}
 
-	pCfg, err := w.GetPxeConfig("deadbeef")
+	pCfg, err := w.GetPxeConfig("deadbeef", "")
 
 	if err != nil {
 		t.Errorf("Failed to return PXE config for known MAC v3: %v", err)
 		return
 	}
 
-	pCfg, err = w.GetPxeConfig("de:ad:be:ef")
+	pCfg, err = w.GetPxeConfig("de:ad:be:ef", "")
 
 	if err != nil {
 		t.Errorf("Failed to return PXE config for known MAC v2: %v", err)
 		return
 	}
 
-	pCfg, err = w.GetPxeConfig("DE-AD-BE-EF")
+	pCfg, err = w.GetPxeConfig("DE-AD-BE-EF", "")
 
 	if err != nil {
 		t.Errorf("Failed to return PXE config for known MAC v3: %v", err)
@@ -255,7 +269,7 @@ func TestWaitron(t *testing.T) {
 		Initrd:   []string{"it_is_rd"},
 	}
 
-	uCfg, err := w.GetPxeConfig("un:kn:ow:nt:hi:ng")
+	uCfg, err := w.GetPxeConfig("un:kn:ow:nt:hi:ng", "")
 
 	if err != nil {
 		t.Errorf("Failed to return PXE config for unknown MAC when _unknown_ exists: %v", err)
@@ -283,6 +297,28 @@ func TestWaitron(t *testing.T) {
 
 	/******************************************************************/
 
+	if err = w.ReportProgress("test01.prod", token, waitron.ProgressEvent{Phase: "partitioning", Percent: 20}); err != nil {
+		t.Errorf("Failed to report progress: %v", err)
+		return
+	}
+
+	if err = w.ReportProgress("test01.prod", token, waitron.ProgressEvent{Phase: "partitioning", Percent: 120}); err == nil {
+		t.Errorf("Accepted progress report with invalid percentage")
+		return
+	}
+
+	if err = w.ReportProgress("test01.prod", "not-a-token", waitron.ProgressEvent{Phase: "partitioning"}); err == nil {
+		t.Errorf("Accepted progress report for unknown job")
+		return
+	}
+
+	if j, err := w.GetJobBlob(token); err != nil || !strings.Contains(string(j), "partitioning") {
+		t.Errorf("Progress missing from job blob: err(%v) job(%s)", err, j)
+		return
+	}
+
+	/******************************************************************/
+
 	if err = w.FinishBuild("test01.prod", token); err != nil {
 		t.Errorf("Failed to finish build: %v", err)
 		return
@@ -359,3 +395,102 @@ func TestWaitron(t *testing.T) {
 		return
 	}
 }
+
+// Two machines that were given the same NIC.
+type CollisionPlugin struct {
+}
+
+func (t *CollisionPlugin) Init() error {
+	return nil
+}
+
+func (t *CollisionPlugin) GetMachine(s string, m string) (*machine.Machine, error) {
+	if s != "copy01.prod" && s != "copy02.prod" {
+		return nil, nil
+	}
+
+	return &machine.Machine{
+		Hostname: s,
+		Network: []machine.Interface{
+			machine.Interface{MacAddress: "DE:AD:BE:EF:00:01"},
+			machine.Interface{MacAddress: "de:ad:be:ef:00:0" + s[5:6]},
+		},
+	}, nil
+}
+
+func (t *CollisionPlugin) PutMachine(m *machine.Machine) error {
+	return nil
+}
+
+func (t *CollisionPlugin) Deinit() error {
+	return nil
+}
+
+func TestBuildCollisions(t *testing.T) {
+	w := waitron.New(&config.Config{
+		BuildType:  config.BuildType{Cmdline: "cmd", ImageURL: "image.com", Kernel: "popcorn"},
+		BuildTypes: make(map[string]config.BuildType),
+		MachineInventoryPlugins: []config.MachineInventoryPluginSettings{
+			config.MachineInventoryPluginSettings{Name: "collision", Type: "collision"},
+		},
+	})
+
+	if err := inventoryplugins.AddMachineInventoryPlugin("collision", func(s *config.MachineInventoryPluginSettings, c *config.Config, lf func(string, config.LogLevel) bool) inventoryplugins.MachineInventoryPlugin {
+		return &CollisionPlugin{}
+	}); err != nil {
+		t.Errorf("Plugin factory failed to add collision type: %v", err)
+		return
+	}
+
+	if err := w.Init(); err != nil {
+		t.Errorf("Failed to init: %v", err)
+		return
+	}
+
+	token1, err := w.Build("copy01.prod", "", nil)
+	if err != nil {
+		t.Errorf("Failed to set build: %v", err)
+		return
+	}
+
+	var ce *waitron.JobCollisionError
+
+	if _, err := w.Build("COPY01.prod", "", nil); !errors.As(err, &ce) || len(ce.MACs) != 0 || ce.Tokens[0] != token1 {
+		t.Errorf("Expected a hostname collision, got %v", err)
+	}
+
+	if _, err := w.BuildWithOptions("copy01.prod", "", nil, waitron.BuildOptions{Force: true}); !errors.As(err, &ce) {
+		t.Errorf("Expected a hostname collision even when forced, got %v", err)
+	}
+
+	if _, err := w.Build("copy02.prod", "", nil); !errors.As(err, &ce) || strings.Join(ce.MACs, ",") != "deadbeef0001" || ce.Tokens[0] != token1 {
+		t.Errorf("Expected a MAC collision, got %v", err)
+		return
+	}
+
+	if status, err := w.GetMachineStatus("copy02.prod"); err == nil {
+		t.Errorf("Refused build left a job behind: %s", status)
+	}
+
+	token2, err := w.BuildWithOptions("copy02.prod", "", nil, waitron.BuildOptions{Force: true})
+	if err != nil {
+		t.Errorf("Failed to force build: %v", err)
+		return
+	}
+
+	// The first job is cancelled, but the MAC it shared now belongs to the second one and has to keep working.
+	if err := w.CancelBuild("copy01.prod", token1); err != nil {
+		t.Errorf("Failed to cancel build: %v", err)
+		return
+	}
+
+	if _, err := w.GetPxeConfig("de:ad:be:ef:00:01", ""); err != nil {
+		t.Errorf("Cleaning up the first job removed the second job's MAC: %v", err)
+		return
+	}
+
+	if status, _ := w.GetJobStatus(token2); status != "installing" {
+		t.Errorf("Shared MAC didn't go to the second job, which is %s", status)
+	}
+
+}